@@ -0,0 +1,778 @@
+// Copyright 2019 The LevelDB-Go and Pebble Authors. All rights reserved. Use
+// of this source code is governed by a BSD-style license that can be found in
+// the LICENSE file.
+
+package pebble
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/petermattis/pebble/internal/crc"
+	"github.com/petermattis/pebble/sstable"
+	"github.com/petermattis/pebble/vfs"
+)
+
+/*
+A backup directory has the following layout:
+
+	meta/000001                backup manifest for backup 1
+	meta/000002                backup manifest for backup 2
+	shared/000012.sst          sstables, shared between backups
+	shared/000013.blob         blob files, shared between backups
+	shared/000002-000012.sst   a different sstable named 000012.sst, copied by
+	                           backup 2
+	private/000001/            MANIFEST, CURRENT, OPTIONS and WALs of backup 1
+	private/000002/            MANIFEST, CURRENT, OPTIONS and WALs of backup 2
+
+A backup manifest is a text file. The first line contains the format version
+and the second line the creation time of the backup in seconds since the
+epoch. Each subsequent line describes a file in the backup:
+
+	file <shared|private> <name> <size> <checksum> <num-entries> <session-id> <path>
+
+The checksum is computed over the file contents using the pebble/crc
+package. For sstables, the number of entries is taken from the sstable
+properties and is verified when the backup is verified. It is zero for all
+other files. The session ID is the identity of the DB session which created
+a shared sstable or blob file (see DB.sessionID), or "-" if unknown. The path
+is the name of the file within the shared or private directory, which differs
+from the name of a shared file if a different file with the same name was
+already shared.
+
+File numbers are reused by different incarnations of a DB (e.g. a DB restored
+from a backup into a new directory), so a shared file is only reused by a
+later backup if its size, number of entries and session ID match those of the
+file being backed up. These are read from the sstable properties and the
+first record of a blob file, without reading the rest of the file. The
+checksum of a file whose session ID is unknown (e.g. an ingested sstable)
+is compared instead, which requires reading the file. The checksums of the
+shared files are verified by VerifyBackup and RestoreBackup.
+
+A backup manifest is written once all of the files in the backup have been
+copied, so a backup without a manifest is incomplete and is ignored.
+*/
+
+const backupFormatVersion = 1
+
+// BackupInfo describes a backup managed by a BackupEngine.
+type BackupInfo struct {
+	// ID is the identifier of the backup. Backup IDs are assigned in
+	// increasing order.
+	ID uint64
+	// Timestamp is the time at which the backup was created.
+	Timestamp time.Time
+	// Size is the total size of the files in the backup, including the
+	// sstables shared with other backups.
+	Size uint64
+	// NumFiles is the number of files in the backup.
+	NumFiles int
+}
+
+type backupFile struct {
+	shared     bool
+	name       string
+	size       uint64
+	checksum   uint32
+	numEntries uint64
+	// sessionID is the identity of the DB session which created a shared
+	// file, or empty if unknown.
+	sessionID string
+	// path is the name of the file within the shared or private directory.
+	path string
+}
+
+type backupMeta struct {
+	id        uint64
+	timestamp time.Time
+	files     []backupFile
+}
+
+func (m *backupMeta) info() BackupInfo {
+	info := BackupInfo{
+		ID:        m.id,
+		Timestamp: m.timestamp,
+		NumFiles:  len(m.files),
+	}
+	for i := range m.files {
+		info.Size += m.files[i].size
+	}
+	return info
+}
+
+// BackupEngine manages a directory of incremental backups of a DB. The
+// sstables of a DB are immutable, so an sstable is copied into the backup
+// directory only once and is shared by all of the backups which contain it.
+// A backup directory should only be used to back up a single DB.
+//
+// It is safe to call the BackupEngine methods from concurrent goroutines.
+type BackupEngine struct {
+	dirname string
+	fs      vfs.FS
+
+	// createMu serializes the creation of backups. The files of a backup are
+	// copied without holding mu.
+	createMu sync.Mutex
+
+	mu struct {
+		sync.Mutex
+		backups map[uint64]*backupMeta
+		// shared maps the names of the shared sstables and blob files
+		// referenced by the backups to their descriptions. There are several
+		// descriptions for a name if different files with that name were
+		// shared.
+		shared map[string][]backupFile
+		// pending holds the paths of the shared files used by the backup being
+		// created, which must not be removed by DeleteBackup.
+		pending map[string]bool
+		nextID  uint64
+	}
+}
+
+// OpenBackupEngine opens the backup directory dirname, creating it if it does
+// not exist.
+func OpenBackupEngine(dirname string, fs vfs.FS) (*BackupEngine, error) {
+	if fs == nil {
+		fs = vfs.Default
+	}
+	e := &BackupEngine{
+		dirname: dirname,
+		fs:      fs,
+	}
+	e.mu.backups = make(map[uint64]*backupMeta)
+	e.mu.shared = make(map[string][]backupFile)
+	e.mu.pending = make(map[string]bool)
+	e.mu.nextID = 1
+
+	for _, dir := range []string{e.metaDir(), e.sharedDir(), filepath.Join(dirname, "private")} {
+		if err := fs.MkdirAll(dir, 0755); err != nil {
+			return nil, err
+		}
+	}
+	names, err := fs.List(e.metaDir())
+	if err != nil {
+		return nil, err
+	}
+	for _, name := range names {
+		id, err := strconv.ParseUint(name, 10, 64)
+		if err != nil {
+			// Remove the remnants of a backup manifest which was never installed.
+			if strings.HasSuffix(name, ".tmp") {
+				fs.Remove(filepath.Join(e.metaDir(), name))
+			}
+			continue
+		}
+		m, err := e.readMeta(id)
+		if err != nil {
+			return nil, err
+		}
+		e.addMetaLocked(m)
+	}
+	return e, nil
+}
+
+func (e *BackupEngine) metaDir() string {
+	return filepath.Join(e.dirname, "meta")
+}
+
+func (e *BackupEngine) sharedDir() string {
+	return filepath.Join(e.dirname, "shared")
+}
+
+func (e *BackupEngine) privateDir(id uint64) string {
+	return filepath.Join(e.dirname, "private", fmt.Sprintf("%06d", id))
+}
+
+func (e *BackupEngine) metaFilename(id uint64) string {
+	return filepath.Join(e.metaDir(), fmt.Sprintf("%06d", id))
+}
+
+func (e *BackupEngine) filename(id uint64, f *backupFile) string {
+	if f.shared {
+		return filepath.Join(e.sharedDir(), f.path)
+	}
+	return filepath.Join(e.privateDir(id), f.path)
+}
+
+func (e *BackupEngine) addMetaLocked(m *backupMeta) {
+	e.mu.backups[m.id] = m
+	for _, f := range m.files {
+		if f.shared {
+			e.addSharedLocked(f)
+		}
+	}
+	if e.mu.nextID <= m.id {
+		e.mu.nextID = m.id + 1
+	}
+}
+
+func (e *BackupEngine) addSharedLocked(f backupFile) {
+	for _, existing := range e.mu.shared[f.name] {
+		if existing.path == f.path {
+			return
+		}
+	}
+	e.mu.shared[f.name] = append(e.mu.shared[f.name], f)
+}
+
+// findShared returns the shared file with the name, size, number of entries
+// and session ID of f, if there is one. If the session ID of f is unknown,
+// the checksum of the file at srcPath must match as well. Otherwise, it sets f.path to an unused path under which f can be copied. In
+// either case, the path is protected from removal by DeleteBackup until the
+// backup has been created.
+func (e *BackupEngine) findShared(
+	id uint64, f *backupFile, srcFS vfs.FS, srcPath string,
+) (_ backupFile, found bool, _ error) {
+	e.mu.Lock()
+	candidates := append([]backupFile(nil), e.mu.shared[f.name]...)
+	e.mu.Unlock()
+
+	var match backupFile
+	var actual backupFile
+	for i := range candidates {
+		existing := &candidates[i]
+		if existing.size != f.size || existing.numEntries != f.numEntries ||
+			existing.sessionID != f.sessionID {
+			continue
+		}
+		if f.sessionID != "" {
+			match = *existing
+			found = true
+			break
+		}
+		if actual.size == 0 {
+			if err := copyAndChecksum(srcFS, srcPath, nil, "", &actual); err != nil {
+				return backupFile{}, false, err
+			}
+		}
+		if existing.size == actual.size && existing.checksum == actual.checksum {
+			match = *existing
+			found = true
+			break
+		}
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	f.path = f.name
+	for _, existing := range e.mu.shared[f.name] {
+		if found && existing.path == match.path {
+			e.mu.pending[match.path] = true
+			return match, true, nil
+		}
+		if existing.path == f.name {
+			// The default path is taken by a different file.
+			f.path = fmt.Sprintf("%06d-%s", id, f.name)
+		}
+	}
+	// Either the file is not shared yet, or it was deleted by DeleteBackup in
+	// the meantime.
+	e.mu.pending[f.path] = true
+	return *f, false, nil
+}
+
+// Backups returns the backups in the backup directory in increasing order of
+// ID.
+func (e *BackupEngine) Backups() []BackupInfo {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	infos := make([]BackupInfo, 0, len(e.mu.backups))
+	for _, m := range e.mu.backups {
+		infos = append(infos, m.info())
+	}
+	sort.Slice(infos, func(i, j int) bool {
+		return infos[i].ID < infos[j].ID
+	})
+	return infos
+}
+
+// CreateBackup creates a new backup of d. Only the sstables which are not
+// already present in the backup directory are copied. The WALs containing
+// data not yet flushed to sstables are included in the backup (see
+// DB.Checkpoint). The other BackupEngine methods are not blocked while the
+// files are copied, though backups are created one at a time.
+func (e *BackupEngine) CreateBackup(d *DB) (info BackupInfo, retErr error) {
+	e.createMu.Lock()
+	defer e.createMu.Unlock()
+
+	cs, err := d.pinCheckpointState()
+	if err != nil {
+		return BackupInfo{}, err
+	}
+	defer d.unpinCheckpointState(cs)
+
+	e.mu.Lock()
+	m := &backupMeta{
+		id:        e.mu.nextID,
+		timestamp: time.Now(),
+	}
+	e.mu.nextID++
+	e.mu.Unlock()
+
+	privateDir := e.privateDir(m.id)
+	// copied holds the shared files copied by this backup.
+	var copied []backupFile
+	defer func() {
+		e.mu.Lock()
+		defer e.mu.Unlock()
+		for path := range e.mu.pending {
+			delete(e.mu.pending, path)
+		}
+		if retErr != nil {
+			// Remove the files of the incomplete backup, including the shared
+			// files it copied, which are not referenced by any other backup.
+			for i := range m.files {
+				if !m.files[i].shared {
+					e.fs.Remove(e.filename(m.id, &m.files[i]))
+				}
+			}
+			for i := range copied {
+				e.fs.Remove(e.filename(m.id, &copied[i]))
+			}
+			e.fs.Remove(privateDir)
+		}
+	}()
+	if err := e.fs.MkdirAll(privateDir, 0755); err != nil {
+		return BackupInfo{}, err
+	}
+
+	srcFS := d.opts.FS
+	copyShared := func(srcPath string, f backupFile) error {
+		existing, found, err := e.findShared(m.id, &f, srcFS, srcPath)
+		if err != nil {
+			return err
+		}
+		if found {
+			// The file is already present in the backup directory.
+			m.files = append(m.files, existing)
+			return nil
+		}
+		// NB: the file is recorded before it is copied so that a partial copy
+		// is removed if the copy fails.
+		copied = append(copied, f)
+		if err := copyAndChecksum(srcFS, srcPath, e.fs, e.filename(m.id, &f), &f); err != nil {
+			return err
+		}
+		m.files = append(m.files, f)
+		return nil
+	}
+
+	for _, meta := range cs.tables {
+		srcPath := dbFilename(d.dirname, fileTypeTable, meta.fileNum)
+		props, err := readProperties(srcFS, srcPath)
+		if err != nil {
+			return BackupInfo{}, err
+		}
+		f := backupFile{
+			shared:     true,
+			name:       filepath.Base(srcPath),
+			size:       meta.size,
+			numEntries: props.NumEntries,
+			sessionID:  props.DBSessionID,
+		}
+		if err := copyShared(srcPath, f); err != nil {
+			return BackupInfo{}, err
+		}
+	}
+
+	// The blob files referenced by the sstables are immutable as well, and are
+	// shared in the same way.
+	for _, fileNum := range cs.blobFiles {
+		srcPath := dbFilename(d.dirname, fileTypeBlob, fileNum)
+		info, err := srcFS.Stat(srcPath)
+		if err != nil {
+			return BackupInfo{}, err
+		}
+		sessionID, err := readBlobSessionID(srcFS, srcPath)
+		if err != nil {
+			return BackupInfo{}, err
+		}
+		f := backupFile{
+			shared:    true,
+			name:      filepath.Base(srcPath),
+			size:      uint64(info.Size()),
+			sessionID: sessionID,
+		}
+		if err := copyShared(srcPath, f); err != nil {
+			return BackupInfo{}, err
+		}
+	}
+
+	// Copy the OPTIONS file and the WALs.
+	srcPaths := []string{dbFilename(d.dirname, fileTypeOptions, cs.optionsFileNum)}
+	for _, logNum := range cs.logNums {
+		srcPaths = append(srcPaths, dbFilename(d.walDirname, fileTypeLog, logNum))
+	}
+	for _, srcPath := range srcPaths {
+		name := filepath.Base(srcPath)
+		f := backupFile{name: name, path: name}
+		m.files = append(m.files, f)
+		if err := copyAndChecksum(srcFS, srcPath, e.fs, e.filename(m.id, &f), &m.files[len(m.files)-1]); err != nil {
+			return BackupInfo{}, err
+		}
+	}
+
+	// Write the MANIFEST and CURRENT files.
+	manifestPath := dbFilename(privateDir, fileTypeManifest, cs.manifestFileNum)
+	m.files = append(m.files, backupFile{name: filepath.Base(manifestPath), path: filepath.Base(manifestPath)})
+	if err := writeCheckpointManifest(e.fs, manifestPath, &cs.ve); err != nil {
+		return BackupInfo{}, err
+	}
+	currentPath := dbFilename(privateDir, fileTypeCurrent, 0)
+	m.files = append(m.files, backupFile{name: filepath.Base(currentPath), path: filepath.Base(currentPath)})
+	if err := setCurrentFile(privateDir, e.fs, cs.manifestFileNum); err != nil {
+		return BackupInfo{}, err
+	}
+	for i, path := range []string{manifestPath, currentPath} {
+		f := &m.files[len(m.files)-2+i]
+		if err := copyAndChecksum(e.fs, path, nil, "", f); err != nil {
+			return BackupInfo{}, err
+		}
+	}
+
+	if err := e.writeMeta(m); err != nil {
+		return BackupInfo{}, err
+	}
+	e.mu.Lock()
+	e.addMetaLocked(m)
+	e.mu.Unlock()
+	return m.info(), nil
+}
+
+// DeleteBackup deletes the specified backup. The shared sstables which are not
+// referenced by any other backup are deleted as well.
+func (e *BackupEngine) DeleteBackup(id uint64) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	m, ok := e.mu.backups[id]
+	if !ok {
+		return fmt.Errorf("pebble: backup %d not found", id)
+	}
+	// Removing the backup manifest deletes the backup. Any failure to remove
+	// the files below merely leaks space.
+	if err := e.fs.Remove(e.metaFilename(id)); err != nil {
+		return err
+	}
+	delete(e.mu.backups, id)
+
+	referenced := make(map[string]bool)
+	for _, other := range e.mu.backups {
+		for _, f := range other.files {
+			if f.shared {
+				referenced[f.path] = true
+			}
+		}
+	}
+	var firstErr error
+	for i := range m.files {
+		f := &m.files[i]
+		if f.shared {
+			if referenced[f.path] || e.mu.pending[f.path] {
+				continue
+			}
+			e.removeSharedLocked(f)
+		}
+		if err := e.fs.Remove(e.filename(id, f)); err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	if err := e.fs.Remove(e.privateDir(id)); err != nil && firstErr == nil {
+		firstErr = err
+	}
+	return firstErr
+}
+
+func (e *BackupEngine) removeSharedLocked(f *backupFile) {
+	files := e.mu.shared[f.name]
+	for i := range files {
+		if files[i].path == f.path {
+			files = append(files[:i:i], files[i+1:]...)
+			break
+		}
+	}
+	if len(files) == 0 {
+		delete(e.mu.shared, f.name)
+	} else {
+		e.mu.shared[f.name] = files
+	}
+}
+
+// VerifyBackup verifies the size and checksum of each file in the specified
+// backup. The number of entries recorded in the properties of each sstable is
+// checked against the number recorded when the backup was created.
+func (e *BackupEngine) VerifyBackup(id uint64) error {
+	e.mu.Lock()
+	m, ok := e.mu.backups[id]
+	e.mu.Unlock()
+	if !ok {
+		return fmt.Errorf("pebble: backup %d not found", id)
+	}
+
+	for i := range m.files {
+		f := &m.files[i]
+		path := e.filename(id, f)
+		actual := backupFile{name: f.name}
+		if err := copyAndChecksum(e.fs, path, nil, "", &actual); err != nil {
+			return err
+		}
+		if err := f.verify(path, &actual); err != nil {
+			return err
+		}
+		if fileType, _, ok := parseDBFilename(f.name); !ok || fileType != fileTypeTable {
+			continue
+		}
+		props, err := readProperties(e.fs, path)
+		if err != nil {
+			return err
+		}
+		if props.NumEntries != f.numEntries {
+			return fmt.Errorf("pebble: backup file %q: expected %d entries, but found %d",
+				path, f.numEntries, props.NumEntries)
+		}
+	}
+	return nil
+}
+
+// RestoreBackup restores the specified backup into destDir, which must not
+// already exist. The checksum of each file is verified as it is copied. The
+// restored directory can be opened with Open.
+func (e *BackupEngine) RestoreBackup(id uint64, destDir string) (retErr error) {
+	e.mu.Lock()
+	m, ok := e.mu.backups[id]
+	e.mu.Unlock()
+	if !ok {
+		return fmt.Errorf("pebble: backup %d not found", id)
+	}
+
+	if _, err := e.fs.Stat(destDir); err == nil {
+		return fmt.Errorf("pebble: restore directory %q already exists", destDir)
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+
+	var created []string
+	defer func() {
+		if retErr != nil {
+			for i := len(created) - 1; i >= 0; i-- {
+				e.fs.Remove(created[i])
+			}
+		}
+	}()
+
+	if err := e.fs.MkdirAll(destDir, 0755); err != nil {
+		return err
+	}
+	created = append(created, destDir)
+	dir, err := e.fs.OpenDir(destDir)
+	if err != nil {
+		return err
+	}
+	defer dir.Close()
+
+	for i := range m.files {
+		f := &m.files[i]
+		srcPath := e.filename(id, f)
+		destPath := filepath.Join(destDir, f.name)
+		actual := backupFile{name: f.name}
+		err := copyAndChecksum(e.fs, srcPath, e.fs, destPath, &actual)
+		if err != nil {
+			return err
+		}
+		created = append(created, destPath)
+		if err := f.verify(srcPath, &actual); err != nil {
+			return err
+		}
+	}
+	return dir.Sync()
+}
+
+func (f *backupFile) verify(path string, actual *backupFile) error {
+	if f.size != actual.size {
+		return fmt.Errorf("pebble: backup file %q: expected size %d, but found %d",
+			path, f.size, actual.size)
+	}
+	if f.checksum != actual.checksum {
+		return fmt.Errorf("pebble: backup file %q: checksum mismatch", path)
+	}
+	return nil
+}
+
+func (e *BackupEngine) readMeta(id uint64) (*backupMeta, error) {
+	filename := e.metaFilename(id)
+	file, err := e.fs.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	m := &backupMeta{id: id}
+	corrupt := func() (*backupMeta, error) {
+		return nil, fmt.Errorf("pebble: corrupt backup manifest %q", filename)
+	}
+	s := bufio.NewScanner(file)
+	var version, timestamp int64
+	if !s.Scan() {
+		return corrupt()
+	}
+	if _, err := fmt.Sscanf(s.Text(), "version %d", &version); err != nil {
+		return corrupt()
+	}
+	if version != backupFormatVersion {
+		return nil, fmt.Errorf("pebble: backup manifest %q: unknown version %d", filename, version)
+	}
+	if !s.Scan() {
+		return corrupt()
+	}
+	if _, err := fmt.Sscanf(s.Text(), "timestamp %d", &timestamp); err != nil {
+		return corrupt()
+	}
+	m.timestamp = time.Unix(timestamp, 0)
+	for s.Scan() {
+		var kind string
+		var f backupFile
+		if _, err := fmt.Sscanf(s.Text(), "file %s %s %d %d %d %s %s",
+			&kind, &f.name, &f.size, &f.checksum, &f.numEntries, &f.sessionID, &f.path); err != nil {
+			return corrupt()
+		}
+		if f.sessionID == "-" {
+			f.sessionID = ""
+		}
+		switch kind {
+		case "shared":
+			f.shared = true
+		case "private":
+		default:
+			return corrupt()
+		}
+		m.files = append(m.files, f)
+	}
+	if err := s.Err(); err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+func (e *BackupEngine) writeMeta(m *backupMeta) error {
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "version %d\n", backupFormatVersion)
+	fmt.Fprintf(&buf, "timestamp %d\n", m.timestamp.Unix())
+	for _, f := range m.files {
+		kind := "private"
+		if f.shared {
+			kind = "shared"
+		}
+		sessionID := f.sessionID
+		if sessionID == "" {
+			sessionID = "-"
+		}
+		fmt.Fprintf(&buf, "file %s %s %d %d %d %s %s\n",
+			kind, f.name, f.size, f.checksum, f.numEntries, sessionID, f.path)
+	}
+
+	// Write the manifest to a temporary file and rename it into place so that
+	// the backup appears atomically.
+	filename := e.metaFilename(m.id)
+	tmpFilename := filename + ".tmp"
+	f, err := e.fs.Create(tmpFilename)
+	if err != nil {
+		return err
+	}
+	if _, err := f.Write(buf.Bytes()); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		f.Close()
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	if err := e.fs.Rename(tmpFilename, filename); err != nil {
+		return err
+	}
+	dir, err := e.fs.OpenDir(e.metaDir())
+	if err != nil {
+		return err
+	}
+	return firstError(dir.Sync(), dir.Close())
+}
+
+// copyAndChecksum copies srcPath on srcFS to destPath on destFS, recording the
+// size and checksum of the file in f. If destFS is nil, the file is only read.
+func copyAndChecksum(srcFS vfs.FS, srcPath string, destFS vfs.FS, destPath string, f *backupFile) error {
+	src, err := srcFS.Open(srcPath)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	w := &checksumWriter{}
+	if destFS == nil {
+		if _, err := io.Copy(w, src); err != nil {
+			return err
+		}
+	} else {
+		dest, err := destFS.Create(destPath)
+		if err != nil {
+			return err
+		}
+		w.w = dest
+		if _, err := io.Copy(w, src); err != nil {
+			dest.Close()
+			return err
+		}
+		if err := dest.Sync(); err != nil {
+			dest.Close()
+			return err
+		}
+		if err := dest.Close(); err != nil {
+			return err
+		}
+	}
+	f.size = w.size
+	f.checksum = w.crc.Value()
+	return nil
+}
+
+// checksumWriter computes the checksum of the data written to it, forwarding
+// the data to w if w is non-nil.
+type checksumWriter struct {
+	w    io.Writer
+	crc  crc.CRC
+	size uint64
+}
+
+func (w *checksumWriter) Write(p []byte) (int, error) {
+	w.crc = w.crc.Update(p)
+	w.size += uint64(len(p))
+	if w.w == nil {
+		return len(p), nil
+	}
+	return w.w.Write(p)
+}
+
+// readProperties returns the properties of the specified sstable.
+func readProperties(fs vfs.FS, path string) (*sstable.Properties, error) {
+	f, err := fs.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	r := sstable.NewReader(f, 0, nil)
+	props := r.Properties
+	// NB: Close returns any error encountered while reading the properties.
+	if err := r.Close(); err != nil {
+		return nil, err
+	}
+	return &props, nil
+}
@@ -0,0 +1,412 @@
+// Copyright 2019 The LevelDB-Go and Pebble Authors. All rights reserved. Use
+// of this source code is governed by a BSD-style license that can be found in
+// the LICENSE file.
+
+package pebble
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/petermattis/pebble/db"
+	"github.com/petermattis/pebble/vfs"
+)
+
+func TestBackupEngine(t *testing.T) {
+	mem := vfs.NewMem()
+	d, err := Open("db", &db.Options{FS: mem})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	set := func(d *DB, keys ...string) {
+		for _, k := range keys {
+			if err := d.Set([]byte(k), []byte(k), nil); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	scan := func(d *DB) string {
+		iter := d.NewIter(nil)
+		var keys []string
+		for valid := iter.First(); valid; valid = iter.Next() {
+			keys = append(keys, string(iter.Key()))
+		}
+		if err := iter.Close(); err != nil {
+			t.Fatal(err)
+		}
+		return strings.Join(keys, " ")
+	}
+	listShared := func() string {
+		names, err := mem.List("backup/shared")
+		if err != nil {
+			t.Fatal(err)
+		}
+		sort.Strings(names)
+		return strings.Join(names, " ")
+	}
+
+	e, err := OpenBackupEngine("backup", mem)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	set(d, "a", "b")
+	if err := d.Compact([]byte("a"), []byte("z")); err != nil {
+		t.Fatal(err)
+	}
+	set(d, "c")
+	if err := d.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	info1, err := e.CreateBackup(d)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info1.ID != 1 {
+		t.Fatalf("expected backup 1, but found %d", info1.ID)
+	}
+	shared1 := listShared()
+	if shared1 == "" {
+		t.Fatalf("expected shared sstables")
+	}
+
+	// The second backup only copies the sstable created by the flush.
+	set(d, "d")
+	if err := d.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	info2, err := e.CreateBackup(d)
+	if err != nil {
+		t.Fatal(err)
+	}
+	shared2 := listShared()
+	if n1, n2 := len(strings.Fields(shared1)), len(strings.Fields(shared2)); n1+1 != n2 {
+		t.Fatalf("expected %d shared sstables, but found %q", n1+1, shared2)
+	}
+	set(d, "e")
+	if err := d.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// The backups are found when reopening the backup directory.
+	e, err = OpenBackupEngine("backup", mem)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if infos := e.Backups(); len(infos) != 2 || infos[0].ID != 1 || infos[1].ID != 2 {
+		t.Fatalf("unexpected backups: %+v", infos)
+	} else if infos[1].Size != info2.Size || infos[1].NumFiles != info2.NumFiles {
+		t.Fatalf("expected %+v, but found %+v", info2, infos[1])
+	}
+	for _, id := range []uint64{1, 2} {
+		if err := e.VerifyBackup(id); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	restore := func(id uint64, dirname, expected string) {
+		if err := e.RestoreBackup(id, dirname); err != nil {
+			t.Fatal(err)
+		}
+		d, err := Open(dirname, &db.Options{FS: mem})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if actual := scan(d); expected != actual {
+			t.Fatalf("expected %q, but found %q", expected, actual)
+		}
+		if err := d.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	restore(1, "restore1", "a b c")
+	restore(2, "restore2", "a b c d")
+	if err := e.RestoreBackup(2, "restore2"); err == nil {
+		t.Fatalf("expected error, but found success")
+	}
+
+	// Deleting the first backup only removes the sstables which are not shared
+	// with the second backup.
+	if err := e.DeleteBackup(1); err != nil {
+		t.Fatal(err)
+	}
+	if infos := e.Backups(); len(infos) != 1 || infos[0].ID != 2 {
+		t.Fatalf("unexpected backups: %+v", infos)
+	}
+	if err := e.VerifyBackup(2); err != nil {
+		t.Fatal(err)
+	}
+	restore(2, "restore3", "a b c d")
+
+	// Corrupt a shared sstable.
+	name := strings.Fields(listShared())[0]
+	f, err := mem.Create("backup/shared/" + name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.Write([]byte("corrupt")); err != nil {
+		t.Fatal(err)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := e.VerifyBackup(2); err == nil {
+		t.Fatalf("expected error, but found success")
+	}
+	if err := e.RestoreBackup(2, "restore4"); err == nil {
+		t.Fatalf("expected error, but found success")
+	}
+	if _, err := mem.Stat("restore4"); err == nil {
+		t.Fatalf("expected failed restore to be cleaned up")
+	}
+}
+
+// failCreateFS fails the creation of the files whose names contain substr.
+type failCreateFS struct {
+	vfs.FS
+	substr string
+}
+
+func (fs failCreateFS) Create(name string) (vfs.File, error) {
+	if fs.substr != "" && strings.Contains(name, fs.substr) {
+		return nil, errors.New("injected error")
+	}
+	return fs.FS.Create(name)
+}
+
+func TestBackupEngineCreateError(t *testing.T) {
+	mem := vfs.NewMem()
+	d, err := Open("db", &db.Options{FS: mem})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Set([]byte("a"), []byte("a"), nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	// The OPTIONS file is copied after the shared sstables, which must be
+	// removed when the backup fails.
+	fs := &failCreateFS{FS: mem, substr: "OPTIONS"}
+	e, err := OpenBackupEngine("backup", fs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := e.CreateBackup(d); err == nil {
+		t.Fatalf("expected error, but found success")
+	}
+	if names, err := mem.List("backup/shared"); err != nil {
+		t.Fatal(err)
+	} else if len(names) != 0 {
+		t.Fatalf("expected no shared files, but found %q", names)
+	}
+	if infos := e.Backups(); len(infos) != 0 {
+		t.Fatalf("unexpected backups: %+v", infos)
+	}
+
+	fs.substr = ""
+	info, err := e.CreateBackup(d)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := e.VerifyBackup(info.ID); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// readCountingFS records the names of the files which are read sequentially,
+// as when they are copied.
+type readCountingFS struct {
+	vfs.FS
+	mu   sync.Mutex
+	read map[string]bool
+}
+
+func (fs *readCountingFS) Open(name string) (vfs.File, error) {
+	f, err := fs.FS.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	return &readCountingFile{File: f, fs: fs, name: name}, nil
+}
+
+type readCountingFile struct {
+	vfs.File
+	fs   *readCountingFS
+	name string
+}
+
+func (f *readCountingFile) Read(p []byte) (int, error) {
+	f.fs.mu.Lock()
+	f.fs.read[filepath.Base(f.name)] = true
+	f.fs.mu.Unlock()
+	return f.File.Read(p)
+}
+
+func TestBackupEngineSharedFilesNotRead(t *testing.T) {
+	fs := &readCountingFS{FS: vfs.NewMem(), read: make(map[string]bool)}
+	d, err := Open("db", &db.Options{FS: fs, MinBlobSize: 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+	e, err := OpenBackupEngine("backup", fs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	setAndBackup := func(key string) {
+		if err := d.Set([]byte(key), bytes.Repeat([]byte(key), 100), nil); err != nil {
+			t.Fatal(err)
+		}
+		if err := d.Flush(); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := e.CreateBackup(d); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// readShared returns the sstables and blob files read by the last backup.
+	readShared := func() string {
+		fs.mu.Lock()
+		defer fs.mu.Unlock()
+		var names []string
+		for name := range fs.read {
+			if fileType, _, ok := parseDBFilename(name); ok &&
+				(fileType == fileTypeTable || fileType == fileTypeBlob) {
+				names = append(names, name)
+			}
+		}
+		sort.Strings(names)
+		fs.read = make(map[string]bool)
+		return strings.Join(names, " ")
+	}
+
+	setAndBackup("a")
+	first := readShared()
+	if len(strings.Fields(first)) != 2 {
+		t.Fatalf("expected an sstable and a blob file to be copied, but found %q", first)
+	}
+
+	// The second backup only reads the new sstable and blob file. The shared
+	// files are identified by their properties.
+	setAndBackup("b")
+	second := readShared()
+	if len(strings.Fields(second)) != 2 || strings.Contains(second, strings.Fields(first)[0]) ||
+		strings.Contains(second, strings.Fields(first)[1]) {
+		t.Fatalf("expected only the new files to be copied, but found %q after %q", second, first)
+	}
+	if err := e.VerifyBackup(2); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestBackupEngineSharedNameCollision(t *testing.T) {
+	mem := vfs.NewMem()
+	open := func(dirname string) *DB {
+		d, err := Open(dirname, &db.Options{FS: mem})
+		if err != nil {
+			t.Fatal(err)
+		}
+		return d
+	}
+	setAndFlush := func(d *DB, key string) {
+		if err := d.Set([]byte(key), []byte(key), nil); err != nil {
+			t.Fatal(err)
+		}
+		if err := d.Flush(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	e, err := OpenBackupEngine("backup", mem)
+	if err != nil {
+		t.Fatal(err)
+	}
+	create := func(d *DB) uint64 {
+		info, err := e.CreateBackup(d)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return info.ID
+	}
+
+	d := open("db")
+	setAndFlush(d, "a")
+	id1 := create(d)
+	if err := d.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Two incarnations of the DB restored from the same backup create
+	// different sstables with the same file number and size.
+	for _, dirname := range []string{"db1", "db2"} {
+		if err := e.RestoreBackup(id1, dirname); err != nil {
+			t.Fatal(err)
+		}
+	}
+	d1 := open("db1")
+	d2 := open("db2")
+	setAndFlush(d1, "x")
+	setAndFlush(d2, "y")
+	id2 := create(d1)
+	id3 := create(d2)
+
+	names, err := mem.List("backup/shared")
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(names)
+	if len(names) != 3 || !strings.HasPrefix(names[0], fmt.Sprintf("%06d-", id3)) {
+		t.Fatalf("expected 3 shared sstables, one of them renamed, but found %q", names)
+	}
+
+	for _, c := range []struct {
+		id       uint64
+		expected string
+	}{
+		{id1, "a"},
+		{id2, "a x"},
+		{id3, "a y"},
+	} {
+		if err := e.VerifyBackup(c.id); err != nil {
+			t.Fatal(err)
+		}
+		dirname := fmt.Sprintf("restore%d", c.id)
+		if err := e.RestoreBackup(c.id, dirname); err != nil {
+			t.Fatal(err)
+		}
+		d := open(dirname)
+		var keys []string
+		iter := d.NewIter(nil)
+		for valid := iter.First(); valid; valid = iter.Next() {
+			keys = append(keys, string(iter.Key()))
+		}
+		if err := iter.Close(); err != nil {
+			t.Fatal(err)
+		}
+		if actual := strings.Join(keys, " "); c.expected != actual {
+			t.Fatalf("%d: expected %q, but found %q", c.id, c.expected, actual)
+		}
+		if err := d.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, d := range []*DB{d1, d2} {
+		if err := d.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
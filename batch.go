@@ -8,9 +8,11 @@ import (
 	"encoding/binary"
 	"errors"
 	"fmt"
+	"math"
 	"sort"
 	"sync"
 	"sync/atomic"
+	"time"
 	"unsafe"
 
 	"github.com/petermattis/pebble/db"
@@ -42,6 +44,7 @@ type batchStorage struct {
 	//     or "\xff\xff\xff\xff" if the batch is invalid,
 	//   - count elements, being:
 	//     - one byte for the kind
+	//     - the varint column family ID (if kind is a column family kind),
 	//     - the varint-string user key,
 	//     - the varint-string value (if kind != delete).
 	// The sequence number and count are stored in little-endian order.
@@ -161,14 +164,44 @@ func (s *batchStorage) Compare(a []byte, b uint32) int {
 // exactly those specified by db.InternalKeyKind. The following table shows the
 // format for records of each kind:
 //
-//   InternalKeyKindDelete       varstring
-//   InternalKeyKindLogData      varstring
-//   InternalKeyKindSet          varstring varstring
-//   InternalKeyKindMerge        varstring varstring
-//   InternalKeyKindRangeDelete  varstring varstring
+//   InternalKeyKindDelete        varstring
+//   InternalKeyKindLogData       varstring
+//   InternalKeyKindSingleDelete  varstring
+//   InternalKeyKindSet           varstring varstring
+//   InternalKeyKindMerge         varstring varstring
+//   InternalKeyKindRangeDelete   varstring varstring
+//   InternalKeyKindSetWithExpiry varstring varstring
 //
 // The intuitive understanding here are that the arguments to Delete(), Set(),
-// Merge(), and DeleteRange() are encoded into the batch.
+// Merge(), SingleDelete(), and DeleteRange() are encoded into the batch. The
+// value of a SetWithTTL() is prefixed by the fixed64 expiration time of the
+// entry (see encodeExpiry).
+//
+// Operations on a column family other than the default column family (see
+// Batch.SetCF) use the column family variants of the kinds, and place the
+// varint32 column family ID before the key:
+//
+//   InternalKeyKindColumnFamilyDeletion     varint32 varstring
+//   InternalKeyKindColumnFamilySingleDelete varint32 varstring
+//   InternalKeyKindColumnFamilyValue        varint32 varstring varstring
+//   InternalKeyKindColumnFamilyMerge        varint32 varstring varstring
+//   InternalKeyKindColumnFamilyRangeDelete  varint32 varstring varstring
+//
+// Column family operations are not indexed: reads from an indexed batch only
+// observe the operations on the default column family.
+//
+// The batches written to the WAL by the two-phase commit operations (see
+// DB.Prepare) contain marker records. A prepared batch is written as a
+// BeginPrepareXID record, followed by the operations of the batch, followed by
+// an EndPrepareXID record. The operations within a prepared section are not
+// applied to the memtable. Committing or rolling back a prepared batch writes
+// a CommitXID or RollbackXID record. The markers other than BeginPrepareXID
+// contain the name of the prepared batch:
+//
+//   InternalKeyKindBeginPrepareXID
+//   InternalKeyKindEndPrepareXID varstring
+//   InternalKeyKindCommitXID     varstring
+//   InternalKeyKindRollbackXID   varstring
 //
 // The internal batch representation is the on disk format for a batch in the
 // WAL, and thus stable. New record kinds may be added, but the existing ones
@@ -177,6 +210,9 @@ type Batch struct {
 	storage batchStorage
 
 	memTableSize uint32
+	// The memtable sizes of the operations on column families other than the
+	// default column family, keyed by column family ID.
+	cfMemTableSize map[uint32]uint32
 
 	// The db to which the batch will be committed.
 	db *DB
@@ -194,6 +230,20 @@ type Batch struct {
 	// memtable.
 	flushable *flushableBatch
 
+	// Optional functions invoked by the commit pipeline before the batch is
+	// assigned a sequence number. An error aborts the commit. Used by
+	// OptimisticTxn to detect conflicts. validate is invoked without holding
+	// the commit mutex, and checks the batch against the visible state of the
+	// DB. validateSince is then invoked with the commit mutex held, so that no
+	// other batch can be sequenced until it returns, and all previously
+	// sequenced batches visible. It only checks the batch against the writes
+	// with sequence numbers greater than or equal to the visible sequence
+	// number at which validate was invoked. validateSince must not read
+	// sstables; it returns errValidateRetry if the check requires it, in which
+	// case both functions are invoked again.
+	validate      func() error
+	validateSince func(seqNum uint64) error
+
 	commit  sync.WaitGroup
 	applied uint32 // updated atomically
 }
@@ -242,8 +292,11 @@ func (b *Batch) release() {
 	b.storage.cmp = nil
 	b.storage.abbreviatedKey = nil
 	b.memTableSize = 0
+	b.cfMemTableSize = nil
 	b.db = nil
 	b.flushable = nil
+	b.validate = nil
+	b.validateSince = nil
 	b.commit = sync.WaitGroup{}
 	atomic.StoreUint32(&b.applied, 0)
 
@@ -258,13 +311,34 @@ func (b *Batch) release() {
 
 func (b *Batch) refreshMemTableSize() {
 	b.memTableSize = 0
+	b.cfMemTableSize = nil
+	var prepared bool
 	for iter := b.iter(); ; {
-		_, key, value, ok := iter.next()
+		cfID, kind, key, value, ok := iter.nextCF()
 		if !ok {
 			break
 		}
-		b.memTableSize += memTableEntrySize(len(key), len(value))
+		if isTwoPhaseMarker(kind) {
+			// The operations within a prepared section are not applied to the
+			// memtable.
+			prepared = kind == db.InternalKeyKindBeginPrepareXID
+			continue
+		}
+		if !prepared {
+			b.addMemTableSize(cfID, memTableEntrySize(len(key), len(value)))
+		}
+	}
+}
+
+func (b *Batch) addMemTableSize(cfID uint32, size uint32) {
+	if cfID == 0 {
+		b.memTableSize += size
+		return
+	}
+	if b.cfMemTableSize == nil {
+		b.cfMemTableSize = make(map[uint32]uint32)
 	}
+	b.cfMemTableSize[cfID] += size
 }
 
 // Apply the operations contained in the batch to the receiver batch.
@@ -290,11 +364,14 @@ func (b *Batch) Apply(batch *Batch, _ *db.WriteOptions) error {
 
 	for iter := batchReader(b.storage.data[offset:]); len(iter) > 0; {
 		offset := uintptr(unsafe.Pointer(&iter[0])) - uintptr(unsafe.Pointer(&b.storage.data[0]))
-		kind, key, value, ok := iter.next()
+		cfID, kind, key, value, ok := iter.nextCF()
 		if !ok {
 			break
 		}
-		if b.index != nil {
+		if isTwoPhaseMarker(kind) {
+			continue
+		}
+		if b.index != nil && cfID == 0 {
 			var err error
 			if kind == db.InternalKeyKindRangeDelete {
 				if b.rangeDelIndex == nil {
@@ -309,7 +386,7 @@ func (b *Batch) Apply(batch *Batch, _ *db.WriteOptions) error {
 				panic(err)
 			}
 		}
-		b.memTableSize += memTableEntrySize(len(key), len(value))
+		b.addMemTableSize(cfID, memTableEntrySize(len(key), len(value)))
 	}
 	return nil
 }
@@ -323,7 +400,7 @@ func (b *Batch) Get(key []byte) (value []byte, err error) {
 	if b.index == nil {
 		return nil, ErrNotIndexed
 	}
-	return b.db.getInternal(key, b, nil /* snapshot */)
+	return b.db.getInternal(&b.db.columnFamily, key, b, nil /* snapshot */)
 }
 
 func (b *Batch) encodeKeyValue(key, value []byte, kind db.InternalKeyKind) uint32 {
@@ -360,6 +437,50 @@ func (b *Batch) Set(key, value []byte, _ *db.WriteOptions) error {
 	return nil
 }
 
+// SetWithTTL adds an action to the batch that sets the key to map to the value
+// until the specified TTL has elapsed. Once the entry has expired, reads
+// behave as if the key had been deleted, and compactions drop the entry. A
+// table holding an expired entry is compacted once the DB next installs a new
+// version of the LSM (e.g. after a flush or compaction). The TTL is measured
+// from the time of the call, according to db.Options.Now. A non-positive TTL
+// produces an entry which has already expired.
+//
+// It is safe to modify the contents of the arguments after SetWithTTL
+// returns.
+func (b *Batch) SetWithTTL(key, value []byte, ttl time.Duration, _ *db.WriteOptions) error {
+	now := time.Now
+	if b.db != nil {
+		now = b.db.opts.Now
+	}
+	if len(b.storage.data) == 0 {
+		b.init(len(key) + expiryLen + len(value) + 2*binary.MaxVarintLen64 + batchHeaderLen)
+	}
+	if !b.increment() {
+		return ErrInvalidBatch
+	}
+
+	pos := len(b.storage.data)
+	offset := uint32(pos)
+	n := expiryLen + len(value)
+	b.grow(1 + 2*maxVarintLen32 + len(key) + n)
+	b.storage.data[pos] = byte(db.InternalKeyKindSetWithExpiry)
+	pos, varlen1 := b.copyStr(pos+1, key)
+	varlen2 := putUvarint32(b.storage.data[pos:], uint32(n))
+	pos += varlen2
+	encodeExpiry(b.storage.data[pos:], now().Add(ttl).UnixNano())
+	copy(b.storage.data[pos+expiryLen:], value)
+	b.storage.data = b.storage.data[:len(b.storage.data)-(2*maxVarintLen32-varlen1-varlen2)]
+
+	if b.index != nil {
+		if err := b.index.Add(offset); err != nil {
+			// We never add duplicate entries, so an error should never occur.
+			panic(err)
+		}
+	}
+	b.memTableSize += memTableEntrySize(len(key), n)
+	return nil
+}
+
 // Merge adds an action to the batch that merges the value at key with the new
 // value. The details of the merge are dependent upon the configured merge
 // operator.
@@ -413,6 +534,37 @@ func (b *Batch) Delete(key []byte, _ *db.WriteOptions) error {
 	return nil
 }
 
+// SingleDelete adds an action to the batch that single deletes the entry for
+// key. See Writer.SingleDelete for more details on the semantics of
+// SingleDelete.
+//
+// It is safe to modify the contents of the arguments after SingleDelete
+// returns.
+func (b *Batch) SingleDelete(key []byte, _ *db.WriteOptions) error {
+	if len(b.storage.data) == 0 {
+		b.init(len(key) + binary.MaxVarintLen64 + batchHeaderLen)
+	}
+	if !b.increment() {
+		return ErrInvalidBatch
+	}
+
+	pos := len(b.storage.data)
+	offset := uint32(pos)
+	b.grow(1 + maxVarintLen32 + len(key))
+	b.storage.data[pos] = byte(db.InternalKeyKindSingleDelete)
+	pos, varlen1 := b.copyStr(pos+1, key)
+	b.storage.data = b.storage.data[:len(b.storage.data)-(maxVarintLen32-varlen1)]
+
+	if b.index != nil {
+		if err := b.index.Add(offset); err != nil {
+			// We never add duplicate entries, so an error should never occur.
+			panic(err)
+		}
+	}
+	b.memTableSize += memTableEntrySize(len(key), 0)
+	return nil
+}
+
 // DeleteRange deletes all of the keys (and values) in the range [start,end)
 // (inclusive on start, exclusive on end).
 //
@@ -443,6 +595,93 @@ func (b *Batch) DeleteRange(start, end []byte, _ *db.WriteOptions) error {
 	return nil
 }
 
+// SetCF adds an action to the batch that sets the key to map to the value in
+// the column family. A nil column family refers to the default column family.
+//
+// It is safe to modify the contents of the arguments after SetCF returns.
+func (b *Batch) SetCF(cf *ColumnFamily, key, value []byte, opts *db.WriteOptions) error {
+	if cf == nil || cf.cf.id == 0 {
+		return b.Set(key, value, opts)
+	}
+	return b.encodeColumnFamily(cf.cf.id, db.InternalKeyKindColumnFamilyValue, key, value)
+}
+
+// MergeCF adds an action to the batch that merges the value at key with the
+// new value in the column family. A nil column family refers to the default
+// column family.
+//
+// It is safe to modify the contents of the arguments after MergeCF returns.
+func (b *Batch) MergeCF(cf *ColumnFamily, key, value []byte, opts *db.WriteOptions) error {
+	if cf == nil || cf.cf.id == 0 {
+		return b.Merge(key, value, opts)
+	}
+	return b.encodeColumnFamily(cf.cf.id, db.InternalKeyKindColumnFamilyMerge, key, value)
+}
+
+// DeleteCF adds an action to the batch that deletes the entry for key in the
+// column family. A nil column family refers to the default column family.
+//
+// It is safe to modify the contents of the arguments after DeleteCF returns.
+func (b *Batch) DeleteCF(cf *ColumnFamily, key []byte, opts *db.WriteOptions) error {
+	if cf == nil || cf.cf.id == 0 {
+		return b.Delete(key, opts)
+	}
+	return b.encodeColumnFamily(cf.cf.id, db.InternalKeyKindColumnFamilyDeletion, key, nil)
+}
+
+// SingleDeleteCF adds an action to the batch that single deletes the entry
+// for key in the column family. A nil column family refers to the default
+// column family. See Writer.SingleDelete for more details on the semantics of
+// SingleDelete.
+//
+// It is safe to modify the contents of the arguments after SingleDeleteCF
+// returns.
+func (b *Batch) SingleDeleteCF(cf *ColumnFamily, key []byte, opts *db.WriteOptions) error {
+	if cf == nil || cf.cf.id == 0 {
+		return b.SingleDelete(key, opts)
+	}
+	return b.encodeColumnFamily(cf.cf.id, db.InternalKeyKindColumnFamilySingleDelete, key, nil)
+}
+
+// DeleteRangeCF deletes all of the keys (and values) in the range [start,end)
+// (inclusive on start, exclusive on end) in the column family. A nil column
+// family refers to the default column family.
+//
+// It is safe to modify the contents of the arguments after DeleteRangeCF
+// returns.
+func (b *Batch) DeleteRangeCF(cf *ColumnFamily, start, end []byte, opts *db.WriteOptions) error {
+	if cf == nil || cf.cf.id == 0 {
+		return b.DeleteRange(start, end, opts)
+	}
+	return b.encodeColumnFamily(cf.cf.id, db.InternalKeyKindColumnFamilyRangeDelete, start, end)
+}
+
+// encodeColumnFamily adds a column family record to the batch. The value is
+// only encoded for the kinds which have a value.
+func (b *Batch) encodeColumnFamily(cfID uint32, kind db.InternalKeyKind, key, value []byte) error {
+	if len(b.storage.data) == 0 {
+		b.init(len(key) + len(value) + 3*binary.MaxVarintLen64 + batchHeaderLen)
+	}
+	if !b.increment() {
+		return ErrInvalidBatch
+	}
+
+	pos := len(b.storage.data)
+	b.grow(1 + 3*maxVarintLen32 + len(key) + len(value))
+	b.storage.data[pos] = byte(kind)
+	pos++
+	pos += putUvarint32(b.storage.data[pos:], cfID)
+	pos, _ = b.copyStr(pos, key)
+	if kind != db.InternalKeyKindColumnFamilyDeletion &&
+		kind != db.InternalKeyKindColumnFamilySingleDelete {
+		pos, _ = b.copyStr(pos, value)
+	}
+	b.storage.data = b.storage.data[:pos]
+
+	b.addMemTableSize(cfID, memTableEntrySize(len(key), len(value)))
+	return nil
+}
+
 // LogData adds the specified to the batch. The data will be written to the
 // WAL, but not added to memtables or sstables. Log data is never indexed,
 // which makes it useful for testing WAL performance.
@@ -466,12 +705,63 @@ func (b *Batch) LogData(data []byte, _ *db.WriteOptions) error {
 	return nil
 }
 
+// encodeTwoPhaseMarker adds a two-phase commit marker record to the batch. The
+// name is not encoded for InternalKeyKindBeginPrepareXID.
+func (b *Batch) encodeTwoPhaseMarker(kind db.InternalKeyKind, name []byte) {
+	if len(b.storage.data) == 0 {
+		b.init(len(name) + binary.MaxVarintLen64 + batchHeaderLen)
+	}
+	// The count cannot overflow as the markers are only added to batches
+	// constructed internally.
+	b.increment()
+
+	pos := len(b.storage.data)
+	if kind == db.InternalKeyKindBeginPrepareXID {
+		b.grow(1)
+		b.storage.data[pos] = byte(kind)
+		return
+	}
+	b.grow(1 + maxVarintLen32 + len(name))
+	b.storage.data[pos] = byte(kind)
+	_, varlen1 := b.copyStr(pos+1, name)
+	b.storage.data = b.storage.data[:len(b.storage.data)-(maxVarintLen32-varlen1)]
+}
+
+// isTwoPhaseMarker returns true if the kind is one of the two-phase commit
+// marker kinds.
+func isTwoPhaseMarker(kind db.InternalKeyKind) bool {
+	switch kind {
+	case db.InternalKeyKindBeginPrepareXID, db.InternalKeyKindEndPrepareXID,
+		db.InternalKeyKindCommitXID, db.InternalKeyKindRollbackXID:
+		return true
+	}
+	return false
+}
+
 // Repr returns the underlying batch representation. It is not safe to modify
 // the contents.
 func (b *Batch) Repr() []byte {
 	return b.storage.data
 }
 
+// Count returns the number of operations in the batch, which is also the
+// number of sequence numbers consumed by the batch when it is committed.
+func (b *Batch) Count() uint32 {
+	if len(b.storage.data) < batchHeaderLen {
+		return 0
+	}
+	return b.count()
+}
+
+// Reader returns a BatchReader positioned before the first operation of the
+// batch.
+func (b *Batch) Reader() BatchReader {
+	if len(b.storage.data) < batchHeaderLen {
+		return BatchReader{}
+	}
+	return BatchReader{r: b.iter()}
+}
+
 // NewIter returns an iterator that is unpositioned (Iterator.Valid() will
 // return false). The iterator can be positioned via a call to SeekGE, SeekLT,
 // First or Last. Only indexed batches support iterators.
@@ -479,8 +769,7 @@ func (b *Batch) NewIter(o *db.IterOptions) *Iterator {
 	if b.index == nil {
 		return &Iterator{err: ErrNotIndexed}
 	}
-	return b.db.newIterInternal(b.newInternalIter(o),
-		b.newRangeDelIter(o), nil /* snapshot */, o)
+	return b.db.newIterInternal(&b.db.columnFamily, b, nil /* snapshot */, o)
 }
 
 // newInternalIter creates a new internalIterator that iterates over the
@@ -661,7 +950,7 @@ func batchDecode(data []byte, offset uint32) (kind db.InternalKeyKind, ukey []by
 		return 0, nil, nil, false
 	}
 	kind, p = db.InternalKeyKind(p[0]), p[1:]
-	if kind > db.InternalKeyKindMax {
+	if !kind.Valid() {
 		return 0, nil, nil, false
 	}
 	p, ukey, ok = batchDecodeStr(p)
@@ -669,7 +958,8 @@ func batchDecode(data []byte, offset uint32) (kind db.InternalKeyKind, ukey []by
 		return 0, nil, nil, false
 	}
 	switch kind {
-	case db.InternalKeyKindSet, db.InternalKeyKindMerge, db.InternalKeyKindRangeDelete:
+	case db.InternalKeyKindSet, db.InternalKeyKindMerge, db.InternalKeyKindRangeDelete,
+		db.InternalKeyKindSetWithExpiry:
 		_, value, ok = batchDecodeStr(p)
 		if !ok {
 			return 0, nil, nil, false
@@ -690,31 +980,87 @@ func batchDecodeStr(data []byte) (odata []byte, s []byte, ok bool) {
 	return data[v:], data[:v], true
 }
 
+// BatchReader iterates over the operations contained in a batch (see
+// Batch.Reader).
+type BatchReader struct {
+	r batchReader
+}
+
+// Next returns the next operation in the batch. Operations on column families
+// are returned with the plain record kinds (see NextCF). The final return
+// value is false once the batch is exhausted, or if the batch is corrupt.
+func (r *BatchReader) Next() (kind db.InternalKeyKind, key []byte, value []byte, ok bool) {
+	return r.r.next()
+}
+
+// NextCF returns the next operation in the batch, along with the ID of the
+// column family the operation applies to.
+func (r *BatchReader) NextCF() (
+	cfID uint32, kind db.InternalKeyKind, key []byte, value []byte, ok bool,
+) {
+	return r.r.nextCF()
+}
+
 type batchReader []byte
 
 // next returns the next operation in this batch.
 // The final return value is false if the batch is corrupi.
 func (r *batchReader) next() (kind db.InternalKeyKind, ukey []byte, value []byte, ok bool) {
+	_, kind, ukey, value, ok = r.nextCF()
+	return kind, ukey, value, ok
+}
+
+// nextCF returns the next operation in this batch, along with the ID of the
+// column family the operation applies to. The column family variants of the
+// record kinds are translated to the corresponding plain kinds.
+// The final return value is false if the batch is corrupt.
+func (r *batchReader) nextCF() (
+	cfID uint32, kind db.InternalKeyKind, ukey []byte, value []byte, ok bool,
+) {
 	p := *r
 	if len(p) == 0 {
-		return 0, nil, nil, false
+		return 0, 0, nil, nil, false
 	}
 	kind, *r = db.InternalKeyKind(p[0]), p[1:]
-	if kind > db.InternalKeyKindMax {
-		return 0, nil, nil, false
+	if !kind.Valid() {
+		return 0, 0, nil, nil, false
+	}
+	var hasCF bool
+	switch kind {
+	case db.InternalKeyKindColumnFamilyDeletion:
+		kind, hasCF = db.InternalKeyKindDelete, true
+	case db.InternalKeyKindColumnFamilyValue:
+		kind, hasCF = db.InternalKeyKindSet, true
+	case db.InternalKeyKindColumnFamilyMerge:
+		kind, hasCF = db.InternalKeyKindMerge, true
+	case db.InternalKeyKindColumnFamilySingleDelete:
+		kind, hasCF = db.InternalKeyKindSingleDelete, true
+	case db.InternalKeyKindColumnFamilyRangeDelete:
+		kind, hasCF = db.InternalKeyKindRangeDelete, true
+	}
+	if kind == db.InternalKeyKindBeginPrepareXID {
+		return 0, kind, nil, nil, true
+	}
+	if hasCF {
+		u, n := binary.Uvarint(*r)
+		if n <= 0 || u > math.MaxUint32 {
+			return 0, 0, nil, nil, false
+		}
+		cfID, *r = uint32(u), (*r)[n:]
 	}
 	ukey, ok = r.nextStr()
 	if !ok {
-		return 0, nil, nil, false
+		return 0, 0, nil, nil, false
 	}
 	switch kind {
-	case db.InternalKeyKindSet, db.InternalKeyKindMerge, db.InternalKeyKindRangeDelete:
+	case db.InternalKeyKindSet, db.InternalKeyKindMerge, db.InternalKeyKindRangeDelete,
+		db.InternalKeyKindSetWithExpiry:
 		value, ok = r.nextStr()
 		if !ok {
-			return 0, nil, nil, false
+			return 0, 0, nil, nil, false
 		}
 	}
-	return kind, ukey, value, true
+	return cfID, kind, ukey, value, true
 }
 
 func (r *batchReader) nextStr() (s []byte, ok bool) {
@@ -817,6 +1163,10 @@ func (i *batchIter) Close() error {
 	return i.err
 }
 
+func (i *batchIter) SetBounds(lower, upper []byte) {
+	i.iter.SetBounds(lower, upper)
+}
+
 type flushableBatchEntry struct {
 	offset   uint32
 	index    uint32
@@ -872,6 +1222,9 @@ func newFlushableBatch(batch *Batch, comparer *db.Comparer) *flushableBatch {
 		if !ok {
 			break
 		}
+		if isTwoPhaseMarker(kind) {
+			continue
+		}
 		entry := flushableBatchEntry{
 			offset: uint32(offset),
 			index:  uint32(index),
@@ -1092,3 +1445,8 @@ func (i *flushableBatchIter) Error() error {
 func (i *flushableBatchIter) Close() error {
 	return i.err
 }
+
+func (i *flushableBatchIter) SetBounds(lower, upper []byte) {
+	// The bounds are not checked by flushableBatchIter (see
+	// flushableBatch.newIter).
+}
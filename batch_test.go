@@ -35,6 +35,7 @@ func TestBatch(t *testing.T) {
 		{db.InternalKeyKindSet, "binarydata", "\x00"},
 		{db.InternalKeyKindSet, "binarydata", "\xff"},
 		{db.InternalKeyKindMerge, "merge", "mergedata"},
+		{db.InternalKeyKindSingleDelete, "roses", ""},
 	}
 	var b Batch
 	for _, tc := range testCases {
@@ -45,6 +46,8 @@ func TestBatch(t *testing.T) {
 			b.Merge([]byte(tc.key), []byte(tc.value), nil)
 		case db.InternalKeyKindDelete:
 			b.Delete([]byte(tc.key), nil)
+		case db.InternalKeyKindSingleDelete:
+			b.SingleDelete([]byte(tc.key), nil)
 		}
 	}
 	iter := b.iter()
@@ -0,0 +1,374 @@
+// Copyright 2019 The LevelDB-Go and Pebble Authors. All rights reserved. Use
+// of this source code is governed by a BSD-style license that can be found in
+// the LICENSE file.
+
+package pebble
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+
+	"github.com/petermattis/pebble/db"
+	"github.com/petermattis/pebble/internal/crc"
+	"github.com/petermattis/pebble/vfs"
+)
+
+// Blob files hold the large values which are separated from their keys (see
+// db.Options.MinBlobSize). A blob file is a sequence of records, each of which
+// holds a single value:
+//
+//   +-----------+--------------+
+//   | checksum  | value        |
+//   | (4 bytes) | (var length) |
+//   +-----------+--------------+
+//
+// The checksum is the CRC of the value (see internal/crc), in little-endian
+// format. The value is referenced from an sstable by a BLOBINDEX entry, whose
+// value is the blob index: the file number of the blob file and the offset and
+// length of the value, encoded as uvarints. The first record of a blob file is
+// not referenced by any sstable: its value is the identity of the DB session
+// which created the blob file.
+//
+// A blob file is written by a single flush or compaction, and is not modified
+// afterwards. The blob files referenced by a table are recorded in the
+// fileMetadata of the table, along with the size of the records referenced by
+// the table and the size of the blob file, and a blob file is deleted once it
+// is no longer referenced by the tables of any version. Compactions rewrite
+// the BLOBINDEX entries which they read from the oldest blob files (see
+// db.Options.BlobGCAgeCutoff), relocating the values into a new blob file, so
+// that the old blob files eventually become unreferenced. The tables
+// referencing one of the oldest blob files are compacted once enough of the
+// blob file is no longer referenced (see db.Options.BlobGCForceThreshold).
+const blobRecordHeaderLen = 4
+
+var errCorruptBlobIndex = errors.New("pebble: corrupt blob index")
+
+func encodeBlobIndex(buf []byte, fileNum, offset, length uint64) []byte {
+	var tmp [3 * binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(tmp[:], fileNum)
+	n += binary.PutUvarint(tmp[n:], offset)
+	n += binary.PutUvarint(tmp[n:], length)
+	return append(buf, tmp[:n]...)
+}
+
+func decodeBlobIndex(index []byte) (fileNum, offset, length uint64, ok bool) {
+	var n int
+	if fileNum, n = binary.Uvarint(index); n <= 0 {
+		return 0, 0, 0, false
+	}
+	index = index[n:]
+	if offset, n = binary.Uvarint(index); n <= 0 {
+		return 0, 0, 0, false
+	}
+	index = index[n:]
+	if length, n = binary.Uvarint(index); n <= 0 || n != len(index) {
+		return 0, 0, 0, false
+	}
+	return fileNum, offset, length, true
+}
+
+// readBlobSessionID returns the identity of the DB session which created the
+// specified blob file.
+func readBlobSessionID(fs vfs.FS, path string) (string, error) {
+	f, err := fs.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	var record [blobRecordHeaderLen + dbSessionIDLen]byte
+	if _, err := f.ReadAt(record[:], 0); err != nil {
+		return "", err
+	}
+	id := record[blobRecordHeaderLen:]
+	if binary.LittleEndian.Uint32(record[:]) != crc.New(id).Value() {
+		return "", fmt.Errorf("pebble: blob file %q: checksum mismatch at offset 0", path)
+	}
+	return string(id), nil
+}
+
+// blobCache holds the open blob files of a DB.
+type blobCache struct {
+	dirname string
+	fs      vfs.FS
+
+	mu struct {
+		sync.Mutex
+		files map[uint64]vfs.File
+	}
+}
+
+func (c *blobCache) init(dirname string, fs vfs.FS) {
+	c.dirname = dirname
+	c.fs = fs
+	c.mu.files = make(map[uint64]vfs.File)
+}
+
+// get returns the value referenced by the specified blob index. The record
+// holding the value is read into *buf, which is grown if it has insufficient
+// capacity, so the value is only valid until the buffer is reused.
+func (c *blobCache) get(index []byte, buf *[]byte) ([]byte, error) {
+	fileNum, offset, length, ok := decodeBlobIndex(index)
+	if !ok {
+		return nil, errCorruptBlobIndex
+	}
+	f, err := c.findFile(fileNum)
+	if err != nil {
+		return nil, err
+	}
+	n := blobRecordHeaderLen + int(length)
+	if cap(*buf) < n {
+		*buf = make([]byte, n)
+	}
+	record := (*buf)[:n]
+	if _, err := f.ReadAt(record, int64(offset)); err != nil {
+		return nil, err
+	}
+	value := record[blobRecordHeaderLen:]
+	if binary.LittleEndian.Uint32(record) != crc.New(value).Value() {
+		return nil, fmt.Errorf("pebble: blob file %06d: checksum mismatch at offset %d", fileNum, offset)
+	}
+	return value, nil
+}
+
+func (c *blobCache) findFile(fileNum uint64) (vfs.File, error) {
+	c.mu.Lock()
+	f := c.mu.files[fileNum]
+	c.mu.Unlock()
+	if f != nil {
+		return f, nil
+	}
+
+	f, err := c.fs.Open(dbFilename(c.dirname, fileTypeBlob, fileNum))
+	if err != nil {
+		return nil, err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if existing := c.mu.files[fileNum]; existing != nil {
+		// The file was opened concurrently.
+		f.Close()
+		return existing, nil
+	}
+	c.mu.files[fileNum] = f
+	return f, nil
+}
+
+// evict closes the specified blob file if it is open. The file must no longer
+// be referenced by any version.
+func (c *blobCache) evict(fileNum uint64) {
+	c.mu.Lock()
+	f := c.mu.files[fileNum]
+	delete(c.mu.files, fileNum)
+	c.mu.Unlock()
+	if f != nil {
+		f.Close()
+	}
+}
+
+func (c *blobCache) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var err error
+	for fileNum, f := range c.mu.files {
+		err = firstError(err, f.Close())
+		delete(c.mu.files, fileNum)
+	}
+	return err
+}
+
+// blobWriter separates the large values output by a flush or compaction from
+// their keys, writing them to a new blob file. It also relocates the values
+// of the blob files which are being garbage collected. The blob file is
+// created when the first value is written to it.
+type blobWriter struct {
+	d        *DB
+	minSize  int
+	relocate map[uint64]bool
+	// sizes holds the sizes of the blob files referenced by the inputs.
+	sizes map[uint64]uint64
+	// created is called with DB.mu held when the blob file is created, and
+	// after the file number has been added to DB.mu.compact.pendingOutputs.
+	created func(fileNum uint64, filename string)
+
+	fileNum uint64
+	file    vfs.File
+	w       *bufio.Writer
+	offset  uint64
+	// refs holds the size of the records referenced by the current table,
+	// keyed by blob file number.
+	refs map[uint64]uint64
+	buf  []byte
+	// valueBuf holds the last value read from a relocated blob file.
+	valueBuf []byte
+}
+
+// newBlobWriter returns a blob writer for the output of a flush or compaction.
+// The sizes of the blob files referenced by the inputs are found in the
+// fileMetadata of the inputs.
+func newBlobWriter(
+	d *DB, opts *db.Options, relocate map[uint64]bool, inputs [][]fileMetadata,
+	created func(fileNum uint64, filename string),
+) *blobWriter {
+	w := &blobWriter{
+		d:        d,
+		minSize:  opts.MinBlobSize,
+		relocate: relocate,
+		sizes:    make(map[uint64]uint64),
+		created:  created,
+		refs:     make(map[uint64]uint64),
+	}
+	for _, files := range inputs {
+		for i := range files {
+			f := &files[i]
+			for j, fileNum := range f.blobFiles {
+				if j < len(f.blobUsage) && f.blobUsage[j].size != 0 {
+					w.sizes[fileNum] = f.blobUsage[j].size
+				}
+			}
+		}
+	}
+	return w
+}
+
+// add returns the entry to add to the current table in place of the specified
+// entry: a SET whose value is separated becomes a BLOBINDEX, and a BLOBINDEX
+// whose value is relocated references the new blob file (or becomes a SET if
+// the value is no longer separated). The returned value is only valid until
+// the next call.
+func (w *blobWriter) add(key db.InternalKey, value []byte) (db.InternalKey, []byte, error) {
+	switch key.Kind() {
+	case db.InternalKeyKindSet:
+		if w.minSize <= 0 || len(value) < w.minSize {
+			return key, value, nil
+		}
+
+	case db.InternalKeyKindBlobIndex:
+		fileNum, _, length, ok := decodeBlobIndex(value)
+		if !ok {
+			return key, nil, errCorruptBlobIndex
+		}
+		if !w.relocate[fileNum] {
+			w.refs[fileNum] += blobRecordHeaderLen + length
+			return key, value, nil
+		}
+		v, err := w.d.blobs.get(value, &w.valueBuf)
+		if err != nil {
+			return key, nil, err
+		}
+		value = v
+		if w.minSize <= 0 || len(value) < w.minSize {
+			key.SetKind(db.InternalKeyKindSet)
+			return key, value, nil
+		}
+
+	default:
+		return key, value, nil
+	}
+
+	if w.file == nil {
+		if err := w.create(); err != nil {
+			return key, nil, err
+		}
+	}
+	w.buf = encodeBlobIndex(w.buf[:0], w.fileNum, w.offset, uint64(len(value)))
+	if err := w.writeRecord(value); err != nil {
+		return key, nil, err
+	}
+	w.refs[w.fileNum] += uint64(blobRecordHeaderLen + len(value))
+	key.SetKind(db.InternalKeyKindBlobIndex)
+	return key, w.buf, nil
+}
+
+func (w *blobWriter) create() error {
+	d := w.d
+	d.mu.Lock()
+	fileNum := d.mu.versions.nextFileNum()
+	filename := dbFilename(d.dirname, fileTypeBlob, fileNum)
+	d.mu.compact.pendingOutputs[fileNum] = struct{}{}
+	w.created(fileNum, filename)
+	d.mu.Unlock()
+
+	file, err := d.opts.FS.Create(filename)
+	if err != nil {
+		return err
+	}
+	w.fileNum = fileNum
+	w.file = vfs.NewSyncingFile(file, vfs.SyncingFileOptions{
+		BytesPerSync: d.opts.BytesPerSync,
+	})
+	w.w = bufio.NewWriter(w.file)
+	return w.writeRecord([]byte(d.sessionID))
+}
+
+// writeRecord appends a record holding the value to the blob file.
+func (w *blobWriter) writeRecord(value []byte) error {
+	var header [blobRecordHeaderLen]byte
+	binary.LittleEndian.PutUint32(header[:], crc.New(value).Value())
+	if _, err := w.w.Write(header[:]); err != nil {
+		return err
+	}
+	if _, err := w.w.Write(value); err != nil {
+		return err
+	}
+	w.offset += uint64(blobRecordHeaderLen + len(value))
+	return nil
+}
+
+// finishTable records the blob files referenced by the entries added since
+// the previous call in the metadata of the table, in increasing order of file
+// number. The size of the blob file being written is recorded by finish.
+func (w *blobWriter) finishTable(meta *fileMetadata) {
+	if len(w.refs) == 0 {
+		return
+	}
+	meta.blobFiles = make([]uint64, 0, len(w.refs))
+	for fileNum := range w.refs {
+		meta.blobFiles = append(meta.blobFiles, fileNum)
+	}
+	sort.Slice(meta.blobFiles, func(i, j int) bool {
+		return meta.blobFiles[i] < meta.blobFiles[j]
+	})
+	meta.blobUsage = make([]blobUsage, len(meta.blobFiles))
+	for i, fileNum := range meta.blobFiles {
+		meta.blobUsage[i] = blobUsage{bytes: w.refs[fileNum], size: w.sizes[fileNum]}
+		delete(w.refs, fileNum)
+	}
+}
+
+// finish syncs and closes the blob file, if one was created, and records its
+// size in the metadata of the specified tables which reference it.
+func (w *blobWriter) finish(metas ...*fileMetadata) error {
+	if w.file == nil {
+		return nil
+	}
+	if err := w.w.Flush(); err != nil {
+		return err
+	}
+	if err := w.file.Sync(); err != nil {
+		return err
+	}
+	err := w.file.Close()
+	w.file = nil
+	for _, meta := range metas {
+		for i, fileNum := range meta.blobFiles {
+			if fileNum == w.fileNum {
+				meta.blobUsage[i].size = w.offset
+			}
+		}
+	}
+	return err
+}
+
+// Close closes the blob file without syncing it, if it is still open.
+func (w *blobWriter) Close() error {
+	if w.file == nil {
+		return nil
+	}
+	err := w.file.Close()
+	w.file = nil
+	return err
+}
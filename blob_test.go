@@ -0,0 +1,250 @@
+// Copyright 2019 The LevelDB-Go and Pebble Authors. All rights reserved. Use
+// of this source code is governed by a BSD-style license that can be found in
+// the LICENSE file.
+
+package pebble
+
+import (
+	"bytes"
+	"fmt"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/petermattis/pebble/db"
+	"github.com/petermattis/pebble/vfs"
+)
+
+func TestBlobFiles(t *testing.T) {
+	mem := vfs.NewMem()
+	opts := &db.Options{
+		FS:              mem,
+		MinBlobSize:     100,
+		BlobGCAgeCutoff: -1,
+	}
+	d, err := Open("db", opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	large := func(c byte) []byte {
+		return bytes.Repeat([]byte{c}, 200)
+	}
+	listBlobs := func(dirname string) string {
+		t.Helper()
+		ls, err := mem.List(dirname)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var blobs []string
+		for _, name := range ls {
+			if fileType, _, ok := parseDBFilename(name); ok && fileType == fileTypeBlob {
+				blobs = append(blobs, name)
+			}
+		}
+		sort.Strings(blobs)
+		return strings.Join(blobs, " ")
+	}
+	// scan returns the keys along with the lengths and first bytes of the
+	// values read by forward and reverse iteration, which must agree.
+	scan := func(r Reader) string {
+		t.Helper()
+		iter := r.NewIter(nil)
+		defer iter.Close()
+		format := func() string {
+			v := iter.Value()
+			return fmt.Sprintf("%s:%d%s", iter.Key(), len(v), v[:1])
+		}
+		var fwd, rev []string
+		for valid := iter.First(); valid; valid = iter.Next() {
+			fwd = append(fwd, format())
+		}
+		for valid := iter.Last(); valid; valid = iter.Prev() {
+			rev = append([]string{format()}, rev...)
+		}
+		if err := iter.Error(); err != nil {
+			t.Fatal(err)
+		}
+		if f, r := strings.Join(fwd, " "), strings.Join(rev, " "); f != r {
+			t.Fatalf("forward iteration found %q, but reverse iteration found %q", f, r)
+		}
+		return strings.Join(fwd, " ")
+	}
+
+	// The large values are separated into a blob file by the flush.
+	if err := d.Set([]byte("a"), []byte("a"), nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Set([]byte("b"), large('b'), nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Set([]byte("c"), large('c'), nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	firstBlob := listBlobs("db")
+	if firstBlob == "" {
+		t.Fatalf("expected a blob file")
+	}
+	if expected, actual := "a:1a b:200b c:200c", scan(d); expected != actual {
+		t.Fatalf("expected %q, but found %q", expected, actual)
+	}
+	if v, err := d.Get([]byte("b")); err != nil || !bytes.Equal(v, large('b')) {
+		t.Fatalf("expected %q, but found %q, %v", large('b'), v, err)
+	}
+
+	// Merge operands are merged with the value read from the blob file.
+	if err := d.Merge([]byte("b"), []byte("x"), nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Set([]byte("c"), large('C'), nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Compact([]byte("a"), []byte("z")); err != nil {
+		t.Fatal(err)
+	}
+	if expected, actual := "a:1a b:201x c:200C", scan(d); expected != actual {
+		t.Fatalf("expected %q, but found %q", expected, actual)
+	}
+	// The first blob file is no longer referenced once b is rewritten by the
+	// merge and c is overwritten, and is deleted.
+	if blobs := listBlobs("db"); len(strings.Fields(blobs)) != 2 || strings.Contains(blobs, firstBlob) {
+		t.Fatalf("expected 2 blob files other than %q, but found %q", firstBlob, blobs)
+	}
+
+	// The blob files are linked into a checkpoint.
+	if err := d.Checkpoint("checkpoint"); err != nil {
+		t.Fatal(err)
+	}
+	if expected, actual := listBlobs("db"), listBlobs("checkpoint"); expected != actual {
+		t.Fatalf("expected blob files %q, but found %q", expected, actual)
+	}
+	if err := d.Close(); err != nil {
+		t.Fatal(err)
+	}
+	c, err := Open("checkpoint", &db.Options{FS: mem})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected, actual := "a:1a b:201x c:200C", scan(c); expected != actual {
+		t.Fatalf("expected %q, but found %q", expected, actual)
+	}
+	if err := c.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Relocating the values of all of the blob files while no longer
+	// separating values moves the values back into the sstables when the
+	// sstables are rewritten by a compaction, and the blob files are deleted.
+	opts.MinBlobSize = 0
+	opts.BlobGCAgeCutoff = 1
+	if d, err = Open("db", opts); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Set([]byte("bb"), []byte("bb"), nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Compact([]byte("a"), []byte("z")); err != nil {
+		t.Fatal(err)
+	}
+	if blobs := listBlobs("db"); blobs != "" {
+		t.Fatalf("expected no blob files, but found %q", blobs)
+	}
+	if expected, actual := "a:1a b:201x bb:2b c:200C", scan(d); expected != actual {
+		t.Fatalf("expected %q, but found %q", expected, actual)
+	}
+	if err := d.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestBlobGC(t *testing.T) {
+	mem := vfs.NewMem()
+	opts := &db.Options{
+		FS:              mem,
+		MinBlobSize:     100,
+		BlobGCAgeCutoff: -1,
+	}
+	d, err := Open("db", opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// blobs returns the blob files referenced by the tables of the DB, once
+	// any compactions have completed.
+	blobs := func() []uint64 {
+		d.mu.Lock()
+		defer d.mu.Unlock()
+		for d.mu.compact.compacting {
+			d.mu.compact.cond.Wait()
+		}
+		var fileNums []uint64
+		for _, files := range d.mu.versions.currentVersion().files {
+			for _, f := range files {
+				fileNums = merge(fileNums, f.blobFiles)
+			}
+		}
+		return fileNums
+	}
+
+	for _, k := range []string{"a", "b", "c", "d"} {
+		if err := d.Set([]byte(k), bytes.Repeat([]byte(k), 200), nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := d.Compact([]byte("a"), []byte("z")); err != nil {
+		t.Fatal(err)
+	}
+	before := blobs()
+	if len(before) != 1 {
+		t.Fatalf("expected a single blob file, but found %v", before)
+	}
+
+	// Overwriting most of the values leaves most of the blob file obsolete,
+	// but the blob file is still referenced.
+	for _, k := range []string{"a", "b", "c"} {
+		if err := d.Set([]byte(k), []byte(k), nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := d.Compact([]byte("a"), []byte("z")); err != nil {
+		t.Fatal(err)
+	}
+	if actual := blobs(); fmt.Sprint(before) != fmt.Sprint(actual) {
+		t.Fatalf("expected %v, but found %v", before, actual)
+	}
+	if err := d.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Once the blob file is old enough to be relocated, the table referencing
+	// it is compacted without being asked to, and the blob file is deleted.
+	opts.BlobGCAgeCutoff = 1
+	if d, err = Open("db", opts); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Set([]byte("e"), []byte("e"), nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	after := blobs()
+	if len(after) != 1 || after[0] == before[0] {
+		t.Fatalf("expected a single new blob file, but found %v", after)
+	}
+	if _, err := mem.Stat(dbFilename("db", fileTypeBlob, before[0])); err == nil {
+		t.Fatalf("expected blob file %d to be deleted", before[0])
+	}
+	if v, err := d.Get([]byte("d")); err != nil || !bytes.Equal(v, bytes.Repeat([]byte("d"), 200)) {
+		t.Fatalf("unexpected value %q: %v", v, err)
+	}
+	if err := d.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -132,6 +132,49 @@ func hash(b []byte) uint32 {
 	return h
 }
 
+type blockFilterWriter struct {
+	bitsPerKey int
+	hashes     []uint32
+}
+
+// AddKey implements the db.FilterWriter interface.
+func (w *blockFilterWriter) AddKey(key []byte) {
+	h := hash(key)
+	if n := len(w.hashes); n == 0 || h != w.hashes[n-1] {
+		w.hashes = append(w.hashes, h)
+	}
+}
+
+// Finish implements the db.FilterWriter interface.
+func (w *blockFilterWriter) Finish(buf []byte) []byte {
+	// The block filter format matches the LevelDB filter format, which is also
+	// used by RocksDB block-based filters.
+	nBits := len(w.hashes) * w.bitsPerKey
+	// For small n, we can see a very high false positive rate. Fix it by
+	// enforcing a minimum bloom filter length.
+	if nBits < 64 {
+		nBits = 64
+	}
+	nBytes := (nBits + 7) / 8
+	nBits = nBytes * 8
+	// +1: 1 byte for num-probes
+	buf, filter := extend(buf, nBytes+1)
+
+	nProbes := calculateProbes(w.bitsPerKey)
+	for _, h := range w.hashes {
+		delta := h>>17 | h<<15 // rotate right 17 bits
+		for i := uint32(0); i < nProbes; i++ {
+			bitPos := h % uint32(nBits)
+			filter[bitPos/8] |= (1 << (bitPos % 8))
+			h += delta
+		}
+	}
+	filter[nBytes] = byte(nProbes)
+
+	w.hashes = w.hashes[:0]
+	return buf
+}
+
 type tableFilterWriter struct {
 	bitsPerKey int
 	hashes     []uint32
@@ -207,6 +250,8 @@ func (p FilterPolicy) MayContain(ftype db.FilterType, f, key []byte) bool {
 	switch ftype {
 	case db.TableFilter:
 		return tableFilter(f).MayContain(key)
+	case db.BlockFilter:
+		return blockFilter(f).MayContain(key)
 	default:
 		panic(fmt.Sprintf("unknown filter type: %v", ftype))
 	}
@@ -219,6 +264,10 @@ func (p FilterPolicy) NewWriter(ftype db.FilterType) db.FilterWriter {
 		return &tableFilterWriter{
 			bitsPerKey: int(p),
 		}
+	case db.BlockFilter:
+		return &blockFilterWriter{
+			bitsPerKey: int(p),
+		}
 	default:
 		panic(fmt.Sprintf("unknown filter type: %v", ftype))
 	}
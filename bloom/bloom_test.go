@@ -5,6 +5,7 @@
 package bloom
 
 import (
+	"encoding/binary"
 	"testing"
 
 	"github.com/petermattis/pebble/db"
@@ -129,6 +130,50 @@ loop:
 	}
 }
 
+func TestBlockBloomFilter(t *testing.T) {
+	le32 := func(i int) []byte {
+		b := make([]byte, 4)
+		binary.LittleEndian.PutUint32(b, uint32(i))
+		return b
+	}
+
+	for _, length := range []int{0, 1, 2, 10, 100, 1000, 10000} {
+		keys := make([][]byte, 0, length)
+		for i := 0; i < length; i++ {
+			keys = append(keys, le32(i))
+		}
+		w := FilterPolicy(10).NewWriter(db.BlockFilter)
+		for _, key := range keys {
+			w.AddKey(key)
+		}
+		f := blockFilter(w.Finish(nil))
+		// The block bloom filter has a minimum size of 64 bits, plus the
+		// num-probes byte.
+		if maxLen := (length*10)/8 + 40; len(f) > maxLen {
+			t.Errorf("length=%d: len(f)=%d > max len %d", length, len(f), maxLen)
+			continue
+		}
+
+		// All added keys must match.
+		for _, key := range keys {
+			if !f.MayContain(key) {
+				t.Fatalf("length=%d: did not contain key %q", length, key)
+			}
+		}
+
+		// Check false positive rate.
+		nFalsePositive := 0
+		for i := 0; i < 10000; i++ {
+			if f.MayContain(le32(1e9 + i)) {
+				nFalsePositive++
+			}
+		}
+		if nFalsePositive > 0.02*10000 {
+			t.Errorf("length=%d: %d false positives in 10000", length, nFalsePositive)
+		}
+	}
+}
+
 func TestHash(t *testing.T) {
 	// The magic want numbers come from running the C++ leveldb code in hash.cc.
 	testCases := []struct {
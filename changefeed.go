@@ -0,0 +1,597 @@
+// Copyright 2019 The LevelDB-Go and Pebble Authors. All rights reserved. Use
+// of this source code is governed by a BSD-style license that can be found in
+// the LICENSE file.
+
+package pebble
+
+import (
+	"errors"
+	"io"
+	"sync"
+	"sync/atomic"
+
+	"github.com/petermattis/pebble/db"
+)
+
+// ErrChangeFeedTruncated is returned by ChangeFeed.Next when the batches
+// following the last delivered batch are no longer available, because the
+// logs containing them have been deleted (or the WAL is disabled).
+var ErrChangeFeedTruncated = errors.New("pebble: change feed truncated")
+
+// ErrChangeFeedClosed is returned by ChangeFeed.Next when the change feed or
+// its DB has been closed.
+var ErrChangeFeedClosed = errors.New("pebble: change feed closed")
+
+const defaultChangeFeedBufferSize = 4 << 20
+
+// ChangeFeedOptions hold the optional parameters for a change feed (see
+// DB.NewChangeFeed).
+type ChangeFeedOptions struct {
+	// StartSeqNum is the sequence number from which to deliver committed
+	// batches. Batches committed before the change feed was created are read
+	// from the WAL, including the archived logs (see db.Options.WALArchiveTTL).
+	// If zero, only the batches committed after the change feed was created
+	// are delivered (so the batch with sequence number zero, which is the
+	// first batch committed to a new DB, is only delivered to change feeds
+	// created before it was committed).
+	StartSeqNum uint64
+
+	// LowerBound and UpperBound restrict the delivered batches to the batches
+	// containing an operation on a key (or a range deletion overlapping a key)
+	// in the range [LowerBound, UpperBound). A nil bound is unbounded.
+	LowerBound []byte
+	UpperBound []byte
+
+	// MaxBufferSize is the maximum total size of the committed batches buffered
+	// in memory awaiting delivery. When the limit is exceeded the buffered
+	// batches written to the logs preceding the live log are discarded, and are
+	// instead read from the WAL once the change feed catches up. The batches
+	// written to the live log are retained regardless of the limit, as the
+	// live log is not read while it is being written. The default is 4 MB.
+	MaxBufferSize int
+}
+
+// changeFeedEntry is a committed batch buffered for delivery.
+type changeFeedEntry struct {
+	seqNum uint64
+	count  uint32
+	// The file number of the log the batch was written to.
+	logNum uint64
+	// The representation of the batch, shared by all of the change feeds.
+	data []byte
+}
+
+// changeFeeds is the set of open change feeds of a DB. The committed batches
+// are pushed to the change feeds in sequence number order by the commit
+// pipeline.
+type changeFeeds struct {
+	// The number of open change feeds, which allows the commit path to skip
+	// locking mu when there are none. Accessed atomically.
+	count int32
+
+	mu sync.Mutex
+	// Signaled whenever a batch is committed or a change feed is closed.
+	cond  sync.Cond
+	feeds map[*ChangeFeed]struct{}
+}
+
+func (c *changeFeeds) init() {
+	c.cond.L = &c.mu
+	c.feeds = make(map[*ChangeFeed]struct{})
+}
+
+// push buffers a batch written to the specified log for delivery by each of
+// the change feeds. Requires DB.mu and commitPipeline.mu are held, which
+// ensures batches are pushed in sequence number order.
+func (c *changeFeeds) push(b *Batch, logNum uint64) {
+	if b.count() == 0 {
+		return
+	}
+	e := changeFeedEntry{
+		seqNum: b.seqNum(),
+		count:  b.count(),
+		logNum: logNum,
+		data:   append([]byte(nil), b.storage.data...),
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for f := range c.feeds {
+		if f.queueSize > 0 && f.queueSize+len(e.data) > f.opts.MaxBufferSize {
+			f.discardLocked(e)
+		}
+		f.queue = append(f.queue, e)
+		f.queueSize += len(e.data)
+	}
+}
+
+// notify wakes the change feeds waiting for a batch to become visible.
+func (c *changeFeeds) notify() {
+	c.mu.Lock()
+	c.cond.Broadcast()
+	c.mu.Unlock()
+}
+
+// minLogNum returns the file number of the oldest log which may contain
+// batches the change feeds have yet to deliver, or 0 if there is no such log.
+func (c *changeFeeds) minLogNum() uint64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var logNum uint64
+	for f := range c.feeds {
+		if f.logNum != 0 && (logNum == 0 || f.logNum < logNum) {
+			logNum = f.logNum
+		}
+	}
+	return logNum
+}
+
+// close closes all of the change feeds, waking any waiting on a batch.
+func (c *changeFeeds) close() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for f := range c.feeds {
+		f.closed = true
+	}
+	c.cond.Broadcast()
+}
+
+// A ChangeFeed delivers the batches committed to a DB in sequence number
+// order. A change feed is created by DB.NewChangeFeed.
+//
+// The committed batches are buffered in memory until they are delivered, and
+// are read from the WAL when a change feed starts from an older sequence
+// number or falls too far behind. Only the logs preceding the live log are
+// read, as the live log is written concurrently: the batches written to the
+// live log are delivered from the buffered batches, except for the batches
+// written before the change feed was created, which are read once the live
+// log has been switched (flushing the memtable). The logs containing batches
+// the change feed has yet to deliver are retained until the change feed is
+// closed, so an unused change feed should be closed promptly.
+type ChangeFeed struct {
+	db   *DB
+	opts ChangeFeedOptions
+	// The sequence number of the next batch to deliver. Only accessed by Next.
+	next uint64
+	// True if the batches skipped by the last call to Next contained writes.
+	// Only accessed by Next and SkippedWrites.
+	skippedWrites bool
+
+	// The following fields are protected by DB.changeFeeds.mu.
+
+	// The buffered batches, in sequence number order.
+	queue     []changeFeedEntry
+	queueSize int
+	// The sequence number from which every committed batch is buffered (or has
+	// been delivered). The batches preceding liveStart are read from the WAL,
+	// and have been written to the logs preceding the live log unless they
+	// were written to switchLogNum.
+	liveStart uint64
+	// The file number of the oldest log which may contain batches yet to be
+	// delivered.
+	logNum  uint64
+	closed  bool
+	reading bool
+
+	// The state for reading batches from the WAL. Only accessed by Next, or by
+	// Close when Next is not running.
+	wal struct {
+		// The file number of the log being read, or last read.
+		logNum uint64
+		r      *LogReader
+	}
+	// The file number of the live log when the change feed was created, if the
+	// change feed starts from a sequence number preceding its creation. The
+	// batches written to that log before the change feed was created are not
+	// buffered, so the log is switched in order to read them. Only accessed by
+	// Next.
+	switchLogNum uint64
+	// True until the first batch has been delivered if the change feed starts
+	// from a sequence number preceding its creation, in which case the logs
+	// containing the first batches may already have been deleted.
+	checkStart bool
+}
+
+// NewChangeFeed returns a change feed of the batches committed to the DB (see
+// ChangeFeed). Change feeds are not supported by read-only DBs.
+func (d *DB) NewChangeFeed(opts *ChangeFeedOptions) (*ChangeFeed, error) {
+	if d.opts.ReadOnly {
+		return nil, ErrReadOnly
+	}
+	f := &ChangeFeed{db: d}
+	if opts != nil {
+		f.opts = *opts
+	}
+	if f.opts.MaxBufferSize <= 0 {
+		f.opts.MaxBufferSize = defaultChangeFeedBufferSize
+	}
+
+	// Holding commitPipeline.mu ensures no batch is concurrently being written,
+	// so every batch from liveStart onwards is pushed to the change feed.
+	d.commit.mu.Lock()
+	defer d.commit.mu.Unlock()
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.mu.closed {
+		return nil, ErrChangeFeedClosed
+	}
+
+	f.liveStart = d.mu.versions.logSeqNum
+	f.next = f.opts.StartSeqNum
+	if f.next == 0 {
+		f.next = f.liveStart
+	}
+	if !d.opts.DisableWAL {
+		if f.next < f.liveStart {
+			f.logNum = d.mu.log.queue[0]
+			if archived := d.walArchive.list(); len(archived) > 0 {
+				f.logNum = archived[0].FileNum
+			}
+			f.switchLogNum = d.mu.log.queue[len(d.mu.log.queue)-1]
+			f.checkStart = true
+		} else {
+			f.logNum = d.mu.log.queue[len(d.mu.log.queue)-1]
+		}
+	}
+
+	c := &d.changeFeeds
+	c.mu.Lock()
+	c.feeds[f] = struct{}{}
+	atomic.AddInt32(&c.count, 1)
+	c.mu.Unlock()
+	return f, nil
+}
+
+// Next blocks until the next committed batch is available, and returns the
+// batch along with its sequence number. The operations of the batch are
+// numbered consecutively from the sequence number; the sequence number
+// following the batch is seqNum+batch.Count(). The returned batch must not be
+// modified. Batches without operations in the key range of the change feed,
+// and batches only preparing or rolling back a two-phase commit, are skipped.
+//
+// Next returns ErrChangeFeedTruncated if the next batch is no longer
+// available, and ErrChangeFeedClosed once the change feed or the DB is closed.
+// Next must not be called concurrently with itself, but may be called
+// concurrently with Close.
+func (f *ChangeFeed) Next() (seqNum uint64, batch *Batch, err error) {
+	c := &f.db.changeFeeds
+	c.mu.Lock()
+	f.reading = true
+	c.mu.Unlock()
+	defer func() {
+		c.mu.Lock()
+		f.reading = false
+		if f.closed {
+			f.closeWAL()
+		}
+		c.mu.Unlock()
+	}()
+
+	f.skippedWrites = false
+	for {
+		seqNum, data, err := f.nextBatch()
+		if err != nil {
+			return 0, nil, err
+		}
+		b := &Batch{}
+		b.storage.data = data
+		f.next = seqNum + uint64(b.count())
+		f.checkStart = false
+		match, writes := f.matches(b)
+		if match {
+			return seqNum, b, nil
+		}
+		f.skippedWrites = f.skippedWrites || writes
+	}
+}
+
+// SkippedWrites returns true if any of the batches skipped by the last call to
+// Next contained writes outside the key range of the change feed. The
+// sequence numbers preceding the batch returned by Next which were not
+// assigned to a skipped batch were consumed without writing to the WAL (e.g.
+// by an ingestion). See WALGapStream.
+func (f *ChangeFeed) SkippedWrites() bool {
+	return f.skippedWrites
+}
+
+// nextBatch returns the representation of the next committed batch, waiting
+// for the batch to be committed and made visible if necessary.
+func (f *ChangeFeed) nextBatch() (uint64, []byte, error) {
+	d := f.db
+	c := &d.changeFeeds
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for {
+		if f.closed {
+			return 0, nil, ErrChangeFeedClosed
+		}
+		for len(f.queue) > 0 && f.queue[0].seqNum+uint64(f.queue[0].count) <= f.next {
+			f.popLocked()
+		}
+
+		visible := atomic.LoadUint64(&d.mu.versions.visibleSeqNum)
+		if len(f.queue) > 0 && (f.queue[0].seqNum <= f.next || f.next >= f.liveStart) {
+			if e := f.queue[0]; e.seqNum < visible {
+				f.popLocked()
+				f.logNum = e.logNum
+				f.resetWAL()
+				// The batches written to switchLogNum have been delivered.
+				f.switchLogNum = 0
+				return e.seqNum, e.data, nil
+			}
+		} else if f.next < f.liveStart {
+			// The next batch precedes the buffered batches, and is read from the
+			// WAL.
+			limit := f.liveStart
+			c.mu.Unlock()
+			seqNum, data, err := f.readWAL(limit)
+			c.mu.Lock()
+			if err != nil {
+				return 0, nil, err
+			}
+			if data == nil {
+				// Every batch preceding the limit has been read.
+				f.resetWAL()
+				if f.next < limit {
+					f.next = limit
+				}
+				continue
+			}
+			for !f.closed && seqNum >= atomic.LoadUint64(&d.mu.versions.visibleSeqNum) {
+				c.cond.Wait()
+			}
+			if f.closed {
+				return 0, nil, ErrChangeFeedClosed
+			}
+			return seqNum, data, nil
+		}
+		c.cond.Wait()
+	}
+}
+
+// popLocked removes the first buffered batch. Requires DB.changeFeeds.mu is
+// held.
+func (f *ChangeFeed) popLocked() {
+	f.queueSize -= len(f.queue[0].data)
+	f.queue[0] = changeFeedEntry{}
+	f.queue = f.queue[1:]
+}
+
+// discardLocked discards the buffered batches written to the logs preceding
+// the log of the batch about to be buffered, which is the live log. The change
+// feed reads the discarded batches from the WAL instead. If the WAL is
+// disabled every buffered batch is discarded. Requires DB.changeFeeds.mu is
+// held.
+func (f *ChangeFeed) discardLocked(e changeFeedEntry) {
+	n := 0
+	for n < len(f.queue) && (e.logNum == 0 || f.queue[n].logNum != e.logNum) {
+		f.queueSize -= len(f.queue[n].data)
+		n++
+	}
+	if n == 0 {
+		return
+	}
+	m := copy(f.queue, f.queue[n:])
+	for i := m; i < len(f.queue); i++ {
+		f.queue[i] = changeFeedEntry{}
+	}
+	f.queue = f.queue[:m]
+	if len(f.queue) > 0 {
+		f.liveStart = f.queue[0].seqNum
+	} else {
+		f.liveStart = e.seqNum
+	}
+}
+
+// readWAL returns the next batch preceding limit which contains operations
+// at or after the next sequence number to deliver, or a nil batch once every
+// such batch has been read.
+func (f *ChangeFeed) readWAL(limit uint64) (uint64, []byte, error) {
+	d := f.db
+	if d.opts.DisableWAL {
+		return 0, nil, ErrChangeFeedTruncated
+	}
+	w := &f.wal
+
+	for {
+		if w.r == nil {
+			done, err := f.nextWAL()
+			if err != nil {
+				return 0, nil, err
+			}
+			if done {
+				if f.checkStart && f.next < limit {
+					return 0, nil, ErrChangeFeedTruncated
+				}
+				return 0, nil, nil
+			}
+		}
+
+		seqNum, b, err := w.r.Next()
+		if err != nil {
+			if err != io.EOF {
+				return 0, nil, err
+			}
+			f.closeWAL()
+			continue
+		}
+
+		if f.checkStart {
+			// The oldest available batch must not follow the next batch to
+			// deliver.
+			if seqNum > f.next {
+				return 0, nil, ErrChangeFeedTruncated
+			}
+			f.checkStart = false
+		}
+		if seqNum >= limit {
+			return 0, nil, nil
+		}
+		if seqNum+uint64(b.count()) <= f.next {
+			continue
+		}
+		return seqNum, b.storage.data, nil
+	}
+}
+
+// logNums returns the file numbers of the archived logs and of the logs
+// preceding the live log, in sequence number order, along with the file
+// number of the live log. The logs preceding the live log have been closed,
+// so reading them does not race with the writes to the WAL.
+func (f *ChangeFeed) logNums() (logNums []uint64, liveLogNum uint64) {
+	d := f.db
+	for _, l := range d.walArchive.list() {
+		logNums = append(logNums, l.FileNum)
+	}
+	d.mu.Lock()
+	n := len(d.mu.log.queue) - 1
+	logNums = append(logNums, d.mu.log.queue[:n]...)
+	liveLogNum = d.mu.log.queue[n]
+	d.mu.Unlock()
+	return logNums, liveLogNum
+}
+
+// nextWAL opens the log following the log last read, or the oldest log which
+// may contain batches yet to be delivered if no log has been read. The live
+// log is never read: if it is the next log, it is switched first if it is
+// switchLogNum, and otherwise every batch preceding liveStart has been read.
+// Returns true if there is no further log to read.
+func (f *ChangeFeed) nextWAL() (done bool, err error) {
+	w := &f.wal
+	logNum := f.logNum
+	if w.logNum != 0 {
+		logNum = w.logNum + 1
+	}
+
+	for {
+		logNums, liveLogNum := f.logNums()
+		for _, n := range logNums {
+			if n >= logNum {
+				return false, f.openWAL(n)
+			}
+		}
+		if liveLogNum != f.switchLogNum {
+			return true, nil
+		}
+		if err := f.switchWAL(liveLogNum); err != nil {
+			return false, err
+		}
+	}
+}
+
+// openWAL opens the specified log for reading.
+func (f *ChangeFeed) openWAL(logNum uint64) error {
+	d := f.db
+	w := &f.wal
+
+	// The log may have been moved into the archive since it was listed.
+	file, err := d.opts.FS.Open(dbFilename(d.walDirname, fileTypeLog, logNum))
+	if err != nil && d.walArchive.enabled() {
+		file, err = d.opts.FS.Open(d.walArchive.path(logNum))
+	}
+	if err != nil {
+		return ErrChangeFeedTruncated
+	}
+	w.logNum = logNum
+	w.r = NewLogReader(file, logNum)
+
+	c := &d.changeFeeds
+	c.mu.Lock()
+	f.logNum = logNum
+	c.mu.Unlock()
+	return nil
+}
+
+// switchWAL switches the specified live log to a new log, closing it so that
+// it can be read.
+func (f *ChangeFeed) switchWAL(liveLogNum uint64) error {
+	d := f.db
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.mu.closed {
+		return ErrChangeFeedClosed
+	}
+	if d.mu.log.queue[len(d.mu.log.queue)-1] != liveLogNum {
+		// The log has already been switched.
+		return nil
+	}
+	return d.makeRoomForWrite(nil)
+}
+
+// resetWAL closes the log being read, if any. The next read from the WAL
+// starts from the oldest log which may contain batches yet to be delivered.
+func (f *ChangeFeed) resetWAL() {
+	f.closeWAL()
+	f.wal.logNum = 0
+}
+
+// closeWAL closes the log being read, if any.
+func (f *ChangeFeed) closeWAL() {
+	w := &f.wal
+	if w.r != nil {
+		w.r.Close()
+		w.r = nil
+	}
+}
+
+// matches returns true if the batch contains an operation in the key range of
+// the change feed, excluding the operations of prepared batches. It also
+// returns whether the batch contains any such operation, regardless of the key
+// range.
+func (f *ChangeFeed) matches(b *Batch) (match, writes bool) {
+	cmp := f.db.cmp
+	lower, upper := f.opts.LowerBound, f.opts.UpperBound
+	var prepared bool
+	for r := b.iter(); ; {
+		_, kind, ukey, value, ok := r.nextCF()
+		if !ok {
+			return false, writes
+		}
+		switch kind {
+		case db.InternalKeyKindBeginPrepareXID:
+			prepared = true
+			continue
+		case db.InternalKeyKindEndPrepareXID:
+			prepared = false
+			continue
+		case db.InternalKeyKindCommitXID, db.InternalKeyKindRollbackXID,
+			db.InternalKeyKindLogData:
+			continue
+		}
+		if prepared {
+			continue
+		}
+		writes = true
+		if kind == db.InternalKeyKindRangeDelete {
+			if (upper == nil || cmp(ukey, upper) < 0) && (lower == nil || cmp(value, lower) > 0) {
+				return true, true
+			}
+			continue
+		}
+		if (upper == nil || cmp(ukey, upper) < 0) && (lower == nil || cmp(ukey, lower) >= 0) {
+			return true, true
+		}
+	}
+}
+
+// Close closes the change feed, releasing the logs it retains. Close may be
+// called concurrently with Next, which then returns ErrChangeFeedClosed.
+func (f *ChangeFeed) Close() error {
+	c := &f.db.changeFeeds
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if _, ok := c.feeds[f]; !ok {
+		return nil
+	}
+	delete(c.feeds, f)
+	atomic.AddInt32(&c.count, -1)
+	f.closed = true
+	f.queue = nil
+	f.queueSize = 0
+	if !f.reading {
+		f.closeWAL()
+	}
+	c.cond.Broadcast()
+	return nil
+}
@@ -0,0 +1,206 @@
+// Copyright 2019 The LevelDB-Go and Pebble Authors. All rights reserved. Use
+// of this source code is governed by a BSD-style license that can be found in
+// the LICENSE file.
+
+package pebble
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/petermattis/pebble/db"
+	"github.com/petermattis/pebble/vfs"
+)
+
+// readChangeFeed returns the next n batches delivered by the change feed as a
+// string.
+func readChangeFeed(t *testing.T, f *ChangeFeed, n int) string {
+	t.Helper()
+	var batches []string
+	for i := 0; i < n; i++ {
+		seqNum, b, err := f.Next()
+		if err != nil {
+			t.Fatal(err)
+		}
+		var buf strings.Builder
+		fmt.Fprintf(&buf, "%d:", seqNum)
+		for r := b.Reader(); ; {
+			kind, key, value, ok := r.Next()
+			if !ok {
+				break
+			}
+			fmt.Fprintf(&buf, " %s(%s,%s)", kind, key, value)
+		}
+		batches = append(batches, buf.String())
+	}
+	return strings.Join(batches, "\n")
+}
+
+func TestChangeFeed(t *testing.T) {
+	d, err := Open("", &db.Options{FS: vfs.NewMem()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+
+	newFeed := func(opts *ChangeFeedOptions) *ChangeFeed {
+		f, err := d.NewChangeFeed(opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return f
+	}
+	apply := func(keys ...string) {
+		b := d.NewBatch()
+		for _, k := range keys {
+			if err := b.Set([]byte(k), []byte(k), nil); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := b.Commit(db.NoSync); err != nil {
+			t.Fatal(err)
+		}
+	}
+	expect := func(expected, actual string) {
+		t.Helper()
+		if expected != actual {
+			t.Fatalf("expected\n%s\nbut found\n%s", expected, actual)
+		}
+	}
+
+	apply("a", "b")
+	apply("c")
+
+	// A change feed starting from an older sequence number reads the batches
+	// committed before its creation from the WAL. The other change feeds only
+	// deliver the batches committed after their creation.
+	resumed := newFeed(&ChangeFeedOptions{StartSeqNum: 1})
+	live := newFeed(nil)
+	filtered := newFeed(&ChangeFeedOptions{
+		StartSeqNum: 1, LowerBound: []byte("b"), UpperBound: []byte("c"),
+	})
+	// A buffer this small is exceeded by every batch, so the batches written to
+	// the logs preceding the live log are always read from the WAL.
+	tiny := newFeed(&ChangeFeedOptions{StartSeqNum: 2, MaxBufferSize: 1})
+
+	apply("d")
+	if err := d.DeleteRange([]byte("a"), []byte("bb"), db.NoSync); err != nil {
+		t.Fatal(err)
+	}
+	apply("e", "f")
+
+	// The first batch is delivered as it contains operations following the
+	// start sequence number.
+	expect(`0: SET(a,a) SET(b,b)
+2: SET(c,c)
+3: SET(d,d)
+4: RANGEDEL(a,bb)
+5: SET(e,e) SET(f,f)`, readChangeFeed(t, resumed, 5))
+	expect(`3: SET(d,d)
+4: RANGEDEL(a,bb)
+5: SET(e,e) SET(f,f)`, readChangeFeed(t, live, 3))
+	expect(`0: SET(a,a) SET(b,b)
+4: RANGEDEL(a,bb)`, readChangeFeed(t, filtered, 2))
+	if !filtered.SkippedWrites() {
+		t.Fatalf("expected the batches outside the key range to be reported as skipped")
+	}
+	expect(`2: SET(c,c)
+3: SET(d,d)
+4: RANGEDEL(a,bb)
+5: SET(e,e) SET(f,f)`, readChangeFeed(t, tiny, 4))
+
+	// Batches are delivered once they are committed, and the logs read by the
+	// change feeds are retained across flushes.
+	done := make(chan string)
+	go func() {
+		done <- readChangeFeed(t, tiny, 2)
+	}()
+	apply("g")
+	if err := d.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	apply("h")
+	expect(`7: SET(g,g)
+8: SET(h,h)`, <-done)
+
+	// Batches preparing or rolling back a two-phase commit are skipped.
+	b := d.NewBatch()
+	if err := b.Set([]byte("i"), []byte("i"), nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Prepare("p1", b, db.NoSync); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Prepare("p2", b, db.NoSync); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.RollbackPrepared("p2", db.NoSync); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.CommitPrepared("p1", db.NoSync); err != nil {
+		t.Fatal(err)
+	}
+	expect(`7: SET(g,g)
+8: SET(h,h)
+16: COMMIT(p1,) SET(i,i)`, readChangeFeed(t, live, 3))
+
+	for _, f := range []*ChangeFeed{resumed, filtered, tiny} {
+		if err := f.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Closing a change feed interrupts Next.
+	errCh := make(chan error)
+	go func() {
+		_, _, err := live.Next()
+		errCh <- err
+	}()
+	if err := live.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-errCh; err != ErrChangeFeedClosed {
+		t.Fatalf("expected %v, but found %v", ErrChangeFeedClosed, err)
+	}
+
+	// Once no change feed retains them, the flushed logs are deleted.
+	if err := d.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	truncated := newFeed(&ChangeFeedOptions{StartSeqNum: 1})
+	if _, _, err := truncated.Next(); err != ErrChangeFeedTruncated {
+		t.Fatalf("expected %v, but found %v", ErrChangeFeedTruncated, err)
+	}
+	if err := truncated.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestChangeFeedDBClose(t *testing.T) {
+	d, err := Open("", &db.Options{FS: vfs.NewMem()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, err := d.NewChangeFeed(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	errCh := make(chan error)
+	go func() {
+		_, _, err := f.Next()
+		errCh <- err
+	}()
+	if err := d.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-errCh; err != ErrChangeFeedClosed {
+		t.Fatalf("expected %v, but found %v", ErrChangeFeedClosed, err)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := d.NewChangeFeed(nil); err != ErrChangeFeedClosed {
+		t.Fatalf("expected %v, but found %v", ErrChangeFeedClosed, err)
+	}
+}
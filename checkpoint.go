@@ -0,0 +1,258 @@
+// Copyright 2019 The LevelDB-Go and Pebble Authors. All rights reserved. Use
+// of this source code is governed by a BSD-style license that can be found in
+// the LICENSE file.
+
+package pebble
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync/atomic"
+
+	"github.com/petermattis/pebble/internal/record"
+	"github.com/petermattis/pebble/vfs"
+)
+
+// Checkpoint constructs a snapshot of the DB instance in the specified
+// directory, which must not already exist. The live sstables and the blob
+// files they reference are hard-linked into the checkpoint when possible and
+// copied otherwise. The OPTIONS file and the WAL files containing data not yet
+// flushed to sstables are copied, and a MANIFEST describing only the live
+// sstables is written. The resulting directory can be opened with Open.
+//
+// The WALs are copied into the checkpoint directory even if Options.WALDir is
+// set, and the wal_dir option is cleared in the copied OPTIONS file. The
+// checkpoint must be opened without Options.WALDir, or the copied WALs will
+// not be replayed.
+//
+// The current memtable is rotated (see Flush) so that the copied WALs are
+// complete. Note that even if hard links are used, the space used by the
+// checkpoint will grow over time as the DB performs compactions and the
+// original sstables are deleted from the DB directory.
+func (d *DB) Checkpoint(destDir string) (ckErr error) {
+	if d.opts.ReadOnly {
+		return ErrReadOnly
+	}
+	fs := d.opts.FS
+	if _, err := fs.Stat(destDir); err == nil {
+		return fmt.Errorf("pebble: checkpoint directory %q already exists", destDir)
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+
+	cs, err := d.pinCheckpointState()
+	if err != nil {
+		return err
+	}
+	defer d.unpinCheckpointState(cs)
+
+	var created []string
+	defer func() {
+		if ckErr != nil {
+			// Attempt to clean up the partially constructed checkpoint.
+			for i := len(created) - 1; i >= 0; i-- {
+				fs.Remove(created[i])
+			}
+		}
+	}()
+
+	if err := fs.MkdirAll(destDir, 0755); err != nil {
+		return err
+	}
+	created = append(created, destDir)
+	dir, err := fs.OpenDir(destDir)
+	if err != nil {
+		return err
+	}
+	defer dir.Close()
+
+	// Copy the OPTIONS file.
+	destPath := dbFilename(destDir, fileTypeOptions, cs.optionsFileNum)
+	if err := copyCheckpointOptions(fs, dbFilename(d.dirname, fileTypeOptions, cs.optionsFileNum), destPath); err != nil {
+		return err
+	}
+	created = append(created, destPath)
+
+	// Link the sstables.
+	for _, meta := range cs.tables {
+		destPath := dbFilename(destDir, fileTypeTable, meta.fileNum)
+		if err := vfs.LinkOrCopy(fs, dbFilename(d.dirname, fileTypeTable, meta.fileNum), destPath); err != nil {
+			return err
+		}
+		created = append(created, destPath)
+	}
+
+	// Link the blob files referenced by the sstables.
+	for _, fileNum := range cs.blobFiles {
+		destPath := dbFilename(destDir, fileTypeBlob, fileNum)
+		if err := vfs.LinkOrCopy(fs, dbFilename(d.dirname, fileTypeBlob, fileNum), destPath); err != nil {
+			return err
+		}
+		created = append(created, destPath)
+	}
+
+	// Write the MANIFEST.
+	destPath = dbFilename(destDir, fileTypeManifest, cs.manifestFileNum)
+	if err := writeCheckpointManifest(fs, destPath, &cs.ve); err != nil {
+		return err
+	}
+	created = append(created, destPath)
+	if err := setCurrentFile(destDir, fs, cs.manifestFileNum); err != nil {
+		return err
+	}
+	created = append(created, dbFilename(destDir, fileTypeCurrent, 0))
+
+	// Copy the WALs.
+	for _, logNum := range cs.logNums {
+		destPath := dbFilename(destDir, fileTypeLog, logNum)
+		if err := vfs.Copy(fs, dbFilename(d.walDirname, fileTypeLog, logNum), destPath); err != nil {
+			return err
+		}
+		created = append(created, destPath)
+	}
+
+	return dir.Sync()
+}
+
+// checkpointState is a consistent view of the files making up a DB. The files
+// are retained until the state is unpinned.
+type checkpointState struct {
+	// ve describes the column families and their live sstables along with the
+	// log and sequence numbers needed to write a MANIFEST for the files.
+	ve versionEdit
+	// tables are the live sstables of all of the column families, which are
+	// retained by referencing the current version of each column family.
+	tables []fileMetadata
+	// blobFiles are the blob files referenced by the tables, in increasing
+	// order.
+	blobFiles       []uint64
+	versions        []*version
+	manifestFileNum uint64
+	optionsFileNum  uint64
+	// logNums are the WALs containing data which has not been flushed to the
+	// sstables in ve, or prepared batches. The WALs are closed and will not be
+	// written to again.
+	logNums []uint64
+}
+
+// pinCheckpointState returns a consistent view of the files making up the DB
+// and prevents those files from being deleted until unpinCheckpointState is
+// called. The current memtable is rotated (see Flush) so that the WALs in the
+// returned state are complete.
+func (d *DB) pinCheckpointState() (*checkpointState, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	// Rotate the memtable and WAL. All of the WALs preceding the new one are
+	// closed and will not be written to again, which allows them to be copied
+	// without tearing the last record.
+	mem := d.mu.mem.mutable
+	if err := d.makeRoomForWrite(nil); err != nil {
+		return nil, err
+	}
+	if d.opts.DisableWAL {
+		// Without a WAL, the contents of the memtable are only captured by
+		// waiting for the memtable to be flushed.
+		d.mu.Unlock()
+		<-mem.flushed()
+		d.mu.Lock()
+	}
+
+	// Disable file deletions so that the WALs remain in place while they are
+	// being copied. Referencing the current versions keeps their sstables
+	// alive.
+	d.mu.cleaner.disabled++
+	cs := &checkpointState{
+		ve: versionEdit{
+			logNumber:          d.mu.versions.logNumber,
+			minLogNumberToKeep: d.mu.versions.minLogNumberToKeep,
+			nextFileNumber:     d.mu.versions.nextFileNumber,
+			lastSequence:       atomic.LoadUint64(&d.mu.versions.logSeqNum),
+		},
+		manifestFileNum: d.mu.versions.manifestFileNumber,
+		optionsFileNum:  d.optionsFileNum,
+	}
+	d.mu.versions.snapshot(&cs.ve)
+	for _, cf := range d.mu.versions.columnFamilies {
+		v := cf.currentVersion()
+		v.ref()
+		cs.versions = append(cs.versions, v)
+		for _, files := range v.files {
+			cs.tables = append(cs.tables, files...)
+			for i := range files {
+				cs.blobFiles = append(cs.blobFiles, files[i].blobFiles...)
+			}
+		}
+	}
+	cs.blobFiles = merge(nil, cs.blobFiles)
+	for _, logNum := range d.mu.log.queue {
+		if logNum >= d.mu.versions.minLogNumber() && logNum < d.mu.mem.mutable.logNum {
+			cs.logNums = append(cs.logNums, logNum)
+		}
+	}
+	return cs, nil
+}
+
+// unpinCheckpointState releases the files retained by pinCheckpointState.
+func (d *DB) unpinCheckpointState(cs *checkpointState) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for _, v := range cs.versions {
+		v.unrefLocked()
+	}
+	d.mu.cleaner.disabled--
+	if d.mu.cleaner.disabled == 0 {
+		jobID := d.mu.nextJobID
+		d.mu.nextJobID++
+		d.deleteObsoleteFiles(jobID)
+	}
+}
+
+// copyCheckpointOptions copies the OPTIONS file oldname to newname, clearing
+// the wal_dir option as the checkpoint holds its WALs in its own directory.
+func copyCheckpointOptions(fs vfs.FS, oldname, newname string) error {
+	src, err := fs.Open(oldname)
+	if err != nil {
+		return err
+	}
+	data, err := ioutil.ReadAll(src)
+	if err = firstError(err, src.Close()); err != nil {
+		return err
+	}
+	lines := strings.Split(string(data), "\n")
+	for i, line := range lines {
+		if strings.HasPrefix(strings.TrimSpace(line), "wal_dir=") {
+			lines[i] = line[:strings.Index(line, "wal_dir=")] + "wal_dir="
+		}
+	}
+
+	f, err := fs.Create(newname)
+	if err != nil {
+		return err
+	}
+	_, err = f.Write([]byte(strings.Join(lines, "\n")))
+	if err == nil {
+		err = f.Sync()
+	}
+	return firstError(err, f.Close())
+}
+
+// writeCheckpointManifest writes a manifest containing the single version edit
+// ve to the specified file.
+func writeCheckpointManifest(fs vfs.FS, filename string, ve *versionEdit) error {
+	f, err := fs.Create(filename)
+	if err != nil {
+		return err
+	}
+	manifest := record.NewWriter(f)
+	err = ve.writeTo(manifest)
+	if err == nil {
+		err = manifest.Close()
+	}
+	if err == nil {
+		err = f.Sync()
+	}
+	return firstError(err, f.Close())
+}
@@ -0,0 +1,173 @@
+// Copyright 2019 The LevelDB-Go and Pebble Authors. All rights reserved. Use
+// of this source code is governed by a BSD-style license that can be found in
+// the LICENSE file.
+
+package pebble
+
+import (
+	"fmt"
+	"io/ioutil"
+	"strings"
+	"testing"
+
+	"github.com/petermattis/pebble/db"
+	"github.com/petermattis/pebble/vfs"
+)
+
+func TestCheckpoint(t *testing.T) {
+	for _, disableWAL := range []bool{false, true} {
+		t.Run(fmt.Sprintf("disableWAL=%t", disableWAL), func(t *testing.T) {
+			mem := vfs.NewMem()
+			opts := &db.Options{
+				DisableWAL: disableWAL,
+				FS:         mem,
+			}
+			d, err := Open("db", opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			set := func(d *DB, keys ...string) {
+				for _, k := range keys {
+					if err := d.Set([]byte(k), []byte(k), db.NoSync); err != nil {
+						t.Fatal(err)
+					}
+				}
+			}
+			scan := func(d *DB) string {
+				iter := d.NewIter(nil)
+				var keys []string
+				for valid := iter.First(); valid; valid = iter.Next() {
+					keys = append(keys, string(iter.Key()))
+				}
+				if err := iter.Close(); err != nil {
+					t.Fatal(err)
+				}
+				return strings.Join(keys, " ")
+			}
+
+			set(d, "a", "b")
+			if err := d.Compact([]byte("a"), []byte("z")); err != nil {
+				t.Fatal(err)
+			}
+			set(d, "c")
+			if err := d.Flush(); err != nil {
+				t.Fatal(err)
+			}
+			// These mutations are only present in the WAL (or memtable).
+			set(d, "d")
+			if err := d.Delete([]byte("a"), db.NoSync); err != nil {
+				t.Fatal(err)
+			}
+
+			if err := d.Checkpoint("checkpoint"); err != nil {
+				t.Fatal(err)
+			}
+			if err := d.Checkpoint("checkpoint"); err == nil {
+				t.Fatalf("expected error, but found success")
+			}
+
+			// Mutations after the checkpoint are not visible in the checkpoint.
+			set(d, "e")
+			if err := d.Compact([]byte("a"), []byte("z")); err != nil {
+				t.Fatal(err)
+			}
+			if expected, actual := "b c d e", scan(d); expected != actual {
+				t.Fatalf("expected %q, but found %q", expected, actual)
+			}
+			if err := d.Close(); err != nil {
+				t.Fatal(err)
+			}
+
+			d, err = Open("checkpoint", opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if expected, actual := "b c d", scan(d); expected != actual {
+				t.Fatalf("expected %q, but found %q", expected, actual)
+			}
+			// The checkpoint is a fully functional DB.
+			set(d, "f")
+			if err := d.Flush(); err != nil {
+				t.Fatal(err)
+			}
+			if expected, actual := "b c d f", scan(d); expected != actual {
+				t.Fatalf("expected %q, but found %q", expected, actual)
+			}
+			if err := d.Close(); err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
+
+func TestCheckpointWALDir(t *testing.T) {
+	mem := vfs.NewMem()
+	opts := &db.Options{
+		FS:     mem,
+		WALDir: "wal",
+	}
+	d, err := Open("db", opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Set([]byte("a"), []byte("a"), nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	// This mutation is only present in the WAL.
+	if err := d.Set([]byte("b"), []byte("b"), nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Checkpoint("checkpoint"); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// The copied OPTIONS file no longer refers to the WAL directory.
+	ls, err := mem.List("checkpoint")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var found bool
+	for _, name := range ls {
+		if fileType, _, ok := parseDBFilename(name); !ok || fileType != fileTypeOptions {
+			continue
+		}
+		f, err := mem.Open("checkpoint/" + name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, err := ioutil.ReadAll(f)
+		f.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !strings.Contains(string(data), "  wal_dir=\n") {
+			t.Fatalf("expected wal_dir to be cleared, but found:\n%s", data)
+		}
+		found = true
+	}
+	if !found {
+		t.Fatalf("expected an OPTIONS file in %q", ls)
+	}
+
+	// The checkpoint is opened without the WAL directory, replaying the WAL
+	// copied into the checkpoint.
+	d, err = Open("checkpoint", &db.Options{FS: mem})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, k := range []string{"a", "b"} {
+		if v, err := d.Get([]byte(k)); err != nil || string(v) != k {
+			t.Fatalf("expected %q, but found %q, %v", k, v, err)
+		}
+	}
+	if err := d.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
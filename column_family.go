@@ -0,0 +1,365 @@
+// Copyright 2019 The LevelDB-Go and Pebble Authors. All rights reserved. Use
+// of this source code is governed by a BSD-style license that can be found in
+// the LICENSE file.
+
+package pebble
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+
+	"github.com/petermattis/pebble/db"
+)
+
+// defaultColumnFamilyName is the name of the default column family, which
+// always exists and has ID 0.
+const defaultColumnFamilyName = "default"
+
+// ErrColumnFamilyDropped is returned when operating on a column family which
+// has been dropped.
+var ErrColumnFamilyDropped = errors.New("pebble: column family dropped")
+
+// columnFamilyOptions returns the options for a column family. The options
+// which pertain to the LSM of the column family are taken from opts, and the
+// remaining options are taken from the options of the DB.
+func columnFamilyOptions(dbOpts, opts *db.Options) *db.Options {
+	var o db.Options
+	if opts != nil {
+		o = *opts
+	}
+	o.BytesPerSync = dbOpts.BytesPerSync
+	if o.Cache == nil {
+		o.Cache = dbOpts.Cache
+	}
+	o.ColumnFamilies = nil
+	o.DisableWAL = dbOpts.DisableWAL
+	o.ErrorIfDBExists = false
+	o.EventListener = dbOpts.EventListener
+	o.FS = dbOpts.FS
+	o.L0SlowdownWritesThreshold = dbOpts.L0SlowdownWritesThreshold
+	o.L0StopWritesThreshold = dbOpts.L0StopWritesThreshold
+	o.Logger = dbOpts.Logger
+	o.MaxManifestFileSize = dbOpts.MaxManifestFileSize
+	o.MaxOpenFiles = dbOpts.MaxOpenFiles
+	o.MemTableStopWritesThreshold = dbOpts.MemTableStopWritesThreshold
+	o.Now = dbOpts.Now
+	o.WALDir = dbOpts.WALDir
+	return o.EnsureDefaults()
+}
+
+// columnFamily holds the state needed for reading and writing a column
+// family. The DB embeds the columnFamily for the default column family.
+type columnFamily struct {
+	id             uint32
+	name           string
+	opts           *db.Options
+	cmp            db.Compare
+	equal          db.Equal
+	merge          db.Merge
+	split          db.Split
+	abbreviatedKey db.AbbreviatedKey
+
+	// newIters opens the tables of the column family using the table cache
+	// shared by the column families of the DB.
+	newIters tableNewIters
+
+	// The size above which the column family's portion of a batch cannot be
+	// added to a memtable.
+	largeBatchThreshold int
+
+	// The LSM of the column family. Protected by DB.mu.
+	versions *columnFamilyVersions
+	// True if the column family has been dropped. Protected by DB.mu.
+	dropped bool
+
+	// readState provides access to the state needed for reading without needing
+	// to acquire DB.mu.
+	readState struct {
+		sync.RWMutex
+		val *readState
+	}
+}
+
+func (cf *columnFamily) init(tableCache *tableCache, id uint32, name string, opts *db.Options) {
+	cf.id = id
+	cf.name = name
+	cf.opts = opts
+	cf.cmp = opts.Comparer.Compare
+	cf.equal = opts.Comparer.Equal
+	cf.merge = opts.Merger.Merge
+	cf.split = opts.Comparer.Split
+	cf.abbreviatedKey = opts.Comparer.AbbreviatedKey
+	if cf.equal == nil {
+		cf.equal = bytes.Equal
+	}
+	cf.newIters = tableCache.newItersWithOptions(opts)
+}
+
+// memTable returns the memtable holding the column family's portion of the
+// flushable f, or nil if f does not contain data for the column family.
+func (cf *columnFamily) memTable(f flushable) flushable {
+	if cf.id == 0 {
+		return f
+	}
+	if m, ok := f.(*memTable); ok {
+		if c := m.columnFamilies[cf.id]; c != nil {
+			return c
+		}
+	}
+	return nil
+}
+
+// ColumnFamily is a handle for a column family of a DB. Each column family is
+// a separate LSM with its own memtables, sstables and options (e.g. Comparer,
+// Merger and Levels), while all of the column families of a DB share a single
+// WAL. A Batch may contain operations on several column families (see
+// Batch.SetCF), all of which are committed atomically.
+//
+// The default column family holds the data read and written via the
+// methods of the DB. It is safe to use a ColumnFamily from concurrent
+// goroutines.
+type ColumnFamily struct {
+	d  *DB
+	cf *columnFamily
+}
+
+// ID returns the ID of the column family. The default column family has ID 0.
+func (c *ColumnFamily) ID() uint32 {
+	return c.cf.id
+}
+
+// Name returns the name of the column family.
+func (c *ColumnFamily) Name() string {
+	return c.cf.name
+}
+
+// Get gets the value for the given key. It returns ErrNotFound if the column
+// family does not contain the key.
+//
+// The caller should not modify the contents of the returned slice, but it is
+// safe to modify the contents of the argument after Get returns.
+func (c *ColumnFamily) Get(key []byte) ([]byte, error) {
+	return c.d.getInternal(c.cf, key, nil /* batch */, nil /* snapshot */)
+}
+
+// NewIter returns an iterator over the column family that is unpositioned
+// (Iterator.Valid() will return false). See DB.NewIter.
+func (c *ColumnFamily) NewIter(o *db.IterOptions) *Iterator {
+	return c.d.newIterInternal(c.cf, nil /* batch */, nil /* snapshot */, o)
+}
+
+// Set sets the value for the given key in the column family.
+//
+// It is safe to modify the contents of the arguments after Set returns.
+func (c *ColumnFamily) Set(key, value []byte, opts *db.WriteOptions) error {
+	b := newBatch(c.d)
+	defer b.release()
+	_ = b.SetCF(c, key, value, opts)
+	return c.d.Apply(b, opts)
+}
+
+// Merge merges the value for the given key in the column family using the
+// column family's merge operator.
+//
+// It is safe to modify the contents of the arguments after Merge returns.
+func (c *ColumnFamily) Merge(key, value []byte, opts *db.WriteOptions) error {
+	b := newBatch(c.d)
+	defer b.release()
+	_ = b.MergeCF(c, key, value, opts)
+	return c.d.Apply(b, opts)
+}
+
+// Delete deletes the value for the given key in the column family.
+//
+// It is safe to modify the contents of the arguments after Delete returns.
+func (c *ColumnFamily) Delete(key []byte, opts *db.WriteOptions) error {
+	b := newBatch(c.d)
+	defer b.release()
+	_ = b.DeleteCF(c, key, opts)
+	return c.d.Apply(b, opts)
+}
+
+// SingleDelete single deletes the value for the given key in the column
+// family. See Writer.SingleDelete for more details on the semantics of
+// SingleDelete.
+//
+// It is safe to modify the contents of the arguments after SingleDelete
+// returns.
+func (c *ColumnFamily) SingleDelete(key []byte, opts *db.WriteOptions) error {
+	b := newBatch(c.d)
+	defer b.release()
+	_ = b.SingleDeleteCF(c, key, opts)
+	return c.d.Apply(b, opts)
+}
+
+// DeleteRange deletes all of the keys (and values) in the range [start,end)
+// (inclusive on start, exclusive on end) in the column family.
+//
+// It is safe to modify the contents of the arguments after DeleteRange
+// returns.
+func (c *ColumnFamily) DeleteRange(start, end []byte, opts *db.WriteOptions) error {
+	b := newBatch(c.d)
+	defer b.release()
+	_ = b.DeleteRangeCF(c, start, end, opts)
+	return c.d.Apply(b, opts)
+}
+
+// Compact the specified range of keys in the column family.
+func (c *ColumnFamily) Compact(start, end []byte) error {
+	return c.d.compactRange(c.cf, start, end)
+}
+
+// CreateColumnFamily creates a new column family with the specified name and
+// options. The options are only used for the LSM of the column family (see
+// db.Options.ColumnFamilies), and must be specified again in
+// db.Options.ColumnFamilies whenever the DB is reopened.
+func (d *DB) CreateColumnFamily(name string, opts *db.Options) (*ColumnFamily, error) {
+	if d.follower || d.opts.ReadOnly {
+		return nil, ErrReadOnly
+	}
+	if name == "" {
+		return nil, errors.New("pebble: empty column family name")
+	}
+	opts = columnFamilyOptions(d.opts, opts)
+
+	d.columnFamilyMu.Lock()
+	defer d.columnFamilyMu.Unlock()
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if name == defaultColumnFamilyName || d.findColumnFamilyLocked(name) != nil {
+		return nil, fmt.Errorf("pebble: column family %q already exists", name)
+	}
+
+	id := d.mu.versions.maxColumnFamily + 1
+	ve := &versionEdit{
+		maxColumnFamily: id,
+		columnFamilyEdits: []*versionEdit{{
+			columnFamily:     id,
+			columnFamilyAdd:  name,
+			columnFamilyOpts: opts,
+		}},
+	}
+	jobID := d.mu.nextJobID
+	d.mu.nextJobID++
+	if err := d.mu.versions.logAndApply(jobID, ve, d.dataDir); err != nil {
+		return nil, err
+	}
+
+	cf := &columnFamily{}
+	cf.init(&d.tableCache, id, name, opts)
+	cf.versions = d.mu.versions.columnFamilies[id]
+	cf.largeBatchThreshold = (opts.MemTableSize - int(d.mu.mem.mutable.emptySize)) / 2
+	d.mu.columnFamilies[id] = cf
+
+	// Rotate the memtable so that the mutable memtable contains a memtable for
+	// the new column family. This also installs the read state for the column
+	// family.
+	if err := d.makeRoomForWrite(nil); err != nil {
+		return nil, err
+	}
+	return &ColumnFamily{d: d, cf: cf}, nil
+}
+
+// DropColumnFamily drops the specified column family. The sstables of the
+// column family are deleted once they are no longer in use. Subsequent
+// operations on the column family return ErrColumnFamilyDropped. The default
+// column family cannot be dropped.
+func (d *DB) DropColumnFamily(c *ColumnFamily) error {
+	if d.follower || d.opts.ReadOnly {
+		return ErrReadOnly
+	}
+	if c.cf.id == 0 {
+		return errors.New("pebble: cannot drop the default column family")
+	}
+
+	d.columnFamilyMu.Lock()
+	defer d.columnFamilyMu.Unlock()
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if c.cf.dropped {
+		return ErrColumnFamilyDropped
+	}
+	ve := &versionEdit{
+		columnFamilyEdits: []*versionEdit{{
+			columnFamily:     c.cf.id,
+			columnFamilyDrop: true,
+		}},
+	}
+	jobID := d.mu.nextJobID
+	d.mu.nextJobID++
+	if err := d.mu.versions.logAndApply(jobID, ve, d.dataDir); err != nil {
+		return err
+	}
+	c.cf.dropped = true
+
+	// Release the read state of the column family, allowing its sstables to
+	// be deleted once outstanding iterators are closed.
+	c.cf.readState.Lock()
+	old := c.cf.readState.val
+	c.cf.readState.val = nil
+	c.cf.readState.Unlock()
+	if old != nil {
+		old.unrefLocked()
+	}
+	d.deleteObsoleteFiles(jobID)
+	return nil
+}
+
+// ColumnFamily returns the column family with the specified name, or nil if
+// no such column family exists. The default column family is named
+// "default".
+func (d *DB) ColumnFamily(name string) *ColumnFamily {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if name == defaultColumnFamilyName {
+		return &ColumnFamily{d: d, cf: &d.columnFamily}
+	}
+	if cf := d.findColumnFamilyLocked(name); cf != nil {
+		return &ColumnFamily{d: d, cf: cf}
+	}
+	return nil
+}
+
+// ColumnFamilies returns the column families of the DB, including the
+// default column family, ordered by ID.
+func (d *DB) ColumnFamilies() []*ColumnFamily {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	cfs := d.columnFamiliesLocked()
+	handles := make([]*ColumnFamily, len(cfs))
+	for i, cf := range cfs {
+		handles[i] = &ColumnFamily{d: d, cf: cf}
+	}
+	return handles
+}
+
+// columnFamiliesLocked returns the column families which have not been
+// dropped, ordered by ID. Requires DB.mu is held.
+func (d *DB) columnFamiliesLocked() []*columnFamily {
+	cfs := make([]*columnFamily, 0, len(d.mu.columnFamilies))
+	for _, cf := range d.mu.columnFamilies {
+		if !cf.dropped {
+			cfs = append(cfs, cf)
+		}
+	}
+	sort.Slice(cfs, func(i, j int) bool {
+		return cfs[i].id < cfs[j].id
+	})
+	return cfs
+}
+
+// findColumnFamilyLocked returns the live column family with the specified
+// name, or nil. Requires DB.mu is held.
+func (d *DB) findColumnFamilyLocked(name string) *columnFamily {
+	for _, cf := range d.mu.columnFamilies {
+		if cf.name == name && !cf.dropped {
+			return cf
+		}
+	}
+	return nil
+}
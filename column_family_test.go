@@ -0,0 +1,233 @@
+// Copyright 2019 The LevelDB-Go and Pebble Authors. All rights reserved. Use
+// of this source code is governed by a BSD-style license that can be found in
+// the LICENSE file.
+
+package pebble
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/petermattis/pebble/db"
+	"github.com/petermattis/pebble/vfs"
+)
+
+func TestColumnFamilies(t *testing.T) {
+	mem := vfs.NewMem()
+	comparer := *db.DefaultComparer
+	comparer.Name = "test-comparer"
+	cfOpts := &db.Options{
+		Comparer: &comparer,
+		Merger: &db.Merger{
+			Merge: func(key, oldValue, newValue, buf []byte) []byte {
+				if string(oldValue) > string(newValue) {
+					return append(buf, oldValue...)
+				}
+				return append(buf, newValue...)
+			},
+			Name: "test-max",
+		},
+	}
+
+	d, err := Open("", &db.Options{FS: mem})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := d.CreateColumnFamily(defaultColumnFamilyName, nil); err == nil {
+		t.Fatalf("expected error, but found success")
+	}
+	cf, err := d.CreateColumnFamily("cf", cfOpts)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := d.CreateColumnFamily("cf", cfOpts); err == nil {
+		t.Fatalf("expected error, but found success")
+	}
+	if cf.ID() != 1 || cf.Name() != "cf" {
+		t.Fatalf("unexpected column family: %d %s", cf.ID(), cf.Name())
+	}
+
+	get := func(r interface {
+		Get(key []byte) ([]byte, error)
+	}, key string) string {
+		v, err := r.Get([]byte(key))
+		if err == db.ErrNotFound {
+			return "<not found>"
+		} else if err != nil {
+			return err.Error()
+		}
+		return string(v)
+	}
+	scan := func(r interface {
+		NewIter(o *db.IterOptions) *Iterator
+	}) string {
+		iter := r.NewIter(nil)
+		var keys []string
+		for valid := iter.First(); valid; valid = iter.Next() {
+			keys = append(keys, string(iter.Key())+":"+string(iter.Value()))
+		}
+		if err := iter.Close(); err != nil {
+			return err.Error()
+		}
+		return strings.Join(keys, " ")
+	}
+	expect := func(expected, actual string) {
+		t.Helper()
+		if expected != actual {
+			t.Fatalf("expected %q, but found %q", expected, actual)
+		}
+	}
+
+	// A batch spanning both column families is committed atomically, and the
+	// column families contain separate data.
+	b := d.NewBatch()
+	_ = b.Set([]byte("a"), []byte("1"), nil)
+	_ = b.SetCF(cf, []byte("a"), []byte("2"), nil)
+	_ = b.MergeCF(cf, []byte("a"), []byte("3"), nil)
+	_ = b.SetCF(cf, []byte("b"), []byte("4"), nil)
+	_ = b.SetCF(cf, []byte("c"), []byte("5"), nil)
+	_ = b.DeleteCF(cf, []byte("c"), nil)
+	if err := d.Apply(b, db.NoSync); err != nil {
+		t.Fatal(err)
+	}
+	expect("1", get(d, "a"))
+	expect("<not found>", get(d, "b"))
+	expect("3", get(cf, "a"))
+	expect("a:1", scan(d))
+	expect("a:3 b:4", scan(cf))
+
+	if err := cf.Set([]byte("d"), []byte("6"), db.NoSync); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if err := cf.DeleteRange([]byte("b"), []byte("c"), db.NoSync); err != nil {
+		t.Fatal(err)
+	}
+	if err := cf.Compact([]byte("a"), []byte("z")); err != nil {
+		t.Fatal(err)
+	}
+	expect("a:3 d:6", scan(cf))
+	if err := cf.Merge([]byte("d"), []byte("7"), db.NoSync); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// The options of the column family must be specified on reopen.
+	if _, err := Open("", &db.Options{FS: mem}); err == nil {
+		t.Fatalf("expected error, but found success")
+	}
+	d, err = Open("", &db.Options{
+		FS:             mem,
+		ColumnFamilies: map[string]*db.Options{"cf": cfOpts},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cf = d.ColumnFamily("cf")
+	if cf == nil {
+		t.Fatalf("column family not found")
+	}
+	expect("a:1", scan(d))
+	expect("a:3 d:7", scan(cf))
+	var names []string
+	for _, c := range d.ColumnFamilies() {
+		names = append(names, c.Name())
+	}
+	expect("default cf", strings.Join(names, " "))
+
+	// Operations on a dropped column family fail.
+	if err := d.DropColumnFamily(d.ColumnFamily(defaultColumnFamilyName)); err == nil {
+		t.Fatalf("expected error, but found success")
+	}
+	if err := d.DropColumnFamily(cf); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.DropColumnFamily(cf); err != ErrColumnFamilyDropped {
+		t.Fatalf("expected %v, but found %v", ErrColumnFamilyDropped, err)
+	}
+	if _, err := cf.Get([]byte("a")); err != ErrColumnFamilyDropped {
+		t.Fatalf("expected %v, but found %v", ErrColumnFamilyDropped, err)
+	}
+	if err := cf.Set([]byte("a"), nil, db.NoSync); err != ErrColumnFamilyDropped {
+		t.Fatalf("expected %v, but found %v", ErrColumnFamilyDropped, err)
+	}
+	if d.ColumnFamily("cf") != nil {
+		t.Fatalf("expected dropped column family to not be found")
+	}
+	if err := d.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// A dropped column family does not need to be specified on reopen, and its
+	// name can be reused.
+	d, err = Open("", &db.Options{FS: mem})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cf, err = d.CreateColumnFamily("cf", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cf.ID() != 2 {
+		t.Fatalf("expected column family 2, but found %d", cf.ID())
+	}
+	expect("", scan(cf))
+	expect("a:1", scan(d))
+	if err := d.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestColumnFamiliesShareTableCache(t *testing.T) {
+	mem := vfs.NewMem()
+	d, err := Open("", &db.Options{FS: mem, MaxOpenFiles: 100})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var cfs []*ColumnFamily
+	for _, name := range []string{"a", "b"} {
+		cf, err := d.CreateColumnFamily(name, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := cf.Set([]byte("k"), []byte(name), db.NoSync); err != nil {
+			t.Fatal(err)
+		}
+		cfs = append(cfs, cf)
+	}
+	if err := d.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	for _, cf := range cfs {
+		if v, err := cf.Get([]byte("k")); err != nil {
+			t.Fatal(err)
+		} else if string(v) != cf.Name() {
+			t.Fatalf("expected %q, but found %q", cf.Name(), v)
+		}
+	}
+
+	// The tables of both column families are held by the table cache of the
+	// DB, which is sized from the MaxOpenFiles of the DB, and are opened using
+	// the options of their column family.
+	if expected := 100 - numNonTableCacheFiles; d.tableCache.size != expected {
+		t.Fatalf("expected table cache size %d, but found %d", expected, d.tableCache.size)
+	}
+	d.tableCache.mu.Lock()
+	opts := make(map[*db.Options]bool)
+	for _, n := range d.tableCache.mu.nodes {
+		opts[n.opts] = true
+	}
+	d.tableCache.mu.Unlock()
+	for _, cf := range cfs {
+		if !opts[cf.cf.opts] {
+			t.Fatalf("table of column family %q not found in the table cache", cf.Name())
+		}
+	}
+	if err := d.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -5,6 +5,7 @@
 package pebble
 
 import (
+	"errors"
 	"runtime"
 	"sync"
 	"sync/atomic"
@@ -218,6 +219,11 @@ type commitPipeline struct {
 	mu sync.Mutex
 	// Queue of pending batches to commit.
 	pending commitQueue
+	// visibleCond is signaled when the visible sequence number is ratcheted
+	// while visibleWaiters is non-zero (see waitVisible).
+	visibleMu      sync.Mutex
+	visibleCond    sync.Cond
+	visibleWaiters int32
 }
 
 func newCommitPipeline(env commitEnv) *commitPipeline {
@@ -225,6 +231,7 @@ func newCommitPipeline(env commitEnv) *commitPipeline {
 		env: env,
 		sem: make(chan struct{}, commitConcurrency),
 	}
+	p.visibleCond.L = &p.visibleMu
 	return p
 }
 
@@ -246,6 +253,12 @@ func (p *commitPipeline) Commit(b *Batch, syncWAL bool) error {
 	// WAL.
 	mem, err := p.prepare(b, syncWAL)
 	if err != nil {
+		if v, ok := err.(validationError); ok {
+			// The batch failed validation and was not enqueued, so the pipeline
+			// is unaffected.
+			<-p.sem
+			return v.err
+		}
 		// TODO(peter): what to do on error? the pipeline will be horked at this
 		// point.
 		panic(err)
@@ -295,12 +308,11 @@ func (p *commitPipeline) AllocateSeqNum(prepare func(), apply func(seqNum uint64
 	// number order.
 	p.pending.enqueue(b)
 
-	// Assign the batch a sequence number.
-	seqNum := *p.env.logSeqNum
-	*p.env.logSeqNum++
+	// Assign the batch a sequence number. The log sequence number is read
+	// atomically without holding mu (see versionSet.logAndApply).
+	seqNum := atomic.AddUint64(p.env.logSeqNum, 1) - 1
 	if seqNum == 0 {
-		seqNum = *p.env.logSeqNum
-		*p.env.logSeqNum++
+		seqNum = atomic.AddUint64(p.env.logSeqNum, 1) - 1
 		b.setCount(2)
 	}
 	b.setSeqNum(seqNum)
@@ -337,7 +349,12 @@ func (p *commitPipeline) prepare(b *Batch, syncWAL bool) (*memTable, error) {
 		syncWG = &b.commit
 	}
 
-	p.mu.Lock()
+	if b.validate == nil {
+		p.mu.Lock()
+	} else if err := p.validate(b); err != nil {
+		b.commit.Add(-count)
+		return nil, validationError{err}
+	}
 
 	// Enqueue the batch in the pending queue. Note that while the pending queue
 	// is lock-free, we want the order of batches to be the same as the sequence
@@ -345,8 +362,7 @@ func (p *commitPipeline) prepare(b *Batch, syncWAL bool) (*memTable, error) {
 	p.pending.enqueue(b)
 
 	// Assign the batch a sequence number.
-	b.setSeqNum(*p.env.logSeqNum)
-	*p.env.logSeqNum += n
+	b.setSeqNum(atomic.AddUint64(p.env.logSeqNum, n) - n)
 
 	// Write the data to the WAL.
 	mem, err := p.env.write(b, syncWG)
@@ -356,6 +372,59 @@ func (p *commitPipeline) prepare(b *Batch, syncWAL bool) (*memTable, error) {
 	return mem, err
 }
 
+// validate validates the batch (see Batch.validate), returning with
+// commitPipeline.mu held if the batch is valid. The batch is first validated
+// without holding commitPipeline.mu against the batches visible at that
+// point, which may require reading sstables. Once commitPipeline.mu is held,
+// no other batch can be sequenced, so only the batches sequenced since the
+// first validation need to be checked, which is done once they are visible.
+func (p *commitPipeline) validate(b *Batch) error {
+	for {
+		seqNum := atomic.LoadUint64(p.env.visibleSeqNum)
+		if err := b.validate(); err != nil {
+			return err
+		}
+
+		p.mu.Lock()
+		p.waitVisible(*p.env.logSeqNum)
+		err := b.validateSince(seqNum)
+		if err == nil {
+			return nil
+		}
+		p.mu.Unlock()
+		if err != errValidateRetry {
+			return err
+		}
+	}
+}
+
+// waitVisible waits for the visible sequence number to reach seqNum.
+func (p *commitPipeline) waitVisible(seqNum uint64) {
+	if atomic.LoadUint64(p.env.visibleSeqNum) >= seqNum {
+		return
+	}
+	atomic.AddInt32(&p.visibleWaiters, 1)
+	p.visibleMu.Lock()
+	for atomic.LoadUint64(p.env.visibleSeqNum) < seqNum {
+		p.visibleCond.Wait()
+	}
+	p.visibleMu.Unlock()
+	atomic.AddInt32(&p.visibleWaiters, -1)
+}
+
+// errValidateRetry is returned by Batch.validateSince if the batch needs to
+// be validated again.
+var errValidateRetry = errors.New("pebble: retry validation")
+
+// validationError wraps an error returned by Batch.validate.
+type validationError struct {
+	err error
+}
+
+func (v validationError) Error() string {
+	return v.err.Error()
+}
+
 func (p *commitPipeline) publish(b *Batch) {
 	// Mark the batch as applied.
 	atomic.StoreUint32(&b.applied, 1)
@@ -389,6 +458,11 @@ func (p *commitPipeline) publish(b *Batch) {
 			}
 			if atomic.CompareAndSwapUint64(p.env.visibleSeqNum, curSeqNum, newSeqNum) {
 				// We successfully published t's sequence number.
+				if atomic.LoadInt32(&p.visibleWaiters) > 0 {
+					p.visibleMu.Lock()
+					p.visibleCond.Broadcast()
+					p.visibleMu.Unlock()
+				}
 				break
 			}
 		}
@@ -6,6 +6,7 @@ package pebble
 
 import (
 	"encoding/binary"
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"sync"
@@ -84,6 +85,74 @@ func TestCommitPipeline(t *testing.T) {
 	}
 }
 
+func TestCommitPipelineValidate(t *testing.T) {
+	var e testCommitEnv
+	p := newCommitPipeline(e.env())
+
+	// The first validation of b1 blocks until b2 has been committed, which
+	// requires the validation to be performed without holding the commit
+	// mutex. The recent validation retries once.
+	validating := make(chan struct{}, 2)
+	release := make(chan struct{})
+	var validateCount int
+	var sinceSeqNums []uint64
+	var b1 Batch
+	_ = b1.Set([]byte("a"), nil, nil)
+	b1.validate = func() error {
+		validateCount++
+		validating <- struct{}{}
+		<-release
+		return nil
+	}
+	b1.validateSince = func(seqNum uint64) error {
+		if v := atomic.LoadUint64(&e.visibleSeqNum); v != e.logSeqNum {
+			t.Errorf("expected all batches to be visible, but found %d != %d", v, e.logSeqNum)
+		}
+		sinceSeqNums = append(sinceSeqNums, seqNum)
+		if len(sinceSeqNums) == 1 {
+			return errValidateRetry
+		}
+		return nil
+	}
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- p.Commit(&b1, false)
+	}()
+
+	<-validating
+	var b2 Batch
+	_ = b2.Set([]byte("b"), nil, nil)
+	if err := p.Commit(&b2, false); err != nil {
+		t.Fatal(err)
+	}
+	close(release)
+	if err := <-errCh; err != nil {
+		t.Fatal(err)
+	}
+
+	if validateCount != 2 {
+		t.Fatalf("expected 2 validations, but found %d", validateCount)
+	}
+	if len(sinceSeqNums) != 2 || sinceSeqNums[0] != 0 || sinceSeqNums[1] != 1 {
+		t.Fatalf("unexpected recent validations: %d", sinceSeqNums)
+	}
+	if b2.seqNum() != 0 || b1.seqNum() != 1 {
+		t.Fatalf("unexpected sequence numbers: %d %d", b1.seqNum(), b2.seqNum())
+	}
+
+	// An error returned by the recent validation aborts the commit.
+	var b3 Batch
+	_ = b3.Set([]byte("c"), nil, nil)
+	b3.validate = func() error { return nil }
+	b3.validateSince = func(seqNum uint64) error { return errors.New("conflict") }
+	if err := p.Commit(&b3, false); err == nil || err.Error() != "conflict" {
+		t.Fatalf("expected conflict, but found %v", err)
+	}
+	if s := atomic.LoadUint64(&e.logSeqNum); s != 2 {
+		t.Fatalf("expected 2, but found %d", s)
+	}
+}
+
 func TestCommitPipelineAllocateSeqNum(t *testing.T) {
 	var e testCommitEnv
 	p := newCommitPipeline(e.env())
@@ -12,6 +12,7 @@ import (
 	"sort"
 	"unsafe"
 
+	"github.com/petermattis/pebble/cache"
 	"github.com/petermattis/pebble/db"
 	"github.com/petermattis/pebble/internal/rangedel"
 	"github.com/petermattis/pebble/sstable"
@@ -102,6 +103,10 @@ func newCompaction(opts *db.Options, cur *version, startLevel, baseLevel int) *c
 // whether the compaction was automatically scheduled or user initiated.
 func (c *compaction) setupOtherInputs() {
 	c.inputs[0] = c.expandInputs(c.inputs[0])
+	if c.startLevel == c.outputLevel {
+		// A compaction of the bottommost level rewrites its inputs in place.
+		return
+	}
 	smallest0, largest0 := ikeyRange(c.cmp, c.inputs[0], nil)
 	c.inputs[1] = c.version.overlaps(c.outputLevel, c.cmp, smallest0.UserKey, largest0.UserKey)
 	smallest01, largest01 := ikeyRange(c.cmp, c.inputs[0], c.inputs[1])
@@ -242,6 +247,21 @@ func (c *compaction) allowZeroSeqNum() bool {
 	return c.elideRangeTombstone(lower, upper)
 }
 
+// newCompactionFilter returns the function applying the compaction filter of
+// the options to the entries of a compaction or flush, or nil if the entries
+// are not filtered.
+func newCompactionFilter(
+	opts *db.Options, ctx db.CompactionFilterContext,
+) func(key, value []byte) (db.CompactionFilterDecision, []byte) {
+	f := opts.CompactionFilter
+	if f == nil || (ctx.Flush && !opts.CompactionFilterOnFlush) {
+		return nil
+	}
+	return func(key, value []byte) (db.CompactionFilterDecision, []byte) {
+		return f.Filter(ctx, key, value)
+	}
+}
+
 // elideTombstone returns true if it is ok to elide a tombstone for the
 // specified key. A return value of true guarantees that there are no key/value
 // pairs at c.level+2 or higher that possibly contain the specified user key.
@@ -416,6 +436,9 @@ func (c *compaction) String() string {
 }
 
 type manualCompaction struct {
+	// The column family to compact. A nil column family specifies the default
+	// column family.
+	cf          *columnFamily
 	level       int
 	outputLevel int
 	done        chan error
@@ -427,7 +450,7 @@ type manualCompaction struct {
 //
 // d.mu must be held when calling this.
 func (d *DB) maybeScheduleFlush() {
-	if d.mu.compact.flushing || d.mu.closed {
+	if d.mu.compact.flushing || d.mu.closed || d.opts.ReadOnly {
 		return
 	}
 	if len(d.mu.mem.queue) <= 1 {
@@ -475,28 +498,12 @@ func (d *DB) flush1() error {
 		return nil
 	}
 
-	// TODO(peter,rangedel): test that range tombstones are properly included in
-	// the output sstable. Should propbably pull out the code below into a method
-	// that can be separately tested.
-	var iter internalIterator
-	if n == 1 {
-		mem := d.mu.mem.queue[0]
-		iter = mem.newIter(nil)
-		if rangeDelIter := mem.newRangeDelIter(nil); rangeDelIter != nil {
-			iter = newMergingIter(d.cmp, iter, rangeDelIter)
-		}
-	} else {
-		iters := make([]internalIterator, 0, 2*n)
-		for i := 0; i < n; i++ {
-			mem := d.mu.mem.queue[i]
-			iters = append(iters, mem.newIter(nil))
-			rangeDelIter := mem.newRangeDelIter(nil)
-			if rangeDelIter != nil {
-				iters = append(iters, rangeDelIter)
-			}
-		}
-		iter = newMergingIter(d.cmp, iters...)
-	}
+	// Capture the column families to flush, ordered by ID so that the default
+	// column family is flushed first. DB.mu is released while the sstables are
+	// written, so column families may be created or dropped concurrently. A
+	// column family dropped during the flush has its output discarded by
+	// versionSet.logAndApply.
+	cfs := d.columnFamiliesLocked()
 
 	jobID := d.mu.nextJobID
 	d.mu.nextJobID++
@@ -506,7 +513,52 @@ func (d *DB) flush1() error {
 		})
 	}
 
-	meta, err := d.writeLevel0Table(iter, true /* allowRangeTombstoneElision */)
+	// The flush of each column family either succeeds or produces an empty
+	// sstable. In either case we want to bump the log number.
+	metrics := &LevelMetrics{}
+	ve := &versionEdit{
+		metrics: map[int]*LevelMetrics{
+			0: metrics,
+		},
+	}
+	ve.logNumber, _ = d.mu.mem.queue[n].logInfo()
+	ve.minLogNumberToKeep = d.minPreparedLogNumLocked()
+	for i := 0; i < n; i++ {
+		_, size := d.mu.mem.queue[i].logInfo()
+		metrics.BytesIn += size
+	}
+
+	var meta fileMetadata
+	var err error
+	for _, cf := range cfs {
+		iter := cf.newFlushIter(d.mu.mem.queue[:n])
+		if iter == nil {
+			continue
+		}
+		m, err1 := d.writeLevel0Table(cf, iter, true /* allowRangeTombstoneElision */)
+		if err1 == errEmptyTable {
+			if cf.id == 0 {
+				err = err1
+			}
+			continue
+		}
+		if err1 != nil {
+			err = err1
+			break
+		}
+		cve := ve.columnFamilyEdit(cf.id)
+		cve.newFiles = []newFileEntry{
+			{level: 0, meta: m},
+		}
+		if cf.id == 0 {
+			meta = m
+			metrics.BytesWritten = m.size
+		} else {
+			cve.metrics = map[int]*LevelMetrics{
+				0: &LevelMetrics{BytesWritten: m.size},
+			}
+		}
+	}
 
 	if d.opts.EventListener.FlushEnd != nil {
 		info := db.FlushInfo{
@@ -520,36 +572,35 @@ func (d *DB) flush1() error {
 	}
 
 	if err != nil && err != errEmptyTable {
-		return err
-	}
-
-	// The flush succeeded or it produced an empty sstable. In either case we
-	// want to bump the log number.
-	metrics := &LevelMetrics{}
-	ve := &versionEdit{
-		metrics: map[int]*LevelMetrics{
-			0: metrics,
-		},
-	}
-	ve.logNumber, _ = d.mu.mem.queue[n].logInfo()
-	for i := 0; i < n; i++ {
-		_, size := d.mu.mem.queue[i].logInfo()
-		metrics.BytesIn += size
-	}
-	if err != errEmptyTable {
-		ve.newFiles = []newFileEntry{
-			{level: 0, meta: meta},
+		// Discard the sstables which were written for the other column families.
+		for _, e := range append([]*versionEdit{ve}, ve.columnFamilyEdits...) {
+			for i := range e.newFiles {
+				meta := &e.newFiles[i].meta
+				delete(d.mu.compact.pendingOutputs, meta.fileNum)
+				for _, fileNum := range meta.blobFiles {
+					delete(d.mu.compact.pendingOutputs, fileNum)
+				}
+				d.mu.versions.addObsoleteLocked([]*fileMetadata{meta})
+			}
 		}
-		metrics.BytesWritten = meta.size
+		return err
 	}
 
+	// NB: logAndApply discards the edits to dropped column families, whose
+	// outputs are no longer pending either.
+	edits := append([]*versionEdit{ve}, ve.columnFamilyEdits...)
 	err = d.mu.versions.logAndApply(jobID, ve, d.dataDir)
-	for i := range ve.newFiles {
-		f := &ve.newFiles[i]
-		if _, ok := d.mu.compact.pendingOutputs[f.meta.fileNum]; !ok {
-			panic("pebble: expected pending output not present")
+	for _, e := range edits {
+		for i := range e.newFiles {
+			f := &e.newFiles[i]
+			if _, ok := d.mu.compact.pendingOutputs[f.meta.fileNum]; !ok {
+				panic("pebble: expected pending output not present")
+			}
+			delete(d.mu.compact.pendingOutputs, f.meta.fileNum)
+			for _, fileNum := range f.meta.blobFiles {
+				delete(d.mu.compact.pendingOutputs, fileNum)
+			}
 		}
-		delete(d.mu.compact.pendingOutputs, f.meta.fileNum)
 	}
 	if err != nil {
 		return err
@@ -572,28 +623,72 @@ func (d *DB) flush1() error {
 	return nil
 }
 
+// newFlushIter returns an iterator over the column family's portion of the
+// memtables, or nil if none of the memtables contain data for a non-default
+// column family.
+func (cf *columnFamily) newFlushIter(queue []flushable) internalIterator {
+	var mems []flushable
+	for _, mem := range queue {
+		if cf.id == 0 {
+			mems = append(mems, mem)
+		} else if m, ok := cf.memTable(mem).(*memTable); ok && !m.empty() {
+			mems = append(mems, m)
+		}
+	}
+	if len(mems) == 0 {
+		return nil
+	}
+
+	// TODO(peter,rangedel): test that range tombstones are properly included in
+	// the output sstable. Should propbably pull out the code below into a method
+	// that can be separately tested.
+	if len(mems) == 1 {
+		mem := mems[0]
+		iter := mem.newIter(nil)
+		if rangeDelIter := mem.newRangeDelIter(nil); rangeDelIter != nil {
+			iter = newMergingIter(cf.cmp, iter, rangeDelIter)
+		}
+		return iter
+	}
+	iters := make([]internalIterator, 0, 2*len(mems))
+	for _, mem := range mems {
+		iters = append(iters, mem.newIter(nil))
+		rangeDelIter := mem.newRangeDelIter(nil)
+		if rangeDelIter != nil {
+			iters = append(iters, rangeDelIter)
+		}
+	}
+	return newMergingIter(cf.cmp, iters...)
+}
+
 // writeLevel0Table writes a memtable to a level-0 on-disk table.
 //
 // If no error is returned, it adds the file number of that on-disk table to
-// d.pendingOutputs. It is the caller's responsibility to remove that fileNum
-// from that set when it has been applied to d.mu.versions.
+// d.pendingOutputs, along with the file numbers of the blob files it
+// references (meta.blobFiles). It is the caller's responsibility to remove
+// those fileNums from that set when they have been applied to d.mu.versions.
 //
 // d.mu must be held when calling this, but the mutex may be dropped and
 // re-acquired during the course of this method.
 func (d *DB) writeLevel0Table(
-	iiter internalIterator, allowRangeTombstoneElision bool,
+	cf *columnFamily, iiter internalIterator, allowRangeTombstoneElision bool,
 ) (meta fileMetadata, err error) {
 	meta.fileNum = d.mu.versions.nextFileNum()
 	filename := dbFilename(d.dirname, fileTypeTable, meta.fileNum)
 	d.mu.compact.pendingOutputs[meta.fileNum] = struct{}{}
+	var blobFileNums []uint64
+	var blobFilenames []string
 	defer func(fileNum uint64) {
 		if err != nil {
 			delete(d.mu.compact.pendingOutputs, fileNum)
+			for _, fileNum := range blobFileNums {
+				delete(d.mu.compact.pendingOutputs, fileNum)
+			}
 		}
 	}(meta.fileNum)
 
 	snapshots := d.mu.snapshots.toSlice()
-	version := d.mu.versions.currentVersion()
+	version := cf.versions.currentVersion()
 
 	// Release the d.mu lock while doing I/O.
 	// Note the unusual order: Unlock and then Lock.
@@ -605,7 +700,7 @@ func (d *DB) writeLevel0Table(
 			return false
 		}
 		for level := 0; level < numLevels; level++ {
-			overlaps := version.overlaps(level, d.cmp, start, end)
+			overlaps := version.overlaps(level, cf.cmp, start, end)
 			if len(overlaps) > 0 {
 				return false
 			}
@@ -635,11 +730,21 @@ func (d *DB) writeLevel0Table(
 	}()
 
 	iter := newCompactionIter(
-		d.cmp, d.merge, iiter, snapshots,
+		cf.cmp, cf.merge, iiter, snapshots,
 		allowZeroSeqNum,
 		func([]byte) bool { return false },
 		elideRangeTombstone,
+		newCompactionFilter(cf.opts, db.CompactionFilterContext{
+			Flush:      true,
+			Bottommost: allowZeroSeqNum,
+		}),
+		cf.opts.Now().UnixNano(),
+		d.blobs.get,
 	)
+	bw := newBlobWriter(d, cf.opts, nil /* relocate */, nil /* inputs */, func(fileNum uint64, filename string) {
+		blobFileNums = append(blobFileNums, fileNum)
+		blobFilenames = append(blobFilenames, filename)
+	})
 	var (
 		file vfs.File
 		tw   *sstable.Writer
@@ -651,8 +756,12 @@ func (d *DB) writeLevel0Table(
 		if tw != nil {
 			err = firstError(err, tw.Close())
 		}
+		err = firstError(err, bw.Close())
 		if err != nil {
 			d.opts.FS.Remove(filename)
+			for _, filename := range blobFilenames {
+				d.opts.FS.Remove(filename)
+			}
 			meta = fileMetadata{}
 		}
 	}()
@@ -664,11 +773,16 @@ func (d *DB) writeLevel0Table(
 	file = vfs.NewSyncingFile(file, vfs.SyncingFileOptions{
 		BytesPerSync: d.opts.BytesPerSync,
 	})
-	tw = sstable.NewWriter(file, d.opts, d.opts.Level(0))
+	tw = sstable.NewWriter(file, cf.opts, cf.opts.Level(0))
+	tw.SetDBSessionID(d.sessionID)
 
 	var count int
 	for key, val := iter.First(); key != nil; key, val = iter.Next() {
-		if err1 := tw.Add(*key, val); err1 != nil {
+		k, v, err1 := bw.add(*key, val)
+		if err1 != nil {
+			return fileMetadata{}, err1
+		}
+		if err1 := tw.Add(k, v); err1 != nil {
 			return fileMetadata{}, err1
 		}
 		count++
@@ -698,6 +812,10 @@ func (d *DB) writeLevel0Table(
 		return fileMetadata{}, errEmptyTable
 	}
 
+	bw.finishTable(&meta)
+	if err := bw.finish(&meta); err != nil {
+		return fileMetadata{}, err
+	}
 	if err := d.dataDir.Sync(); err != nil {
 		return fileMetadata{}, err
 	}
@@ -707,10 +825,11 @@ func (d *DB) writeLevel0Table(
 		return fileMetadata{}, err
 	}
 	meta.size = writerMeta.Size
-	meta.smallest = writerMeta.Smallest(d.cmp)
-	meta.largest = writerMeta.Largest(d.cmp)
+	meta.smallest = writerMeta.Smallest(cf.cmp)
+	meta.largest = writerMeta.Largest(cf.cmp)
 	meta.smallestSeqNum = writerMeta.SmallestSeqNum
 	meta.largestSeqNum = writerMeta.LargestSeqNum
+	meta.smallestExpiry = writerMeta.SmallestExpiry
 	tw = nil
 
 	return meta, nil
@@ -720,7 +839,7 @@ func (d *DB) writeLevel0Table(
 //
 // d.mu must be held when calling this.
 func (d *DB) maybeScheduleCompaction() {
-	if d.mu.compact.compacting || d.mu.closed {
+	if d.mu.compact.compacting || d.mu.closed || d.opts.ReadOnly {
 		return
 	}
 
@@ -730,7 +849,7 @@ func (d *DB) maybeScheduleCompaction() {
 		return
 	}
 
-	if !d.mu.versions.picker.compactionNeeded() {
+	if d.pickColumnFamilyLocked() == nil {
 		// There is no work to be done.
 		return
 	}
@@ -762,15 +881,27 @@ func (d *DB) compact() {
 // re-acquired during the course of this method.
 func (d *DB) compact1() (err error) {
 	var c *compaction
+	var cf *columnFamily
 	if len(d.mu.compact.manual) > 0 {
 		manual := d.mu.compact.manual[0]
 		d.mu.compact.manual = d.mu.compact.manual[1:]
-		c = d.mu.versions.picker.pickManual(d.opts, manual)
 		defer func() {
 			manual.done <- err
 		}()
+		cf = manual.cf
+		if cf == nil {
+			cf = &d.columnFamily
+		}
+		if cf.dropped {
+			return ErrColumnFamilyDropped
+		}
+		c = cf.versions.picker.pickManual(cf.opts, manual)
 	} else {
-		c = d.mu.versions.picker.pickAuto(d.opts)
+		cf = d.pickColumnFamilyLocked()
+		if cf == nil {
+			return nil
+		}
+		c = cf.versions.picker.pickAuto(cf.opts)
 	}
 	if c == nil {
 		return nil
@@ -795,7 +926,7 @@ func (d *DB) compact1() (err error) {
 		d.opts.EventListener.CompactionBegin(info)
 	}
 
-	ve, pendingOutputs, err := d.compactDiskTables(c)
+	ve, pendingOutputs, err := d.compactDiskTables(cf, c)
 
 	if d.opts.EventListener.CompactionEnd != nil {
 		info.Err = err
@@ -811,6 +942,10 @@ func (d *DB) compact1() (err error) {
 	if err != nil {
 		return err
 	}
+	if cf.id != 0 {
+		ve.columnFamily = cf.id
+		ve = &versionEdit{columnFamilyEdits: []*versionEdit{ve}}
+	}
 	err = d.mu.versions.logAndApply(jobID, ve, d.dataDir)
 	for _, fileNum := range pendingOutputs {
 		if _, ok := d.mu.compact.pendingOutputs[fileNum]; !ok {
@@ -826,18 +961,40 @@ func (d *DB) compact1() (err error) {
 	return nil
 }
 
+// pickColumnFamilyLocked returns the column family most in need of
+// compaction, or nil if no column family needs to be compacted. Requires
+// DB.mu is held.
+func (d *DB) pickColumnFamilyLocked() *columnFamily {
+	var best *columnFamilyVersions
+	for _, cf := range d.mu.versions.columnFamilies {
+		if !cf.picker.compactionNeeded() {
+			continue
+		}
+		if best == nil || best.picker.score < cf.picker.score ||
+			(best.picker.score == cf.picker.score && cf.id < best.id) {
+			best = cf
+		}
+	}
+	if best == nil {
+		return nil
+	}
+	return d.mu.columnFamilies[best.id]
+}
+
 // compactDiskTables runs a compaction that produces new on-disk tables from
 // old on-disk tables.
 //
 // d.mu must be held when calling this, but the mutex may be dropped and
 // re-acquired during the course of this method.
-func (d *DB) compactDiskTables(c *compaction) (ve *versionEdit, pendingOutputs []uint64, retErr error) {
+func (d *DB) compactDiskTables(
+	cf *columnFamily, c *compaction,
+) (ve *versionEdit, pendingOutputs []uint64, retErr error) {
 	// Check for a trivial move of one table from one level to the next. We avoid
 	// such a move if there is lots of overlapping grandparent data. Otherwise,
 	// the move could create a parent file that will require a very expensive
 	// merge later on.
-	if len(c.inputs[0]) == 1 && len(c.inputs[1]) == 0 &&
-		totalSize(c.grandparents) <= maxGrandparentOverlapBytes(d.opts, c.outputLevel) {
+	if len(c.inputs[0]) == 1 && len(c.inputs[1]) == 0 && c.startLevel != c.outputLevel &&
+		totalSize(c.grandparents) <= maxGrandparentOverlapBytes(cf.opts, c.outputLevel) {
 		meta := &c.inputs[0][0]
 		return &versionEdit{
 			deletedFiles: map[deletedFileEntry]bool{
@@ -864,24 +1021,37 @@ func (d *DB) compactDiskTables(c *compaction) (ve *versionEdit, pendingOutputs [
 	}()
 
 	snapshots := d.mu.snapshots.toSlice()
+	relocate := cf.versions.currentVersion().blobFilesToRelocate(cf.opts.BlobGCAgeCutoff)
 
 	// Release the d.mu lock while doing I/O.
 	// Note the unusual order: Unlock and then Lock.
 	d.mu.Unlock()
 	defer d.mu.Lock()
 
-	c.cmp = d.cmp
-	iiter, err := c.newInputIter(d.newIters)
+	c.cmp = cf.cmp
+	iiter, err := c.newInputIter(cf.newIters)
 	if err != nil {
 		return nil, pendingOutputs, err
 	}
-	iter := newCompactionIter(d.cmp, d.merge, iiter, snapshots,
-		c.allowZeroSeqNum(), c.elideTombstone, c.elideRangeTombstone)
+	allowZeroSeqNum := c.allowZeroSeqNum()
+	iter := newCompactionIter(cf.cmp, cf.merge, iiter, snapshots,
+		allowZeroSeqNum, c.elideTombstone, c.elideRangeTombstone,
+		newCompactionFilter(cf.opts, db.CompactionFilterContext{
+			Bottommost:  allowZeroSeqNum,
+			OutputLevel: c.outputLevel,
+		}),
+		cf.opts.Now().UnixNano(), d.blobs.get)
 
 	var (
 		filenames []string
 		tw        *sstable.Writer
 	)
+	// The blob file is created with d.mu held, which protects pendingOutputs
+	// and filenames.
+	bw := newBlobWriter(d, cf.opts, relocate, c.inputs[:], func(fileNum uint64, filename string) {
+		pendingOutputs = append(pendingOutputs, fileNum)
+		filenames = append(filenames, filename)
+	})
 	defer func() {
 		if iter != nil {
 			retErr = firstError(retErr, iter.Close())
@@ -889,6 +1059,7 @@ func (d *DB) compactDiskTables(c *compaction) (ve *versionEdit, pendingOutputs [
 		if tw != nil {
 			retErr = firstError(retErr, tw.Close())
 		}
+		retErr = firstError(retErr, bw.Close())
 		if retErr != nil {
 			for _, filename := range filenames {
 				d.opts.FS.Remove(filename)
@@ -925,7 +1096,8 @@ func (d *DB) compactDiskTables(c *compaction) (ve *versionEdit, pendingOutputs [
 			BytesPerSync: d.opts.BytesPerSync,
 		})
 		filenames = append(filenames, filename)
-		tw = sstable.NewWriter(file, d.opts, d.opts.Level(c.outputLevel))
+		tw = sstable.NewWriter(file, cf.opts, cf.opts.Level(c.outputLevel))
+		tw.SetDBSessionID(d.sessionID)
 
 		ve.newFiles = append(ve.newFiles, newFileEntry{
 			level: c.outputLevel,
@@ -964,6 +1136,8 @@ func (d *DB) compactDiskTables(c *compaction) (ve *versionEdit, pendingOutputs [
 		meta.size = writerMeta.Size
 		meta.smallestSeqNum = writerMeta.SmallestSeqNum
 		meta.largestSeqNum = writerMeta.LargestSeqNum
+		meta.smallestExpiry = writerMeta.SmallestExpiry
+		bw.finishTable(meta)
 
 		metrics.BytesWritten += meta.size
 
@@ -973,7 +1147,7 @@ func (d *DB) compactDiskTables(c *compaction) (ve *versionEdit, pendingOutputs [
 			// previous tables largest key.
 			prevMeta := &ve.newFiles[n-2].meta
 			if writerMeta.SmallestRange.UserKey != nil &&
-				d.cmp(writerMeta.SmallestRange.UserKey, prevMeta.largest.UserKey) <= 0 {
+				cf.cmp(writerMeta.SmallestRange.UserKey, prevMeta.largest.UserKey) <= 0 {
 				// The range boundary user key is less than or equal to the previous
 				// table's largest key. We need the tables to be key-space partitioned,
 				// so force the boundary to a key that we know is larger than the
@@ -992,14 +1166,14 @@ func (d *DB) compactDiskTables(c *compaction) (ve *versionEdit, pendingOutputs [
 		}
 
 		if key.UserKey != nil && writerMeta.LargestRange.UserKey != nil {
-			if d.cmp(writerMeta.LargestRange.UserKey, key.UserKey) >= 0 {
+			if cf.cmp(writerMeta.LargestRange.UserKey, key.UserKey) >= 0 {
 				writerMeta.LargestRange = key
 				writerMeta.LargestRange.Trailer = db.InternalKeyRangeDeleteSentinel
 			}
 		}
 
-		meta.smallest = writerMeta.Smallest(d.cmp)
-		meta.largest = writerMeta.Largest(d.cmp)
+		meta.smallest = writerMeta.Smallest(cf.cmp)
+		meta.largest = writerMeta.Largest(cf.cmp)
 
 		return nil
 	}
@@ -1019,7 +1193,11 @@ func (d *DB) compactDiskTables(c *compaction) (ve *versionEdit, pendingOutputs [
 			}
 		}
 
-		if err := tw.Add(*key, val); err != nil {
+		k, v, err := bw.add(*key, val)
+		if err != nil {
+			return nil, pendingOutputs, err
+		}
+		if err := tw.Add(k, v); err != nil {
 			return nil, pendingOutputs, err
 		}
 	}
@@ -1027,6 +1205,13 @@ func (d *DB) compactDiskTables(c *compaction) (ve *versionEdit, pendingOutputs [
 	if err := finishOutput(db.InternalKey{}); err != nil {
 		return nil, pendingOutputs, err
 	}
+	metas := make([]*fileMetadata, len(ve.newFiles))
+	for i := range ve.newFiles {
+		metas[i] = &ve.newFiles[i].meta
+	}
+	if err := bw.finish(metas...); err != nil {
+		return nil, pendingOutputs, err
+	}
 
 	for i := range c.inputs {
 		level := c.startLevel
@@ -1091,6 +1276,7 @@ func (d *DB) scanObsoleteFiles() {
 
 	var obsoleteLogs []uint64
 	var obsoleteTables []uint64
+	var obsoleteBlobs []uint64
 	var obsoleteManifests []uint64
 	var obsoleteOptions []uint64
 
@@ -1121,6 +1307,11 @@ func (d *DB) scanObsoleteFiles() {
 				continue
 			}
 			obsoleteTables = append(obsoleteTables, fileNum)
+		case fileTypeBlob:
+			if _, ok := liveFileNums[fileNum]; ok {
+				continue
+			}
+			obsoleteBlobs = append(obsoleteBlobs, fileNum)
 		default:
 			// Don't delete files we don't know about.
 			continue
@@ -1130,6 +1321,7 @@ func (d *DB) scanObsoleteFiles() {
 	d.mu.Lock()
 	d.mu.log.queue = merge(d.mu.log.queue, obsoleteLogs)
 	d.mu.versions.obsoleteTables = merge(d.mu.versions.obsoleteTables, obsoleteTables)
+	d.mu.versions.obsoleteBlobs = merge(d.mu.versions.obsoleteBlobs, obsoleteBlobs)
 	d.mu.versions.obsoleteManifests = merge(d.mu.versions.obsoleteManifests, obsoleteManifests)
 	d.mu.versions.obsoleteOptions = merge(d.mu.versions.obsoleteOptions, obsoleteOptions)
 	d.mu.Unlock()
@@ -1144,17 +1336,30 @@ func (d *DB) deleteObsoleteFiles(jobID int) {
 	for d.mu.cleaner.cleaning {
 		d.mu.cleaner.cond.Wait()
 	}
+	if d.mu.cleaner.disabled > 0 {
+		// File deletions are disabled. The obsolete files remain queued and will
+		// be deleted by a subsequent call once deletions are re-enabled.
+		return
+	}
 	d.mu.cleaner.cleaning = true
 	defer func() {
 		d.mu.cleaner.cleaning = false
 		d.mu.cleaner.cond.Signal()
 	}()
 
+	// Logs containing batches which the change feeds have yet to deliver are
+	// retained as well.
+	minLogNum := d.mu.versions.minLogNumber()
+	if n := d.changeFeeds.minLogNum(); n != 0 && n < minLogNum {
+		minLogNum = n
+	}
+
 	var obsoleteLogs []uint64
 	for i := range d.mu.log.queue {
 		// NB: d.mu.versions.logNumber is the file number of the latest log that
-		// has had its contents persisted to the LSM.
-		if d.mu.log.queue[i] >= d.mu.versions.logNumber {
+		// has had its contents persisted to the LSM. Older logs containing
+		// prepared batches are retained as well.
+		if d.mu.log.queue[i] >= minLogNum {
 			obsoleteLogs = d.mu.log.queue[:i]
 			d.mu.log.queue = d.mu.log.queue[i:]
 			d.mu.versions.metrics.WAL.Files -= uint64(len(obsoleteLogs))
@@ -1165,23 +1370,36 @@ func (d *DB) deleteObsoleteFiles(jobID int) {
 	obsoleteTables := d.mu.versions.obsoleteTables
 	d.mu.versions.obsoleteTables = nil
 
+	obsoleteBlobs := d.mu.versions.obsoleteBlobFiles(d.mu.compact.pendingOutputs)
+
 	obsoleteManifests := d.mu.versions.obsoleteManifests
 	d.mu.versions.obsoleteManifests = nil
 
 	obsoleteOptions := d.mu.versions.obsoleteOptions
 	d.mu.versions.obsoleteOptions = nil
 
+	// An obsolete table may belong to any of the column families, including
+	// column families which have been dropped, whose blocks may be held by
+	// the block cache of the column family.
+	var blockCaches []*cache.Cache
+	for _, cf := range d.mu.columnFamilies {
+		if c := cf.opts.Cache; c != d.opts.Cache {
+			blockCaches = append(blockCaches, c)
+		}
+	}
+
 	// Release d.mu while doing I/O
 	// Note the unusual order: Unlock and then Lock.
 	d.mu.Unlock()
 	defer d.mu.Lock()
 
-	files := [4]struct {
+	files := [5]struct {
 		fileType fileType
 		obsolete []uint64
 	}{
 		{fileTypeLog, obsoleteLogs},
 		{fileTypeTable, obsoleteTables},
+		{fileTypeBlob, obsoleteBlobs},
 		{fileTypeManifest, obsoleteManifests},
 		{fileTypeOptions, obsoleteOptions},
 	}
@@ -1194,14 +1412,34 @@ func (d *DB) deleteObsoleteFiles(jobID int) {
 		for _, fileNum := range f.obsolete {
 			switch f.fileType {
 			case fileTypeLog:
+				if d.walArchive.enabled() {
+					// Obsolete logs are moved into the archive rather than being
+					// deleted or recycled. The archive is purged below. A log which
+					// cannot be archived is recycled or deleted instead, as it would
+					// otherwise remain in the WAL directory until the next restart.
+					err := d.walArchive.add(d.walDirname, fileNum)
+					if err == nil {
+						continue
+					}
+					d.opts.Logger.Errorf("[JOB %d] WAL %06d archival failed: %v", jobID, fileNum, err)
+				}
 				if d.logRecycler.add(fileNum) {
 					continue
 				}
 			case fileTypeTable:
 				d.tableCache.evict(fileNum)
+				for _, c := range blockCaches {
+					c.EvictFile(fileNum)
+				}
+			case fileTypeBlob:
+				d.blobs.evict(fileNum)
 			}
 
-			path := dbFilename(d.dirname, f.fileType, fileNum)
+			dirname := d.dirname
+			if f.fileType == fileTypeLog {
+				dirname = d.walDirname
+			}
+			path := dbFilename(dirname, f.fileType, fileNum)
 			err := d.opts.FS.Remove(path)
 
 			if err != os.ErrNotExist {
@@ -1237,6 +1475,10 @@ func (d *DB) deleteObsoleteFiles(jobID int) {
 			}
 		}
 	}
+
+	if d.walArchive.enabled() {
+		d.purgeWALArchive(jobID)
+	}
 }
 
 func merge(a, b []uint64) []uint64 {
@@ -20,7 +20,7 @@ import (
 // contains two keys: a.PUT.2 and a.PUT.1. Instead of returning both entries,
 // compactionIter collapses the second entry because it is no longer
 // necessary. The high-level structure for compactionIter is to iterate over
-// its internal iterator and output 1 entry for every user-key. There are four
+// its internal iterator and output 1 entry for every user-key. There are five
 // complications to this story.
 //
 // 1. Eliding Deletion Tombstones
@@ -121,6 +121,50 @@ import (
 // to take the range tombstones into consideration when outputting normal
 // keys. Just as with point deletions, a range deletion covering an entry can
 // cause the entry to be elided.
+//
+// 5. Single Deletions
+//
+// A SINGLEDEL only deletes the most recent version of a key, which allows it
+// to be elided along with the SET it shadows. Consider the entries
+// a.SINGLEDEL.2 and a.SET.1. Both entries are elided, regardless of the level
+// being compacted to. If a SINGLEDEL is not followed by a SET in the same
+// snapshot stripe, it is output unless it is the last entry in the bottom
+// snapshot stripe and can be elided like a deletion tombstone. The behavior
+// is undefined if a key is set more than once before being single deleted.
+//
+// 6. Compaction Filters
+//
+// A db.CompactionFilter can keep, remove or rewrite the value of a SET entry,
+// or of a SETEXPIRY entry which has not expired, in which case the filter sees
+// the value without its expiration time and a rewritten value keeps it. MERGE
+// entries are not filtered. Only an entry in the top snapshot stripe, which is
+// not visible to any snapshot, is passed to the filter. Consider the entries
+// a.SET.9 and a.SET.5 with a snapshot at sequence number 7. Removing a.SET.9
+// must not resurrect a.SET.5, which is still needed by the snapshot, so the
+// removed entry is output as a.DEL.9. The deletion tombstone is elided instead
+// if it is in the last snapshot stripe and can be elided like any other
+// deletion tombstone.
+//
+// 7. Expiration
+//
+// A SETEXPIRY entry is a SET whose value is prefixed by an expiration time
+// (see Batch.SetWithTTL). Once the entry has expired it is read as a deletion
+// tombstone, and compactionIter rewrites it as one: a.SETEXPIRY.9 becomes
+// a.DEL.9, which is elided if possible. Unlike a compaction filter, this
+// applies to every snapshot stripe, because an expired entry is hidden from
+// the snapshots as well. MERGE operations inherit the expiration time of the
+// SETEXPIRY entry they are merged with: a.MERGE.3 and a.SETEXPIRY.2 collapse
+// to a.SETEXPIRY.3 while the entry is live, and to a.DEL.3 once it has
+// expired.
+//
+// 8. Blob Indexes
+//
+// A BLOBINDEX entry is a SET whose value is stored in a blob file, and is
+// passed through unchanged like a SET, without reading its value. The value
+// is only read when it is needed: when the entry is passed to a compaction
+// filter, or when MERGE operations are merged with it. a.MERGE.3 and
+// a.BLOBINDEX.2 collapse to a.SET.3, whose value may be separated again by
+// the compaction (see blobWriter).
 type compactionIter struct {
 	cmp   db.Compare
 	merge db.Merge
@@ -158,6 +202,16 @@ type compactionIter struct {
 	allowZeroSeqNum     bool
 	elideTombstone      func(key []byte) bool
 	elideRangeTombstone func(start, end []byte) bool
+	// The compaction filter applied to SET entries, or nil if the entries are
+	// not filtered.
+	filter func(key, value []byte) (db.CompactionFilterDecision, []byte)
+	// The current time in nanoseconds since the Unix epoch. SETEXPIRY entries
+	// which expire at or before this time have expired.
+	now int64
+	// readBlob returns the value referenced by the blob index of a BLOBINDEX
+	// entry, reading it into blobBuf.
+	readBlob func(index []byte, buf *[]byte) ([]byte, error)
+	blobBuf  []byte
 }
 
 func newCompactionIter(
@@ -168,6 +222,9 @@ func newCompactionIter(
 	allowZeroSeqNum bool,
 	elideTombstone func(key []byte) bool,
 	elideRangeTombstone func(start, end []byte) bool,
+	filter func(key, value []byte) (db.CompactionFilterDecision, []byte),
+	now int64,
+	readBlob func(index []byte, buf *[]byte) ([]byte, error),
 ) *compactionIter {
 	i := &compactionIter{
 		cmp:                 cmp,
@@ -177,6 +234,9 @@ func newCompactionIter(
 		allowZeroSeqNum:     allowZeroSeqNum,
 		elideTombstone:      elideTombstone,
 		elideRangeTombstone: elideRangeTombstone,
+		filter:              filter,
+		now:                 now,
+		readBlob:            readBlob,
 	}
 	i.rangeDelFrag.Cmp = cmp
 	i.rangeDelFrag.Emit = i.emitRangeDelChunk
@@ -223,13 +283,19 @@ func (i *compactionIter) Next() (*db.InternalKey, []byte) {
 			i.skip = true
 			return &i.key, i.value
 
+		case db.InternalKeyKindSingleDelete:
+			if i.singleDeleteNext() {
+				return &i.key, i.value
+			}
+			continue
+
 		case db.InternalKeyKindRangeDelete:
 			i.key = i.cloneKey(i.key)
 			i.rangeDelFrag.Add(i.key, i.iterValue)
 			i.nextInStripe()
 			continue
 
-		case db.InternalKeyKindSet:
+		case db.InternalKeyKindSet, db.InternalKeyKindBlobIndex:
 			if i.rangeDelFrag.Deleted(i.key, i.curSnapshotSeqNum) {
 				i.saveKey()
 				i.skipStripe()
@@ -238,6 +304,63 @@ func (i *compactionIter) Next() (*db.InternalKey, []byte) {
 
 			i.saveKey()
 			i.value = i.iterValue
+			if i.filter != nil && i.curSnapshotIdx == len(i.snapshots) {
+				value := i.value
+				if i.key.Kind() == db.InternalKeyKindBlobIndex {
+					if value, i.err = i.readBlob(i.value, &i.blobBuf); i.err != nil {
+						return nil, nil
+					}
+				}
+				switch decision, value := i.filter(i.key.UserKey, value); decision {
+				case db.CompactionFilterRemove:
+					// The entry is removed by outputting a deletion tombstone in its
+					// place, which is elided if possible (see Compaction Filters
+					// above).
+					if i.deleteEntry() {
+						return &i.key, i.value
+					}
+					continue
+				case db.CompactionFilterChangeValue:
+					i.valueBuf = append(i.valueBuf[:0], value...)
+					i.value = i.valueBuf
+					i.key.SetKind(db.InternalKeyKindSet)
+				}
+			}
+			i.valid = true
+			i.skip = true
+			i.maybeZeroSeqnum()
+			return &i.key, i.value
+
+		case db.InternalKeyKindSetWithExpiry:
+			if i.rangeDelFrag.Deleted(i.key, i.curSnapshotSeqNum) {
+				i.saveKey()
+				i.skipStripe()
+				continue
+			}
+
+			i.saveKey()
+			if expiry, _ := decodeExpiry(i.iterValue); expiry <= i.now {
+				// The expired entry is replaced by a deletion tombstone, which is
+				// elided if possible (see Expiration above).
+				if i.deleteEntry() {
+					return &i.key, i.value
+				}
+				continue
+			}
+			i.value = i.iterValue
+			if i.filter != nil && i.curSnapshotIdx == len(i.snapshots) {
+				expiry, value := decodeExpiry(i.value)
+				switch decision, value := i.filter(i.key.UserKey, value); decision {
+				case db.CompactionFilterRemove:
+					if i.deleteEntry() {
+						return &i.key, i.value
+					}
+					continue
+				case db.CompactionFilterChangeValue:
+					i.valueBuf = appendExpiry(i.valueBuf[:0], expiry, value)
+					i.value = i.valueBuf
+				}
+			}
 			i.valid = true
 			i.skip = true
 			i.maybeZeroSeqnum()
@@ -287,6 +410,21 @@ func snapshotIndex(seq uint64, snapshots []uint64) (int, uint64) {
 	return index, snapshots[index]
 }
 
+// deleteEntry replaces the current entry with a deletion tombstone. Returns
+// true if the tombstone needs to be output, and false if it was elided along
+// with the remainder of the last snapshot stripe.
+func (i *compactionIter) deleteEntry() bool {
+	if i.curSnapshotIdx == 0 && i.elideTombstone(i.key.UserKey) {
+		i.skipStripe()
+		return false
+	}
+	i.key.SetKind(db.InternalKeyKindDelete)
+	i.value = nil
+	i.valid = true
+	i.skip = true
+	return true
+}
+
 func (i *compactionIter) skipStripe() {
 	for i.nextInStripe() {
 	}
@@ -339,7 +477,7 @@ func (i *compactionIter) mergeNext() (*db.InternalKey, []byte) {
 		}
 		key := i.iterKey
 		switch key.Kind() {
-		case db.InternalKeyKindDelete:
+		case db.InternalKeyKindDelete, db.InternalKeyKindSingleDelete:
 			// We've hit a deletion tombstone. Return everything up to this point and
 			// then skip entries until the next snapshot stripe.
 			i.valueBuf = i.value[:0]
@@ -367,6 +505,49 @@ func (i *compactionIter) mergeNext() (*db.InternalKey, []byte) {
 			i.skip = true
 			return &i.key, i.value
 
+		case db.InternalKeyKindBlobIndex:
+			if i.rangeDelFrag.Deleted(*key, i.curSnapshotSeqNum) {
+				i.skip = true
+				return &i.key, i.value
+			}
+
+			// We've hit a Set value stored in a blob file. Merge with the value
+			// read from the blob file and return a Set, as above.
+			value, err := i.readBlob(i.iterValue, &i.blobBuf)
+			if err != nil {
+				i.err = err
+				return nil, nil
+			}
+			i.value = i.merge(i.key.UserKey, i.value, value, nil)
+			i.valueBuf = i.value[:0]
+			i.key.SetKind(db.InternalKeyKindSet)
+			i.skip = true
+			return &i.key, i.value
+
+		case db.InternalKeyKindSetWithExpiry:
+			if i.rangeDelFrag.Deleted(*key, i.curSnapshotSeqNum) {
+				i.skip = true
+				return &i.key, i.value
+			}
+
+			// We've hit a Set value with an expiration time, which the merged
+			// value inherits. If the entry has expired, the merged value has
+			// expired along with it and is replaced by a deletion tombstone.
+			// Otherwise, MERGE+MERGE+SETEXPIRY -> SETEXPIRY.
+			expiry, value := decodeExpiry(i.iterValue)
+			if expiry <= i.now {
+				i.key.SetKind(db.InternalKeyKindDelete)
+				i.value = nil
+				i.skip = true
+				return &i.key, i.value
+			}
+			merged := i.merge(i.key.UserKey, i.value, value, nil)
+			i.value = appendExpiry(make([]byte, 0, expiryLen+len(merged)), expiry, merged)
+			i.valueBuf = i.value[:0]
+			i.key.SetKind(db.InternalKeyKindSetWithExpiry)
+			i.skip = true
+			return &i.key, i.value
+
 		case db.InternalKeyKindMerge:
 			if i.rangeDelFrag.Deleted(*key, i.curSnapshotSeqNum) {
 				i.skip = true
@@ -385,6 +566,50 @@ func (i *compactionIter) mergeNext() (*db.InternalKey, []byte) {
 	}
 }
 
+// singleDeleteNext processes a SINGLEDEL entry, eliding it along with the SET
+// it shadows in the same snapshot stripe. Returns true if the SINGLEDEL needs
+// to be output, and false if it was elided.
+func (i *compactionIter) singleDeleteNext() bool {
+	// Save the current key and value.
+	i.saveKey()
+	i.saveValue()
+	snapshotIdx := i.curSnapshotIdx
+
+	for {
+		if !i.nextInStripe() {
+			// We've reached the end of the snapshot stripe without finding a SET. If
+			// this is the last snapshot stripe the SINGLEDEL can be elided like a
+			// deletion tombstone.
+			if snapshotIdx == 0 && i.elideTombstone(i.key.UserKey) {
+				return false
+			}
+			i.valid = true
+			i.skip = false
+			return true
+		}
+
+		switch i.iterKey.Kind() {
+		case db.InternalKeyKindRangeDelete:
+			// Range tombstones are added to the fragmenter by nextInStripe.
+			continue
+
+		case db.InternalKeyKindSet, db.InternalKeyKindSetWithExpiry, db.InternalKeyKindBlobIndex:
+			// The SINGLEDEL and the SET it shadows annihilate each other. Any older
+			// entries in the stripe are shadowed by the SET and are skipped.
+			i.skipStripe()
+			return false
+
+		default:
+			// We've hit an entry which cannot be elided along with the SINGLEDEL
+			// (e.g. a DEL or MERGE). Output the SINGLEDEL and skip entries until the
+			// next snapshot stripe.
+			i.valid = true
+			i.skip = true
+			return true
+		}
+	}
+}
+
 func (i *compactionIter) saveKey() {
 	i.keyBuf = append(i.keyBuf[:0], i.iterKey.UserKey...)
 	i.key.UserKey = i.keyBuf
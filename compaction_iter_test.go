@@ -51,6 +51,27 @@ func TestCompactionIter(t *testing.T) {
 	var vals [][]byte
 	var snapshots []uint64
 	var elideTombstones bool
+	var filter func(key, value []byte) (db.CompactionFilterDecision, []byte)
+	var now int64
+
+	// testFilter removes the values prefixed with "rm", and upper cases the
+	// values prefixed with "up".
+	testFilter := func(key, value []byte) (db.CompactionFilterDecision, []byte) {
+		switch {
+		case bytes.HasPrefix(value, []byte("rm")):
+			return db.CompactionFilterRemove, nil
+		case bytes.HasPrefix(value, []byte("up")):
+			return db.CompactionFilterChangeValue, bytes.ToUpper(value)
+		}
+		return db.CompactionFilterKeep, nil
+	}
+
+	// testReadBlob returns the blob index suffixed with "-blob" as the value of
+	// a BLOBINDEX entry.
+	testReadBlob := func(index []byte, buf *[]byte) ([]byte, error) {
+		*buf = append(append((*buf)[:0], index...), "-blob"...)
+		return *buf, nil
+	}
 
 	newIter := func() *compactionIter {
 		return newCompactionIter(
@@ -65,6 +86,9 @@ func TestCompactionIter(t *testing.T) {
 			func(_, _ []byte) bool {
 				return elideTombstones
 			},
+			filter,
+			now,
+			testReadBlob,
 		)
 	}
 
@@ -75,14 +99,27 @@ func TestCompactionIter(t *testing.T) {
 			vals = vals[:0]
 			for _, key := range strings.Split(d.Input, "\n") {
 				j := strings.Index(key, ":")
-				keys = append(keys, db.ParseInternalKey(key[:j]))
-				vals = append(vals, []byte(key[j+1:]))
+				ikey := db.ParseInternalKey(key[:j])
+				value := []byte(key[j+1:])
+				if ikey.Kind() == db.InternalKeyKindSetWithExpiry {
+					// The value of a SETEXPIRY entry is specified as <expiry>/<value>.
+					k := bytes.IndexByte(value, '/')
+					expiry, err := strconv.ParseInt(string(value[:k]), 10, 64)
+					if err != nil {
+						return err.Error()
+					}
+					value = appendExpiry(nil, expiry, value[k+1:])
+				}
+				keys = append(keys, ikey)
+				vals = append(vals, value)
 			}
 			return ""
 
 		case "iter":
 			snapshots = snapshots[:0]
 			elideTombstones = false
+			filter = nil
+			now = 0
 			for _, arg := range d.CmdArgs {
 				switch arg.Key {
 				case "snapshots":
@@ -99,6 +136,20 @@ func TestCompactionIter(t *testing.T) {
 					if err != nil {
 						return err.Error()
 					}
+				case "filter":
+					enabled, err := strconv.ParseBool(arg.Vals[0])
+					if err != nil {
+						return err.Error()
+					}
+					if enabled {
+						filter = testFilter
+					}
+				case "now":
+					var err error
+					now, err = strconv.ParseInt(arg.Vals[0], 10, 64)
+					if err != nil {
+						return err.Error()
+					}
 				default:
 					return fmt.Sprintf("%s: unknown arg: %s", d.Cmd, arg.Key)
 				}
@@ -133,7 +184,10 @@ func TestCompactionIter(t *testing.T) {
 				default:
 					return fmt.Sprintf("unknown op: %s", parts[0])
 				}
-				if iter.Valid() {
+				if iter.Valid() && iter.Key().Kind() == db.InternalKeyKindSetWithExpiry {
+					expiry, value := decodeExpiry(iter.Value())
+					fmt.Fprintf(&b, "%s:%d/%s\n", iter.Key(), expiry, value)
+				} else if iter.Valid() {
 					fmt.Fprintf(&b, "%s:%s\n", iter.Key(), iter.Value())
 				} else if err := iter.Error(); err != nil {
 					fmt.Fprintf(&b, "err=%v\n", err)
@@ -181,12 +181,19 @@ func (p *compactionPicker) initTarget(v *version, opts *db.Options) {
 		return
 	}
 
-	// No levels exceeded their size threshold. Check for forced compactions.
-	for level := 0; level < numLevels-1; level++ {
-		files := v.files[p.level]
+	// No levels exceeded their size threshold. Check for forced compactions,
+	// including the compaction of tables holding expired entries and of tables
+	// referencing mostly obsolete blob files. The tables in the bottommost
+	// level are compacted in place. Expired entries are only noticed when a new
+	// version is installed.
+	now := uint64(opts.Now().UnixNano())
+	collect := v.blobFilesToCollect(opts.BlobGCAgeCutoff, opts.BlobGCForceThreshold)
+	for level := 0; level < numLevels; level++ {
+		files := v.files[level]
 		for i := range files {
 			f := &files[i]
-			if f.markedForCompaction {
+			if f.markedForCompaction || (f.smallestExpiry != 0 && f.smallestExpiry <= now) ||
+				referencesAny(f.blobFiles, collect) {
 				p.score = 1.0
 				p.level = level
 				p.file = i
@@ -200,6 +207,16 @@ func (p *compactionPicker) initTarget(v *version, opts *db.Options) {
 	// snapshot.
 }
 
+// referencesAny returns true if any of the blob files is in collect.
+func referencesAny(blobFiles []uint64, collect map[uint64]bool) bool {
+	for _, fileNum := range blobFiles {
+		if collect[fileNum] {
+			return true
+		}
+	}
+	return false
+}
+
 // pickAuto picks the best compaction, if any.
 func (p *compactionPicker) pickAuto(opts *db.Options) (c *compaction) {
 	if !p.compactionNeeded() {
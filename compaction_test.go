@@ -11,6 +11,7 @@ import (
 	"sort"
 	"strconv"
 	"strings"
+	"sync"
 	"testing"
 	"time"
 
@@ -1079,3 +1080,116 @@ func TestCompactionAllowZeroSeqNum(t *testing.T) {
 			}
 		})
 }
+
+// expiringCompactionFilter removes the values prefixed with "expired", and
+// records the contexts it is invoked with.
+type expiringCompactionFilter struct {
+	mu       sync.Mutex
+	contexts []db.CompactionFilterContext
+}
+
+func (f *expiringCompactionFilter) Filter(
+	ctx db.CompactionFilterContext, key, value []byte,
+) (db.CompactionFilterDecision, []byte) {
+	f.mu.Lock()
+	f.contexts = append(f.contexts, ctx)
+	f.mu.Unlock()
+	if bytes.HasPrefix(value, []byte("expired")) {
+		return db.CompactionFilterRemove, nil
+	}
+	return db.CompactionFilterKeep, nil
+}
+
+func (f *expiringCompactionFilter) Name() string {
+	return "expiring"
+}
+
+func TestCompactionFilter(t *testing.T) {
+	for _, onFlush := range []bool{false, true} {
+		t.Run(fmt.Sprintf("on-flush=%t", onFlush), func(t *testing.T) {
+			filter := &expiringCompactionFilter{}
+			d, err := Open("", &db.Options{
+				FS:                      vfs.NewMem(),
+				CompactionFilter:        filter,
+				CompactionFilterOnFlush: onFlush,
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			set := func(key, value string) {
+				t.Helper()
+				if err := d.Set([]byte(key), []byte(value), nil); err != nil {
+					t.Fatal(err)
+				}
+			}
+			get := func(r Reader, key string) string {
+				t.Helper()
+				v, err := r.Get([]byte(key))
+				if err == db.ErrNotFound {
+					return "<not found>"
+				} else if err != nil {
+					t.Fatal(err)
+				}
+				return string(v)
+			}
+
+			set("a", "live")
+			set("b", "old")
+			if err := d.Flush(); err != nil {
+				t.Fatal(err)
+			}
+			// The removal of b must not resurrect the older value of b, which is
+			// retained for the snapshot.
+			snap := d.NewSnapshot()
+			set("b", "expired")
+			set("c", "expired")
+			if err := d.Flush(); err != nil {
+				t.Fatal(err)
+			}
+			if expected, actual := "expired", get(d, "c"); !onFlush && expected != actual {
+				t.Fatalf("expected %q, but found %q", expected, actual)
+			}
+			if err := d.Compact([]byte("a"), []byte("z")); err != nil {
+				t.Fatal(err)
+			}
+
+			for _, c := range []struct {
+				r        Reader
+				key      string
+				expected string
+			}{
+				{d, "a", "live"},
+				{d, "b", "<not found>"},
+				{d, "c", "<not found>"},
+				{snap, "a", "live"},
+				{snap, "b", "old"},
+				{snap, "c", "<not found>"},
+			} {
+				if actual := get(c.r, c.key); c.expected != actual {
+					t.Fatalf("%s: expected %q, but found %q", c.key, c.expected, actual)
+				}
+			}
+			if err := snap.Close(); err != nil {
+				t.Fatal(err)
+			}
+
+			filter.mu.Lock()
+			var flushes, compactions int
+			for _, ctx := range filter.contexts {
+				if ctx.Flush {
+					flushes++
+				} else {
+					compactions++
+				}
+			}
+			filter.mu.Unlock()
+			if (flushes > 0) != onFlush || (!onFlush && compactions == 0) {
+				t.Fatalf("unexpected filter invocations: %d flushes, %d compactions",
+					flushes, compactions)
+			}
+			if err := d.Close(); err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
@@ -247,7 +247,7 @@ func runDBDefineCmd(td *datadriven.TestData) (*DB, error) {
 		if rangeDelIter := mem.newRangeDelIter(nil); rangeDelIter != nil {
 			iter = newMergingIter(d.cmp, iter, rangeDelIter)
 		}
-		meta, err := d.writeLevel0Table(iter, false /* allowRangeTombstoneElision */)
+		meta, err := d.writeLevel0Table(&d.columnFamily, iter, false /* allowRangeTombstoneElision */)
 		if err != nil {
 			return nil
 		}
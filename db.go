@@ -76,6 +76,28 @@ type Writer interface {
 	// It is safe to modify the contents of the arguments after Delete returns.
 	Delete(key []byte, o *db.WriteOptions) error
 
+	// SingleDelete is similar to Delete in that it deletes the value for the
+	// given key. Like Delete, it is a blind operation that will succeed even if
+	// the given key does not exist.
+	//
+	// WARNING: Undefined (non-deterministic) behavior will result if a key is
+	// overwritten and then deleted using SingleDelete. The record may appear
+	// deleted immediately, but be resurrected at a later time after compactions
+	// have been performed. Or the record may be deleted permanently. A Delete
+	// operation lays down a "tombstone" which shadows all previous versions of
+	// a key. The SingleDelete operation is akin to "anti-matter" and will only
+	// delete the most recently written version of a key. These different
+	// semantics allow the DB to avoid propagating a SingleDelete operation
+	// during a compaction as soon as the corresponding Set operation is
+	// encountered. These semantics require extreme care to handle properly.
+	// Only use if you have a workload where the performance gain is critical
+	// and you can guarantee that a record is written once and then deleted
+	// once.
+	//
+	// It is safe to modify the contents of the arguments after SingleDelete
+	// returns.
+	SingleDelete(key []byte, o *db.WriteOptions) error
+
 	// DeleteRange deletes all of the keys (and values) in the range [start,end)
 	// (inclusive on start, exclusive on end).
 	//
@@ -129,34 +151,51 @@ type Writer interface {
 //		Comparer: myComparer,
 //	})
 type DB struct {
-	dirname        string
-	walDirname     string
-	opts           *db.Options
-	cmp            db.Compare
-	equal          db.Equal
-	merge          db.Merge
-	abbreviatedKey db.AbbreviatedKey
+	// The default column family. The options of the default column family are
+	// the options of the DB.
+	columnFamily
+
+	dirname    string
+	walDirname string
 
 	dataDir vfs.File
 	walDir  vfs.File
 
-	tableCache tableCache
-	newIters   tableNewIters
-
 	commit   *commitPipeline
 	fileLock io.Closer
 
-	largeBatchThreshold int
-	optionsFileNum      uint64
+	optionsFileNum uint64
 
-	// readState provides access to the state needed for reading without needing
-	// to acquire DB.mu.
-	readState struct {
-		sync.RWMutex
-		val *readState
-	}
+	// sessionID is the identity of the DB session, which is recorded in the
+	// tables and blob files created by the session. It allows the files to be
+	// identified without reading them (see BackupEngine).
+	sessionID string
 
 	logRecycler logRecycler
+	// walArchive holds the archived logs if WAL archival is enabled (see
+	// db.Options.WALArchiveTTL).
+	walArchive walArchive
+
+	// tableCache holds the open tables of all of the column families, whose
+	// number is limited by Options.MaxOpenFiles.
+	tableCache tableCache
+
+	// blobs holds the open blob files, which store the values separated from
+	// their keys (see db.Options.MinBlobSize).
+	blobs blobCache
+
+	// columnFamilyMu serializes the creation and dropping of column families.
+	columnFamilyMu sync.Mutex
+
+	// lockTable holds the locks of pessimistic transactions (see Txn).
+	lockTable lockTable
+
+	// changeFeeds holds the open change feeds (see ChangeFeed).
+	changeFeeds changeFeeds
+
+	// follower is true if the DB is the replica of a primary DB, which only
+	// applies the batches received from the primary (see OpenFollower).
+	follower bool
 
 	// TODO(peter): describe exactly what this mutex protects. So far: every
 	// field in the struct.
@@ -168,6 +207,15 @@ type DB struct {
 
 		versions versionSet
 
+		// The column families of the DB (including the default column family)
+		// keyed by ID. Dropped column families are retained so that their
+		// table caches can be evicted and closed.
+		columnFamilies map[uint32]*columnFamily
+
+		// The batches which have been prepared but not yet committed or rolled
+		// back, keyed by name. See DB.Prepare.
+		prepared map[string]*preparedBatch
+
 		log struct {
 			queue   []uint64
 			size    uint64
@@ -200,6 +248,10 @@ type DB struct {
 		cleaner struct {
 			cond     sync.Cond
 			cleaning bool
+			// disabled is a count of the operations (e.g. Checkpoint) which
+			// require obsolete files to be retained. Obsolete files are not
+			// deleted while disabled is non-zero.
+			disabled int
 		}
 
 		// The list of active snapshots.
@@ -216,14 +268,17 @@ var _ Writer = (*DB)(nil)
 // The caller should not modify the contents of the returned slice, but it is
 // safe to modify the contents of the argument after Get returns.
 func (d *DB) Get(key []byte) ([]byte, error) {
-	return d.getInternal(key, nil /* batch */, nil /* snapshot */)
+	return d.getInternal(&d.columnFamily, key, nil /* batch */, nil /* snapshot */)
 }
 
-func (d *DB) getInternal(key []byte, b *Batch, s *Snapshot) ([]byte, error) {
+func (d *DB) getInternal(cf *columnFamily, key []byte, b *Batch, s *Snapshot) ([]byte, error) {
 	// Grab and reference the current readState. This prevents the underlying
 	// files in the associated version from being deleted if there is a current
 	// compaction. The readState is unref'd by Iterator.Close().
-	readState := d.loadReadState()
+	readState := cf.loadReadState()
+	if readState == nil {
+		return nil, ErrColumnFamilyDropped
+	}
 
 	// Determine the seqnum to read at after grabbing the read state (current and
 	// memtables) above.
@@ -240,9 +295,9 @@ func (d *DB) getInternal(key []byte, b *Batch, s *Snapshot) ([]byte, error) {
 	}
 
 	get := &buf.get
-	get.cmp = d.cmp
-	get.equal = d.equal
-	get.newIters = d.newIters
+	get.cmp = cf.cmp
+	get.equal = cf.equal
+	get.newIters = cf.newIters
 	get.snapshot = seqNum
 	get.key = key
 	get.batch = b
@@ -251,9 +306,11 @@ func (d *DB) getInternal(key []byte, b *Batch, s *Snapshot) ([]byte, error) {
 	get.version = readState.current
 
 	i := &buf.dbi
-	i.cmp = d.cmp
-	i.equal = d.equal
-	i.merge = d.merge
+	i.cmp = cf.cmp
+	i.equal = cf.equal
+	i.merge = cf.merge
+	i.now = d.opts.Now
+	i.blobs = &d.blobs
 	i.iter = get
 	i.readState = readState
 
@@ -279,6 +336,18 @@ func (d *DB) Set(key, value []byte, opts *db.WriteOptions) error {
 	return d.Apply(b, opts)
 }
 
+// SetWithTTL sets the value for the given key until the specified TTL has
+// elapsed (see Batch.SetWithTTL).
+//
+// It is safe to modify the contents of the arguments after SetWithTTL
+// returns.
+func (d *DB) SetWithTTL(key, value []byte, ttl time.Duration, opts *db.WriteOptions) error {
+	b := newBatch(d)
+	defer b.release()
+	_ = b.SetWithTTL(key, value, ttl, opts)
+	return d.Apply(b, opts)
+}
+
 // Delete deletes the value for the given key. Deletes are blind all will
 // succeed even if the given key does not exist.
 //
@@ -290,6 +359,19 @@ func (d *DB) Delete(key []byte, opts *db.WriteOptions) error {
 	return d.Apply(b, opts)
 }
 
+// SingleDelete adds an action to the batch that single deletes the entry for
+// key. See Writer.SingleDelete for more details on the semantics of
+// SingleDelete.
+//
+// It is safe to modify the contents of the arguments after SingleDelete
+// returns.
+func (d *DB) SingleDelete(key []byte, opts *db.WriteOptions) error {
+	b := newBatch(d)
+	defer b.release()
+	_ = b.SingleDelete(key, opts)
+	return d.Apply(b, opts)
+}
+
 // DeleteRange deletes all of the keys (and values) in the range [start,end)
 // (inclusive on start, exclusive on end).
 //
@@ -335,15 +417,33 @@ func (d *DB) LogData(data []byte, opts *db.WriteOptions) error {
 //
 // It is safe to modify the contents of the arguments after Apply returns.
 func (d *DB) Apply(batch *Batch, opts *db.WriteOptions) error {
+	if d.follower || d.opts.ReadOnly {
+		return ErrReadOnly
+	}
+	return d.apply(batch, opts)
+}
+
+func (d *DB) apply(batch *Batch, opts *db.WriteOptions) error {
 	sync := opts.GetSync()
 	if sync && d.opts.DisableWAL {
 		return errors.New("pebble: WAL disabled")
 	}
 
-	if int(batch.memTableSize) >= d.largeBatchThreshold {
+	if len(batch.cfMemTableSize) > 0 {
+		// Batches containing operations on column families are never flushable
+		// batches, so each portion of the batch must fit in the memtable of its
+		// column family.
+		if err := d.checkColumnFamilyBatch(batch); err != nil {
+			return err
+		}
+	} else if int(batch.memTableSize) >= d.largeBatchThreshold {
 		batch.flushable = newFlushableBatch(batch, d.opts.Comparer)
 	}
 	err := d.commit.Commit(batch, sync)
+	if err == nil && atomic.LoadInt32(&d.changeFeeds.count) > 0 {
+		// The batch is now visible, and can be delivered by the change feeds.
+		d.changeFeeds.notify()
+	}
 	if err == nil {
 		// If this is a large batch, we need to clear the batch contents as the
 		// flushable batch may still be present in the flushables queue.
@@ -354,6 +454,27 @@ func (d *DB) Apply(batch *Batch, opts *db.WriteOptions) error {
 	return err
 }
 
+// checkColumnFamilyBatch verifies that the column families operated on by the
+// batch exist, and that the batch fits in the memtables of the column
+// families.
+func (d *DB) checkColumnFamilyBatch(batch *Batch) error {
+	if int(batch.memTableSize) >= d.largeBatchThreshold {
+		return errors.New("pebble: batch containing column family operations is too large")
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for id, size := range batch.cfMemTableSize {
+		cf := d.mu.columnFamilies[id]
+		if cf == nil || cf.dropped {
+			return ErrColumnFamilyDropped
+		}
+		if int(size) >= cf.largeBatchThreshold {
+			return fmt.Errorf("pebble: batch is too large for column family %q", cf.name)
+		}
+	}
+	return nil
+}
+
 func (d *DB) commitApply(b *Batch, mem *memTable) error {
 	if b.flushable != nil {
 		// This is a large batch which was already added to the immutable queue.
@@ -386,6 +507,13 @@ func (d *DB) commitWrite(b *Batch, wg *sync.WaitGroup) (*memTable, error) {
 
 	if err == nil {
 		d.mu.log.bytesIn += uint64(len(b.storage.data))
+		if atomic.LoadInt32(&d.changeFeeds.count) > 0 {
+			var logNum uint64
+			if !d.opts.DisableWAL {
+				logNum = d.mu.log.queue[len(d.mu.log.queue)-1]
+			}
+			d.changeFeeds.push(b, logNum)
+		}
 	}
 
 	d.mu.Unlock()
@@ -413,6 +541,7 @@ type iterAlloc struct {
 	rangeDelIters   [3 + numLevels]internalIterator
 	largestUserKeys [3 + numLevels][]byte
 	levels          [numLevels]levelIter
+	tailing         tailingState
 }
 
 var iterAllocPool = sync.Pool{
@@ -421,18 +550,18 @@ var iterAllocPool = sync.Pool{
 	},
 }
 
-// newIterInternal constructs a new iterator, merging in batchIter as an extra
-// level.
+// newIterInternal constructs a new iterator, merging in the batch (if non-nil)
+// as an extra level.
 func (d *DB) newIterInternal(
-	batchIter internalIterator,
-	batchRangeDelIter internalIterator,
-	s *Snapshot,
-	o *db.IterOptions,
+	cf *columnFamily, b *Batch, s *Snapshot, o *db.IterOptions,
 ) *Iterator {
 	// Grab and reference the current readState. This prevents the underlying
 	// files in the associated version from being deleted if there is a current
 	// compaction. The readState is unref'd by Iterator.Close().
-	readState := d.loadReadState()
+	readState := cf.loadReadState()
+	if readState == nil {
+		return &Iterator{err: ErrColumnFamilyDropped}
+	}
 
 	// Determine the seqnum to read at after grabbing the read state (current and
 	// memtables) above.
@@ -449,17 +578,38 @@ func (d *DB) newIterInternal(
 	dbi := &buf.dbi
 	dbi.alloc = buf
 	dbi.opts = o
-	dbi.cmp = d.cmp
-	dbi.equal = d.equal
-	dbi.merge = d.merge
+	dbi.cmp = cf.cmp
+	dbi.equal = cf.equal
+	dbi.merge = cf.merge
+	dbi.now = d.opts.Now
+	dbi.blobs = &d.blobs
+	dbi.split = cf.split
 	dbi.readState = readState
+	dbi.iter = &buf.merging
+	dbi.db = d
+	dbi.cf = cf
+	dbi.batch = b
+	dbi.snapshot = s
+	dbi.seqNum = seqNum
+	dbi.initTailing()
+	if err := buf.initMergingIter(cf, b, readState, seqNum, o); err != nil {
+		dbi.err = err
+	}
+	return dbi
+}
 
+// initMergingIter initializes the merging iterator of an Iterator over the
+// specified readState at the specified sequence number, merging in the batch
+// (if non-nil) as an extra level.
+func (buf *iterAlloc) initMergingIter(
+	cf *columnFamily, b *Batch, readState *readState, seqNum uint64, o *db.IterOptions,
+) error {
 	iters := buf.iters[:0]
 	rangeDelIters := buf.rangeDelIters[:0]
 	largestUserKeys := buf.largestUserKeys[:0]
-	if batchIter != nil {
-		iters = append(iters, batchIter)
-		rangeDelIters = append(rangeDelIters, batchRangeDelIter)
+	if b != nil {
+		iters = append(iters, b.newInternalIter(o))
+		rangeDelIters = append(rangeDelIters, b.newRangeDelIter(o))
 		largestUserKeys = append(largestUserKeys, nil)
 	}
 
@@ -478,10 +628,12 @@ func (d *DB) newIterInternal(
 	current := readState.current
 	for i := len(current.files[0]) - 1; i >= 0; i-- {
 		f := &current.files[0][i]
-		iter, rangeDelIter, err := d.newIters(f, o)
+		iter, rangeDelIter, err := cf.newIters(f, o)
 		if err != nil {
-			dbi.err = err
-			return dbi
+			// The iterators constructed so far are closed by Iterator.Close.
+			buf.merging.iters = iters
+			buf.merging.rangeDelIters = rangeDelIters
+			return err
 		}
 		iters = append(iters, iter)
 		rangeDelIters = append(rangeDelIters, rangeDelIter)
@@ -511,12 +663,14 @@ func (d *DB) newIterInternal(
 		var li *levelIter
 		if len(levels) > 0 {
 			li = &levels[0]
+			*li = levelIter{}
 			levels = levels[1:]
 		} else {
 			li = &levelIter{}
 		}
 
-		li.init(o, d.cmp, d.newIters, current.files[level])
+		li.init(o, cf.cmp, cf.newIters, current.files[level])
+		li.initSplit(cf.split)
 		li.initRangeDel(&rangeDelIters[0])
 		li.initLargestUserKey(&largestUserKeys[0])
 		iters = append(iters, li)
@@ -524,10 +678,96 @@ func (d *DB) newIterInternal(
 		largestUserKeys = largestUserKeys[1:]
 	}
 
-	buf.merging.init(d.cmp, iters...)
+	buf.merging.init(cf.cmp, iters...)
 	buf.merging.snapshot = seqNum
-	dbi.iter = &buf.merging
-	return dbi
+	return nil
+}
+
+// refreshMergingIter updates the merging iterator of a tailing Iterator,
+// which was initialized over the readState old, to iterate over the readState
+// cur. The iterators over the memtables are replaced and iterators over the
+// new L0 files are added, while the iterators over the sstables of old are
+// retained. It returns false, leaving the merging iterator unchanged, if the
+// sstables of old are not all present in cur, in which case the merging
+// iterator needs to be rebuilt (see initMergingIter). An error encountered
+// while closing the replaced memtable iterators is returned along with true.
+func (buf *iterAlloc) refreshMergingIter(
+	cf *columnFamily, old, cur *readState, o *db.IterOptions,
+) (bool, error) {
+	oldFiles, curFiles := old.current.files, cur.current.files
+	if len(curFiles[0]) < len(oldFiles[0]) {
+		return false, nil
+	}
+	for level := range oldFiles {
+		n := len(oldFiles[level])
+		if level > 0 && len(curFiles[level]) != n {
+			return false, nil
+		}
+		for j := 0; j < n; j++ {
+			if oldFiles[level][j].fileNum != curFiles[level][j].fileNum {
+				return false, nil
+			}
+		}
+	}
+
+	// The iterators are ordered from newest to oldest: the memtables, the new
+	// L0 files, and then the retained iterators (the old L0 files and the level
+	// iterators).
+	m := &buf.merging
+	numOldMem := len(old.memtables)
+	newL0 := curFiles[0][len(oldFiles[0]):]
+	n := len(cur.memtables) + len(newL0) + len(m.iters) - numOldMem
+	iters := make([]internalIterator, 0, n)
+	rangeDelIters := make([]internalIterator, 0, n)
+	largestUserKeys := make([][]byte, 0, n)
+	for j := len(cur.memtables) - 1; j >= 0; j-- {
+		mem := cur.memtables[j]
+		iters = append(iters, mem.newIter(o))
+		rangeDelIters = append(rangeDelIters, mem.newRangeDelIter(o))
+		largestUserKeys = append(largestUserKeys, nil)
+	}
+	for j := len(newL0) - 1; j >= 0; j-- {
+		iter, rangeDelIter, err := cf.newIters(&newL0[j], o)
+		if err != nil {
+			closeIters(iters, rangeDelIters)
+			return false, err
+		}
+		iters = append(iters, iter)
+		rangeDelIters = append(rangeDelIters, rangeDelIter)
+		largestUserKeys = append(largestUserKeys, nil)
+	}
+	retained := len(iters)
+	iters = append(iters, m.iters[numOldMem:]...)
+	rangeDelIters = append(rangeDelIters, m.rangeDelIters[numOldMem:]...)
+	largestUserKeys = append(largestUserKeys, m.largestUserKeys[numOldMem:]...)
+	err := closeIters(m.iters[:numOldMem], m.rangeDelIters[:numOldMem])
+
+	// The level iterators refer to their entries in the range deletion
+	// iterators and largest user keys, which have moved.
+	for j := retained + len(oldFiles[0]); j < len(iters); j++ {
+		li := iters[j].(*levelIter)
+		li.initRangeDel(&rangeDelIters[j])
+		li.initLargestUserKey(&largestUserKeys[j])
+	}
+	m.rangeDelIters = rangeDelIters
+	m.largestUserKeys = largestUserKeys
+	m.init(cf.cmp, iters...)
+	return true, err
+}
+
+// closeIters closes the specified point and (non-nil) range deletion
+// iterators, returning the first error encountered.
+func closeIters(iters, rangeDelIters []internalIterator) error {
+	var err error
+	for _, iter := range iters {
+		err = firstError(err, iter.Close())
+	}
+	for _, iter := range rangeDelIters {
+		if iter != nil {
+			err = firstError(err, iter.Close())
+		}
+	}
+	return err
 }
 
 // NewBatch returns a new empty write-only batch. Any reads on the batch will
@@ -554,8 +794,7 @@ func (d *DB) NewIndexedBatch() *Batch {
 // apparent memory and disk usage leak. Use snapshots (see NewSnapshot) for
 // point-in-time snapshots which avoids these problems.
 func (d *DB) NewIter(o *db.IterOptions) *Iterator {
-	return d.newIterInternal(nil, /* batchIter */
-		nil /* batchRangeDelIter */, nil /* snapshot */, o)
+	return d.newIterInternal(&d.columnFamily, nil /* batch */, nil /* snapshot */, o)
 }
 
 // NewSnapshot returns a point-in-time view of the current DB state. Iterators
@@ -591,28 +830,41 @@ func (d *DB) Close() error {
 	for d.mu.compact.compacting || d.mu.compact.flushing {
 		d.mu.compact.cond.Wait()
 	}
-	err := d.tableCache.Close()
-	err = firstError(err, d.mu.log.Close())
-	err = firstError(err, d.fileLock.Close())
+	var err error
+	err = firstError(err, d.tableCache.Close())
+	err = firstError(err, d.blobs.Close())
+	d.changeFeeds.close()
+	if d.mu.log.LogWriter != nil {
+		err = firstError(err, d.mu.log.Close())
+	}
+	if d.fileLock != nil {
+		err = firstError(err, d.fileLock.Close())
+	}
 	d.commit.Close()
 	d.mu.closed = true
 
 	err = firstError(err, d.dataDir.Close())
 
 	if err == nil {
-		d.readState.val.unrefLocked()
-
-		current := d.mu.versions.currentVersion()
-		for v := d.mu.versions.versions.front(); true; v = v.next {
-			refs := atomic.LoadInt32(&v.refs)
-			if v == current {
-				if refs != 1 {
-					return fmt.Errorf("leaked iterators: current\n%s", v)
-				}
-				break
+		for _, cf := range d.mu.columnFamilies {
+			if cf.readState.val != nil {
+				cf.readState.val.unrefLocked()
 			}
-			if refs != 0 {
-				return fmt.Errorf("leaked iterators:\n%s", v)
+		}
+
+		for _, cf := range d.mu.versions.columnFamilies {
+			current := cf.currentVersion()
+			for v := cf.versions.front(); true; v = v.next {
+				refs := atomic.LoadInt32(&v.refs)
+				if v == current {
+					if refs != 1 {
+						return fmt.Errorf("leaked iterators: current\n%s", v)
+					}
+					break
+				}
+				if refs != 0 {
+					return fmt.Errorf("leaked iterators:\n%s", v)
+				}
 			}
 		}
 	}
@@ -621,23 +873,39 @@ func (d *DB) Close() error {
 
 // Compact the specified range of keys in the database.
 func (d *DB) Compact(start, end []byte /* CompactionOptions */) error {
+	return d.compactRange(&d.columnFamily, start, end)
+}
+
+// compactRange compacts the specified range of keys in the column family.
+func (d *DB) compactRange(cf *columnFamily, start, end []byte) error {
+	if d.opts.ReadOnly {
+		return ErrReadOnly
+	}
 	iStart := db.MakeInternalKey(start, db.InternalKeySeqNumMax, db.InternalKeyKindMax)
 	iEnd := db.MakeInternalKey(end, 0, 0)
 	meta := []*fileMetadata{&fileMetadata{smallest: iStart, largest: iEnd}}
 
 	d.mu.Lock()
+	if cf.dropped {
+		d.mu.Unlock()
+		return ErrColumnFamilyDropped
+	}
 	maxLevelWithFiles := 1
-	cur := d.mu.versions.currentVersion()
+	cur := cf.versions.currentVersion()
 	for level := 0; level < numLevels; level++ {
-		if len(cur.overlaps(level, d.cmp, start, end)) > 0 {
+		if len(cur.overlaps(level, cf.cmp, start, end)) > 0 {
 			maxLevelWithFiles = level + 1
 		}
 	}
 
 	// Determine if any memtable overlaps with the compaction range. We wait for
 	// any such overlap to flush (initiating a flush if necessary).
+	overlaps := func(mem flushable) bool {
+		m := cf.memTable(mem)
+		return m != nil && ingestMemtableOverlaps(cf.cmp, m, meta)
+	}
 	mem, err := func() (flushable, error) {
-		if ingestMemtableOverlaps(d.cmp, d.mu.mem.mutable, meta) {
+		if overlaps(d.mu.mem.mutable) {
 			mem := d.mu.mem.mutable
 			return mem, d.makeRoomForWrite(nil)
 		}
@@ -646,7 +914,7 @@ func (d *DB) Compact(start, end []byte /* CompactionOptions */) error {
 		// for the newest table that overlaps.
 		for i := len(d.mu.mem.queue) - 1; i >= 0; i-- {
 			mem := d.mu.mem.queue[i]
-			if ingestMemtableOverlaps(d.cmp, mem, meta) {
+			if overlaps(mem) {
 				return mem, nil
 			}
 		}
@@ -664,6 +932,7 @@ func (d *DB) Compact(start, end []byte /* CompactionOptions */) error {
 
 	for level := 0; level < maxLevelWithFiles; {
 		manual := &manualCompaction{
+			cf:    cf,
 			done:  make(chan error, 1),
 			level: level,
 			start: iStart,
@@ -690,8 +959,85 @@ func (d *DB) manualCompact(manual *manualCompaction) error {
 	return <-manual.done
 }
 
+// DeleteFilesInRange deletes all of the keys (and values) in the range
+// [start,end) (inclusive on start, exclusive on end), immediately reclaiming
+// the space used by sstables which are fully contained within the range. A
+// range deletion tombstone is written for the keys in sstables which
+// partially overlap the range, and the contained sstables are then removed
+// from the LSM without being compacted.
+//
+// Snapshots which predate the call to DeleteFilesInRange may no longer see
+// the keys contained in the removed sstables.
+func (d *DB) DeleteFilesInRange(start, end []byte) error {
+	opts := db.Sync
+	if d.opts.DisableWAL {
+		opts = db.NoSync
+	}
+	b := newBatch(d)
+	defer b.release()
+	_ = b.DeleteRange(start, end, opts)
+	if err := d.Apply(b, opts); err != nil {
+		return err
+	}
+	// Only sstables which are older than the range tombstone can be removed.
+	// Newer sstables (such as the one containing the range tombstone after a
+	// flush) need to be retained.
+	seqNum := b.seqNum()
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	// Wait for any running compaction to finish and prevent new compactions
+	// from starting while the version edit is applied, as the compaction might
+	// otherwise use an sstable which is being removed.
+	for d.mu.compact.compacting {
+		d.mu.compact.cond.Wait()
+	}
+	d.mu.compact.compacting = true
+	defer func() {
+		d.mu.compact.compacting = false
+		d.maybeScheduleCompaction()
+		d.mu.compact.cond.Broadcast()
+	}()
+
+	ve := &versionEdit{
+		deletedFiles: map[deletedFileEntry]bool{},
+	}
+	current := d.mu.versions.currentVersion()
+	for level := range current.files {
+		for _, f := range current.overlaps(level, d.cmp, start, end) {
+			if f.largestSeqNum >= seqNum || d.cmp(start, f.smallest.UserKey) > 0 {
+				continue
+			}
+			// The end of the range is exclusive. A range tombstone ending at end
+			// results in a largest key of end with the sentinel trailer, which is
+			// also exclusive.
+			if c := d.cmp(f.largest.UserKey, end); c > 0 ||
+				(c == 0 && f.largest.Trailer != db.InternalKeyRangeDeleteSentinel) {
+				continue
+			}
+			ve.deletedFiles[deletedFileEntry{level: level, fileNum: f.fileNum}] = true
+		}
+	}
+	if len(ve.deletedFiles) == 0 {
+		return nil
+	}
+
+	jobID := d.mu.nextJobID
+	d.mu.nextJobID++
+	if err := d.mu.versions.logAndApply(jobID, ve, d.dataDir); err != nil {
+		return err
+	}
+	d.updateReadStateLocked()
+	d.deleteObsoleteFiles(jobID)
+	return nil
+}
+
 // Flush the memtable to stable storage.
 func (d *DB) Flush() error {
+	if d.opts.ReadOnly {
+		return ErrReadOnly
+	}
 	d.mu.Lock()
 	mem := d.mu.mem.mutable
 	err := d.makeRoomForWrite(nil)
@@ -707,6 +1053,9 @@ func (d *DB) Flush() error {
 //
 // TODO(peter): untested
 func (d *DB) AsyncFlush() error {
+	if d.opts.ReadOnly {
+		return ErrReadOnly
+	}
 	d.mu.Lock()
 	err := d.makeRoomForWrite(nil)
 	d.mu.Unlock()
@@ -750,7 +1099,7 @@ func (d *DB) walPreallocateSize() int {
 }
 
 func (d *DB) throttleWrite() {
-	if len(d.mu.versions.currentVersion().files[0]) <= d.opts.L0SlowdownWritesThreshold {
+	if d.mu.versions.numL0Files() <= d.opts.L0SlowdownWritesThreshold {
 		return
 	}
 	// fmt.Printf("L0 slowdown writes threshold\n")
@@ -790,7 +1139,7 @@ func (d *DB) makeRoomForWrite(b *Batch) error {
 			d.mu.compact.cond.Wait()
 			continue
 		}
-		if len(d.mu.versions.currentVersion().files[0]) > d.opts.L0StopWritesThreshold {
+		if d.mu.versions.numL0Files() > d.opts.L0StopWritesThreshold {
 			// There are too many level-0 files, so we wait.
 			// fmt.Printf("L0 stop writes threshold\n")
 			d.mu.compact.cond.Wait()
@@ -901,7 +1250,7 @@ func (d *DB) makeRoomForWrite(b *Batch) error {
 		// also have to wait for all previous immutable tables to
 		// flush. Additionally, the memtable is tied to particular WAL file and we
 		// want to go through the flush path in order to recycle that WAL file.
-		d.mu.mem.mutable = newMemTable(d.opts)
+		d.mu.mem.mutable = d.newMemTableLocked()
 		// NB: When the immutable memtable is flushed to disk it will apply a
 		// versionEdit to the manifest telling it that log files < newLogNumber
 		// have been applied. newLogNumber corresponds to the WAL that contains
@@ -916,6 +1265,23 @@ func (d *DB) makeRoomForWrite(b *Batch) error {
 	}
 }
 
+// newMemTableLocked returns a new memtable for the default column family
+// which holds a memtable for each of the other column families. Requires
+// DB.mu is held.
+func (d *DB) newMemTableLocked() *memTable {
+	m := newMemTable(d.opts)
+	for id, cf := range d.mu.columnFamilies {
+		if id == 0 || cf.dropped {
+			continue
+		}
+		if m.columnFamilies == nil {
+			m.columnFamilies = make(map[uint32]*memTable)
+		}
+		m.columnFamilies[id] = newMemTable(cf.opts)
+	}
+	return m
+}
+
 // firstError returns the first non-nil error of err0 and err1, or nil if both
 // are nil.
 func firstError(err0, err1 error) error {
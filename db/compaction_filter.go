@@ -0,0 +1,68 @@
+// Copyright 2019 The LevelDB-Go and Pebble Authors. All rights reserved. Use
+// of this source code is governed by a BSD-style license that can be found in
+// the LICENSE file.
+
+package db
+
+// CompactionFilterDecision is the decision of a CompactionFilter for an entry.
+type CompactionFilterDecision int
+
+// The available compaction filter decisions.
+const (
+	// CompactionFilterKeep keeps the entry unchanged.
+	CompactionFilterKeep CompactionFilterDecision = iota
+	// CompactionFilterRemove removes the entry. The entry is replaced by a
+	// deletion tombstone, which shadows the older entries for the key, unless
+	// it is known that no older entries exist.
+	CompactionFilterRemove
+	// CompactionFilterChangeValue replaces the value of the entry with the
+	// value returned by the filter.
+	CompactionFilterChangeValue
+)
+
+// CompactionFilterContext describes the compaction (or flush) during which a
+// CompactionFilter is invoked.
+type CompactionFilterContext struct {
+	// Flush is true if the entries are being flushed from a memtable rather
+	// than compacted.
+	Flush bool
+	// Bottommost is true if there are no entries at lower levels of the LSM
+	// which overlap the key range of the compaction. That is, the compaction
+	// is producing the oldest versions of its keys.
+	Bottommost bool
+	// OutputLevel is the level of the LSM the compaction is writing to.
+	OutputLevel int
+}
+
+// CompactionFilter is invoked during compactions for the value of each user
+// key, and can keep, remove or rewrite the value. This allows data which is no
+// longer needed (e.g. expired versions of MVCC keys) to be garbage collected
+// in the background.
+//
+// Only the latest value of a key which is set by a SET entry, and which is not
+// visible to any snapshot, is passed to the filter: the entries which are
+// visible to a snapshot are left unchanged. The value of an entry written by
+// SetWithTTL is passed without its expiration time, which is kept if the
+// value is changed. Merge operands, the values merged from them during the
+// compaction, and deletions are not passed to the filter.
+//
+// Tables which are moved to a lower level without being rewritten are not
+// filtered. The filter may be invoked concurrently by several compactions,
+// and must not call back into the DB.
+type CompactionFilter interface {
+	// Filter returns the decision for the entry with the specified key and
+	// value, along with the new value if the decision is
+	// CompactionFilterChangeValue. The key and value must not be retained or
+	// modified.
+	Filter(ctx CompactionFilterContext, key, value []byte) (CompactionFilterDecision, []byte)
+
+	// Name returns the name of the filter.
+	Name() string
+}
+
+func compactionFilterName(f CompactionFilter) string {
+	if f == nil {
+		return "none"
+	}
+	return f.Name()
+}
@@ -213,6 +213,31 @@ func (i WALCreateInfo) String() string {
 		i.JobID, i.FileNum, i.RecycledFileNum)
 }
 
+// WALCorruptionInfo contains the info for a WAL corruption event, which
+// reports the contents of a WAL which were dropped due to corruption when the
+// WAL was replayed (see Options.WALRecoveryMode).
+type WALCorruptionInfo struct {
+	Path    string
+	FileNum uint64
+	// SeqNum is the sequence number following the last batch replayed from the
+	// WAL before the dropped contents, or zero if no batch was replayed.
+	SeqNum uint64
+	// Tail is true if the remainder of the WAL was dropped, and false if only
+	// the corrupted records were skipped.
+	Tail bool
+	// Err is the corruption which caused the contents to be dropped.
+	Err error
+}
+
+func (i WALCorruptionInfo) String() string {
+	if i.Tail {
+		return fmt.Sprintf("WAL %06d corrupted: dropped tail after sequence number %d: %s",
+			i.FileNum, i.SeqNum, i.Err)
+	}
+	return fmt.Sprintf("WAL %06d corrupted: skipped records after sequence number %d: %s",
+		i.FileNum, i.SeqNum, i.Err)
+}
+
 // WALDeleteInfo contains the info for a WAL deletion event.
 type WALDeleteInfo struct {
 	// JobID is the ID of the job the caused the WAL to be deleted.
@@ -272,6 +297,10 @@ type EventListener struct {
 	// WALCreated is invoked after a WAL has been created.
 	WALCreated func(WALCreateInfo)
 
+	// WALCorruption is invoked when corrupted contents of a WAL are dropped
+	// while the WAL is replayed.
+	WALCorruption func(WALCorruptionInfo)
+
 	// WALDeleted is invoked after a WAL has been deleted.
 	WALDeleted func(WALDeleteInfo)
 }
@@ -325,6 +354,9 @@ func MakeLoggingEventListener(logger Logger) EventListener {
 		WALCreated: func(info WALCreateInfo) {
 			logger.Infof("%s", info.String())
 		},
+		WALCorruption: func(info WALCorruptionInfo) {
+			logger.Infof("%s", info.String())
+		},
 		WALDeleted: func(info WALDeleteInfo) {
 			logger.Infof("%s", info.String())
 		},
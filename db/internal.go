@@ -18,24 +18,33 @@ type InternalKeyKind uint8
 
 // These constants are part of the file format, and should not be changed.
 const (
-	InternalKeyKindDelete  InternalKeyKind = 0
-	InternalKeyKindSet                     = 1
-	InternalKeyKindMerge                   = 2
-	InternalKeyKindLogData                 = 3
-	// InternalKeyKindColumnFamilyDeletion                     = 4
-	// InternalKeyKindColumnFamilyValue                        = 5
-	// InternalKeyKindColumnFamilyMerge                        = 6
-	// InternalKeyKindSingleDelete                             = 7
-	// InternalKeyKindColumnFamilySingleDelete                 = 8
-	// InternalKeyKindBeginPrepareXID                          = 9
-	// InternalKeyKindEndPrepareXID                            = 10
-	// InternalKeyKindCommitXID                                = 11
-	// InternalKeyKindRollbackXID                              = 12
+	InternalKeyKindDelete                   InternalKeyKind = 0
+	InternalKeyKindSet                                      = 1
+	InternalKeyKindMerge                                    = 2
+	InternalKeyKindLogData                                  = 3
+	InternalKeyKindColumnFamilyDeletion                     = 4
+	InternalKeyKindColumnFamilyValue                        = 5
+	InternalKeyKindColumnFamilyMerge                        = 6
+	InternalKeyKindSingleDelete                             = 7
+	InternalKeyKindColumnFamilySingleDelete                 = 8
+	InternalKeyKindBeginPrepareXID                          = 9
+	InternalKeyKindEndPrepareXID                            = 10
+	InternalKeyKindCommitXID                                = 11
+	InternalKeyKindRollbackXID                              = 12
 	// InternalKeyKindNoop                                     = 13
-	// InternalKeyKindColumnFamilyRangeDelete                  = 14
-	InternalKeyKindRangeDelete = 15
+	InternalKeyKindColumnFamilyRangeDelete = 14
+	InternalKeyKindRangeDelete             = 15
 	// InternalKeyKindColumnFamilyBlobIndex                    = 16
-	// InternalKeyKindBlobIndex                                = 17
+
+	// InternalKeyKindBlobIndex is a SET whose value is stored in a blob file,
+	// and which carries a reference to the value in place of the value.
+	InternalKeyKindBlobIndex = 17
+
+	// InternalKeyKindSetWithExpiry is a SET whose value is prefixed by the time
+	// at which the entry expires. The kinds below 0x80 are reserved for those
+	// defined by RocksDB (whose largest kind is 0x7F), so the kinds which are
+	// specific to Pebble are numbered from 0x80.
+	InternalKeyKindSetWithExpiry = 0x80
 
 	// This maximum value isn't part of the file format. It's unlikely,
 	// but future extensions may increase this value.
@@ -67,13 +76,28 @@ const (
 )
 
 var internalKeyKindNames = []string{
-	InternalKeyKindDelete:      "DEL",
-	InternalKeyKindSet:         "SET",
-	InternalKeyKindMerge:       "MERGE",
-	InternalKeyKindLogData:     "LOGDATA",
-	InternalKeyKindRangeDelete: "RANGEDEL",
-	InternalKeyKindMax:         "MAX",
-	InternalKeyKindInvalid:     "INVALID",
+	InternalKeyKindDelete:          "DEL",
+	InternalKeyKindSet:             "SET",
+	InternalKeyKindMerge:           "MERGE",
+	InternalKeyKindLogData:         "LOGDATA",
+	InternalKeyKindSingleDelete:    "SINGLEDEL",
+	InternalKeyKindBeginPrepareXID: "BEGINPREPARE",
+	InternalKeyKindEndPrepareXID:   "ENDPREPARE",
+	InternalKeyKindCommitXID:       "COMMIT",
+	InternalKeyKindRollbackXID:     "ROLLBACK",
+	InternalKeyKindRangeDelete:     "RANGEDEL",
+	InternalKeyKindBlobIndex:       "BLOBINDEX",
+	InternalKeyKindSetWithExpiry:   "SETEXPIRY",
+	InternalKeyKindInvalid:         "INVALID",
+}
+
+// Valid returns true if the kind is valid. InternalKeyKindSetWithExpiry is
+// valid despite being larger than InternalKeyKindMax, whose value is retained
+// for compatibility with the index blocks of sstables written by RocksDB. The
+// kinds which are larger than InternalKeyKindMax sort before it, which does
+// not affect searching as search keys also have the maximal sequence number.
+func (k InternalKeyKind) Valid() bool {
+	return k <= InternalKeyKindMax || k == InternalKeyKindSetWithExpiry
 }
 
 func (k InternalKeyKind) String() string {
@@ -130,12 +154,15 @@ func MakeRangeDeleteSentinelKey(userKey []byte) InternalKey {
 }
 
 var kindsMap = map[string]InternalKeyKind{
-	"DEL":      InternalKeyKindDelete,
-	"RANGEDEL": InternalKeyKindRangeDelete,
-	"SET":      InternalKeyKindSet,
-	"MERGE":    InternalKeyKindMerge,
-	"INVALID":  InternalKeyKindInvalid,
-	"MAX":      InternalKeyKindMax,
+	"DEL":       InternalKeyKindDelete,
+	"SINGLEDEL": InternalKeyKindSingleDelete,
+	"RANGEDEL":  InternalKeyKindRangeDelete,
+	"SET":       InternalKeyKindSet,
+	"MERGE":     InternalKeyKindMerge,
+	"SETEXPIRY": InternalKeyKindSetWithExpiry,
+	"INVALID":   InternalKeyKindInvalid,
+	"BLOBINDEX": InternalKeyKindBlobIndex,
+	"MAX":       InternalKeyKindMax,
 }
 
 // ParseInternalKey parses the string representation of an internal key. The
@@ -287,7 +314,7 @@ func (k InternalKey) Kind() InternalKeyKind {
 
 // Valid returns true if the key has a valid kind.
 func (k InternalKey) Valid() bool {
-	return k.Kind() <= InternalKeyKindMax
+	return k.Kind().Valid()
 }
 
 // Clone clones the storage for the UserKey component of the key.
@@ -13,6 +13,7 @@ import (
 // Logger defines an interface for writing log messages.
 type Logger interface {
 	Infof(format string, args ...interface{})
+	Errorf(format string, args ...interface{})
 	Fatalf(format string, args ...interface{})
 }
 
@@ -22,6 +23,10 @@ func (defaultLogger) Infof(format string, args ...interface{}) {
 	_ = log.Output(2, fmt.Sprintf(format, args...))
 }
 
+func (defaultLogger) Errorf(format string, args ...interface{}) {
+	_ = log.Output(2, "ERROR: "+fmt.Sprintf(format, args...))
+}
+
 func (defaultLogger) Fatalf(format string, args ...interface{}) {
 	_ = log.Output(2, fmt.Sprintf(format, args...))
 	os.Exit(1)
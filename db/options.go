@@ -7,7 +7,9 @@ package db
 import (
 	"bytes"
 	"fmt"
+	"math"
 	"strings"
+	"time"
 
 	"github.com/petermattis/pebble/cache"
 	"github.com/petermattis/pebble/vfs"
@@ -41,13 +43,19 @@ type FilterType int
 
 // The available filter types.
 const (
+	// TableFilter is a single filter over all of the keys in a table.
 	TableFilter FilterType = iota
+	// BlockFilter is a sequence of filters, each of which covers the keys of
+	// the data blocks within a 2KB range of the table.
+	BlockFilter
 )
 
 func (t FilterType) String() string {
 	switch t {
 	case TableFilter:
 		return "table"
+	case BlockFilter:
+		return "block"
 	}
 	return "unknown"
 }
@@ -108,6 +116,46 @@ const (
 	TableFormatLevelDB
 )
 
+// WALRecoveryMode specifies how corruption of the write-ahead logs is handled
+// when the logs are replayed as the DB is opened. The contents of a log which
+// are dropped due to corruption are reported by EventListener.WALCorruption.
+type WALRecoveryMode int
+
+// The available WAL recovery modes.
+const (
+	// WALRecoveryTolerateCorruptedTailRecords drops a corrupted or partially
+	// written record at the tail of a log, as left behind by a crash during a
+	// write. Corruption followed by valid records is an error.
+	WALRecoveryTolerateCorruptedTailRecords WALRecoveryMode = iota
+	// WALRecoveryAbsoluteConsistency treats any corruption, including a
+	// partially written record at the tail of a log, as an error. Log
+	// recycling is disabled in this mode, as recycled logs contain the
+	// remains of their previous contents.
+	WALRecoveryAbsoluteConsistency
+	// WALRecoveryPointInTime stops replaying at the first corruption, dropping
+	// the remainder of the corrupted log and all of the subsequent logs. The
+	// DB is recovered to a consistent point in time.
+	WALRecoveryPointInTime
+	// WALRecoverySkipAnyCorruptedRecords skips the corrupted records and
+	// replays the records following them. The batches in the corrupted
+	// records are lost, which may leave the DB in an inconsistent state.
+	WALRecoverySkipAnyCorruptedRecords
+)
+
+func (m WALRecoveryMode) String() string {
+	switch m {
+	case WALRecoveryTolerateCorruptedTailRecords:
+		return "tolerate-corrupted-tail-records"
+	case WALRecoveryAbsoluteConsistency:
+		return "absolute-consistency"
+	case WALRecoveryPointInTime:
+		return "point-in-time"
+	case WALRecoverySkipAnyCorruptedRecords:
+		return "skip-any-corrupted-records"
+	}
+	return "unknown"
+}
+
 // LevelOptions holds the optional per-level parameters.
 type LevelOptions struct {
 	// BlockRestartInterval is the number of keys between restart points
@@ -151,6 +199,16 @@ type LevelOptions struct {
 	// filters should be preferred except under constrained memory situations.
 	FilterType FilterType
 
+	// IndexBlockSize is the target uncompressed size in bytes of each index
+	// block. When the index of a table is larger than this target, the index is
+	// partitioned: a two-level index is written, in which a top-level index
+	// block points to the index partitions. Only the top-level index is pinned
+	// by an open table, while the partitions are loaded through the block cache
+	// like data blocks.
+	//
+	// The default value (math.MaxInt32) disables partitioned indexes.
+	IndexBlockSize int
+
 	// The target file size for the level.
 	TargetFileSize int64
 }
@@ -174,12 +232,75 @@ func (o *LevelOptions) EnsureDefaults() *LevelOptions {
 	if o.Compression <= DefaultCompression || o.Compression >= nCompression {
 		o.Compression = SnappyCompression
 	}
+	if o.IndexBlockSize <= 0 {
+		o.IndexBlockSize = math.MaxInt32
+	}
 	if o.TargetFileSize <= 0 {
 		o.TargetFileSize = 2 << 20 // 2 MB
 	}
 	return o
 }
 
+// TablePropertyCollector provides a hook for collecting user-defined
+// properties based on the keys and values stored in an sstable. A new
+// TablePropertyCollector is created for an sstable when the sstable is being
+// written.
+type TablePropertyCollector interface {
+	// Add is called with each new entry added to the sstable. While the sstable
+	// is itself sorted by key, do not assume that the entries are added in any
+	// order. In particular, the ordering of point entries and range tombstones
+	// is unspecified.
+	Add(key InternalKey, value []byte) error
+
+	// Finish is called when all entries have been added to the sstable. The
+	// collected properties (if any) should be added to the specified map. Note
+	// that in case of an error during sstable construction, Finish may not be
+	// called.
+	Finish(userProps map[string]string) error
+
+	// The name of the property collector.
+	Name() string
+}
+
+// BlockPropertyCollector provides a hook for collecting user-defined
+// properties for each data block in an sstable. The properties are stored
+// alongside the index entry for the block and can be used by a
+// BlockPropertyFilter to skip data blocks during iteration. A new
+// BlockPropertyCollector is created for an sstable when the sstable is being
+// written.
+type BlockPropertyCollector interface {
+	// Add is called with each new point entry added to the current data
+	// block. Range tombstones are not stored in data blocks and are not passed
+	// to Add.
+	Add(key InternalKey, value []byte) error
+
+	// FinishDataBlock is called when all the entries have been added to the
+	// current data block. The returned property is stored with the index entry
+	// for the block. The collector should reset its per-block state so that it
+	// can be used for the next data block.
+	FinishDataBlock() ([]byte, error)
+
+	// The name of the property collector. The name is used to match a
+	// BlockPropertyFilter with the properties it consumes and must not contain
+	// commas.
+	Name() string
+}
+
+// BlockPropertyFilter is used by an iterator to skip data blocks based on the
+// properties collected by the BlockPropertyCollector with the same name.
+type BlockPropertyFilter interface {
+	// Intersects returns true if the data block described by prop may contain
+	// entries of interest to the iterator and false if the block can be
+	// skipped. Intersects is not called for blocks in sstables that were
+	// written without the corresponding collector; such blocks are never
+	// skipped.
+	Intersects(prop []byte) (bool, error)
+
+	// The name of the BlockPropertyCollector whose properties the filter
+	// consumes.
+	Name() string
+}
+
 // Options holds the optional parameters for configuring pebble. These options
 // apply to the DB at large; per-query options are defined by the ReadOptions
 // and WriteOptions types.
@@ -192,6 +313,28 @@ type Options struct {
 	// The default value is 512KB.
 	BytesPerSync int
 
+	// CompactionFilter is invoked for the value of each user key during
+	// compactions, and can keep, remove or rewrite the value (see
+	// CompactionFilter). Merge operands are not filtered.
+	//
+	// The default value means to use no filter.
+	CompactionFilter CompactionFilter
+
+	// CompactionFilterOnFlush specifies whether the CompactionFilter is also
+	// invoked when memtables are flushed.
+	//
+	// The default value is false.
+	CompactionFilterOnFlush bool
+
+	// ColumnFamilies holds the options for the column families of the DB,
+	// keyed by column family name. The options for every column family which
+	// exists in the DB must be specified when the DB is opened. Only the
+	// options which pertain to the LSM of a column family are used (e.g.
+	// Comparer, Merger, Levels, LBaseMaxBytes, L0CompactionThreshold and
+	// MemTableSize). The remaining options are taken from the options of the
+	// DB.
+	ColumnFamilies map[string]*Options
+
 	// TODO(peter): provide a cache interface.
 	Cache *cache.Cache
 
@@ -279,6 +422,50 @@ type Options struct {
 	// The default merger concatenates values.
 	Merger *Merger
 
+	// Now returns the current time, which determines whether the entries
+	// written with a TTL (see pebble.Batch.SetWithTTL) have expired. Expired
+	// entries are hidden from reads, and dropped by compactions.
+	//
+	// The default value is time.Now.
+	Now func() time.Time
+
+	// MinBlobSize is the size above which values are separated from their keys
+	// and stored in blob files, which are referenced from the sstables. Such
+	// values are written when their keys are flushed, and are not rewritten by
+	// most compactions, which reduces the write amplification of large values.
+	// A value smaller than MinBlobSize is stored in the sstables.
+	//
+	// The default value is 0, which disables the separation of values.
+	MinBlobSize int
+
+	// BlobGCAgeCutoff is the fraction of the oldest blob files whose values are
+	// relocated to new blob files when they are read by a compaction. A blob
+	// file is deleted once it is no longer referenced by any sstable, and the
+	// relocation ensures that the space used by the obsolete values in old blob
+	// files is reclaimed. A negative value disables the relocation of values.
+	//
+	// The default value is 0.25.
+	BlobGCAgeCutoff float64
+
+	// BlobGCForceThreshold is the fraction of a blob file, among the oldest
+	// blob files selected by BlobGCAgeCutoff, which must be obsolete for the
+	// sstables referencing it to be compacted, relocating their values so that
+	// the blob file can be deleted. A negative value disables the compactions,
+	// leaving the blob file to be relocated by compactions picked for other
+	// reasons.
+	//
+	// The default value is 0.5.
+	BlobGCForceThreshold float64
+
+	// ReadOnly indicates that the DB should be opened in read-only mode. Opening
+	// a DB in read-only mode does not modify any of its files: the WAL is
+	// replayed into memtables rather than flushed, and no flushes, compactions
+	// or deletions of obsolete files are performed. Writes to a read-only DB
+	// return an error. The DB must already exist.
+	//
+	// The default value is false.
+	ReadOnly bool
+
 	// TableFormat specifies the format version for sstables. The default is
 	// TableFormatRocksDBv2 which creates RocksDB compatible sstables. Use
 	// TableFormatLevelDB to create LevelDB compatible sstable which can be used
@@ -289,10 +476,41 @@ type Options struct {
 	// sstable directly, and not used when opening a database.
 	TableFormat TableFormat
 
+	// BlockPropertyCollectors is a list of BlockPropertyCollector creation
+	// functions. A new BlockPropertyCollector is created for each sstable
+	// built and lives for the lifetime of the table. The collected properties
+	// are stored with the index entries of the sstable's data blocks (see
+	// IterOptions.BlockPropertyFilters).
+	BlockPropertyCollectors []func() BlockPropertyCollector
+
+	// TablePropertyCollectors is a list of TablePropertyCollector creation
+	// functions. A new TablePropertyCollector is created for each sstable built
+	// and lives for the lifetime of the table. The collected properties are
+	// stored in the sstable's user properties (see
+	// sstable.Properties.UserProperties).
+	TablePropertyCollectors []func() TablePropertyCollector
+
 	// WALDir specifies the directory to store write-ahead logs (WALs) in. If
 	// empty (the default), WALs will be stored in the same directory as sstables
 	// (i.e. the directory passed to pebble.Open).
 	WALDir string
+
+	// WALArchiveTTL and WALArchiveSizeLimit enable the archival of obsolete
+	// write-ahead logs. If either is non-zero, a WAL which is no longer needed
+	// for recovery is moved into the "archive" subdirectory of the WAL
+	// directory rather than being deleted or recycled. Archived WALs are deleted
+	// once they have not been modified for longer than WALArchiveTTL (if
+	// non-zero), and the oldest archived WALs are deleted while the total size
+	// of the archive exceeds WALArchiveSizeLimit (if non-zero). See
+	// pebble.DB.ArchivedLogs.
+	WALArchiveTTL       time.Duration
+	WALArchiveSizeLimit int64
+
+	// WALRecoveryMode specifies how corruption of the WAL is handled when the
+	// DB is opened.
+	//
+	// The default value is WALRecoveryTolerateCorruptedTailRecords.
+	WALRecoveryMode WALRecoveryMode
 }
 
 // EnsureDefaults ensures that the default values for all options are set if a
@@ -301,6 +519,12 @@ func (o *Options) EnsureDefaults() *Options {
 	if o == nil {
 		o = &Options{}
 	}
+	if o.BlobGCAgeCutoff == 0 {
+		o.BlobGCAgeCutoff = 0.25
+	}
+	if o.BlobGCForceThreshold == 0 {
+		o.BlobGCForceThreshold = 0.5
+	}
 	if o.BytesPerSync <= 0 {
 		o.BytesPerSync = 512 << 10
 	}
@@ -354,6 +578,9 @@ func (o *Options) EnsureDefaults() *Options {
 	if o.Merger == nil {
 		o.Merger = DefaultMerger
 	}
+	if o.Now == nil {
+		o.Now = time.Now
+	}
 	if o.FS == nil {
 		o.FS = vfs.Default
 	}
@@ -380,8 +607,22 @@ func (o *Options) String() string {
 	fmt.Fprintf(&buf, "  pebble_version=0.1\n")
 	fmt.Fprintf(&buf, "\n")
 	fmt.Fprintf(&buf, "[Options]\n")
+	fmt.Fprintf(&buf, "  blob_gc_age_cutoff=%g\n", o.BlobGCAgeCutoff)
+	fmt.Fprintf(&buf, "  blob_gc_force_threshold=%g\n", o.BlobGCForceThreshold)
+	if len(o.BlockPropertyCollectors) > 0 {
+		fmt.Fprintf(&buf, "  block_property_collectors=[")
+		for i := range o.BlockPropertyCollectors {
+			if i > 0 {
+				fmt.Fprintf(&buf, ",")
+			}
+			// NB: Creation of property collectors is expected to be cheap.
+			fmt.Fprintf(&buf, "%s", o.BlockPropertyCollectors[i]().Name())
+		}
+		fmt.Fprintf(&buf, "]\n")
+	}
 	fmt.Fprintf(&buf, "  bytes_per_sync=%d\n", o.BytesPerSync)
 	fmt.Fprintf(&buf, "  cache_size=%d\n", o.Cache.MaxSize())
+	fmt.Fprintf(&buf, "  compaction_filter=%s\n", compactionFilterName(o.CompactionFilter))
 	fmt.Fprintf(&buf, "  comparer=%s\n", o.Comparer.Name)
 	fmt.Fprintf(&buf, "  disable_wal=%t\n", o.DisableWAL)
 	fmt.Fprintf(&buf, "  l0_compaction_threshold=%d\n", o.L0CompactionThreshold)
@@ -393,7 +634,22 @@ func (o *Options) String() string {
 	fmt.Fprintf(&buf, "  mem_table_size=%d\n", o.MemTableSize)
 	fmt.Fprintf(&buf, "  mem_table_stop_writes_threshold=%d\n", o.MemTableStopWritesThreshold)
 	fmt.Fprintf(&buf, "  merger=%s\n", o.Merger.Name)
+	fmt.Fprintf(&buf, "  min_blob_size=%d\n", o.MinBlobSize)
+	if len(o.TablePropertyCollectors) > 0 {
+		fmt.Fprintf(&buf, "  table_property_collectors=[")
+		for i := range o.TablePropertyCollectors {
+			if i > 0 {
+				fmt.Fprintf(&buf, ",")
+			}
+			// NB: Creation of property collectors is expected to be cheap.
+			fmt.Fprintf(&buf, "%s", o.TablePropertyCollectors[i]().Name())
+		}
+		fmt.Fprintf(&buf, "]\n")
+	}
+	fmt.Fprintf(&buf, "  wal_archive_size_limit=%d\n", o.WALArchiveSizeLimit)
+	fmt.Fprintf(&buf, "  wal_archive_ttl=%s\n", o.WALArchiveTTL)
 	fmt.Fprintf(&buf, "  wal_dir=%s\n", o.WALDir)
+	fmt.Fprintf(&buf, "  wal_recovery_mode=%s\n", o.WALRecoveryMode)
 
 	for i := range o.Levels {
 		l := &o.Levels[i]
@@ -404,6 +660,7 @@ func (o *Options) String() string {
 		fmt.Fprintf(&buf, "  compression=%s\n", l.Compression)
 		fmt.Fprintf(&buf, "  filter_policy=%s\n", filterPolicyName(l.FilterPolicy))
 		fmt.Fprintf(&buf, "  filter_type=%s\n", l.FilterType)
+		fmt.Fprintf(&buf, "  index_block_size=%d\n", l.IndexBlockSize)
 		fmt.Fprintf(&buf, "  target_file_size=%d\n", l.TargetFileSize)
 	}
 
@@ -479,24 +736,47 @@ type IterOptions struct {
 	UpperBound []byte
 	// TableFilter can be used to filter the tables that are scanned during
 	// iteration based on the user properties. Return true to scan the table and
-	// false to skip scanning.
-	//
-	// TODO(peter): unimplemented.
-	// TableFilter func(userProps map[string]string) bool
+	// false to skip scanning. A skipped table contributes neither point keys
+	// nor range deletion tombstones to the iterator. Memtables are not
+	// filtered.
+	TableFilter func(userProps map[string]string) bool
+	// BlockPropertyFilters can be used to skip the data blocks that are scanned
+	// during iteration based on the properties collected by
+	// Options.BlockPropertyCollectors. A data block is skipped if any of the
+	// filters reports that the block's property does not intersect. Skipping
+	// blocks does not affect range deletion tombstones and memtables are not
+	// filtered. Filtering is done at block granularity, so an iterator may
+	// still return keys that do not satisfy the filters.
+	BlockPropertyFilters []BlockPropertyFilter
 
 	// If Prefix is true, the iterator will only be used to iterate over keys
-	// matching that of the key it is first positioned at. If the Comparer was
-	// supplied with a user-defined Split function and bloom filters are
+	// matching that of the key it is positioned at by SeekGE. If the Comparer
+	// was supplied with a user-defined Split function and bloom filters are
 	// enabled, this allows for improved performance by skipping SSTables known
-	// not to contain the given prefix. The iterator will not properly observe
-	// keys not matching the prefix.
+	// not to contain the given prefix. After a call to SeekGE, the iterator
+	// becomes invalid once forward iteration reaches a key with a different
+	// prefix. If LowerBound is set, First is a prefix seek to LowerBound. Last,
+	// SeekLT and First without a LowerBound ignore the prefix. Reverse
+	// iteration after a prefix seek will not properly observe keys not matching
+	// the prefix.
+	//
+	// Prefix has no effect if the Comparer does not have a Split function.
 	//
 	// TODO(tbg): should an assertion trip if the first key's prefix is unstable?
 	// TODO(tbg): should Prefix override (or sharpen) {Lower,Upper}Bound? When
 	// we see the first key, we get the prefix and a separator which should be
 	// a good {Lower,Upper}Bound.
-	// TODO(tbg): unimplemented.
-	// Prefix bool
+	Prefix bool
+
+	// If Tailing is true, the iterator observes the writes committed after it
+	// was created. Once a tailing iterator has been exhausted, a subsequent call
+	// to Next refreshes the iterator's view of the DB if new writes have become
+	// visible, and resumes iteration after the last key returned. Seeking a
+	// tailing iterator also refreshes its view. A tailing iterator only supports
+	// forward iteration: SeekLT, Last and Prev return false and set an error.
+	//
+	// Tailing has no effect on iterators over snapshots and batches.
+	Tailing bool
 }
 
 // GetLowerBound returns the LowerBound or nil if the receiver is nil.
@@ -515,6 +795,25 @@ func (o *IterOptions) GetUpperBound() []byte {
 	return o.UpperBound
 }
 
+// GetBlockPropertyFilters returns the BlockPropertyFilters or nil if the
+// receiver is nil.
+func (o *IterOptions) GetBlockPropertyFilters() []BlockPropertyFilter {
+	if o == nil {
+		return nil
+	}
+	return o.BlockPropertyFilters
+}
+
+// GetPrefix returns the Prefix or false if the receiver is nil.
+func (o *IterOptions) GetPrefix() bool {
+	return o != nil && o.Prefix
+}
+
+// GetTailing returns the Tailing or false if the receiver is nil.
+func (o *IterOptions) GetTailing() bool {
+	return o != nil && o.Tailing
+}
+
 // WriteOptions hold the optional per-query parameters for Set and Delete
 // operations.
 //
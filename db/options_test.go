@@ -40,8 +40,11 @@ func TestOptionsString(t *testing.T) {
   pebble_version=0.1
 
 [Options]
+  blob_gc_age_cutoff=0.25
+  blob_gc_force_threshold=0.5
   bytes_per_sync=524288
   cache_size=0
+  compaction_filter=none
   comparer=leveldb.BytewiseComparator
   disable_wal=false
   l0_compaction_threshold=4
@@ -53,7 +56,11 @@ func TestOptionsString(t *testing.T) {
   mem_table_size=4194304
   mem_table_stop_writes_threshold=2
   merger=pebble.concatenate
+  min_blob_size=0
+  wal_archive_size_limit=0
+  wal_archive_ttl=0s
   wal_dir=
+  wal_recovery_mode=tolerate-corrupted-tail-records
 
 [Level "0"]
   block_restart_interval=16
@@ -61,6 +68,7 @@ func TestOptionsString(t *testing.T) {
   compression=Snappy
   filter_policy=none
   filter_type=table
+  index_block_size=2147483647
   target_file_size=2097152
 `
 
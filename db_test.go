@@ -506,6 +506,133 @@ func TestGetMerge(t *testing.T) {
 	}
 }
 
+func TestSingleDelete(t *testing.T) {
+	d, err := Open("", &db.Options{
+		FS: vfs.NewMem(),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, k := range []string{"a", "b"} {
+		if err := d.Set([]byte(k), []byte(k), nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := d.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.SingleDelete([]byte("a"), nil); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := d.Get([]byte("a")); err != db.ErrNotFound {
+		t.Fatalf("expected not found, but found %v", err)
+	}
+	if err := d.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := d.Get([]byte("a")); err != db.ErrNotFound {
+		t.Fatalf("expected not found, but found %v", err)
+	}
+
+	// Compaction elides the single delete along with the set it shadows, so
+	// the only remaining key is "b".
+	if err := d.Compact([]byte("a"), []byte("z")); err != nil {
+		t.Fatal(err)
+	}
+	d.mu.Lock()
+	v := d.mu.versions.currentVersion()
+	for level := range v.files {
+		for _, f := range v.files[level] {
+			if string(f.smallest.UserKey) != "b" || string(f.largest.UserKey) != "b" {
+				t.Errorf("unexpected table %d on L%d: %s-%s",
+					f.fileNum, level, f.smallest, f.largest)
+			}
+		}
+	}
+	d.mu.Unlock()
+
+	if err := d.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestDeleteFilesInRange(t *testing.T) {
+	mem := vfs.NewMem()
+	d, err := Open("", &db.Options{
+		FS: mem,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	set := func(keys ...string) {
+		for _, k := range keys {
+			if err := d.Set([]byte(k), []byte(k), nil); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	tables := func() map[string]uint64 {
+		d.mu.Lock()
+		defer d.mu.Unlock()
+		m := make(map[string]uint64)
+		for _, files := range d.mu.versions.currentVersion().files {
+			for _, f := range files {
+				m[fmt.Sprintf("%s-%s", f.smallest.UserKey, f.largest.UserKey)] = f.fileNum
+			}
+		}
+		return m
+	}
+
+	set("a", "b")
+	if err := d.Compact([]byte("a"), []byte("b")); err != nil {
+		t.Fatal(err)
+	}
+	set("c", "d")
+	if err := d.Compact([]byte("c"), []byte("d")); err != nil {
+		t.Fatal(err)
+	}
+	set("e")
+	if err := d.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	before := tables()
+	if _, ok := before["c-d"]; !ok || len(before) != 3 {
+		t.Fatalf("unexpected tables: %v", before)
+	}
+
+	if err := d.DeleteFilesInRange([]byte("b"), []byte("e")); err != nil {
+		t.Fatal(err)
+	}
+
+	// The table fully contained in the range is removed. The remaining tables
+	// partially overlap the range and are left in place.
+	after := tables()
+	if _, ok := after["c-d"]; ok || len(after) != 2 {
+		t.Fatalf("unexpected tables: %v", after)
+	}
+	if _, err := mem.Stat(dbFilename("", fileTypeTable, before["c-d"])); err == nil {
+		t.Fatalf("expected table %d to be deleted", before["c-d"])
+	}
+
+	iter := d.NewIter(nil)
+	var keys []string
+	for valid := iter.First(); valid; valid = iter.Next() {
+		keys = append(keys, string(iter.Key()))
+	}
+	if err := iter.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if expected, actual := "a e", strings.Join(keys, " "); expected != actual {
+		t.Fatalf("expected %q, but found %q", expected, actual)
+	}
+
+	if err := d.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
 func TestIterLeak(t *testing.T) {
 	for _, leak := range []bool{true, false} {
 		t.Run(fmt.Sprintf("leak=%t", leak), func(t *testing.T) {
@@ -0,0 +1,474 @@
+// Copyright 2019 The LevelDB-Go and Pebble Authors. All rights reserved. Use
+// of this source code is governed by a BSD-style license that can be found in
+// the LICENSE file.
+
+package pebble
+
+import (
+	"errors"
+	"sort"
+
+	"github.com/petermattis/pebble/db"
+)
+
+// DiffKind describes how the value of a key changed between two snapshots.
+type DiffKind int8
+
+const (
+	// DiffAdded indicates that the key did not exist in the older snapshot.
+	DiffAdded DiffKind = iota
+	// DiffDeleted indicates that the key does not exist in the newer snapshot.
+	DiffDeleted
+	// DiffModified indicates that the key exists in both snapshots with
+	// different values.
+	DiffModified
+)
+
+var diffKindNames = []string{
+	DiffAdded:    "added",
+	DiffDeleted:  "deleted",
+	DiffModified: "modified",
+}
+
+func (k DiffKind) String() string {
+	if int(k) < len(diffKindNames) {
+		return diffKindNames[k]
+	}
+	return "unknown"
+}
+
+// diffSpan is a range of keys [start,end) deleted by a range tombstone written
+// between the two snapshots of a DiffIterator.
+type diffSpan struct {
+	start, end []byte
+}
+
+// DiffIterator iterates over the keys whose visible value differs between two
+// snapshots of a DB, in key order. For each key it provides the value at the
+// older and at the newer snapshot, and the kind of the change. A key which
+// was written between the snapshots, but whose value ended up unchanged (e.g.
+// a key which was added and subsequently deleted), is omitted.
+//
+// Only the memtables and sstables which contain writes newer than the older
+// snapshot are scanned for changed keys, which makes the cost of a diff
+// proportional to the amount of data written between the snapshots rather
+// than to the size of the DB. The exception is a range deletion written
+// between the snapshots: the keys within its range are enumerated in both
+// snapshots.
+//
+// A DiffIterator only supports forward iteration. The snapshots must remain
+// open while the iterator is in use.
+type DiffIterator struct {
+	cmp db.Compare
+	// The sequence numbers of the older and newer snapshot. A key was changed
+	// between the snapshots if it has an entry with a sequence number in
+	// [fromSeqNum,toSeqNum).
+	fromSeqNum uint64
+	toSeqNum   uint64
+	// Iterators over the older and newer snapshot, used to look up the values
+	// of the changed keys.
+	from *Iterator
+	to   *Iterator
+	// An iterator over the point entries of the memtables and sstables written
+	// since the older snapshot. The entries newer than toSeqNum are hidden.
+	changed internalIterator
+	// The current entry of the changed iterator.
+	changedKey *db.InternalKey
+	// The disjoint, sorted ranges deleted by range tombstones written between
+	// the snapshots, and the index of the next range to be iterated over.
+	spans   []diffSpan
+	spanIdx int
+	// True while the keys in [from.Key(),spanEnd) and [to.Key(),spanEnd) are
+	// being compared.
+	inSpan  bool
+	spanEnd []byte
+	// When inSpan is true, whether the from and to iterators need to be
+	// advanced past the current key before looking for the next change.
+	nextFrom, nextTo bool
+
+	key      []byte
+	keyBuf   []byte
+	kind     DiffKind
+	oldValue []byte
+	newValue []byte
+	valid    bool
+	err      error
+}
+
+// NewDiffIter returns an iterator over the keys of the default column family
+// whose visible value changed between the from and to snapshots. A nil to
+// snapshot denotes the current state of the DB. The from snapshot must not be
+// newer than the to snapshot. Only the bounds and table filter of the
+// iterator options are used. The iterator is unpositioned (Valid() will return
+// false) and can be positioned via a call to SeekGE or First.
+func (d *DB) NewDiffIter(from, to *Snapshot, o *db.IterOptions) *DiffIterator {
+	if from == nil || from.db != d || (to != nil && to.db != d) {
+		return &DiffIterator{err: errors.New("pebble: invalid diff snapshot")}
+	}
+	if to != nil && from.seqNum > to.seqNum {
+		return &DiffIterator{err: errors.New("pebble: diff snapshots out of order")}
+	}
+
+	var opts db.IterOptions
+	if o != nil {
+		opts.LowerBound = o.LowerBound
+		opts.UpperBound = o.UpperBound
+		opts.TableFilter = o.TableFilter
+	}
+	cf := &d.columnFamily
+	i := &DiffIterator{
+		cmp:        d.cmp,
+		fromSeqNum: from.seqNum,
+		from:       d.newIterInternal(cf, nil /* batch */, from, &opts),
+		to:         d.newIterInternal(cf, nil /* batch */, to, &opts),
+	}
+	if i.err = firstError(i.from.Error(), i.to.Error()); i.err != nil {
+		return i
+	}
+	// The to iterator references a readState containing every entry visible at
+	// its sequence number, which is the sequence number of the snapshot or the
+	// visible sequence number at the time the iterator was created.
+	i.toSeqNum = i.to.seqNum
+	i.err = i.initChanged(d, i.to.readState, &opts)
+	return i
+}
+
+// initChanged initializes the iterator over the changed point entries and the
+// ranges deleted between the snapshots from the memtables and sstables of the
+// readState.
+func (i *DiffIterator) initChanged(d *DB, readState *readState, o *db.IterOptions) error {
+	var iters []internalIterator
+	var spans []diffSpan
+	addIters := func(iter, rangeDelIter internalIterator) error {
+		iters = append(iters, iter)
+		if rangeDelIter == nil {
+			return nil
+		}
+		for key, end := rangeDelIter.First(); key != nil; key, end = rangeDelIter.Next() {
+			if seqNum := key.SeqNum(); seqNum >= i.fromSeqNum && seqNum < i.toSeqNum {
+				spans = append(spans, diffSpan{
+					start: append([]byte(nil), key.UserKey...),
+					end:   append([]byte(nil), end...),
+				})
+			}
+		}
+		return rangeDelIter.Close()
+	}
+
+	for _, mem := range readState.memtables {
+		if err := addIters(mem.newIter(o), mem.newRangeDelIter(o)); err != nil {
+			i.changed = newMergingIter(i.cmp, iters...)
+			return err
+		}
+	}
+	// Only the sstables containing entries newer than the older snapshot need
+	// to be examined.
+	for _, files := range readState.current.files {
+		for j := range files {
+			f := &files[j]
+			if f.largestSeqNum < i.fromSeqNum {
+				continue
+			}
+			iter, rangeDelIter, err := d.newIters(f, o)
+			if err == nil {
+				err = addIters(iter, rangeDelIter)
+			}
+			if err != nil {
+				// The iterators opened so far are closed by DiffIterator.Close.
+				i.changed = newMergingIter(i.cmp, iters...)
+				return err
+			}
+		}
+	}
+	m := newMergingIter(i.cmp, iters...)
+	m.snapshot = i.toSeqNum
+	i.changed = m
+	i.spans = i.normalizeSpans(spans, o)
+	return nil
+}
+
+// normalizeSpans clips the spans to the iterator bounds, and sorts and merges
+// them into a list of disjoint spans.
+func (i *DiffIterator) normalizeSpans(spans []diffSpan, o *db.IterOptions) []diffSpan {
+	lower, upper := o.GetLowerBound(), o.GetUpperBound()
+	for j := range spans {
+		s := &spans[j]
+		if lower != nil && i.cmp(s.start, lower) < 0 {
+			s.start = lower
+		}
+		if upper != nil && i.cmp(s.end, upper) > 0 {
+			s.end = upper
+		}
+	}
+	sort.Slice(spans, func(a, b int) bool {
+		return i.cmp(spans[a].start, spans[b].start) < 0
+	})
+	var result []diffSpan
+	for _, s := range spans {
+		if i.cmp(s.start, s.end) >= 0 {
+			continue
+		}
+		if n := len(result); n > 0 && i.cmp(s.start, result[n-1].end) <= 0 {
+			if i.cmp(s.end, result[n-1].end) > 0 {
+				result[n-1].end = s.end
+			}
+			continue
+		}
+		result = append(result, s)
+	}
+	return result
+}
+
+// SeekGE moves the iterator to the first changed key which is greater than or
+// equal to the given key. Returns true if the iterator is pointing at a valid
+// entry and false otherwise.
+func (i *DiffIterator) SeekGE(key []byte) bool {
+	if i.err != nil {
+		return false
+	}
+	if lowerBound := i.from.opts.GetLowerBound(); lowerBound != nil && i.cmp(key, lowerBound) < 0 {
+		key = lowerBound
+	}
+	i.changedKey, _ = i.changed.SeekGE(key)
+	i.spanIdx = sort.Search(len(i.spans), func(j int) bool {
+		return i.cmp(i.spans[j].end, key) > 0
+	})
+	i.inSpan = false
+	if i.spanIdx < len(i.spans) && i.cmp(i.spans[i.spanIdx].start, key) < 0 {
+		i.enterSpan(key)
+	}
+	return i.findNext()
+}
+
+// First moves the iterator to the first changed key. Returns true if the
+// iterator is pointing at a valid entry and false otherwise.
+func (i *DiffIterator) First() bool {
+	if i.err != nil {
+		return false
+	}
+	if lowerBound := i.from.opts.GetLowerBound(); lowerBound != nil {
+		return i.SeekGE(lowerBound)
+	}
+	i.changedKey, _ = i.changed.First()
+	i.spanIdx = 0
+	i.inSpan = false
+	return i.findNext()
+}
+
+// Next moves the iterator to the next changed key. Returns true if the
+// iterator is pointing at a valid entry and false otherwise.
+func (i *DiffIterator) Next() bool {
+	if i.err != nil || !i.valid {
+		return false
+	}
+	return i.findNext()
+}
+
+// enterSpan starts comparing the keys within the next span, starting at the
+// specified key.
+func (i *DiffIterator) enterSpan(start []byte) {
+	i.spanEnd = i.spans[i.spanIdx].end
+	i.spanIdx++
+	i.inSpan = true
+	i.nextFrom, i.nextTo = false, false
+	i.from.SeekGE(start)
+	i.to.SeekGE(start)
+}
+
+// findNext finds the next changed key, either within the current span or
+// among the changed point entries.
+func (i *DiffIterator) findNext() bool {
+	i.valid = false
+	for {
+		if i.inSpan {
+			if i.nextSpanEntry() {
+				return true
+			}
+			if i.err != nil {
+				return false
+			}
+			// The changed point entries within the span have been accounted for.
+			i.inSpan = false
+			i.changedKey, _ = i.changed.SeekGE(i.spanEnd)
+			continue
+		}
+
+		key := i.nextChangedKey()
+		if i.spanIdx < len(i.spans) {
+			if s := &i.spans[i.spanIdx]; key == nil || i.cmp(s.start, key.UserKey) <= 0 {
+				i.enterSpan(s.start)
+				continue
+			}
+		}
+		if key == nil {
+			i.err = firstError(i.changed.Error(), firstError(i.from.Error(), i.to.Error()))
+			return false
+		}
+		i.keyBuf = append(i.keyBuf[:0], key.UserKey...)
+		i.key = i.keyBuf
+		// Skip the remaining entries for the key.
+		for {
+			i.changedKey, _ = i.changed.Next()
+			if i.changedKey == nil || i.cmp(i.changedKey.UserKey, i.key) != 0 {
+				break
+			}
+		}
+		if i.compare() {
+			return true
+		}
+		if i.err != nil {
+			return false
+		}
+	}
+}
+
+// nextChangedKey returns the first changed point entry at or after the current
+// position of the changed iterator, skipping the entries written before the
+// older snapshot and range deletions (which are accounted for by the spans).
+func (i *DiffIterator) nextChangedKey() *db.InternalKey {
+	key := i.changedKey
+	for ; key != nil; key, _ = i.changed.Next() {
+		if key.SeqNum() >= i.fromSeqNum && key.Kind() != db.InternalKeyKindRangeDelete {
+			break
+		}
+	}
+	i.changedKey = key
+	if upperBound := i.from.opts.GetUpperBound(); key != nil && upperBound != nil &&
+		i.cmp(key.UserKey, upperBound) >= 0 {
+		return nil
+	}
+	return key
+}
+
+// compare looks up the values of i.key in both snapshots, and returns true if
+// they differ.
+func (i *DiffIterator) compare() bool {
+	fromOK := i.from.SeekGE(i.key) && i.cmp(i.from.Key(), i.key) == 0
+	toOK := i.to.SeekGE(i.key) && i.cmp(i.to.Key(), i.key) == 0
+	if i.err = firstError(i.from.Error(), i.to.Error()); i.err != nil {
+		return false
+	}
+	return i.setEntry(fromOK, toOK)
+}
+
+// nextSpanEntry advances the from and to iterators in step within the current
+// span, and returns true when it finds a key whose value differs.
+func (i *DiffIterator) nextSpanEntry() bool {
+	for {
+		if i.nextFrom {
+			i.from.Next()
+		}
+		if i.nextTo {
+			i.to.Next()
+		}
+		if i.err = firstError(i.from.Error(), i.to.Error()); i.err != nil {
+			return false
+		}
+		fromOK := i.from.Valid() && i.cmp(i.from.Key(), i.spanEnd) < 0
+		toOK := i.to.Valid() && i.cmp(i.to.Key(), i.spanEnd) < 0
+		if fromOK && toOK {
+			if c := i.cmp(i.from.Key(), i.to.Key()); c < 0 {
+				toOK = false
+			} else if c > 0 {
+				fromOK = false
+			}
+		}
+		i.nextFrom, i.nextTo = fromOK, toOK
+		switch {
+		case fromOK:
+			i.keyBuf = append(i.keyBuf[:0], i.from.Key()...)
+		case toOK:
+			i.keyBuf = append(i.keyBuf[:0], i.to.Key()...)
+		default:
+			return false
+		}
+		i.key = i.keyBuf
+		if i.setEntry(fromOK, toOK) {
+			return true
+		}
+	}
+}
+
+// setEntry sets the current entry from the values of i.key in the from and to
+// snapshots, and returns true if the values differ. The key exists in the
+// from (to) snapshot if fromOK (toOK) is true, in which case the from (to)
+// iterator is positioned at the key.
+func (i *DiffIterator) setEntry(fromOK, toOK bool) bool {
+	i.oldValue, i.newValue = nil, nil
+	switch {
+	case fromOK && toOK:
+		i.oldValue, i.newValue = i.from.Value(), i.to.Value()
+		if string(i.oldValue) == string(i.newValue) {
+			return false
+		}
+		i.kind = DiffModified
+	case fromOK:
+		i.oldValue = i.from.Value()
+		i.kind = DiffDeleted
+	case toOK:
+		i.newValue = i.to.Value()
+		i.kind = DiffAdded
+	default:
+		return false
+	}
+	i.valid = true
+	return true
+}
+
+// Key returns the key of the current entry, or nil if done. The caller should
+// not modify the contents of the returned slice, and its contents may change
+// on the next call to Next.
+func (i *DiffIterator) Key() []byte {
+	if !i.valid {
+		return nil
+	}
+	return i.key
+}
+
+// Kind returns the kind of the change of the current entry.
+func (i *DiffIterator) Kind() DiffKind {
+	return i.kind
+}
+
+// OldValue returns the value of the current entry in the older snapshot, or
+// nil if the key did not exist. The caller should not modify the contents of
+// the returned slice, and its contents may change on the next call to Next.
+func (i *DiffIterator) OldValue() []byte {
+	return i.oldValue
+}
+
+// NewValue returns the value of the current entry in the newer snapshot, or
+// nil if the key does not exist. The caller should not modify the contents of
+// the returned slice, and its contents may change on the next call to Next.
+func (i *DiffIterator) NewValue() []byte {
+	return i.newValue
+}
+
+// Valid returns true if the iterator is positioned at a valid entry and false
+// otherwise.
+func (i *DiffIterator) Valid() bool {
+	return i.valid
+}
+
+// Error returns any accumulated error.
+func (i *DiffIterator) Error() error {
+	return i.err
+}
+
+// Close closes the iterator and returns any accumulated error. It is valid to
+// call Close multiple times. Other methods should not be called after the
+// iterator has been closed.
+func (i *DiffIterator) Close() error {
+	err := i.err
+	if i.changed != nil {
+		err = firstError(err, i.changed.Close())
+	}
+	if i.from != nil {
+		err = firstError(err, i.from.Close())
+	}
+	if i.to != nil {
+		err = firstError(err, i.to.Close())
+	}
+	*i = DiffIterator{}
+	return err
+}
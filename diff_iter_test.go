@@ -0,0 +1,222 @@
+// Copyright 2019 The LevelDB-Go and Pebble Authors. All rights reserved. Use
+// of this source code is governed by a BSD-style license that can be found in
+// the LICENSE file.
+
+package pebble
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/petermattis/pebble/db"
+	"github.com/petermattis/pebble/vfs"
+	"golang.org/x/exp/rand"
+)
+
+// formatDiff returns the entries of the diff iterator as a string.
+func formatDiff(t *testing.T, iter *DiffIterator, valid bool) string {
+	t.Helper()
+	var entries []string
+	for ; valid; valid = iter.Next() {
+		entries = append(entries, fmt.Sprintf("%s:%s(%s->%s)",
+			iter.Key(), iter.Kind(), iter.OldValue(), iter.NewValue()))
+	}
+	if err := iter.Error(); err != nil {
+		t.Fatal(err)
+	}
+	return strings.Join(entries, " ")
+}
+
+func TestDiffIter(t *testing.T) {
+	d, err := Open("", &db.Options{FS: vfs.NewMem()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+
+	set := func(key, value string) {
+		if err := d.Set([]byte(key), []byte(value), db.NoSync); err != nil {
+			t.Fatal(err)
+		}
+	}
+	del := func(key string) {
+		if err := d.Delete([]byte(key), db.NoSync); err != nil {
+			t.Fatal(err)
+		}
+	}
+	flush := func() {
+		if err := d.Flush(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	diff := func(from, to *Snapshot, o *db.IterOptions) string {
+		t.Helper()
+		iter := d.NewDiffIter(from, to, o)
+		defer iter.Close()
+		return formatDiff(t, iter, iter.First())
+	}
+	expect := func(expected, actual string) {
+		t.Helper()
+		if expected != actual {
+			t.Fatalf("expected\n%s\nbut found\n%s", expected, actual)
+		}
+	}
+
+	for _, k := range []string{"a", "b", "c", "d", "da", "x"} {
+		set(k, "1")
+	}
+	flush()
+	if err := d.Compact([]byte("a"), []byte("z")); err != nil {
+		t.Fatal(err)
+	}
+	s1 := d.NewSnapshot()
+	defer s1.Close()
+
+	set("b", "2")
+	del("c")
+	set("e", "2")
+	// Keys whose value ends up unchanged are omitted.
+	set("f", "2")
+	del("f")
+	set("a", "1")
+	flush()
+	if err := d.DeleteRange([]byte("d"), []byte("e"), db.NoSync); err != nil {
+		t.Fatal(err)
+	}
+	set("db", "2")
+	s2 := d.NewSnapshot()
+	defer s2.Close()
+	set("x", "3")
+
+	expect("b:modified(1->2) c:deleted(1->) d:deleted(1->) da:deleted(1->) db:added(->2) e:added(->2)",
+		diff(s1, s2, nil))
+	expect("x:modified(1->3)", diff(s2, nil, nil))
+	expect("", diff(s2, s2, nil))
+	expect("c:deleted(1->) d:deleted(1->) da:deleted(1->)",
+		diff(s1, s2, &db.IterOptions{LowerBound: []byte("bb"), UpperBound: []byte("db")}))
+
+	iter := d.NewDiffIter(s1, nil, nil)
+	expect("da:deleted(1->) db:added(->2) e:added(->2) x:modified(1->3)",
+		formatDiff(t, iter, iter.SeekGE([]byte("d1"))))
+	if err := iter.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	iter = d.NewDiffIter(s2, s1, nil)
+	if iter.First() || iter.Error() == nil {
+		t.Fatalf("expected error, but found success")
+	}
+	if err := iter.Close(); err == nil {
+		t.Fatalf("expected error, but found success")
+	}
+}
+
+func TestDiffIterRandomized(t *testing.T) {
+	seed := uint64(time.Now().UnixNano())
+	rng := rand.New(rand.NewSource(seed))
+	t.Logf("seed %d", seed)
+
+	d, err := Open("", &db.Options{FS: vfs.NewMem(), MemTableSize: 64 << 10})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+
+	randKey := func() []byte {
+		return []byte(fmt.Sprintf("%03d", rng.Intn(200)))
+	}
+	// naiveDiff computes the diff by comparing full scans of the snapshots.
+	naiveDiff := func(from, to *Snapshot) string {
+		scan := func(s *Snapshot) map[string]string {
+			var iter *Iterator
+			if s != nil {
+				iter = s.NewIter(nil)
+			} else {
+				iter = d.NewIter(nil)
+			}
+			defer iter.Close()
+			m := make(map[string]string)
+			for valid := iter.First(); valid; valid = iter.Next() {
+				m[string(iter.Key())] = string(iter.Value())
+			}
+			return m
+		}
+		old, new := scan(from), scan(to)
+		var entries []string
+		for i := 0; i < 200; i++ {
+			k := fmt.Sprintf("%03d", i)
+			o, oldOK := old[k]
+			n, newOK := new[k]
+			switch {
+			case oldOK && newOK && o != n:
+				entries = append(entries, fmt.Sprintf("%s:modified(%s->%s)", k, o, n))
+			case oldOK && !newOK:
+				entries = append(entries, fmt.Sprintf("%s:deleted(%s->)", k, o))
+			case !oldOK && newOK:
+				entries = append(entries, fmt.Sprintf("%s:added(->%s)", k, n))
+			}
+		}
+		return strings.Join(entries, " ")
+	}
+
+	// Range deletions are only written after the last flush, which keeps the
+	// range tombstones in the memtable.
+	var snapshots []*Snapshot
+	for i := 0; i < 2100; i++ {
+		var err error
+		switch r := rng.Intn(100); {
+		case r < 60:
+			err = d.Set(randKey(), []byte(fmt.Sprint(i)), db.NoSync)
+		case r < 80:
+			err = d.Delete(randKey(), db.NoSync)
+		case r < 83:
+			if i < 2000 {
+				continue
+			}
+			start, end := randKey(), randKey()
+			if string(start) > string(end) {
+				start, end = end, start
+			}
+			err = d.DeleteRange(start, end, db.NoSync)
+		case r < 85:
+			if i < 2000 {
+				err = d.Flush()
+			}
+		case r < 86:
+			if i < 2000 {
+				err = d.Compact([]byte("000"), []byte("200"))
+			}
+		case r < 90:
+			snapshots = append(snapshots, d.NewSnapshot())
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for i := 0; i < 20 && len(snapshots) > 0; i++ {
+		from := snapshots[rng.Intn(len(snapshots))]
+		to := snapshots[rng.Intn(len(snapshots))]
+		if from.seqNum > to.seqNum {
+			from, to = to, from
+		}
+		if rng.Intn(4) == 0 {
+			to = nil
+		}
+		iter := d.NewDiffIter(from, to, nil)
+		actual := formatDiff(t, iter, iter.First())
+		if err := iter.Close(); err != nil {
+			t.Fatal(err)
+		}
+		if expected := naiveDiff(from, to); expected != actual {
+			t.Fatalf("expected\n%s\nbut found\n%s", expected, actual)
+		}
+	}
+	for _, s := range snapshots {
+		if err := s.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
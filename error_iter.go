@@ -12,6 +12,9 @@ type errorIter struct {
 
 var _ internalIterator = (*errorIter)(nil)
 
+// emptyIter is an iterator over no entries.
+var emptyIter = &errorIter{err: nil}
+
 func newErrorIter(err error) *errorIter {
 	return &errorIter{err: err}
 }
@@ -59,3 +62,5 @@ func (c *errorIter) Error() error {
 func (c *errorIter) Close() error {
 	return c.err
 }
+
+func (c *errorIter) SetBounds(lower, upper []byte) {}
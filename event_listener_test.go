@@ -44,6 +44,10 @@ func (b *syncedBuffer) Infof(format string, args ...interface{}) {
 	}
 }
 
+func (b *syncedBuffer) Errorf(format string, args ...interface{}) {
+	b.Infof(format, args...)
+}
+
 func (b *syncedBuffer) Fatalf(format string, args ...interface{}) {
 	panic(fmt.Sprintf(format, args...))
 }
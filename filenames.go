@@ -23,6 +23,7 @@ const (
 	fileTypeManifest
 	fileTypeCurrent
 	fileTypeOptions
+	fileTypeBlob
 )
 
 func dbFilename(dirname string, fileType fileType, fileNum uint64) string {
@@ -42,6 +43,8 @@ func dbFilename(dirname string, fileType fileType, fileNum uint64) string {
 		return fmt.Sprintf("%s%cCURRENT", dirname, os.PathSeparator)
 	case fileTypeOptions:
 		return fmt.Sprintf("%s%cOPTIONS-%06d", dirname, os.PathSeparator, fileNum)
+	case fileTypeBlob:
+		return fmt.Sprintf("%s%c%06d.blob", dirname, os.PathSeparator, fileNum)
 	}
 	panic("unreachable")
 }
@@ -79,6 +82,8 @@ func parseDBFilename(filename string) (fileType fileType, fileNum uint64, ok boo
 			return fileTypeTable, u, true
 		case "log":
 			return fileTypeLog, u, true
+		case "blob":
+			return fileTypeBlob, u, true
 		}
 	}
 	return 0, 0, false
@@ -18,6 +18,8 @@ func TestParseDBFilename(t *testing.T) {
 		"abcdef.log":          false,
 		"000001ldb":           false,
 		"000001.sst":          true,
+		"000001.blob":         true,
+		"000001.blob.tmp":     false,
 		"CURRENT":             true,
 		"CURRaNT":             false,
 		"LOCK":                true,
@@ -52,6 +54,7 @@ func TestFilenameRoundTrip(t *testing.T) {
 		fileTypeManifest: true,
 		fileTypeTable:    true,
 		fileTypeOptions:  true,
+		fileTypeBlob:     true,
 	}
 	for fileType, numbered := range testCases {
 		fileNums := []uint64{0}
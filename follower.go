@@ -0,0 +1,222 @@
+// Copyright 2019 The LevelDB-Go and Pebble Authors. All rights reserved. Use
+// of this source code is governed by a BSD-style license that can be found in
+// the LICENSE file.
+
+package pebble
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+
+	"github.com/petermattis/pebble/db"
+)
+
+// ErrReadOnly is returned when writing to a DB which does not accept writes,
+// such as a follower (see OpenFollower) or a DB opened in read-only mode (see
+// db.Options.ReadOnly).
+var ErrReadOnly = errors.New("pebble: read-only")
+
+// errFollowerClosed is the error of a follower after it has been closed.
+var errFollowerClosed = errors.New("pebble: follower closed")
+
+// WALStream is a stream of the batches committed on a primary DB, in sequence
+// number order. ChangeFeed implements WALStream.
+type WALStream interface {
+	// Next blocks until the next committed batch is available, and returns
+	// the batch along with its sequence number.
+	Next() (seqNum uint64, batch *Batch, err error)
+	// Close closes the stream. Close may be called concurrently with Next,
+	// which must then return an error.
+	Close() error
+}
+
+// A WALGapStream is a WALStream which may skip sequence numbers, and reports
+// whether any of the skipped sequence numbers were assigned to writes. A
+// follower only accepts a gap in the sequence numbers of the batches it
+// receives from a WALGapStream, and only if the gap holds no writes: the
+// sequence numbers were consumed on the primary without writing a batch to
+// the WAL (e.g. by an ingestion), or by batches which only prepare or roll
+// back a two-phase commit. ChangeFeed implements WALGapStream.
+type WALGapStream interface {
+	WALStream
+	// SkippedWrites returns true if any of the sequence numbers skipped
+	// between the batch most recently returned by Next and the preceding
+	// batch were assigned to writes.
+	SkippedWrites() bool
+}
+
+// WALTransport connects a follower to its primary (see OpenFollower).
+type WALTransport interface {
+	// Subscribe returns a stream of the batches committed on the primary,
+	// starting from the batch containing the specified sequence number.
+	Subscribe(startSeqNum uint64) (WALStream, error)
+}
+
+// A Follower is a replica of a primary DB which applies the batches committed
+// on the primary, as received through a WALTransport. The replica is read
+// through the follower's DB, which rejects writes with ErrReadOnly. Reads
+// (including snapshots and iterators) observe the replicated batches
+// atomically, as they would on the primary.
+//
+// The batches are applied with the sequence numbers they were assigned on the
+// primary, and written to the follower's WAL, so that a reopened follower
+// resumes replication where it left off. Replication stops with an error if
+// the stream skips the sequence numbers of writes (see WALGapStream), as the
+// replica would otherwise silently miss them. Only the contents of the WAL are
+// replicated: the follower must be initialized with the column families of
+// the primary, and sstables ingested into the primary are not replicated. A
+// follower is typically initialized from a checkpoint of the primary (see
+// DB.Checkpoint).
+type Follower struct {
+	db     *DB
+	stream WALStream
+	done   chan struct{}
+
+	mu struct {
+		sync.Mutex
+		// Signaled whenever a batch has been applied, or replication stops.
+		cond   sync.Cond
+		err    error
+		closed bool
+	}
+}
+
+// OpenFollower opens the DB in the specified directory as a follower of the
+// primary connected to by the transport. Replication resumes from the first
+// sequence number which has not been applied to the DB.
+func OpenFollower(dirname string, opts *db.Options, transport WALTransport) (*Follower, error) {
+	d, err := Open(dirname, opts)
+	if err != nil {
+		return nil, err
+	}
+	d.follower = true
+
+	d.commit.mu.Lock()
+	startSeqNum := d.mu.versions.logSeqNum
+	d.commit.mu.Unlock()
+
+	stream, err := transport.Subscribe(startSeqNum)
+	if err != nil {
+		d.Close()
+		return nil, err
+	}
+	f := &Follower{
+		db:     d,
+		stream: stream,
+		done:   make(chan struct{}),
+	}
+	f.mu.cond.L = &f.mu.Mutex
+	go f.replicate()
+	return f, nil
+}
+
+// DB returns the follower's DB. The DB must not be closed directly; use
+// Follower.Close instead.
+func (f *Follower) DB() *DB {
+	return f.db
+}
+
+// replicate applies the batches received from the primary until the stream
+// fails or the follower is closed.
+func (f *Follower) replicate() {
+	defer close(f.done)
+	gaps, _ := f.stream.(WALGapStream)
+	for {
+		seqNum, b, err := f.stream.Next()
+		if err == nil {
+			err = f.db.applyReplicated(seqNum, b, gaps != nil && !gaps.SkippedWrites())
+		}
+
+		f.mu.Lock()
+		if err != nil {
+			if f.mu.closed {
+				err = errFollowerClosed
+			}
+			f.mu.err = err
+		}
+		f.mu.cond.Broadcast()
+		f.mu.Unlock()
+		if err != nil {
+			return
+		}
+	}
+}
+
+// WaitForSeqNum blocks until the batches preceding the specified sequence
+// number have been applied, or replication stops. It returns the error which
+// stopped replication, if any.
+func (f *Follower) WaitForSeqNum(seqNum uint64) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for f.mu.err == nil && atomic.LoadUint64(&f.db.mu.versions.visibleSeqNum) < seqNum {
+		f.mu.cond.Wait()
+	}
+	return f.mu.err
+}
+
+// Err returns the error which stopped replication, or nil if the follower is
+// replicating.
+func (f *Follower) Err() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.mu.err
+}
+
+// Close stops replication and closes the follower's DB.
+func (f *Follower) Close() error {
+	f.mu.Lock()
+	if f.mu.closed {
+		f.mu.Unlock()
+		return nil
+	}
+	f.mu.closed = true
+	f.mu.Unlock()
+
+	err := f.stream.Close()
+	<-f.done
+	return firstError(err, f.db.Close())
+}
+
+// applyReplicated applies a batch received from the primary with the
+// sequence number it was assigned on the primary. The sequence numbers
+// preceding the batch which have not been applied may only be skipped if
+// gapOK is true.
+func (d *DB) applyReplicated(seqNum uint64, b *Batch, gapOK bool) error {
+	count := uint64(b.Count())
+
+	// Batches are only applied to a follower by the replication loop, so the
+	// log sequence number cannot change between here and the commit of the
+	// batch.
+	d.commit.mu.Lock()
+	logSeqNum := d.mu.versions.logSeqNum
+	if seqNum+count <= logSeqNum {
+		// The batch has already been applied.
+		d.commit.mu.Unlock()
+		return nil
+	}
+	if seqNum < logSeqNum {
+		d.commit.mu.Unlock()
+		return fmt.Errorf("pebble: replicated batch at sequence number %d overlaps sequence number %d",
+			seqNum, logSeqNum)
+	}
+	if seqNum > logSeqNum {
+		if !gapOK {
+			d.commit.mu.Unlock()
+			return fmt.Errorf("pebble: replicated batch at sequence number %d skips sequence number %d",
+				seqNum, logSeqNum)
+		}
+		// The sequence numbers were consumed on the primary without writes to
+		// replicate.
+		atomic.StoreUint64(&d.mu.versions.logSeqNum, seqNum)
+		atomic.StoreUint64(&d.mu.versions.visibleSeqNum, seqNum)
+	}
+	d.commit.mu.Unlock()
+
+	batch := newBatch(d)
+	defer batch.release()
+	batch.storage.data = append(batch.storage.data[:0], b.storage.data...)
+	batch.refreshMemTableSize()
+	return d.apply(batch, db.NoSync)
+}
@@ -0,0 +1,256 @@
+// Copyright 2019 The LevelDB-Go and Pebble Authors. All rights reserved. Use
+// of this source code is governed by a BSD-style license that can be found in
+// the LICENSE file.
+
+package pebble
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"github.com/petermattis/pebble/db"
+	"github.com/petermattis/pebble/vfs"
+)
+
+// changeFeedTransport is an in-process WALTransport, which streams the
+// batches committed on the primary through change feeds.
+type changeFeedTransport struct {
+	primary *DB
+}
+
+func (t changeFeedTransport) Subscribe(startSeqNum uint64) (WALStream, error) {
+	return t.primary.NewChangeFeed(&ChangeFeedOptions{StartSeqNum: startSeqNum})
+}
+
+// lossyTransport is an in-process WALTransport which drops the batches
+// committed on the primary at the specified sequence numbers.
+type lossyTransport struct {
+	primary *DB
+	drop    map[uint64]bool
+}
+
+func (t lossyTransport) Subscribe(startSeqNum uint64) (WALStream, error) {
+	feed, err := t.primary.NewChangeFeed(&ChangeFeedOptions{StartSeqNum: startSeqNum})
+	if err != nil {
+		return nil, err
+	}
+	return lossyStream{feed, t.drop}, nil
+}
+
+type lossyStream struct {
+	feed *ChangeFeed
+	drop map[uint64]bool
+}
+
+func (s lossyStream) Next() (uint64, *Batch, error) {
+	for {
+		seqNum, b, err := s.feed.Next()
+		if err != nil || !s.drop[seqNum] {
+			return seqNum, b, err
+		}
+	}
+}
+
+func (s lossyStream) Close() error {
+	return s.feed.Close()
+}
+
+// failingTransport is a WALTransport whose streams fail immediately.
+type failingTransport struct{}
+
+func (failingTransport) Subscribe(uint64) (WALStream, error) {
+	return failingStream{}, nil
+}
+
+type failingStream struct{}
+
+func (failingStream) Next() (uint64, *Batch, error) {
+	return 0, nil, errors.New("disconnected")
+}
+
+func (failingStream) Close() error {
+	return nil
+}
+
+func TestFollower(t *testing.T) {
+	mem := vfs.NewMem()
+	primary, err := Open("primary", &db.Options{FS: mem})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer primary.Close()
+
+	apply := func(keys ...string) {
+		t.Helper()
+		b := primary.NewBatch()
+		for _, k := range keys {
+			if strings.HasPrefix(k, "-") {
+				err = b.Delete([]byte(k[1:]), nil)
+			} else {
+				err = b.Set([]byte(k), []byte(k), nil)
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := b.Commit(db.NoSync); err != nil {
+			t.Fatal(err)
+		}
+	}
+	scan := func(r Reader) string {
+		iter := r.NewIter(nil)
+		var keys []string
+		for valid := iter.First(); valid; valid = iter.Next() {
+			keys = append(keys, string(iter.Key()))
+		}
+		if err := iter.Close(); err != nil {
+			t.Fatal(err)
+		}
+		return strings.Join(keys, " ")
+	}
+	var f *Follower
+	catchUp := func() {
+		t.Helper()
+		seqNum := atomic.LoadUint64(&primary.mu.versions.visibleSeqNum)
+		if err := f.WaitForSeqNum(seqNum); err != nil {
+			t.Fatal(err)
+		}
+		if expected, actual := scan(primary), scan(f.DB()); expected != actual {
+			t.Fatalf("expected %q, but found %q", expected, actual)
+		}
+	}
+
+	// The follower is initialized from a checkpoint of the primary, and
+	// catches up with the batches committed since the checkpoint.
+	if _, err := primary.CreateColumnFamily("cf", nil); err != nil {
+		t.Fatal(err)
+	}
+	apply("a", "b")
+	if err := primary.Checkpoint("follower"); err != nil {
+		t.Fatal(err)
+	}
+	apply("c", "-a")
+	apply("d")
+	transport := changeFeedTransport{primary}
+	opts := &db.Options{
+		FS:             mem,
+		ColumnFamilies: map[string]*db.Options{"cf": {}},
+	}
+	if f, err = OpenFollower("follower", opts, transport); err != nil {
+		t.Fatal(err)
+	}
+	catchUp()
+
+	// Snapshots of the follower are unaffected by the replicated batches.
+	snap := f.DB().NewSnapshot()
+	for i := 0; i < 10; i++ {
+		apply(fmt.Sprintf("e%d", i), "-b")
+	}
+	apply("f")
+	catchUp()
+	if expected, actual := "b c d", scan(snap); expected != actual {
+		t.Fatalf("expected %q, but found %q", expected, actual)
+	}
+	if err := snap.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// The sequence numbers of batches which only prepare or roll back a
+	// two-phase commit are skipped.
+	b := primary.NewBatch()
+	if err := b.Set([]byte("p"), []byte("p"), nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := primary.Prepare("txn", b, db.NoSync); err != nil {
+		t.Fatal(err)
+	}
+	if err := primary.RollbackPrepared("txn", db.NoSync); err != nil {
+		t.Fatal(err)
+	}
+	apply("i")
+	catchUp()
+
+	// The follower rejects writes, including schema changes.
+	if err := f.DB().Set([]byte("x"), nil, db.NoSync); err != ErrReadOnly {
+		t.Fatalf("expected %v, but found %v", ErrReadOnly, err)
+	}
+	if _, err := f.DB().CreateColumnFamily("cf2", nil); err != ErrReadOnly {
+		t.Fatalf("expected %v, but found %v", ErrReadOnly, err)
+	}
+	if err := f.DB().DropColumnFamily(f.DB().ColumnFamily("cf")); err != ErrReadOnly {
+		t.Fatalf("expected %v, but found %v", ErrReadOnly, err)
+	}
+
+	// A reopened follower resumes replication where it left off.
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+	apply("g", "-c")
+	if f, err = OpenFollower("follower", opts, transport); err != nil {
+		t.Fatal(err)
+	}
+	apply("h")
+	catchUp()
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestFollowerGap(t *testing.T) {
+	mem := vfs.NewMem()
+	primary, err := Open("primary", &db.Options{FS: mem})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer primary.Close()
+	if err := primary.Set([]byte("a"), []byte("a"), db.NoSync); err != nil {
+		t.Fatal(err)
+	}
+	if err := primary.Checkpoint("follower"); err != nil {
+		t.Fatal(err)
+	}
+
+	var seqNums []uint64
+	for _, k := range []string{"b", "c", "d"} {
+		seqNums = append(seqNums, atomic.LoadUint64(&primary.mu.versions.visibleSeqNum))
+		if err := primary.Set([]byte(k), []byte(k), db.NoSync); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// A follower stops replicating rather than missing the writes of a batch
+	// which was not delivered.
+	transport := lossyTransport{primary, map[uint64]bool{seqNums[1]: true}}
+	f, err := OpenFollower("follower", &db.Options{FS: mem}, transport)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = f.WaitForSeqNum(seqNums[2] + 1)
+	expected := fmt.Sprintf("pebble: replicated batch at sequence number %d skips sequence number %d",
+		seqNums[2], seqNums[1])
+	if err == nil || err.Error() != expected {
+		t.Fatalf("expected %q, but found %v", expected, err)
+	}
+	if v, err := f.DB().Get([]byte("d")); err != db.ErrNotFound {
+		t.Fatalf("expected not found, but found %q, %v", v, err)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestFollowerTransportError(t *testing.T) {
+	f, err := OpenFollower("", &db.Options{FS: vfs.NewMem()}, failingTransport{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := f.WaitForSeqNum(1); err == nil || err.Error() != "disconnected" {
+		t.Fatalf("expected disconnected, but found %v", err)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -185,3 +185,7 @@ func (g *getIter) Close() error {
 	}
 	return g.err
 }
+
+func (g *getIter) SetBounds(lower, upper []byte) {
+	panic("pebble: SetBounds unimplemented")
+}
@@ -30,6 +30,7 @@ func ingestLoad1(opts *db.Options, path string, fileNum uint64) (*fileMetadata,
 	meta := &fileMetadata{}
 	meta.fileNum = fileNum
 	meta.size = uint64(stat.Size())
+	meta.smallestExpiry = r.Properties.SmallestExpiry
 	meta.smallest = db.InternalKey{}
 	meta.largest = db.InternalKey{}
 	smallestSet, largestSet := false, false
@@ -242,6 +243,9 @@ func ingestTargetLevel(cmp db.Compare, v *version, meta *fileMetadata) int {
 // https://github.com/petermattis/pebble/issues/25 for an idea for how to fix
 // this hiccup.
 func (d *DB) Ingest(paths []string) error {
+	if d.follower || d.opts.ReadOnly {
+		return ErrReadOnly
+	}
 	// Allocate file numbers for all of the files being ingested and mark them as
 	// pending in order to prevent them from being deleted. Note that this causes
 	// the file number ordering to be out of alignment with sequence number
@@ -79,6 +79,12 @@ type internalIterator interface {
 	// It is valid to call Close multiple times. Other methods should not be
 	// called after the iterator has been closed.
 	Close() error
+
+	// SetBounds changes the bounds of the iterator. Note that the lower bound
+	// is only checked by SeekLT, Last and Prev, and the upper bound is only
+	// checked by SeekGE, First and Next. The iterator must be repositioned by a
+	// call to SeekGE, SeekLT, First or Last after its bounds have been changed.
+	SetBounds(lower, upper []byte)
 }
 
 // sstable.Iterator implements the internalIterator interface.
@@ -61,6 +61,14 @@ func (it *Iterator) Close() error {
 	return nil
 }
 
+// SetBounds sets the lower and upper bounds for the iterator. Note that the
+// result of Next and Prev will be undefined until the iterator has been
+// repositioned with SeekGE, SeekLT, First, or Last.
+func (it *Iterator) SetBounds(lower, upper []byte) {
+	it.lower = lower
+	it.upper = upper
+}
+
 // Error returns any accumulated error.
 func (it *Iterator) Error() error {
 	return nil
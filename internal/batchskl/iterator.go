@@ -49,6 +49,14 @@ func (it *Iterator) Close() error {
 	return nil
 }
 
+// SetBounds sets the lower and upper bounds for the iterator. Note that the
+// result of Next and Prev will be undefined until the iterator has been
+// repositioned with SeekGE, SeekLT, First, or Last.
+func (it *Iterator) SetBounds(lower, upper []byte) {
+	it.lower = lower
+	it.upper = upper
+}
+
 // SeekGE moves the iterator to the first entry whose key is greater than or
 // equal to the given key. Returns true if the iterator is pointing at a valid
 // entry and false otherwise. Note that SeekGE only checks the upper bound. It
@@ -163,3 +163,8 @@ func (i *Iter) Error() error {
 func (i *Iter) Close() error {
 	return nil
 }
+
+// SetBounds implements internalIterator.SetBounds, as documented in the pebble
+// package. Range tombstones are not truncated to the iterator bounds, so
+// SetBounds is a no-op.
+func (i *Iter) SetBounds(lower, upper []byte) {}
@@ -392,6 +392,15 @@ func (w *LogWriter) SyncRecord(p []byte, wg *sync.WaitGroup) (int64, error) {
 	return offset, w.err
 }
 
+// Sync asynchronously persists any unwritten data to the underlying writer.
+// Done will be called on the wait group upon completion. Sync must not be
+// called concurrently with SyncRecord or Close.
+func (w *LogWriter) Sync(wg *sync.WaitGroup) {
+	f := &w.flusher
+	f.syncQ.push(wg)
+	f.ready.Signal()
+}
+
 // Size returns the current size of the file.
 func (w *LogWriter) Size() int64 {
 	return w.blockNum*blockSize + int64(w.block.written)
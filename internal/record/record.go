@@ -205,9 +205,9 @@ func (r *Reader) nextChunk(wantFirst bool) error {
 					// Skip the rest of the block, if it looks like it is all
 					// zeroes. This is common with WAL preallocation.
 					//
-					// Set r.err to be an error so r.recover actually recovers.
+					// Set r.err to be an error so r.Recover actually recovers.
 					r.err = ErrZeroedChunk
-					r.recover()
+					r.Recover()
 					continue
 				}
 				return ErrZeroedChunk
@@ -233,14 +233,14 @@ func (r *Reader) nextChunk(wantFirst bool) error {
 			r.end = r.begin + int(length)
 			if r.end > r.n {
 				if r.recovering {
-					r.recover()
+					r.Recover()
 					continue
 				}
 				return ErrInvalidChunk
 			}
 			if checksum != crc.New(r.buf[r.begin-headerSize+6:r.end]).Value() {
 				if r.recovering {
-					r.recover()
+					r.Recover()
 					continue
 				}
 				return ErrInvalidChunk
@@ -285,12 +285,12 @@ func (r *Reader) Next() (io.Reader, error) {
 	return singleReader{r, r.seq}, nil
 }
 
-// recover clears any errors read so far, so that calling Next will start
+// Recover clears any errors read so far, so that calling Next will start
 // reading from the next good 32KiB block. If there are no such blocks, Next
-// will return io.EOF. recover also marks the current reader, the one most
-// recently returned by Next, as stale. If recover is called without any
-// prior error, then recover is a no-op.
-func (r *Reader) recover() {
+// will return io.EOF. Recover also marks the current reader, the one most
+// recently returned by Next, as stale. If Recover is called without any
+// prior error, then Recover is a no-op.
+func (r *Reader) Recover() {
 	if r.err == nil {
 		return
 	}
@@ -385,7 +385,7 @@ func TestRecoverNoOp(t *testing.T) {
 	seq, begin, end, n := r.seq, r.begin, r.end, r.n
 
 	// Should be a no-op since r.err == nil.
-	r.recover()
+	r.Recover()
 
 	// r.err was nil, nothing should have changed.
 	if seq != r.seq || begin != r.begin || end != r.end || n != r.n {
@@ -432,7 +432,7 @@ func TestBasicRecover(t *testing.T) {
 	}
 
 	// Recover from that checksum mismatch.
-	r.recover()
+	r.Recover()
 	currentOffset, err := underlyingReader.Seek(0, os.SEEK_CUR)
 	if err != nil {
 		t.Fatalf("current offset: %v", err)
@@ -489,7 +489,7 @@ func TestRecoverSingleBlock(t *testing.T) {
 	}
 
 	// Recover from that checksum mismatch.
-	r.recover()
+	r.Recover()
 
 	// All of the data in the second record r1 is lost because the first record
 	// r0 shared a partial block with it. The second record also overlapped
@@ -547,7 +547,7 @@ func TestRecoverMultipleBlocks(t *testing.T) {
 	}
 
 	// Recover from that checksum mismatch.
-	r.recover()
+	r.Recover()
 
 	// All of the data in the second record is lost because the first
 	// record shared a partial block with it. The following two records
@@ -577,7 +577,7 @@ func verifyLastBlockRecover(recs *testRecords) error {
 			if err == nil {
 				return errors.New("Expected a checksum mismatch error, got nil")
 			}
-			r.recover()
+			r.Recover()
 		case len(recs.records):
 			if err != io.EOF {
 				return fmt.Errorf("Expected io.EOF, got %v", err)
@@ -677,7 +677,7 @@ func TestSeekRecord(t *testing.T) {
 	if _, err = r.Next(); err == nil {
 		t.Fatalf("Expected an error seeking to an invalid chunk boundary")
 	}
-	r.recover()
+	r.Recover()
 
 	// Seek to the fifth block and verify all records can be read as appropriate.
 	err = r.seekRecord(blockSize * 4)
@@ -715,7 +715,7 @@ func TestSeekRecord(t *testing.T) {
 	if err != io.EOF {
 		t.Fatalf("Seeking past EOF raised unexpected error: %v", err)
 	}
-	r.recover() // Verify recovery works.
+	r.Recover() // Verify recovery works.
 
 	// Validate the current records are returned after seeking to a valid offset.
 	err = r.seekRecord(blockSize * 4)
@@ -5,7 +5,10 @@
 package pebble
 
 import (
+	"errors"
 	"fmt"
+	"sync/atomic"
+	"time"
 
 	"github.com/petermattis/pebble/db"
 )
@@ -18,6 +21,8 @@ const (
 	iterPosPrev iterPos = -1
 )
 
+var errTailingReverse = errors.New("pebble: tailing iterator does not support reverse iteration")
+
 // Iterator iterates over a DB's key/value pairs in key order.
 //
 // An iterator must be closed after use, but it is not necessary to read an
@@ -31,10 +36,15 @@ const (
 // key/value pairs are not guaranteed to be a consistent snapshot of that DB
 // at a particular point in time.
 type Iterator struct {
-	opts      *db.IterOptions
+	opts *db.IterOptions
+	// optsBuf holds a copy of the options once they have been changed by
+	// SetBounds or SetOptions, which avoids modifying the options passed by
+	// the caller.
+	optsBuf   db.IterOptions
 	cmp       db.Compare
 	equal     db.Equal
 	merge     db.Merge
+	split     db.Split
 	iter      internalIterator
 	readState *readState
 	err       error
@@ -44,10 +54,81 @@ type Iterator struct {
 	valueBuf  []byte
 	valueBuf2 []byte
 	valid     bool
+	// prefix holds the prefix of the key passed to SeekGE if prefix iteration
+	// is enabled (see IterOptions.Prefix), and is nil otherwise.
+	prefix    []byte
 	iterKey   *db.InternalKey
 	iterValue []byte
 	pos       iterPos
 	alloc     *iterAlloc
+	// The DB, column family, batch and snapshot the iterator was created from,
+	// and the sequence number its view of the DB was created at. These allow
+	// the internal iterators to be rebuilt (see rebuild).
+	db       *DB
+	cf       *columnFamily
+	batch    *Batch
+	snapshot *Snapshot
+	seqNum   uint64
+	// tailing is non-nil for a tailing iterator (see IterOptions.Tailing).
+	tailing *tailingState
+	// The clock which determines whether SETEXPIRY entries have expired, and
+	// the time it returned when the first such entry was encountered. The
+	// iterator uses a single point in time for its lifetime.
+	now      func() time.Time
+	nowNanos int64
+	nowValid bool
+	// The blob files from which the values of BLOBINDEX entries are read, and
+	// the buffer holding the last such value.
+	blobs   *blobCache
+	blobBuf []byte
+}
+
+// expired decodes the value of a SETEXPIRY entry, returning the value which
+// was set and whether the entry has expired.
+func (i *Iterator) expired(value []byte) ([]byte, bool) {
+	expiry, v := decodeExpiry(value)
+	if !i.nowValid {
+		i.nowNanos = i.now().UnixNano()
+		i.nowValid = true
+	}
+	return v, expiry <= i.nowNanos
+}
+
+// blobValue returns the value referenced by the blob index of a BLOBINDEX
+// entry, or false if the value could not be read.
+func (i *Iterator) blobValue(index []byte) ([]byte, bool) {
+	value, err := i.blobs.get(index, &i.blobBuf)
+	if err != nil {
+		i.err = err
+		return nil, false
+	}
+	return value, true
+}
+
+// tailingState holds the state of a tailing iterator.
+type tailingState struct {
+	// The position from which iteration resumes once the iterator has been
+	// exhausted: the first key if first is true, and otherwise the first key
+	// greater than (or equal to, if inclusive is true) key.
+	first     bool
+	key       []byte
+	inclusive bool
+}
+
+func (t *tailingState) setKey(key []byte, inclusive bool) {
+	t.first = false
+	t.key = append(t.key[:0], key...)
+	t.inclusive = inclusive
+}
+
+// initTailing makes the iterator a tailing iterator if requested by the
+// options. Iterators over snapshots and batches are never tailing.
+func (i *Iterator) initTailing() {
+	i.tailing = nil
+	if i.opts.GetTailing() && i.batch == nil && i.snapshot == nil {
+		i.alloc.tailing = tailingState{key: i.alloc.tailing.key[:0]}
+		i.tailing = &i.alloc.tailing
+	}
 }
 
 func (i *Iterator) findNextEntry() bool {
@@ -56,8 +137,14 @@ func (i *Iterator) findNextEntry() bool {
 
 	for i.iterKey != nil {
 		key := *i.iterKey
+		if i.prefix != nil && key.Kind() != db.InternalKeyKindRangeDelete &&
+			!i.equal(i.prefix, key.UserKey[:i.split(key.UserKey)]) {
+			// We've iterated past the keys matching the prefix.
+			return false
+		}
+
 		switch key.Kind() {
-		case db.InternalKeyKindDelete:
+		case db.InternalKeyKindDelete, db.InternalKeyKindSingleDelete:
 			i.nextUserKey()
 			continue
 
@@ -74,6 +161,30 @@ func (i *Iterator) findNextEntry() bool {
 			i.valid = true
 			return true
 
+		case db.InternalKeyKindBlobIndex:
+			value, ok := i.blobValue(i.iterValue)
+			if !ok {
+				return false
+			}
+			i.keyBuf = append(i.keyBuf[:0], key.UserKey...)
+			i.key = i.keyBuf
+			i.value = value
+			i.valid = true
+			return true
+
+		case db.InternalKeyKindSetWithExpiry:
+			value, expired := i.expired(i.iterValue)
+			if expired {
+				// An expired entry is treated as a deletion tombstone.
+				i.nextUserKey()
+				continue
+			}
+			i.keyBuf = append(i.keyBuf[:0], key.UserKey...)
+			i.key = i.keyBuf
+			i.value = value
+			i.valid = true
+			return true
+
 		case db.InternalKeyKindMerge:
 			return i.mergeNext(key)
 
@@ -108,6 +219,9 @@ func (i *Iterator) nextUserKey() {
 func (i *Iterator) findPrevEntry() bool {
 	i.valid = false
 	i.pos = iterPosCur
+	// expiredKey is true if the key i.key has expired, in which case its merge
+	// operands are hidden.
+	var expiredKey bool
 
 	for i.iterKey != nil {
 		key := *i.iterKey
@@ -120,9 +234,10 @@ func (i *Iterator) findPrevEntry() bool {
 		}
 
 		switch key.Kind() {
-		case db.InternalKeyKindDelete:
+		case db.InternalKeyKindDelete, db.InternalKeyKindSingleDelete:
 			i.value = nil
 			i.valid = false
+			expiredKey = false
 			i.iterKey, i.iterValue = i.iter.Prev()
 			continue
 
@@ -137,10 +252,44 @@ func (i *Iterator) findPrevEntry() bool {
 			i.key = i.keyBuf
 			i.value = i.iterValue
 			i.valid = true
+			expiredKey = false
+			i.iterKey, i.iterValue = i.iter.Prev()
+			continue
+
+		case db.InternalKeyKindBlobIndex:
+			value, ok := i.blobValue(i.iterValue)
+			if !ok {
+				i.valid = false
+				return false
+			}
+			i.keyBuf = append(i.keyBuf[:0], key.UserKey...)
+			i.key = i.keyBuf
+			i.value = value
+			i.valid = true
+			expiredKey = false
+			i.iterKey, i.iterValue = i.iter.Prev()
+			continue
+
+		case db.InternalKeyKindSetWithExpiry:
+			// An expired entry is treated as a deletion tombstone, which also
+			// hides the newer merge operands for the key (see mergeNext).
+			value, expired := i.expired(i.iterValue)
+			i.keyBuf = append(i.keyBuf[:0], key.UserKey...)
+			i.key = i.keyBuf
+			i.value = value
+			i.valid = !expired
+			expiredKey = expired
 			i.iterKey, i.iterValue = i.iter.Prev()
 			continue
 
 		case db.InternalKeyKindMerge:
+			if expiredKey {
+				if i.equal(key.UserKey, i.key) {
+					i.iterKey, i.iterValue = i.iter.Prev()
+					continue
+				}
+				expiredKey = false
+			}
 			if !i.valid {
 				i.keyBuf = append(i.keyBuf[:0], key.UserKey...)
 				i.key = i.keyBuf
@@ -214,7 +363,7 @@ func (i *Iterator) mergeNext(key db.InternalKey) bool {
 			return true
 		}
 		switch key.Kind() {
-		case db.InternalKeyKindDelete:
+		case db.InternalKeyKindDelete, db.InternalKeyKindSingleDelete:
 			// We've hit a deletion tombstone. Return everything up to this
 			// point.
 			return true
@@ -229,6 +378,30 @@ func (i *Iterator) mergeNext(key db.InternalKey) bool {
 			i.value = i.merge(i.key, i.value, i.iterValue, nil)
 			return true
 
+		case db.InternalKeyKindBlobIndex:
+			// We've hit a Set value stored in a blob file. Merge with the existing
+			// value and return.
+			value, ok := i.blobValue(i.iterValue)
+			if !ok {
+				i.valid = false
+				return false
+			}
+			i.value = i.merge(i.key, i.value, value, nil)
+			return true
+
+		case db.InternalKeyKindSetWithExpiry:
+			// We've hit a Set value with an expiration time, which the merged
+			// value inherits. If the entry has expired, the key is hidden along
+			// with it. Otherwise, merge with the existing value and return.
+			value, expired := i.expired(i.iterValue)
+			if expired {
+				i.valid = false
+				i.nextUserKey()
+				return i.findNextEntry()
+			}
+			i.value = i.merge(i.key, i.value, value, nil)
+			return true
+
 		case db.InternalKeyKindMerge:
 			// We've hit another Merge value. Merge with the existing value and
 			// continue looping.
@@ -254,11 +427,30 @@ func (i *Iterator) SeekGE(key []byte) bool {
 	if lowerBound := i.opts.GetLowerBound(); lowerBound != nil && i.cmp(key, lowerBound) < 0 {
 		key = lowerBound
 	}
+	if i.tailing != nil {
+		i.tailing.setKey(key, true /* inclusive */)
+		if i.refreshTailing(); i.err != nil {
+			return false
+		}
+	}
+	return i.seekGE(key)
+}
 
+func (i *Iterator) seekGE(key []byte) bool {
+	i.setPrefix(key)
 	i.iterKey, i.iterValue = i.iter.SeekGE(key)
 	return i.findNextEntry()
 }
 
+// setPrefix sets the prefix that forward iteration is restricted to if prefix
+// iteration is enabled. The prefix is cleared otherwise.
+func (i *Iterator) setPrefix(key []byte) {
+	i.prefix = nil
+	if i.split != nil && i.opts.GetPrefix() {
+		i.prefix = append(i.prefix[:0], key[:i.split(key)]...)
+	}
+}
+
 // SeekLT moves the iterator to the last key/value pair whose key is less than
 // the given key. Returns true if the iterator is pointing at a valid entry and
 // false otherwise.
@@ -266,11 +458,16 @@ func (i *Iterator) SeekLT(key []byte) bool {
 	if i.err != nil {
 		return false
 	}
+	if i.tailing != nil {
+		i.err, i.valid = errTailingReverse, false
+		return false
+	}
 
 	if upperBound := i.opts.GetUpperBound(); upperBound != nil && i.cmp(key, upperBound) >= 0 {
 		key = upperBound
 	}
 
+	i.prefix = nil
 	i.iterKey, i.iterValue = i.iter.SeekLT(key)
 	return i.findPrevEntry()
 }
@@ -281,10 +478,23 @@ func (i *Iterator) First() bool {
 	if i.err != nil {
 		return false
 	}
+	if i.tailing != nil {
+		i.tailing.first = true
+		if i.refreshTailing(); i.err != nil {
+			return false
+		}
+	}
+	return i.first()
+}
 
+func (i *Iterator) first() bool {
 	if lowerBound := i.opts.GetLowerBound(); lowerBound != nil {
+		// NB: the seek to the lower bound is a prefix seek if prefix iteration
+		// is enabled.
+		i.setPrefix(lowerBound)
 		i.iterKey, i.iterValue = i.iter.SeekGE(lowerBound)
 	} else {
+		i.prefix = nil
 		i.iterKey, i.iterValue = i.iter.First()
 	}
 	return i.findNextEntry()
@@ -296,7 +506,12 @@ func (i *Iterator) Last() bool {
 	if i.err != nil {
 		return false
 	}
+	if i.tailing != nil {
+		i.err, i.valid = errTailingReverse, false
+		return false
+	}
 
+	i.prefix = nil
 	if upperBound := i.opts.GetUpperBound(); upperBound != nil {
 		i.iterKey, i.iterValue = i.iter.SeekLT(upperBound)
 	} else {
@@ -311,6 +526,13 @@ func (i *Iterator) Next() bool {
 	if i.err != nil {
 		return false
 	}
+	if i.tailing != nil {
+		return i.nextTailing()
+	}
+	return i.next()
+}
+
+func (i *Iterator) next() bool {
 	switch i.pos {
 	case iterPosCur:
 		i.nextUserKey()
@@ -336,6 +558,10 @@ func (i *Iterator) Prev() bool {
 	if i.err != nil {
 		return false
 	}
+	if i.tailing != nil {
+		i.err, i.valid = errTailingReverse, false
+		return false
+	}
 	switch i.pos {
 	case iterPosCur:
 		i.prevUserKey()
@@ -355,6 +581,175 @@ func (i *Iterator) Prev() bool {
 	return i.findPrevEntry()
 }
 
+// nextTailing moves a tailing iterator to the next key/value pair. If the
+// iterator is exhausted, its view of the DB is refreshed and iteration resumes
+// after the last key returned.
+func (i *Iterator) nextTailing() bool {
+	t := i.tailing
+	if i.valid {
+		t.setKey(i.key, false /* inclusive */)
+		if i.next() || i.err != nil {
+			return i.valid
+		}
+	}
+	if !i.refreshTailing() {
+		return false
+	}
+	if t.first {
+		return i.first()
+	}
+	if !i.seekGE(t.key) || t.inclusive || !i.equal(i.key, t.key) {
+		return i.valid
+	}
+	return i.next()
+}
+
+// refreshTailing replaces the view of the DB of a tailing iterator with the
+// current view if new writes have become visible since the view was created.
+// It returns true if the view was replaced, in which case the iterator needs
+// to be repositioned. New writes usually only change the memtables and add L0
+// files, in which case only the memtable iterators are replaced and iterators
+// over the new L0 files are added (see iterAlloc.refreshMergingIter). The
+// internal iterators are only rebuilt if the other sstables have changed.
+func (i *Iterator) refreshTailing() bool {
+	if atomic.LoadUint64(&i.db.mu.versions.visibleSeqNum) == i.seqNum {
+		return false
+	}
+	readState := i.cf.loadReadState()
+	if readState == nil {
+		i.err, i.valid = ErrColumnFamilyDropped, false
+		return false
+	}
+	ok, err := i.alloc.refreshMergingIter(i.cf, i.readState, readState, i.opts)
+	if !ok {
+		readState.unref()
+		if err != nil {
+			i.err, i.valid = err, false
+			return false
+		}
+		return i.rebuild()
+	}
+	i.readState.unref()
+	i.readState = readState
+	// Determine the seqnum to read at after grabbing the read state (see
+	// DB.newIterInternal).
+	i.seqNum = atomic.LoadUint64(&i.db.mu.versions.visibleSeqNum)
+	i.alloc.merging.snapshot = i.seqNum
+	i.iterKey, i.iterValue, i.valid = nil, nil, false
+	if err != nil {
+		i.err = err
+		return false
+	}
+	return true
+}
+
+// rebuild replaces the internal iterators with iterators over the current
+// readState, leaving the iterator unpositioned. Unless the iterator reads from
+// a snapshot, the memtables and sstables are merged at the current visible
+// sequence number. It returns false if an error was encountered.
+func (i *Iterator) rebuild() bool {
+	readState := i.cf.loadReadState()
+	if readState == nil {
+		i.err, i.valid = ErrColumnFamilyDropped, false
+		return false
+	}
+	// Determine the seqnum to read at after grabbing the read state (see
+	// DB.newIterInternal).
+	if i.snapshot == nil {
+		i.seqNum = atomic.LoadUint64(&i.db.mu.versions.visibleSeqNum)
+	}
+
+	if err := i.iter.Close(); err != nil {
+		i.err = err
+	}
+	i.readState.unref()
+	i.readState = readState
+	i.alloc.merging = mergingIter{}
+	if err := i.alloc.initMergingIter(i.cf, i.batch, readState, i.seqNum, i.opts); err != nil {
+		i.err = err
+	}
+	i.iterKey, i.iterValue, i.valid = nil, nil, false
+	return i.err == nil
+}
+
+// SetBounds changes the lower and upper bounds of the iterator (see
+// IterOptions.LowerBound and IterOptions.UpperBound) without rebuilding it,
+// which is cheaper than closing the iterator and creating a new one. The view
+// of the DB is not changed. The iterator is left unpositioned (Valid() will
+// return false) and must be repositioned via a call to SeekGE, SeekLT, First
+// or Last.
+//
+// The read set of an OptimisticTxn and the locks of a Txn only cover the
+// bounds that an iterator was created with.
+func (i *Iterator) SetBounds(lower, upper []byte) {
+	if i.iter == nil {
+		return
+	}
+	if i.opts != &i.optsBuf {
+		if i.opts != nil {
+			i.optsBuf = *i.opts
+		}
+		i.opts = &i.optsBuf
+	}
+	i.opts.LowerBound = lower
+	i.opts.UpperBound = upper
+	i.iter.SetBounds(lower, upper)
+	i.invalidate()
+}
+
+// SetOptions replaces the options of the iterator. If only the bounds differ
+// from the current options, SetOptions is equivalent to SetBounds. Otherwise
+// the internal iterators are rebuilt, and unless the iterator reads from a
+// snapshot its view of the DB is refreshed to include all of the writes
+// committed before the call. In either case the iterator is left unpositioned
+// (Valid() will return false). Note that Tailing has no effect on iterators
+// over snapshots and batches.
+func (i *Iterator) SetOptions(o *db.IterOptions) {
+	if i.iter == nil {
+		return
+	}
+	if onlyBoundsDiffer(i.opts, o) {
+		i.SetBounds(o.GetLowerBound(), o.GetUpperBound())
+		return
+	}
+	i.optsBuf = db.IterOptions{}
+	if o != nil {
+		i.optsBuf = *o
+	}
+	i.opts = &i.optsBuf
+	i.initTailing()
+	i.rebuild()
+	i.invalidate()
+}
+
+// onlyBoundsDiffer returns true if the options are identical apart from the
+// lower and upper bounds. Table filters are not comparable and are always
+// considered to differ unless both are nil.
+func onlyBoundsDiffer(a, b *db.IterOptions) bool {
+	var za, zb db.IterOptions
+	if a != nil {
+		za = *a
+	}
+	if b != nil {
+		zb = *b
+	}
+	return za.TableFilter == nil && zb.TableFilter == nil &&
+		len(za.BlockPropertyFilters) == 0 && len(zb.BlockPropertyFilters) == 0 &&
+		za.Prefix == zb.Prefix && za.Tailing == zb.Tailing
+}
+
+// invalidate leaves the iterator unpositioned.
+func (i *Iterator) invalidate() {
+	i.iterKey, i.iterValue = nil, nil
+	i.key, i.value = nil, nil
+	i.valid = false
+	i.prefix = nil
+	i.pos = iterPosCur
+	if i.tailing != nil {
+		i.tailing.first = true
+	}
+}
+
 // Key returns the key of the current key/value pair, or nil if done. The
 // caller should not modify the contents of the returned slice, and its
 // contents may change on the next call to Next.
@@ -389,8 +784,10 @@ func (i *Iterator) Close() error {
 		i.readState.unref()
 		i.readState = nil
 	}
-	if err := i.iter.Close(); err != nil && i.err != nil {
-		i.err = err
+	if i.iter != nil {
+		if err := i.iter.Close(); err != nil && i.err != nil {
+			i.err = err
+		}
 	}
 	err := i.err
 	if alloc := i.alloc; alloc != nil {
@@ -13,8 +13,10 @@ import (
 	"testing"
 	"time"
 
+	"github.com/petermattis/pebble/bloom"
 	"github.com/petermattis/pebble/db"
 	"github.com/petermattis/pebble/internal/datadriven"
+	"github.com/petermattis/pebble/vfs"
 	"golang.org/x/exp/rand"
 )
 
@@ -175,6 +177,11 @@ func (f *fakeIter) Close() error {
 	return f.closeErr
 }
 
+func (f *fakeIter) SetBounds(lower, upper []byte) {
+	f.lower = lower
+	f.upper = upper
+}
+
 // testIterator tests creating a combined iterator from a number of sub-
 // iterators. newFunc is a constructor function. splitFunc returns a random
 // split of the testKeyValuePairs slice such that walking a combined iterator
@@ -308,6 +315,8 @@ func TestIterator(t *testing.T) {
 			cmp:   cmp,
 			equal: equal,
 			merge: db.DefaultMerger.Merge,
+			// Use a split function which treats the entire key as the prefix.
+			split: func(a []byte) int { return len(a) },
 			iter:  iter,
 		}
 	}
@@ -329,6 +338,10 @@ func TestIterator(t *testing.T) {
 			var opts db.IterOptions
 
 			for _, arg := range d.CmdArgs {
+				if arg.Key == "prefix" {
+					opts.Prefix = true
+					continue
+				}
 				if len(arg.Vals) != 1 {
 					return fmt.Sprintf("%s: %s=<value>", d.Cmd, arg.Key)
 				}
@@ -358,6 +371,304 @@ func TestIterator(t *testing.T) {
 	})
 }
 
+// countingFilterPolicy wraps a FilterPolicy and counts the number of filter
+// checks which indicated that a key was not present.
+type countingFilterPolicy struct {
+	db.FilterPolicy
+	negatives int
+}
+
+func (c *countingFilterPolicy) MayContain(ftype db.FilterType, filter, key []byte) bool {
+	if !c.FilterPolicy.MayContain(ftype, filter, key) {
+		c.negatives++
+		return false
+	}
+	return true
+}
+
+func TestIteratorPrefix(t *testing.T) {
+	// The prefix of a key is everything up to and including the '@' separator.
+	comparer := *db.DefaultComparer
+	comparer.Name = "test-prefix"
+	comparer.Split = func(a []byte) int {
+		return bytes.IndexByte(a, '@') + 1
+	}
+	filter := &countingFilterPolicy{FilterPolicy: bloom.FilterPolicy(100)}
+
+	d, err := Open("", &db.Options{
+		Comparer: &comparer,
+		FS:       vfs.NewMem(),
+		Levels: []db.LevelOptions{{
+			FilterPolicy: filter,
+			FilterType:   db.TableFilter,
+		}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	set := func(keys ...string) {
+		for _, k := range keys {
+			if err := d.Set([]byte(k), []byte(k), nil); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	set("a@1", "b@1")
+	if err := d.Compact([]byte("a"), []byte("z")); err != nil {
+		t.Fatal(err)
+	}
+	set("c@1")
+	if err := d.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	set("b@2", "e@1")
+	if err := d.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	set("d@1")
+
+	scan := func(opts *db.IterOptions, key string) string {
+		iter := d.NewIter(opts)
+		defer func() {
+			if err := iter.Close(); err != nil {
+				t.Fatal(err)
+			}
+		}()
+		var keys []string
+		for valid := iter.SeekGE([]byte(key)); valid; valid = iter.Next() {
+			keys = append(keys, string(iter.Key()))
+		}
+		return strings.Join(keys, " ")
+	}
+
+	testCases := []struct {
+		prefix bool
+		key    string
+		want   string
+	}{
+		{false, "b@", "b@1 b@2 c@1 d@1 e@1"},
+		{true, "b@", "b@1 b@2"},
+		{true, "c@", "c@1"},
+		{true, "d@", "d@1"},
+		{true, "f@", ""},
+	}
+	for _, c := range testCases {
+		filter.negatives = 0
+		if got := scan(&db.IterOptions{Prefix: c.prefix}, c.key); c.want != got {
+			t.Fatalf("prefix=%t %s: expected %q, but found %q", c.prefix, c.key, c.want, got)
+		}
+		if c.prefix && c.key == "d@" && filter.negatives == 0 {
+			t.Fatalf("expected the prefix filter to exclude sstables")
+		}
+	}
+
+	if err := d.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// rangeDelPropertyCollector records whether an sstable contains range
+// deletion tombstones in the "test.range-dels" user property.
+type rangeDelPropertyCollector struct {
+	rangeDels bool
+}
+
+func (c *rangeDelPropertyCollector) Add(key db.InternalKey, value []byte) error {
+	if key.Kind() == db.InternalKeyKindRangeDelete {
+		c.rangeDels = true
+	}
+	return nil
+}
+
+func (c *rangeDelPropertyCollector) Finish(userProps map[string]string) error {
+	userProps["test.range-dels"] = fmt.Sprint(c.rangeDels)
+	return nil
+}
+
+func (c *rangeDelPropertyCollector) Name() string {
+	return "range-dels"
+}
+
+func TestIteratorTableFilter(t *testing.T) {
+	d, err := Open("", &db.Options{
+		FS: vfs.NewMem(),
+		TablePropertyCollectors: []func() db.TablePropertyCollector{
+			func() db.TablePropertyCollector { return &rangeDelPropertyCollector{} },
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	set := func(keys ...string) {
+		for _, k := range keys {
+			if err := d.Set([]byte(k), []byte(k), nil); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	set("a", "b")
+	if err := d.Compact([]byte("a"), []byte("z")); err != nil {
+		t.Fatal(err)
+	}
+	set("c")
+	if err := d.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.DeleteRange([]byte("b"), []byte("c"), nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	set("d")
+
+	scan := func(opts *db.IterOptions) string {
+		iter := d.NewIter(opts)
+		defer func() {
+			if err := iter.Close(); err != nil {
+				t.Fatal(err)
+			}
+		}()
+		var keys []string
+		for valid := iter.First(); valid; valid = iter.Next() {
+			keys = append(keys, string(iter.Key()))
+		}
+		return strings.Join(keys, " ")
+	}
+
+	var calls int
+	testCases := []struct {
+		filter func(userProps map[string]string) bool
+		calls  int
+		want   string
+	}{
+		{nil, 0, "a c d"},
+		{func(map[string]string) bool { calls++; return true }, 3, "a c d"},
+		{func(map[string]string) bool { calls++; return false }, 3, "d"},
+		// Skipping the sstable containing the range deletion tombstone makes the
+		// deleted key visible.
+		{func(userProps map[string]string) bool {
+			calls++
+			return userProps["test.range-dels"] != "true"
+		}, 3, "a b c d"},
+	}
+	for i, c := range testCases {
+		calls = 0
+		if got := scan(&db.IterOptions{TableFilter: c.filter}); c.want != got {
+			t.Fatalf("%d: expected %q, but found %q", i, c.want, got)
+		}
+		if c.calls != calls {
+			t.Fatalf("%d: expected %d table filter calls, but found %d", i, c.calls, calls)
+		}
+	}
+
+	if err := d.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// maxValueCollector collects the maximum value of the entries in each data
+// block.
+type maxValueCollector struct {
+	max []byte
+}
+
+func (c *maxValueCollector) Add(key db.InternalKey, value []byte) error {
+	if bytes.Compare(value, c.max) > 0 {
+		c.max = append(c.max[:0], value...)
+	}
+	return nil
+}
+
+func (c *maxValueCollector) FinishDataBlock() ([]byte, error) {
+	prop := append([]byte(nil), c.max...)
+	c.max = c.max[:0]
+	return prop, nil
+}
+
+func (c *maxValueCollector) Name() string {
+	return "max-value"
+}
+
+// minValueFilter skips data blocks which only contain values less than min.
+type minValueFilter struct {
+	min []byte
+}
+
+func (f minValueFilter) Intersects(prop []byte) (bool, error) {
+	return bytes.Compare(prop, f.min) >= 0, nil
+}
+
+func (f minValueFilter) Name() string {
+	return "max-value"
+}
+
+func TestIteratorBlockPropertyFilter(t *testing.T) {
+	d, err := Open("", &db.Options{
+		FS: vfs.NewMem(),
+		BlockPropertyCollectors: []func() db.BlockPropertyCollector{
+			func() db.BlockPropertyCollector { return &maxValueCollector{} },
+		},
+		// A block size of 1 places every key in its own data block.
+		Levels: []db.LevelOptions{{BlockSize: 1}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	set := func(kvs ...string) {
+		for _, kv := range kvs {
+			if err := d.Set([]byte(kv[:1]), []byte(kv[1:]), nil); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	set("a1", "b5", "c2")
+	if err := d.Compact([]byte("a"), []byte("z")); err != nil {
+		t.Fatal(err)
+	}
+	set("d7", "e3")
+	if err := d.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	set("f1")
+
+	scan := func(opts *db.IterOptions) string {
+		iter := d.NewIter(opts)
+		defer func() {
+			if err := iter.Close(); err != nil {
+				t.Fatal(err)
+			}
+		}()
+		var keys []string
+		for valid := iter.First(); valid; valid = iter.Next() {
+			keys = append(keys, string(iter.Key()))
+		}
+		return strings.Join(keys, " ")
+	}
+
+	testCases := []struct {
+		filters []db.BlockPropertyFilter
+		want    string
+	}{
+		{nil, "a b c d e f"},
+		{[]db.BlockPropertyFilter{minValueFilter{[]byte("3")}}, "b d e f"},
+		{[]db.BlockPropertyFilter{minValueFilter{[]byte("6")}}, "d f"},
+		{[]db.BlockPropertyFilter{minValueFilter{[]byte("9")}}, "f"},
+	}
+	for i, c := range testCases {
+		if got := scan(&db.IterOptions{BlockPropertyFilters: c.filters}); c.want != got {
+			t.Fatalf("%d: expected %q, but found %q", i, c.want, got)
+		}
+	}
+
+	if err := d.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
 func BenchmarkIteratorSeekGE(b *testing.B) {
 	m, keys := buildMemTable(b)
 	iter := &Iterator{
@@ -407,3 +718,388 @@ func BenchmarkIteratorPrev(b *testing.B) {
 		iter.Prev()
 	}
 }
+
+func TestIteratorTailing(t *testing.T) {
+	d, err := Open("", &db.Options{FS: vfs.NewMem()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+
+	set := func(keys ...string) {
+		for _, k := range keys {
+			if err := d.Set([]byte(k), []byte(k), db.NoSync); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	// next returns the keys returned by the iterator until it is exhausted.
+	next := func(iter *Iterator) string {
+		var keys []string
+		for iter.Next() {
+			keys = append(keys, string(iter.Key()))
+		}
+		if err := iter.Error(); err != nil {
+			t.Fatal(err)
+		}
+		return strings.Join(keys, ",")
+	}
+	expect := func(expected, actual string) {
+		t.Helper()
+		if expected != actual {
+			t.Fatalf("expected %q, but found %q", expected, actual)
+		}
+	}
+
+	set("b", "c")
+	iter := d.NewIter(&db.IterOptions{Tailing: true, UpperBound: []byte("y")})
+	if !iter.First() {
+		t.Fatal("expected valid iterator")
+	}
+	expect("b", string(iter.Key()))
+	expect("c", next(iter))
+	expect("", next(iter))
+
+	// Writes after the last key returned are observed once they are visible,
+	// while writes before it are not.
+	set("a", "d", "e")
+	expect("d,e", next(iter))
+	if err := d.Delete([]byte("e"), db.NoSync); err != nil {
+		t.Fatal(err)
+	}
+	set("f")
+	expect("f", next(iter))
+
+	// The iterator observes the memtables and sstables created by flushes and
+	// compactions.
+	set("g")
+	if err := d.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	expect("g", next(iter))
+	set("h")
+	if err := d.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Compact([]byte("a"), []byte("z")); err != nil {
+		t.Fatal(err)
+	}
+	set("i", "z")
+	expect("h,i", next(iter))
+
+	// Seeking observes new writes.
+	set("ca")
+	if !iter.SeekGE([]byte("c")) {
+		t.Fatal("expected valid iterator")
+	}
+	expect("c", string(iter.Key()))
+	expect("ca,d,f,g,h,i", next(iter))
+
+	// Reverse iteration is not supported.
+	if iter.Prev() {
+		t.Fatal("expected invalid iterator")
+	}
+	if err := iter.Close(); err != errTailingReverse {
+		t.Fatalf("expected %v, but found %v", errTailingReverse, err)
+	}
+
+	// An iterator which was exhausted before returning a key resumes from the
+	// start, or the key it was seeked to.
+	for _, c := range []struct {
+		seek     func(iter *Iterator) bool
+		expected string
+	}{
+		{func(iter *Iterator) bool { return iter.First() }, "ja,jb"},
+		{func(iter *Iterator) bool { return iter.SeekGE([]byte("jb")) }, "jb"},
+	} {
+		iter := d.NewIter(&db.IterOptions{
+			Tailing: true, LowerBound: []byte("j"), UpperBound: []byte("k"),
+		})
+		if c.seek(iter) {
+			t.Fatalf("expected invalid iterator, but found %q", iter.Key())
+		}
+		set("ja", "jb")
+		expect(c.expected, next(iter))
+		if err := iter.Close(); err != nil {
+			t.Fatal(err)
+		}
+		for _, k := range []string{"ja", "jb"} {
+			if err := d.Delete([]byte(k), db.NoSync); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+}
+
+func TestIteratorTailingRefresh(t *testing.T) {
+	d, err := Open("", &db.Options{FS: vfs.NewMem()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+
+	// Record the sstables opened by the iterators.
+	var opened []uint64
+	newIters := d.columnFamily.newIters
+	d.columnFamily.newIters = func(
+		meta *fileMetadata, opts *db.IterOptions,
+	) (internalIterator, internalIterator, error) {
+		opened = append(opened, meta.fileNum)
+		return newIters(meta, opts)
+	}
+
+	set := func(keys ...string) {
+		for _, k := range keys {
+			if err := d.Set([]byte(k), []byte(k), db.NoSync); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	flush := func() {
+		if err := d.Flush(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	seek := func(iter *Iterator, key string) string {
+		t.Helper()
+		if !iter.SeekGE([]byte(key)) {
+			t.Fatalf("expected valid iterator")
+		}
+		keys := []string{string(iter.Key())}
+		for iter.Next() {
+			keys = append(keys, string(iter.Key()))
+		}
+		if err := iter.Error(); err != nil {
+			t.Fatal(err)
+		}
+		return strings.Join(keys, ",")
+	}
+	files := func(level int) []uint64 {
+		d.mu.Lock()
+		defer d.mu.Unlock()
+		var fileNums []uint64
+		for _, f := range d.mu.versions.currentVersion().files[level] {
+			fileNums = append(fileNums, f.fileNum)
+		}
+		return fileNums
+	}
+
+	set("a", "b", "c")
+	flush()
+	if err := d.Compact([]byte("a"), []byte("z")); err != nil {
+		t.Fatal(err)
+	}
+	l6 := files(numLevels - 1)
+	if len(l6) != 1 || len(files(0)) != 0 {
+		t.Fatalf("expected a single L6 file, but found %d %d", files(0), l6)
+	}
+
+	iter := d.NewIter(&db.IterOptions{Tailing: true})
+	if !iter.SeekGE([]byte("b")) {
+		t.Fatalf("expected valid iterator")
+	}
+
+	// A flush only adds an iterator over the new L0 file. The level iterator
+	// positioned in the L6 file is retained.
+	set("d")
+	flush()
+	l0 := files(0)
+	if len(l0) != 1 {
+		t.Fatalf("expected a single L0 file, but found %d", l0)
+	}
+	opened = nil
+	if s := seek(iter, "b"); s != "b,c,d" {
+		t.Fatalf("expected %q, but found %q", "b,c,d", s)
+	}
+	if len(opened) != 1 || opened[0] != l0[0] {
+		t.Fatalf("expected only %d to be opened, but found %d", l0, opened)
+	}
+
+	// A compaction replaces the files below L0, which rebuilds the iterator.
+	if err := d.Compact([]byte("a"), []byte("z")); err != nil {
+		t.Fatal(err)
+	}
+	set("e")
+	if s := seek(iter, "a"); s != "a,b,c,d,e" {
+		t.Fatalf("expected %q, but found %q", "a,b,c,d,e", s)
+	}
+	if err := iter.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestIteratorSetBounds(t *testing.T) {
+	d, err := Open("", &db.Options{FS: vfs.NewMem()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+
+	set := func(keys ...string) {
+		for _, k := range keys {
+			if err := d.Set([]byte(k), []byte(k), db.NoSync); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	// scan returns the keys returned by the iterator in forward order, and
+	// verifies that reverse iteration returns the same keys.
+	scan := func(iter *Iterator) string {
+		t.Helper()
+		var fwd, rev []string
+		for valid := iter.First(); valid; valid = iter.Next() {
+			fwd = append(fwd, string(iter.Key()))
+		}
+		for valid := iter.Last(); valid; valid = iter.Prev() {
+			rev = append([]string{string(iter.Key())}, rev...)
+		}
+		if err := iter.Error(); err != nil {
+			t.Fatal(err)
+		}
+		if f, r := strings.Join(fwd, ","), strings.Join(rev, ","); f != r {
+			t.Fatalf("forward iteration found %q, but reverse iteration found %q", f, r)
+		}
+		return strings.Join(fwd, ",")
+	}
+	bound := func(s string) []byte {
+		if s == "" {
+			return nil
+		}
+		return []byte(s)
+	}
+
+	// Spread the keys across the sstables in L1 and below, an sstable in L0,
+	// the memtable and an indexed batch.
+	set("a", "b", "c")
+	if err := d.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	set("x", "y")
+	if err := d.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Compact([]byte("a"), []byte("z")); err != nil {
+		t.Fatal(err)
+	}
+	set("d", "e")
+	if err := d.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	set("f", "z")
+	b := d.NewIndexedBatch()
+	defer b.Close()
+	if err := b.Set([]byte("g"), []byte("g"), nil); err != nil {
+		t.Fatal(err)
+	}
+
+	testCases := []struct {
+		lower, upper string
+		db, batch    string
+	}{
+		{"b", "y", "b,c,d,e,f,x", "b,c,d,e,f,g,x"},
+		{"", "", "a,b,c,d,e,f,x,y,z", "a,b,c,d,e,f,g,x,y,z"},
+		{"bb", "e", "c,d", "c,d"},
+		{"w", "ya", "x,y", "x,y"},
+		{"c", "", "c,d,e,f,x,y,z", "c,d,e,f,g,x,y,z"},
+		{"", "c", "a,b", "a,b"},
+		{"e", "x", "e,f", "e,f,g"},
+	}
+	for _, r := range []Reader{d, b} {
+		opts := &db.IterOptions{LowerBound: []byte("b"), UpperBound: []byte("e")}
+		iter := r.NewIter(opts)
+		if !iter.SeekGE([]byte("c")) {
+			t.Fatal("expected valid iterator")
+		}
+		iter.SetBounds([]byte("a"), []byte("y"))
+		if iter.Valid() {
+			t.Fatal("expected invalid iterator")
+		}
+
+		for _, c := range testCases {
+			iter.SetBounds(bound(c.lower), bound(c.upper))
+			expected := c.db
+			if r == b {
+				expected = c.batch
+			}
+			if actual := scan(iter); expected != actual {
+				t.Fatalf("[%s,%s): expected %q, but found %q", c.lower, c.upper, expected, actual)
+			}
+		}
+		// The options passed to NewIter are not modified.
+		if string(opts.LowerBound) != "b" || string(opts.UpperBound) != "e" {
+			t.Fatalf("unexpected modification of options: %+v", opts)
+		}
+		if err := iter.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestIteratorSetOptions(t *testing.T) {
+	d, err := Open("", &db.Options{FS: vfs.NewMem()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+
+	set := func(keys ...string) {
+		for _, k := range keys {
+			if err := d.Set([]byte(k), []byte(k), db.NoSync); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	scan := func(iter *Iterator) string {
+		var keys []string
+		for valid := iter.First(); valid; valid = iter.Next() {
+			keys = append(keys, string(iter.Key()))
+		}
+		if err := iter.Error(); err != nil {
+			t.Fatal(err)
+		}
+		return strings.Join(keys, ",")
+	}
+	expect := func(expected, actual string) {
+		t.Helper()
+		if expected != actual {
+			t.Fatalf("expected %q, but found %q", expected, actual)
+		}
+	}
+
+	set("a", "b")
+	if err := d.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	set("c")
+	iter := d.NewIter(nil)
+	expect("a,b,c", scan(iter))
+
+	// Changing only the bounds does not change the iterator's view of the DB.
+	set("d")
+	iter.SetOptions(&db.IterOptions{LowerBound: []byte("b")})
+	expect("b,c", scan(iter))
+
+	// Changing other options rebuilds the iterator, refreshing its view of the
+	// DB.
+	iter.SetOptions(&db.IterOptions{
+		LowerBound:  []byte("b"),
+		TableFilter: func(map[string]string) bool { return false },
+	})
+	expect("c,d", scan(iter))
+	iter.SetOptions(nil)
+	expect("a,b,c,d", scan(iter))
+
+	// An iterator over a snapshot retains the view of the snapshot.
+	snap := d.NewSnapshot()
+	defer snap.Close()
+	set("e")
+	siter := snap.NewIter(nil)
+	siter.SetOptions(&db.IterOptions{TableFilter: func(map[string]string) bool { return true }})
+	expect("a,b,c,d", scan(siter))
+
+	for _, it := range []*Iterator{iter, siter} {
+		if err := it.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
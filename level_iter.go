@@ -32,8 +32,12 @@ type tableNewIters func(
 type levelIter struct {
 	opts      *db.IterOptions
 	tableOpts *db.IterOptions
-	cmp       db.Compare
-	index     int
+	// The lower and upper bounds of the iterator, initialized from opts and
+	// changed by SetBounds.
+	lower []byte
+	upper []byte
+	cmp   db.Compare
+	index int
 	// The key to return when iterating past an sstable boundary and that
 	// boundary is a range deletion tombstone. Note that if boundary != nil, then
 	// iter == nil, and if iter != nil, then boundary == nil.
@@ -55,6 +59,14 @@ type levelIter struct {
 	// - `boundary` can hold either the lower- or upper-bound, depending on the iterator direction.
 	// - `boundary` is not exposed to the next higher-level iterator, i.e., `mergingIter`.
 	largestUserKey *[]byte
+	// split, prefix and prefixKey support IterOptions.Prefix. If prefix
+	// iteration is enabled, prefixKey holds a copy of the key passed to the
+	// most recent call to SeekGE and prefix holds its prefix as determined by
+	// split. Otherwise, or if the iterator was last positioned by a call other
+	// than SeekGE, prefix is nil.
+	split     db.Split
+	prefix    []byte
+	prefixKey []byte
 }
 
 // levelIter implements the internalIterator interface.
@@ -72,12 +84,18 @@ func (l *levelIter) init(
 	opts *db.IterOptions, cmp db.Compare, newIters tableNewIters, files []fileMetadata,
 ) {
 	l.opts = opts
+	l.lower = opts.GetLowerBound()
+	l.upper = opts.GetUpperBound()
 	l.cmp = cmp
 	l.index = -1
 	l.newIters = newIters
 	l.files = files
 }
 
+func (l *levelIter) initSplit(split db.Split) {
+	l.split = split
+}
+
 func (l *levelIter) initRangeDel(rangeDelIter *internalIterator) {
 	l.rangeDelIter = rangeDelIter
 }
@@ -135,7 +153,7 @@ func (l *levelIter) loadFile(index, dir int) bool {
 		}
 
 		f := &l.files[l.index]
-		lowerBound := l.opts.GetLowerBound()
+		lowerBound := l.lower
 		if lowerBound != nil {
 			if l.cmp(f.largest.UserKey, lowerBound) < 0 {
 				// The largest key in the sstable is smaller than the lower bound.
@@ -151,7 +169,7 @@ func (l *levelIter) loadFile(index, dir int) bool {
 				lowerBound = nil
 			}
 		}
-		upperBound := l.opts.GetUpperBound()
+		upperBound := l.upper
 		if upperBound != nil {
 			if l.cmp(f.smallest.UserKey, upperBound) >= 0 {
 				// The smallest key in the sstable is greater than or equal to the
@@ -169,13 +187,31 @@ func (l *levelIter) loadFile(index, dir int) bool {
 			}
 		}
 
+		if l.prefix != nil && dir > 0 {
+			smallest := f.smallest.UserKey
+			if l.cmp(smallest[:l.split(smallest)], l.prefix) > 0 {
+				// The prefix of the smallest key in the sstable is greater than the
+				// iteration prefix. Neither this sstable nor any subsequent one can
+				// contain a key with the iteration prefix.
+				return false
+			}
+		}
+
 		var opts *db.IterOptions
-		if lowerBound != nil || upperBound != nil {
+		if l.opts != nil || l.lower != nil || l.upper != nil {
+			// Pass through the iterator options (e.g. TableFilter) with the bounds
+			// trimmed for the sstable. Prefix is only passed if the levelIter was
+			// positioned by a prefix SeekGE.
 			if l.tableOpts == nil {
 				l.tableOpts = &db.IterOptions{}
 			}
+			*l.tableOpts = db.IterOptions{}
+			if l.opts != nil {
+				*l.tableOpts = *l.opts
+			}
 			l.tableOpts.LowerBound = lowerBound
 			l.tableOpts.UpperBound = upperBound
+			l.tableOpts.Prefix = l.prefix != nil
 			opts = l.tableOpts
 		}
 
@@ -197,6 +233,11 @@ func (l *levelIter) loadFile(index, dir int) bool {
 func (l *levelIter) SeekGE(key []byte) (*db.InternalKey, []byte) {
 	// NB: the top-level Iterator has already adjusted key based on
 	// IterOptions.LowerBound.
+	l.prefix = nil
+	if l.split != nil && l.opts.GetPrefix() {
+		l.prefixKey = append(l.prefixKey[:0], key...)
+		l.prefix = l.prefixKey[:l.split(l.prefixKey)]
+	}
 	if !l.loadFile(l.findFileGE(key), 1) {
 		return nil, nil
 	}
@@ -209,6 +250,7 @@ func (l *levelIter) SeekGE(key []byte) (*db.InternalKey, []byte) {
 func (l *levelIter) SeekLT(key []byte) (*db.InternalKey, []byte) {
 	// NB: the top-level Iterator has already adjusted key based on
 	// IterOptions.UpperBound.
+	l.prefix = nil
 	if !l.loadFile(l.findFileLT(key), -1) {
 		return nil, nil
 	}
@@ -221,6 +263,7 @@ func (l *levelIter) SeekLT(key []byte) (*db.InternalKey, []byte) {
 func (l *levelIter) First() (*db.InternalKey, []byte) {
 	// NB: the top-level Iterator will call SeekGE if IterOptions.LowerBound is
 	// set.
+	l.prefix = nil
 	if !l.loadFile(0, 1) {
 		return nil, nil
 	}
@@ -233,6 +276,7 @@ func (l *levelIter) First() (*db.InternalKey, []byte) {
 func (l *levelIter) Last() (*db.InternalKey, []byte) {
 	// NB: the top-level Iterator will call SeekLT if IterOptions.UpperBound is
 	// set.
+	l.prefix = nil
 	if !l.loadFile(len(l.files)-1, -1) {
 		return nil, nil
 	}
@@ -250,7 +294,7 @@ func (l *levelIter) Next() (*db.InternalKey, []byte) {
 	if l.iter == nil {
 		if l.boundary != nil {
 			if l.loadFile(l.index+1, 1) {
-				if key, val := l.iter.First(); key != nil {
+				if key, val := l.iterFirst(); key != nil {
 					return key, val
 				}
 				return l.skipEmptyFileForward()
@@ -306,10 +350,22 @@ func (l *levelIter) Prev() (*db.InternalKey, []byte) {
 	return l.skipEmptyFileBackward()
 }
 
+// iterFirst positions the iterator for the current file at its first entry.
+// If the levelIter was positioned by a prefix SeekGE, the file is instead
+// positioned with SeekGE(prefixKey). Every key in a subsequent file is greater
+// than or equal to prefixKey so the result is the same, but the table's prefix
+// filter is consulted before any data blocks are loaded.
+func (l *levelIter) iterFirst() (*db.InternalKey, []byte) {
+	if l.prefix != nil {
+		return l.iter.SeekGE(l.prefixKey)
+	}
+	return l.iter.First()
+}
+
 func (l *levelIter) skipEmptyFileForward() (*db.InternalKey, []byte) {
 	var key *db.InternalKey
 	var val []byte
-	for ; key == nil; key, val = l.iter.First() {
+	for ; key == nil; key, val = l.iterFirst() {
 		if l.err = l.iter.Close(); l.err != nil {
 			return nil, nil
 		}
@@ -393,6 +449,25 @@ func (l *levelIter) Error() error {
 	return l.iter.Error()
 }
 
+func (l *levelIter) SetBounds(lower, upper []byte) {
+	l.lower = lower
+	l.upper = upper
+	if l.iter == nil {
+		return
+	}
+	// Trim the bounds for the current sstable as done by loadFile. Note that
+	// the current sstable may lie outside the new bounds, in which case the
+	// sstable iterator is exhausted as soon as it is positioned.
+	f := &l.files[l.index]
+	if lower != nil && l.cmp(lower, f.smallest.UserKey) < 0 {
+		lower = nil
+	}
+	if upper != nil && l.cmp(upper, f.largest.UserKey) > 0 {
+		upper = nil
+	}
+	l.iter.SetBounds(lower, upper)
+}
+
 func (l *levelIter) Close() error {
 	if l.iter != nil {
 		l.err = l.iter.Close()
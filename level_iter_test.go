@@ -59,6 +59,10 @@ func TestLevelIter(t *testing.T) {
 		case "iter":
 			var opts db.IterOptions
 			for _, arg := range d.CmdArgs {
+				if arg.Key == "prefix" {
+					opts.Prefix = true
+					continue
+				}
 				if len(arg.Vals) != 1 {
 					return fmt.Sprintf("%s: %s=<value>", d.Cmd, arg.Key)
 				}
@@ -73,6 +77,8 @@ func TestLevelIter(t *testing.T) {
 			}
 
 			iter := newLevelIter(&opts, db.DefaultComparer.Compare, newIters, files)
+			// Use a split function which treats the entire key as the prefix.
+			iter.initSplit(func(a []byte) int { return len(a) })
 			defer iter.Close()
 			return runInternalIterCmd(d, iter)
 
@@ -120,6 +126,43 @@ func TestLevelIter(t *testing.T) {
 	})
 }
 
+func TestLevelIterPrefixOptions(t *testing.T) {
+	var files []fileMetadata
+	var iters []*fakeIter
+	for _, key := range []string{"a", "b"} {
+		ikey := db.ParseInternalKey(key + ".SET.1")
+		iters = append(iters, &fakeIter{keys: []db.InternalKey{ikey}, vals: [][]byte{[]byte(key)}})
+		files = append(files, fileMetadata{fileNum: uint64(len(files)), smallest: ikey, largest: ikey})
+	}
+
+	// prefixes records the Prefix option passed when loading each sstable.
+	var prefixes []bool
+	newIters := func(
+		meta *fileMetadata, opts *db.IterOptions,
+	) (internalIterator, internalIterator, error) {
+		prefixes = append(prefixes, opts.GetPrefix())
+		f := *iters[meta.fileNum]
+		return &f, nil, nil
+	}
+
+	opts := &db.IterOptions{Prefix: true}
+	iter := newLevelIter(opts, db.DefaultComparer.Compare, newIters, files)
+	iter.initSplit(func(a []byte) int { return len(a) })
+	defer iter.Close()
+
+	// Only the sstable loaded by the prefix SeekGE is iterated with the Prefix
+	// option, and not the sstable loaded by the subsequent First.
+	if key, _ := iter.SeekGE([]byte("b")); key == nil || string(key.UserKey) != "b" {
+		t.Fatalf("expected b, but found %v", key)
+	}
+	if key, _ := iter.First(); key == nil || string(key.UserKey) != "a" {
+		t.Fatalf("expected a, but found %v", key)
+	}
+	if expected, actual := "[true false]", fmt.Sprint(prefixes); expected != actual {
+		t.Fatalf("expected %s, but found %s", expected, actual)
+	}
+}
+
 func TestLevelIterBoundaries(t *testing.T) {
 	cmp := db.DefaultComparer.Compare
 	mem := vfs.NewMem()
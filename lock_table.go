@@ -0,0 +1,242 @@
+// Copyright 2019 The LevelDB-Go and Pebble Authors. All rights reserved. Use
+// of this source code is governed by a BSD-style license that can be found in
+// the LICENSE file.
+
+package pebble
+
+import (
+	"errors"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/petermattis/pebble/db"
+)
+
+// ErrLockTimeout is returned when a lock could not be acquired within the
+// lock timeout of a transaction (see TxnOptions.LockTimeout).
+var ErrLockTimeout = errors.New("pebble: lock timeout")
+
+// ErrDeadlock is returned when acquiring a lock would create a cycle of
+// transactions waiting on each other's locks. The lock is not acquired. The
+// transaction should be rolled back and retried.
+var ErrDeadlock = errors.New("pebble: deadlock detected")
+
+// LockMode is the mode of a lock on a key or key range.
+type LockMode int
+
+const (
+	// LockShared is a lock which can be held by several transactions at once.
+	LockShared LockMode = iota
+	// LockExclusive is a lock which can only be held by a single transaction.
+	LockExclusive
+)
+
+// lock is a lock held by a transaction on a key or key range.
+type lock struct {
+	txnID uint64
+	mode  LockMode
+	span  txnSpan
+}
+
+// pointLocks are the point locks on a key.
+type pointLocks struct {
+	key   []byte
+	locks []*lock
+}
+
+// lockTable tracks the locks held by transactions on keys and key ranges, and
+// the transactions waiting to acquire locks. Two locks conflict if their spans
+// intersect, they are held by different transactions, and at least one of the
+// locks is exclusive.
+//
+// A transaction waiting on a lock records the transactions holding the
+// conflicting locks in a waits-for graph. A deadlock is detected when a
+// transaction is about to wait on a transaction which (transitively) waits on
+// it, in which case the lock request fails with ErrDeadlock. Waiters are woken
+// whenever a lock is released in order to retry their lock request.
+type lockTable struct {
+	cmp       db.Compare
+	mu        sync.Mutex
+	nextTxnID uint64
+	// The point locks, sorted by key. Keys are compared using cmp, as distinct
+	// byte strings may be equal according to cmp.
+	points []pointLocks
+	// The range locks.
+	ranges []*lock
+	// The IDs of the transactions each waiting transaction is waiting on.
+	waitsFor map[uint64][]uint64
+	// Closed and replaced whenever locks are released.
+	released chan struct{}
+}
+
+func (lt *lockTable) init(cmp db.Compare) {
+	lt.cmp = cmp
+	lt.waitsFor = make(map[uint64][]uint64)
+	lt.released = make(chan struct{})
+}
+
+// newTxnID returns a new transaction ID.
+func (lt *lockTable) newTxnID() uint64 {
+	lt.mu.Lock()
+	defer lt.mu.Unlock()
+	lt.nextTxnID++
+	return lt.nextTxnID
+}
+
+// acquire acquires the lock l, waiting for conflicting locks to be released.
+// A zero timeout waits indefinitely, while a negative timeout fails
+// immediately if the lock cannot be acquired.
+func (lt *lockTable) acquire(l *lock, timeout time.Duration) error {
+	var timer *time.Timer
+	var expired <-chan time.Time
+	defer func() {
+		if timer != nil {
+			timer.Stop()
+		}
+	}()
+
+	lt.mu.Lock()
+	defer lt.mu.Unlock()
+	defer delete(lt.waitsFor, l.txnID)
+
+	for {
+		holders := lt.conflictsLocked(l)
+		if len(holders) == 0 {
+			lt.insertLocked(l)
+			return nil
+		}
+		if timeout < 0 {
+			return ErrLockTimeout
+		}
+		lt.waitsFor[l.txnID] = holders
+		if lt.deadlockedLocked(l.txnID) {
+			return ErrDeadlock
+		}
+		if timeout > 0 && timer == nil {
+			timer = time.NewTimer(timeout)
+			expired = timer.C
+		}
+
+		released := lt.released
+		lt.mu.Unlock()
+		select {
+		case <-released:
+			lt.mu.Lock()
+		case <-expired:
+			lt.mu.Lock()
+			return ErrLockTimeout
+		}
+	}
+}
+
+// release releases the specified locks, waking any waiting transactions.
+func (lt *lockTable) release(locks []*lock) {
+	if len(locks) == 0 {
+		return
+	}
+	lt.mu.Lock()
+	defer lt.mu.Unlock()
+	for _, l := range locks {
+		if l.span.point {
+			i := lt.searchPointsLocked(l.span.start)
+			p := &lt.points[i]
+			p.locks = removeLock(p.locks, l)
+			if len(p.locks) == 0 {
+				lt.points = append(lt.points[:i], lt.points[i+1:]...)
+			}
+		} else {
+			lt.ranges = removeLock(lt.ranges, l)
+		}
+	}
+	close(lt.released)
+	lt.released = make(chan struct{})
+}
+
+func removeLock(locks []*lock, l *lock) []*lock {
+	for i := range locks {
+		if locks[i] == l {
+			locks[i] = locks[len(locks)-1]
+			locks[len(locks)-1] = nil
+			return locks[:len(locks)-1]
+		}
+	}
+	return locks
+}
+
+// searchPointsLocked returns the index of the first point locks whose key is
+// greater than or equal to key. Requires lockTable.mu is held.
+func (lt *lockTable) searchPointsLocked(key []byte) int {
+	return sort.Search(len(lt.points), func(i int) bool {
+		return lt.cmp(lt.points[i].key, key) >= 0
+	})
+}
+
+func (lt *lockTable) insertLocked(l *lock) {
+	if !l.span.point {
+		lt.ranges = append(lt.ranges, l)
+		return
+	}
+	i := lt.searchPointsLocked(l.span.start)
+	if i == len(lt.points) || lt.cmp(lt.points[i].key, l.span.start) != 0 {
+		lt.points = append(lt.points, pointLocks{})
+		copy(lt.points[i+1:], lt.points[i:])
+		lt.points[i] = pointLocks{key: l.span.start}
+	}
+	lt.points[i].locks = append(lt.points[i].locks, l)
+}
+
+// conflictsLocked returns the IDs of the transactions holding locks which
+// conflict with l. Requires lockTable.mu is held.
+func (lt *lockTable) conflictsLocked(l *lock) []uint64 {
+	var holders []uint64
+	check := func(o *lock) {
+		if o.txnID == l.txnID || (o.mode == LockShared && l.mode == LockShared) {
+			return
+		}
+		if !o.span.intersects(lt.cmp, &l.span) {
+			return
+		}
+		for _, id := range holders {
+			if id == o.txnID {
+				return
+			}
+		}
+		holders = append(holders, o.txnID)
+	}
+
+	// Only the point locks within the span need to be checked.
+	i := 0
+	if l.span.start != nil {
+		i = lt.searchPointsLocked(l.span.start)
+	}
+	for ; i < len(lt.points) && l.span.contains(lt.cmp, lt.points[i].key); i++ {
+		for _, o := range lt.points[i].locks {
+			check(o)
+		}
+	}
+	for _, o := range lt.ranges {
+		check(o)
+	}
+	return holders
+}
+
+// deadlockedLocked returns true if the transaction waits (transitively) on
+// itself. Requires lockTable.mu is held.
+func (lt *lockTable) deadlockedLocked(txnID uint64) bool {
+	visited := make(map[uint64]bool)
+	stack := append([]uint64(nil), lt.waitsFor[txnID]...)
+	for len(stack) > 0 {
+		id := stack[len(stack)-1]
+		stack = stack[:len(stack)-1]
+		if id == txnID {
+			return true
+		}
+		if visited[id] {
+			continue
+		}
+		visited[id] = true
+		stack = append(stack, lt.waitsFor[id]...)
+	}
+	return false
+}
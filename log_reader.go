@@ -0,0 +1,68 @@
+// Copyright 2019 The LevelDB-Go and Pebble Authors. All rights reserved. Use
+// of this source code is governed by a BSD-style license that can be found in
+// the LICENSE file.
+
+package pebble
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+
+	"github.com/petermattis/pebble/internal/record"
+	"github.com/petermattis/pebble/vfs"
+)
+
+// LogReader reads the batches contained in a write-ahead log, in sequence
+// number order.
+type LogReader struct {
+	file    vfs.File
+	fileNum uint64
+	rr      *record.Reader
+	buf     bytes.Buffer
+}
+
+// NewLogReader returns a LogReader for the batches contained in the log file
+// with the specified file number. The LogReader takes ownership of the file,
+// which is closed by LogReader.Close.
+func NewLogReader(file vfs.File, fileNum uint64) *LogReader {
+	return &LogReader{
+		file:    file,
+		fileNum: fileNum,
+		rr:      record.NewReader(file, fileNum),
+	}
+}
+
+// Next returns the next batch in the log, along with its sequence number. The
+// batch is not indexed, and may be applied to a DB. Next returns io.EOF once
+// the end of the log has been reached.
+func (r *LogReader) Next() (seqNum uint64, batch *Batch, err error) {
+	rec, err := r.rr.Next()
+	if err == nil {
+		r.buf.Reset()
+		_, err = io.Copy(&r.buf, rec)
+	}
+	if err != nil {
+		// It is common to encounter a zeroed or invalid chunk due to WAL
+		// preallocation and WAL recycling, and a log which is still being
+		// written may end with a partially written record. All of these are
+		// treated like EOF.
+		if err == io.ErrUnexpectedEOF || err == record.ErrZeroedChunk ||
+			err == record.ErrInvalidChunk {
+			err = io.EOF
+		}
+		return 0, nil, err
+	}
+	if r.buf.Len() < batchHeaderLen {
+		return 0, nil, fmt.Errorf("pebble: corrupt log file %06d.log", r.fileNum)
+	}
+
+	b := &Batch{}
+	b.storage.data = append([]byte(nil), r.buf.Bytes()...)
+	return b.seqNum(), b, nil
+}
+
+// Close closes the log file.
+func (r *LogReader) Close() error {
+	return r.file.Close()
+}
@@ -42,6 +42,12 @@ func memTableEntrySize(keyBytes, valueBytes int) uint32 {
 // commitPipeline serializes batch preparation, and allows batch application to
 // proceed concurrently.
 //
+// The memtable for the default column family also holds a memtable for each of
+// the other column families, all of which share the WAL of the default
+// memtable. The column family memtables are prepared, applied, and flushed
+// together with the default memtable, which holds the references and flushed
+// state for all of them.
+//
 // It is safe to call get, apply, newIter, and newRangeDelIter concurrently.
 type memTable struct {
 	cmp         db.Compare
@@ -55,6 +61,9 @@ type memTable struct {
 	tombstones  rangeTombstoneCache
 	logNum      uint64
 	logSize     uint64
+	// The memtables for the column families other than the default column
+	// family, keyed by column family ID.
+	columnFamilies map[uint32]*memTable
 }
 
 // newMemTable returns a new MemTable.
@@ -111,7 +120,8 @@ func (m *memTable) get(key []byte) (value []byte, err error) {
 	if !m.equal(key, ikey.UserKey) {
 		return nil, db.ErrNotFound
 	}
-	if ikey.Kind() == db.InternalKeyKindDelete {
+	switch ikey.Kind() {
+	case db.InternalKeyKindDelete, db.InternalKeyKindSingleDelete:
 		return nil, db.ErrNotFound
 	}
 	return val, nil
@@ -122,35 +132,73 @@ func (m *memTable) get(key []byte) (value []byte, err error) {
 // that prepare is not thread-safe, while apply is. The caller must call
 // unref() after the batch has been applied.
 func (m *memTable) prepare(batch *Batch) error {
-	a := m.skl.Arena()
-	if atomic.LoadInt32(&m.refs) == 1 {
-		// If there are no other concurrent apply operations, we can update the
-		// reserved bytes setting to accurately reflect how many bytes of been
-		// allocated vs the over-estimation present in memTableEntrySize.
-		m.reserved = a.Size()
-	}
-
-	avail := a.Capacity() - m.reserved
-	if batch.memTableSize > avail {
+	refs := atomic.LoadInt32(&m.refs)
+	if batch.memTableSize > m.availBytes(refs) {
 		return arenaskl.ErrArenaFull
 	}
+	// Space is reserved in the column family memtables only if all of them
+	// have room for the batch.
+	for id, size := range batch.cfMemTableSize {
+		if c := m.columnFamilies[id]; c != nil && size > c.availBytes(refs) {
+			return arenaskl.ErrArenaFull
+		}
+	}
 	m.reserved += batch.memTableSize
+	for id, size := range batch.cfMemTableSize {
+		if c := m.columnFamilies[id]; c != nil {
+			c.reserved += size
+		}
+	}
 
 	m.ref()
 	return nil
 }
 
+// availBytes returns the number of bytes which can be reserved in the
+// memtable's arena. refs is the reference count of the default memtable.
+func (m *memTable) availBytes(refs int32) uint32 {
+	a := m.skl.Arena()
+	if refs == 1 {
+		// If there are no other concurrent apply operations, we can update the
+		// reserved bytes setting to accurately reflect how many bytes of been
+		// allocated vs the over-estimation present in memTableEntrySize.
+		m.reserved = a.Size()
+	}
+	return a.Capacity() - m.reserved
+}
+
 func (m *memTable) apply(batch *Batch, seqNum uint64) error {
 	var ins arenaskl.Inserter
 	var tombstoneCount uint32
 	startSeqNum := seqNum
+	var prepared bool
 	for iter := batch.iter(); ; seqNum++ {
-		kind, ukey, value, ok := iter.next()
+		cfID, kind, ukey, value, ok := iter.nextCF()
 		if !ok {
 			break
 		}
+		if isTwoPhaseMarker(kind) {
+			// The operations within a prepared section are not applied until the
+			// prepared batch is committed (see DB.Prepare).
+			prepared = kind == db.InternalKeyKindBeginPrepareXID
+			continue
+		}
+		if prepared {
+			continue
+		}
 		var err error
 		ikey := db.MakeInternalKey(ukey, seqNum, kind)
+		if cfID != 0 {
+			// Operations on a column family which does not have a memtable (i.e.
+			// a column family which has been dropped) are ignored.
+			if c := m.columnFamilies[cfID]; c != nil {
+				err = c.applyColumnFamily(ikey, value)
+			}
+			if err != nil {
+				return err
+			}
+			continue
+		}
 		switch kind {
 		case db.InternalKeyKindRangeDelete:
 			err = m.rangeDelSkl.Add(ikey, value)
@@ -172,6 +220,20 @@ func (m *memTable) apply(batch *Batch, seqNum uint64) error {
 	return nil
 }
 
+// applyColumnFamily adds an entry to the memtable of a column family.
+func (m *memTable) applyColumnFamily(ikey db.InternalKey, value []byte) error {
+	switch ikey.Kind() {
+	case db.InternalKeyKindRangeDelete:
+		if err := m.rangeDelSkl.Add(ikey, value); err != nil {
+			return err
+		}
+		m.tombstones.invalidate(1)
+		return nil
+	default:
+		return m.skl.Add(ikey, value)
+	}
+}
+
 // newIter returns an iterator that is unpositioned (Iterator.Valid() will
 // return false). The iterator can be positioned via a call to SeekGE,
 // SeekLT, First or Last.
@@ -642,6 +642,12 @@ func (m *mergingIter) Error() error {
 	return m.iters[m.heap.items[0].index].Error()
 }
 
+func (m *mergingIter) SetBounds(lower, upper []byte) {
+	for _, iter := range m.iters {
+		iter.SetBounds(lower, upper)
+	}
+}
+
 func (m *mergingIter) Close() error {
 	for _, iter := range m.iters {
 		if err := iter.Close(); err != nil && m.err == nil {
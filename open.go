@@ -6,6 +6,8 @@ package pebble
 
 import (
 	"bytes"
+	"crypto/rand"
+	"encoding/hex"
 	"fmt"
 	"io"
 	"io/ioutil"
@@ -19,6 +21,18 @@ import (
 	"github.com/petermattis/pebble/vfs"
 )
 
+// dbSessionIDLen is the length of the identity of a DB session.
+const dbSessionIDLen = 32
+
+// newDBSessionID returns a random identity for a DB session.
+func newDBSessionID() (string, error) {
+	var buf [dbSessionIDLen / 2]byte
+	if _, err := rand.Read(buf[:]); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(buf[:]), nil
+}
+
 func createDB(dirname string, opts *db.Options) (retErr error) {
 	const manifestFileNum = 1
 	ve := versionEdit{
@@ -38,11 +52,7 @@ func createDB(dirname string, opts *db.Options) (retErr error) {
 	defer f.Close()
 
 	recWriter := record.NewWriter(f)
-	w, err := recWriter.Next()
-	if err != nil {
-		return err
-	}
-	err = ve.encode(w)
+	err = ve.writeTo(recWriter)
 	if err != nil {
 		return err
 	}
@@ -57,24 +67,24 @@ func createDB(dirname string, opts *db.Options) (retErr error) {
 func Open(dirname string, opts *db.Options) (*DB, error) {
 	opts = opts.EnsureDefaults()
 	d := &DB{
-		dirname:        dirname,
-		walDirname:     opts.WALDir,
-		opts:           opts,
-		cmp:            opts.Comparer.Compare,
-		equal:          opts.Comparer.Equal,
-		merge:          opts.Merger.Merge,
-		abbreviatedKey: opts.Comparer.AbbreviatedKey,
-		logRecycler:    logRecycler{limit: opts.MemTableStopWritesThreshold + 1},
-	}
-	if d.equal == nil {
-		d.equal = bytes.Equal
+		dirname:     dirname,
+		walDirname:  opts.WALDir,
+		logRecycler: logRecycler{limit: opts.MemTableStopWritesThreshold + 1},
+	}
+	if opts.WALRecoveryMode == db.WALRecoveryAbsoluteConsistency {
+		// A recycled log contains the remains of its previous contents, which
+		// are indistinguishable from corruption.
+		d.logRecycler.limit = 0
 	}
 	tableCacheSize := opts.MaxOpenFiles - numNonTableCacheFiles
 	if tableCacheSize < minTableCacheSize {
 		tableCacheSize = minTableCacheSize
 	}
-	d.tableCache.init(dirname, opts.FS, d.opts, tableCacheSize)
-	d.newIters = d.tableCache.newIters
+	d.tableCache.init(dirname, opts.FS, opts, tableCacheSize)
+	d.columnFamily.init(&d.tableCache, 0, defaultColumnFamilyName, opts)
+	d.blobs.init(dirname, opts.FS)
+	d.lockTable.init(d.cmp)
+	d.changeFeeds.init()
 	d.commit = newCommitPipeline(commitEnv{
 		logSeqNum:     &d.mu.versions.logSeqNum,
 		visibleSeqNum: &d.mu.versions.visibleSeqNum,
@@ -83,25 +93,29 @@ func Open(dirname string, opts *db.Options) (*DB, error) {
 	})
 	d.mu.nextJobID = 1
 	d.mu.mem.cond.L = &d.mu.Mutex
-	d.mu.mem.mutable = newMemTable(d.opts)
-	d.mu.mem.queue = append(d.mu.mem.queue, d.mu.mem.mutable)
 	d.mu.cleaner.cond.L = &d.mu.Mutex
 	d.mu.compact.cond.L = &d.mu.Mutex
 	d.mu.compact.pendingOutputs = make(map[uint64]struct{})
 	d.mu.snapshots.init()
-	d.largeBatchThreshold = (d.opts.MemTableSize - int(d.mu.mem.mutable.emptySize)) / 2
+	d.mu.columnFamilies = map[uint32]*columnFamily{0: &d.columnFamily}
+	d.mu.prepared = make(map[string]*preparedBatch)
 
 	d.mu.Lock()
 	defer d.mu.Unlock()
 
-	// Lock the database directory.
-	err := opts.FS.MkdirAll(dirname, 0755)
-	if err != nil {
-		return nil, err
-	}
-	fileLock, err := opts.FS.Lock(dbFilename(dirname, fileTypeLock, 0))
-	if err != nil {
-		return nil, err
+	// Lock the database directory. A read-only DB neither creates nor locks the
+	// directory, allowing it to be opened while another process is writing to
+	// the DB (see OpenSecondary).
+	var fileLock io.Closer
+	if !opts.ReadOnly {
+		err := opts.FS.MkdirAll(dirname, 0755)
+		if err != nil {
+			return nil, err
+		}
+		fileLock, err = opts.FS.Lock(dbFilename(dirname, fileTypeLock, 0))
+		if err != nil {
+			return nil, err
+		}
 	}
 	defer func() {
 		if fileLock != nil {
@@ -109,6 +123,10 @@ func Open(dirname string, opts *db.Options) (*DB, error) {
 		}
 	}()
 
+	var err error
+	if d.sessionID, err = newDBSessionID(); err != nil {
+		return nil, err
+	}
 	d.dataDir, err = opts.FS.OpenDir(dirname)
 	if err != nil {
 		return nil, err
@@ -119,14 +137,26 @@ func Open(dirname string, opts *db.Options) (*DB, error) {
 	if d.walDirname == d.dirname {
 		d.walDir = d.dataDir
 	} else {
-		err := opts.FS.MkdirAll(d.walDirname, 0755)
+		if !opts.ReadOnly {
+			if err := opts.FS.MkdirAll(d.walDirname, 0755); err != nil {
+				return nil, err
+			}
+		}
+		d.walDir, err = opts.FS.OpenDir(d.walDirname)
 		if err != nil {
 			return nil, err
 		}
-		d.walDir, err = opts.FS.OpenDir(d.walDirname)
+	}
+	if !opts.ReadOnly && (opts.WALArchiveTTL > 0 || opts.WALArchiveSizeLimit > 0) {
+		if err := d.walArchive.init(opts.FS, d.walDirname, opts); err != nil {
+			return nil, err
+		}
 	}
 
 	if _, err := opts.FS.Stat(dbFilename(dirname, fileTypeCurrent, 0)); os.IsNotExist(err) {
+		if opts.ReadOnly {
+			return nil, fmt.Errorf("pebble: database %q does not exist", dirname)
+		}
 		// Create the DB if it did not already exist.
 		if err := createDB(dirname, opts); err != nil {
 			return nil, err
@@ -146,6 +176,24 @@ func Open(dirname string, opts *db.Options) (*DB, error) {
 		return nil, err
 	}
 
+	// Set up the column families loaded from the manifest, and the mutable
+	// memtable which holds a memtable for each of them.
+	d.versions = &d.mu.versions.columnFamilyVersions
+	for id, v := range d.mu.versions.columnFamilies {
+		if id == 0 {
+			continue
+		}
+		cf := &columnFamily{}
+		cf.init(&d.tableCache, id, v.name, v.opts)
+		cf.versions = v
+		d.mu.columnFamilies[id] = cf
+	}
+	d.mu.mem.mutable = d.newMemTableLocked()
+	d.mu.mem.queue = append(d.mu.mem.queue, d.mu.mem.mutable)
+	for _, cf := range d.mu.columnFamilies {
+		cf.largeBatchThreshold = (cf.opts.MemTableSize - int(d.mu.mem.mutable.emptySize)) / 2
+	}
+
 	ls, err := opts.FS.List(d.walDirname)
 	if err != nil {
 		return nil, err
@@ -164,7 +212,7 @@ func Open(dirname string, opts *db.Options) (*DB, error) {
 		}
 		switch ft {
 		case fileTypeLog:
-			if fn >= d.mu.versions.logNumber || fn == d.mu.versions.prevLogNumber {
+			if fn >= d.mu.versions.minLogNumber() || fn == d.mu.versions.prevLogNumber {
 				logFiles = append(logFiles, fileNumAndName{fn, filename})
 			}
 		case fileTypeOptions:
@@ -177,20 +225,48 @@ func Open(dirname string, opts *db.Options) (*DB, error) {
 		return logFiles[i].num < logFiles[j].num
 	})
 	var ve versionEdit
+	var stopLogNum uint64
 	for _, lf := range logFiles {
-		maxSeqNum, err := d.replayWAL(&ve, opts.FS, filepath.Join(d.walDirname, lf.name), lf.num)
+		d.mu.versions.markFileNumUsed(lf.num)
+		path := filepath.Join(d.walDirname, lf.name)
+		if stopLogNum != 0 {
+			// The replay stopped at a corruption in a previous log. The log is
+			// dropped entirely, recovering the DB to the point in time preceding
+			// the corruption.
+			if opts.EventListener.WALCorruption != nil {
+				opts.EventListener.WALCorruption(db.WALCorruptionInfo{
+					Path:    path,
+					FileNum: lf.num,
+					Tail:    true,
+					Err:     fmt.Errorf("pebble: log follows corrupted log %06d", stopLogNum),
+				})
+			}
+			continue
+		}
+		maxSeqNum, stop, err := d.replayWAL(&ve, opts.FS, path, lf.num)
 		if err != nil {
 			return nil, err
 		}
-		d.mu.versions.markFileNumUsed(lf.num)
+		if stop {
+			stopLogNum = lf.num
+		}
 		if d.mu.versions.logSeqNum < maxSeqNum {
 			d.mu.versions.logSeqNum = maxSeqNum
 		}
 	}
 	d.mu.versions.visibleSeqNum = d.mu.versions.logSeqNum
 
-	// Create an empty .log file.
+	if opts.ReadOnly {
+		// The replayed logs are retained in the memtables, and the DB is left
+		// unmodified.
+		d.updateReadStateLocked()
+		return d, nil
+	}
+
+	// Create an empty .log file. The logs containing the recovered prepared
+	// batches are retained.
 	ve.logNumber = d.mu.versions.nextFileNum()
+	ve.minLogNumberToKeep = d.minPreparedLogNumLocked()
 	d.mu.log.queue = append(d.mu.log.queue, ve.logNumber)
 	logFile, err := opts.FS.Create(dbFilename(d.walDirname, fileTypeLog, ve.logNumber))
 	if err != nil {
@@ -236,7 +312,10 @@ func Open(dirname string, opts *db.Options) (*DB, error) {
 	return d, nil
 }
 
-// replayWAL replays the edits in the specified log file.
+// replayWAL replays the edits in the specified log file. Corruption of the log
+// is handled according to db.Options.WALRecoveryMode. If stop is true, the
+// replay stopped at a corruption and subsequent logs must not be replayed (see
+// db.WALRecoveryPointInTime).
 //
 // d.mu must be held when calling this, but the mutex may be dropped and
 // re-acquired during the course of this method.
@@ -245,37 +324,78 @@ func (d *DB) replayWAL(
 	fs vfs.FS,
 	filename string,
 	logNum uint64,
-) (maxSeqNum uint64, err error) {
+) (maxSeqNum uint64, stop bool, err error) {
 	file, err := fs.Open(filename)
 	if err != nil {
-		return 0, err
+		return 0, false, err
 	}
 	defer file.Close()
 
+	// The contents of logs older than the log number have already been
+	// flushed. Such logs are only retained because they contain prepared
+	// batches, and only need to be scanned for the two-phase commit markers.
+	preparedOnly := logNum < d.mu.versions.logNumber && logNum != d.mu.versions.prevLogNumber
+
 	var (
-		b   Batch
-		buf bytes.Buffer
-		mem *memTable
-		rr  = record.NewReader(file, logNum)
+		b        Batch
+		buf      bytes.Buffer
+		mem      *memTable
+		memEmpty bool
+		rr       = record.NewReader(file, logNum)
 	)
 	for {
 		r, err := rr.Next()
 		if err == nil {
 			_, err = io.Copy(&buf, r)
 		}
+		if err == io.EOF {
+			break
+		}
 		if err != nil {
-			// It is common to encounter a zeroed or invalid chunk due to WAL
-			// preallocation and WAL recycling. We need to distinguish these errors
-			// from EOF in order to recognize that the record was truncated, but want
-			// to otherwise treat them like EOF.
-			if err == io.EOF || err == record.ErrZeroedChunk || err == record.ErrInvalidChunk {
+			buf.Reset()
+			if !isLogCorruption(err) {
+				return 0, false, err
+			}
+			// Determine whether the corruption is at the tail of the log by
+			// looking for a valid record following it. If one is found, it is
+			// left in buf.
+			more, skipErr := skipLogCorruption(rr, &buf)
+			if skipErr != nil {
+				return 0, false, skipErr
+			}
+			// It is common to encounter a zeroed chunk at the tail of a log due to
+			// WAL preallocation. A read-only DB may also encounter a partially
+			// written record at the tail of a log which is still being written by
+			// another process. Neither is a corruption.
+			if !more && (err == record.ErrZeroedChunk ||
+				(err == io.ErrUnexpectedEOF && d.opts.ReadOnly)) {
 				break
 			}
-			return 0, err
+			mode := d.opts.WALRecoveryMode
+			if mode == db.WALRecoveryAbsoluteConsistency ||
+				(mode == db.WALRecoveryTolerateCorruptedTailRecords && more) {
+				return 0, false, fmt.Errorf("pebble: corrupt log file %q: %v", filename, err)
+			}
+			stop = more && mode == db.WALRecoveryPointInTime
+			if d.opts.EventListener.WALCorruption != nil {
+				d.opts.EventListener.WALCorruption(db.WALCorruptionInfo{
+					Path:    filename,
+					FileNum: logNum,
+					SeqNum:  maxSeqNum,
+					Tail:    !more || stop,
+					Err:     err,
+				})
+			}
+			if !more || stop {
+				buf.Reset()
+				break
+			}
+			// The corrupted records have been skipped, and buf holds the record
+			// following them.
 		}
 
 		if buf.Len() < batchHeaderLen {
-			return 0, fmt.Errorf("pebble: corrupt log file %q", filename)
+			return 0, false, fmt.Errorf("pebble: corrupt log file %q", filename)
 		}
 
 		// TODO(peter): If the batch is too large to fit in the memtable, flush the
@@ -285,45 +405,119 @@ func (d *DB) replayWAL(
 		b.refreshMemTableSize()
 		seqNum := b.seqNum()
 		maxSeqNum = seqNum + uint64(b.count())
+		d.replayPreparedLocked(&b, logNum)
+
+		if preparedOnly {
+			buf.Reset()
+			continue
+		}
 
 		if mem == nil {
-			mem = newMemTable(d.opts)
+			mem = d.newMemTableLocked()
+			mem.logNum = logNum
+			memEmpty = true
 		}
 
 		for {
 			err := mem.prepare(&b)
+			if err == arenaskl.ErrArenaFull && d.opts.ReadOnly && !memEmpty {
+				// A read-only DB cannot write the memtable to disk. It is retained,
+				// and the replay continues in a new memtable.
+				d.retainMemTableLocked(mem)
+				mem = d.newMemTableLocked()
+				mem.logNum = logNum
+				memEmpty = true
+				continue
+			}
 			if err == arenaskl.ErrArenaFull {
 				// TODO(peter): write the memtable to disk.
 				panic(err)
 			}
 			if err != nil {
-				return 0, err
+				return 0, false, err
 			}
 			break
 		}
 
 		if err := mem.apply(&b, seqNum); err != nil {
-			return 0, err
+			return 0, false, err
 		}
 		mem.unref()
+		memEmpty = false
 
 		buf.Reset()
 	}
 
-	if mem != nil && !mem.empty() {
-		meta, err := d.writeLevel0Table(mem.newIter(nil),
+	if mem == nil {
+		return maxSeqNum, stop, nil
+	}
+	if d.opts.ReadOnly {
+		d.retainMemTableLocked(mem)
+		return maxSeqNum, stop, nil
+	}
+	for _, cf := range d.columnFamiliesLocked() {
+		m, ok := cf.memTable(mem).(*memTable)
+		if !ok || m.empty() {
+			continue
+		}
+		meta, err := d.writeLevel0Table(cf, m.newIter(nil),
 			true /* allowRangeTombstoneElision */)
 		if err != nil {
-			return 0, err
+			return 0, false, err
 		}
-		ve.newFiles = append(ve.newFiles, newFileEntry{level: 0, meta: meta})
+		cve := ve.columnFamilyEdit(cf.id)
+		cve.newFiles = append(cve.newFiles, newFileEntry{level: 0, meta: meta})
 		// Strictly speaking, it's too early to delete meta.fileNum from d.pendingOutputs,
 		// but we are replaying the log file, which happens before Open returns, so there
 		// is no possibility of deleteObsoleteFiles being called concurrently here.
 		delete(d.mu.compact.pendingOutputs, meta.fileNum)
+		for _, fileNum := range meta.blobFiles {
+			delete(d.mu.compact.pendingOutputs, fileNum)
+		}
 	}
 
-	return maxSeqNum, nil
+	return maxSeqNum, stop, nil
+}
+
+// isLogCorruption returns true if the error encountered while reading a log
+// indicates that the log is corrupted.
+func isLogCorruption(err error) bool {
+	return err == record.ErrZeroedChunk || err == record.ErrInvalidChunk ||
+		err == io.ErrUnexpectedEOF
+}
+
+// skipLogCorruption skips over the corrupted portion of a log after the reader
+// encountered a corruption. It returns true if a valid record follows the
+// corruption, in which case the record is read into buf.
+func skipLogCorruption(rr *record.Reader, buf *bytes.Buffer) (bool, error) {
+	for {
+		rr.Recover()
+		buf.Reset()
+		r, err := rr.Next()
+		if err == nil {
+			_, err = io.Copy(buf, r)
+		}
+		switch {
+		case err == nil:
+			return true, nil
+		case err == io.EOF:
+			return false, nil
+		case !isLogCorruption(err):
+			return false, err
+		}
+	}
+}
+
+// retainMemTableLocked adds a memtable containing the contents of a replayed
+// log to the queue of memtables of a read-only DB, ahead of the mutable
+// memtable. Requires d.mu is held.
+func (d *DB) retainMemTableLocked(mem *memTable) {
+	// The queue is never modified in place (see DB.mu.mem.queue).
+	n := len(d.mu.mem.queue) - 1
+	queue := make([]flushable, 0, n+2)
+	queue = append(queue, d.mu.mem.queue[:n]...)
+	queue = append(queue, mem, d.mu.mem.queue[n])
+	d.mu.mem.queue = queue
 }
 
 func checkOptions(opts *db.Options, path string) error {
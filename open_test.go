@@ -5,6 +5,7 @@
 package pebble
 
 import (
+	"fmt"
 	"io/ioutil"
 	"os"
 	"path/filepath"
@@ -219,3 +220,109 @@ func TestOpenOptionsCheck(t *testing.T) {
 	_, err = Open("", opts)
 	require.Regexp(t, `merger name from file.*!=.*`, err)
 }
+
+func TestOpenWALRecoveryMode(t *testing.T) {
+	// newDB creates a DB whose log contains 6 batches, each setting a key to a
+	// 10KB value, and corrupts the log using the specified function.
+	newDB := func(corrupt func(data []byte) []byte) (vfs.FS, string) {
+		mem := vfs.NewMem()
+		d, err := Open("", &db.Options{FS: mem})
+		if err != nil {
+			t.Fatal(err)
+		}
+		value := make([]byte, 10000)
+		for i := 1; i <= 6; i++ {
+			if err := d.Set([]byte(fmt.Sprintf("k%d", i)), value, db.NoSync); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := d.Close(); err != nil {
+			t.Fatal(err)
+		}
+
+		ls, err := mem.List("")
+		if err != nil {
+			t.Fatal(err)
+		}
+		var path string
+		for _, filename := range ls {
+			if ft, _, ok := parseDBFilename(filename); ok && ft == fileTypeLog {
+				path = filename
+			}
+		}
+		f, err := mem.Open(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, err := ioutil.ReadAll(f)
+		if err != nil {
+			t.Fatal(err)
+		}
+		f.Close()
+		if f, err = mem.Create(path); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := f.Write(corrupt(data)); err != nil {
+			t.Fatal(err)
+		}
+		f.Close()
+		return mem, path
+	}
+	// The second batch lies within the first block of the log, and is followed
+	// by valid batches in the second block.
+	corruptMiddle := func(data []byte) []byte {
+		data[15000] ^= 0xff
+		return data
+	}
+	// The last batch is partially written.
+	truncateTail := func(data []byte) []byte {
+		return data[:len(data)-100]
+	}
+
+	testCases := []struct {
+		corrupt  func([]byte) []byte
+		mode     db.WALRecoveryMode
+		expected string
+	}{
+		{corruptMiddle, db.WALRecoveryTolerateCorruptedTailRecords, "error"},
+		{corruptMiddle, db.WALRecoveryAbsoluteConsistency, "error"},
+		{corruptMiddle, db.WALRecoveryPointInTime, "k1 [tail after 1]"},
+		{corruptMiddle, db.WALRecoverySkipAnyCorruptedRecords, "k1 k5 k6 [skipped after 1]"},
+		{truncateTail, db.WALRecoveryTolerateCorruptedTailRecords, "k1 k2 k3 k4 k5 [tail after 5]"},
+		{truncateTail, db.WALRecoveryAbsoluteConsistency, "error"},
+		{truncateTail, db.WALRecoveryPointInTime, "k1 k2 k3 k4 k5 [tail after 5]"},
+		{truncateTail, db.WALRecoverySkipAnyCorruptedRecords, "k1 k2 k3 k4 k5 [tail after 5]"},
+	}
+	for i, c := range testCases {
+		mem, path := newDB(c.corrupt)
+		var events []string
+		d, err := Open("", &db.Options{
+			FS:              mem,
+			WALRecoveryMode: c.mode,
+			EventListener: db.EventListener{
+				WALCorruption: func(info db.WALCorruptionInfo) {
+					if info.Path != path {
+						t.Fatalf("%d: expected path %s, but found %s", i, path, info.Path)
+					}
+					kind := "skipped"
+					if info.Tail {
+						kind = "tail"
+					}
+					events = append(events, fmt.Sprintf("[%s after %d]", kind, info.SeqNum))
+				},
+			},
+		})
+		var actual string
+		if err != nil {
+			actual = "error"
+		} else {
+			actual = strings.Join(append(strings.Fields(scanKeys(t, d)), events...), " ")
+			if err := d.Close(); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if c.expected != actual {
+			t.Fatalf("%d: %s: expected %q, but found %q", i, c.mode, c.expected, actual)
+		}
+	}
+}
@@ -0,0 +1,374 @@
+// Copyright 2019 The LevelDB-Go and Pebble Authors. All rights reserved. Use
+// of this source code is governed by a BSD-style license that can be found in
+// the LICENSE file.
+
+package pebble
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/petermattis/pebble/db"
+)
+
+// ErrTxnDone is returned when operating on a transaction which has already
+// been committed or rolled back.
+var ErrTxnDone = errors.New("pebble: transaction already committed or rolled back")
+
+// ConflictError is returned by OptimisticTxn.Commit when a key read by the
+// transaction was written by another writer after the transaction's snapshot
+// was taken. The transaction is not committed and can be retried.
+type ConflictError struct {
+	// Key is the key that was read by the transaction and subsequently
+	// written. For a conflicting range read, Key is the start of the range
+	// (nil if the range is unbounded).
+	Key []byte
+}
+
+func (e *ConflictError) Error() string {
+	return fmt.Sprintf("pebble: transaction conflict on key %q", e.Key)
+}
+
+// OptimisticTxn is a transaction which detects conflicts at commit time. Reads
+// observe the writes of the transaction layered on top of a snapshot of the
+// DB taken when the transaction was created. The keys and ranges read by the
+// transaction are recorded, and the transaction commits only if none of them
+// was written (with a sequence number above that of the snapshot) by another
+// writer in the meantime. Otherwise Commit returns a *ConflictError.
+//
+// Conflict detection is performed within the commit pipeline, so it accounts
+// for all writes to the DB, not only those performed by other transactions.
+// Iterators record the range covered by their bounds (the entire key space if
+// unbounded) regardless of how much of the range is actually iterated over.
+// Blind writes are not recorded and do not cause conflicts.
+//
+// An OptimisticTxn operates on the default column family and is not safe for
+// concurrent use.
+type OptimisticTxn struct {
+	db       *DB
+	batch    *Batch
+	snapshot *Snapshot
+	reads    []txnSpan
+}
+
+var _ Reader = (*OptimisticTxn)(nil)
+
+// NewOptimisticTxn returns a new optimistic transaction. The transaction must
+// be finished by calling either Commit or Rollback.
+func (d *DB) NewOptimisticTxn() *OptimisticTxn {
+	return &OptimisticTxn{
+		db:       d,
+		batch:    d.NewIndexedBatch(),
+		snapshot: d.NewSnapshot(),
+	}
+}
+
+// Get gets the value for the given key, recording the key in the read set of
+// the transaction. It returns ErrNotFound if neither the transaction nor the
+// transaction's snapshot of the DB contains the key.
+//
+// The caller should not modify the contents of the returned slice, but it is
+// safe to modify the contents of the argument after Get returns.
+func (t *OptimisticTxn) Get(key []byte) ([]byte, error) {
+	if t.batch == nil {
+		return nil, ErrTxnDone
+	}
+	t.reads = append(t.reads, txnSpan{start: append([]byte(nil), key...), point: true})
+	return t.db.getInternal(&t.db.columnFamily, key, t.batch, t.snapshot)
+}
+
+// NewIter returns an iterator over the writes of the transaction merged with
+// the transaction's snapshot of the DB, recording the range covered by the
+// iterator bounds in the read set of the transaction. The iterator is
+// unpositioned (Iterator.Valid() will return false).
+func (t *OptimisticTxn) NewIter(o *db.IterOptions) *Iterator {
+	if t.batch == nil {
+		return &Iterator{err: ErrTxnDone}
+	}
+	span := txnSpan{}
+	if lower := o.GetLowerBound(); lower != nil {
+		span.start = append([]byte(nil), lower...)
+	}
+	if upper := o.GetUpperBound(); upper != nil {
+		span.end = append([]byte(nil), upper...)
+	}
+	t.reads = append(t.reads, span)
+	return t.db.newIterInternal(&t.db.columnFamily, t.batch, t.snapshot, o)
+}
+
+// Set sets the value for the given key within the transaction.
+//
+// It is safe to modify the contents of the arguments after Set returns.
+func (t *OptimisticTxn) Set(key, value []byte) error {
+	if t.batch == nil {
+		return ErrTxnDone
+	}
+	return t.batch.Set(key, value, nil)
+}
+
+// Merge merges the value for the given key within the transaction.
+//
+// It is safe to modify the contents of the arguments after Merge returns.
+func (t *OptimisticTxn) Merge(key, value []byte) error {
+	if t.batch == nil {
+		return ErrTxnDone
+	}
+	return t.batch.Merge(key, value, nil)
+}
+
+// Delete deletes the value for the given key within the transaction.
+//
+// It is safe to modify the contents of the arguments after Delete returns.
+func (t *OptimisticTxn) Delete(key []byte) error {
+	if t.batch == nil {
+		return ErrTxnDone
+	}
+	return t.batch.Delete(key, nil)
+}
+
+// SingleDelete single deletes the value for the given key within the
+// transaction. See Writer.SingleDelete for the semantics of SingleDelete.
+//
+// It is safe to modify the contents of the arguments after SingleDelete
+// returns.
+func (t *OptimisticTxn) SingleDelete(key []byte) error {
+	if t.batch == nil {
+		return ErrTxnDone
+	}
+	return t.batch.SingleDelete(key, nil)
+}
+
+// DeleteRange deletes all of the keys (and values) in the range [start,end)
+// (inclusive on start, exclusive on end) within the transaction.
+//
+// It is safe to modify the contents of the arguments after DeleteRange
+// returns.
+func (t *OptimisticTxn) DeleteRange(start, end []byte) error {
+	if t.batch == nil {
+		return ErrTxnDone
+	}
+	return t.batch.DeleteRange(start, end, nil)
+}
+
+// Commit atomically applies the writes of the transaction to the DB if none of
+// the keys and ranges read by the transaction were written since the
+// transaction's snapshot was taken, and returns a *ConflictError otherwise.
+// The transaction is finished regardless of the outcome.
+func (t *OptimisticTxn) Commit(opts *db.WriteOptions) error {
+	if t.batch == nil {
+		return ErrTxnDone
+	}
+	defer t.finish()
+	if len(t.reads) > 0 {
+		t.batch.validate = t.checkConflicts
+		t.batch.validateSince = t.checkRecentConflicts
+	}
+	return t.db.Apply(t.batch, opts)
+}
+
+// Rollback discards the writes of the transaction and finishes the
+// transaction.
+func (t *OptimisticTxn) Rollback() error {
+	if t.batch == nil {
+		return ErrTxnDone
+	}
+	t.finish()
+	return nil
+}
+
+// Close implements Reader.Close by rolling back the transaction if it has not
+// already been finished.
+func (t *OptimisticTxn) Close() error {
+	if t.batch != nil {
+		t.finish()
+	}
+	return nil
+}
+
+func (t *OptimisticTxn) finish() {
+	t.batch.release()
+	t.batch = nil
+	_ = t.snapshot.Close()
+	t.snapshot = nil
+	t.reads = nil
+}
+
+// checkConflicts returns a *ConflictError if any of the keys or ranges read
+// by the transaction have been written since the transaction's snapshot was
+// taken. It is invoked by the commit pipeline (see Batch.validate), and checks
+// the writes visible at that point.
+func (t *OptimisticTxn) checkConflicts() error {
+	return t.checkConflictsSince(t.snapshot.seqNum, false /* memOnly */)
+}
+
+// checkRecentConflicts returns a *ConflictError if any of the keys or ranges
+// read by the transaction have been written with a sequence number greater
+// than or equal to seqNum. It is invoked by the commit pipeline with the
+// commit mutex held (see Batch.validateSince), and only examines the
+// memtables. It returns errValidateRetry if any of the writes might have
+// been flushed or ingested into an sstable.
+func (t *OptimisticTxn) checkRecentConflicts(seqNum uint64) error {
+	if seqNum < t.snapshot.seqNum {
+		seqNum = t.snapshot.seqNum
+	}
+	return t.checkConflictsSince(seqNum, true /* memOnly */)
+}
+
+func (t *OptimisticTxn) checkConflictsSince(seqNum uint64, memOnly bool) error {
+	d := t.db
+	readState := d.loadReadState()
+	defer readState.unref()
+
+	for i := range t.reads {
+		span := &t.reads[i]
+		conflict, err := span.writtenSince(d, readState, seqNum, memOnly)
+		if err != nil {
+			return err
+		}
+		if conflict {
+			return &ConflictError{Key: span.start}
+		}
+	}
+	return nil
+}
+
+// txnSpan is a key, or a range of keys [start,end), read by a transaction. A
+// nil start or end denotes an unbounded range.
+type txnSpan struct {
+	start, end []byte
+	point      bool
+}
+
+// contains returns true if the span contains the key.
+func (s *txnSpan) contains(cmp db.Compare, key []byte) bool {
+	if s.point {
+		return cmp(s.start, key) == 0
+	}
+	return (s.start == nil || cmp(s.start, key) <= 0) &&
+		(s.end == nil || cmp(key, s.end) < 0)
+}
+
+// overlaps returns true if the span overlaps the range [start,end).
+func (s *txnSpan) overlaps(cmp db.Compare, start, end []byte) bool {
+	if s.point {
+		return cmp(start, s.start) <= 0 && cmp(s.start, end) < 0
+	}
+	return (s.start == nil || cmp(s.start, end) < 0) &&
+		(s.end == nil || cmp(start, s.end) < 0)
+}
+
+// intersects returns true if the span and o have a key in common.
+func (s *txnSpan) intersects(cmp db.Compare, o *txnSpan) bool {
+	switch {
+	case s.point && o.point:
+		return cmp(s.start, o.start) == 0
+	case s.point:
+		return o.contains(cmp, s.start)
+	case o.point:
+		return s.contains(cmp, o.start)
+	}
+	return (s.start == nil || o.end == nil || cmp(s.start, o.end) < 0) &&
+		(o.start == nil || s.end == nil || cmp(o.start, s.end) < 0)
+}
+
+// covers returns true if every key in o is contained in the span.
+func (s *txnSpan) covers(cmp db.Compare, o *txnSpan) bool {
+	if o.point {
+		return s.contains(cmp, o.start)
+	}
+	if s.point {
+		return false
+	}
+	return (s.start == nil || (o.start != nil && cmp(s.start, o.start) <= 0)) &&
+		(s.end == nil || (o.end != nil && cmp(o.end, s.end) <= 0))
+}
+
+// overlapsFile returns true if the span overlaps the key range of the file.
+func (s *txnSpan) overlapsFile(cmp db.Compare, f *fileMetadata) bool {
+	if s.start != nil && cmp(f.largest.UserKey, s.start) < 0 {
+		return false
+	}
+	if s.point {
+		return cmp(s.start, f.smallest.UserKey) >= 0
+	}
+	return s.end == nil || cmp(f.smallest.UserKey, s.end) < 0
+}
+
+// writtenSince returns true if any key within the span has been written with
+// a sequence number greater than or equal to seqNum, either by a point
+// operation or by a range deletion. If memOnly is true, sstables are not read,
+// and errValidateRetry is returned if one of them needs to be examined.
+func (s *txnSpan) writtenSince(
+	d *DB, readState *readState, seqNum uint64, memOnly bool,
+) (bool, error) {
+	for _, mem := range readState.memtables {
+		written, err := s.iterWrittenSince(d.cmp, mem.newIter(nil), mem.newRangeDelIter(nil), seqNum)
+		if err != nil || written {
+			return written, err
+		}
+	}
+
+	// Only the sstables containing entries newer than the snapshot need to be
+	// examined.
+	for _, files := range readState.current.files {
+		for i := range files {
+			f := &files[i]
+			if f.largestSeqNum < seqNum || !s.overlapsFile(d.cmp, f) {
+				continue
+			}
+			if memOnly {
+				return false, errValidateRetry
+			}
+			iter, rangeDelIter, err := d.newIters(f, nil)
+			if err != nil {
+				return false, err
+			}
+			written, err := s.iterWrittenSince(d.cmp, iter, rangeDelIter, seqNum)
+			if err != nil || written {
+				return written, err
+			}
+		}
+	}
+	return false, nil
+}
+
+// iterWrittenSince returns true if the point iterator contains a key within
+// the span, or the range deletion iterator contains a tombstone overlapping
+// the span, with a sequence number greater than or equal to seqNum. The
+// iterators are closed.
+func (s *txnSpan) iterWrittenSince(
+	cmp db.Compare, iter, rangeDelIter internalIterator, seqNum uint64,
+) (written bool, err error) {
+	defer func() {
+		err = firstError(err, iter.Close())
+		if rangeDelIter != nil {
+			err = firstError(err, rangeDelIter.Close())
+		}
+	}()
+
+	var key *db.InternalKey
+	if s.start == nil {
+		key, _ = iter.First()
+	} else {
+		key, _ = iter.SeekGE(s.start)
+	}
+	for ; key != nil && s.contains(cmp, key.UserKey); key, _ = iter.Next() {
+		if key.SeqNum() >= seqNum {
+			return true, nil
+		}
+		if s.point {
+			// The entries for a key are ordered by decreasing sequence number, so
+			// only the first entry needs to be examined.
+			break
+		}
+	}
+
+	if rangeDelIter != nil {
+		for key, end := rangeDelIter.First(); key != nil; key, end = rangeDelIter.Next() {
+			if key.SeqNum() >= seqNum && s.overlaps(cmp, key.UserKey, end) {
+				return true, nil
+			}
+		}
+	}
+	return false, nil
+}
@@ -0,0 +1,250 @@
+// Copyright 2019 The LevelDB-Go and Pebble Authors. All rights reserved. Use
+// of this source code is governed by a BSD-style license that can be found in
+// the LICENSE file.
+
+package pebble
+
+import (
+	"strconv"
+	"sync"
+	"testing"
+
+	"github.com/petermattis/pebble/db"
+	"github.com/petermattis/pebble/vfs"
+)
+
+func TestOptimisticTxn(t *testing.T) {
+	d, err := Open("", &db.Options{FS: vfs.NewMem()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+
+	for _, k := range []string{"a", "b", "c"} {
+		if err := d.Set([]byte(k), []byte(k), db.NoSync); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	testCases := []struct {
+		name     string
+		read     func(txn *OptimisticTxn)
+		write    func() error
+		flush    bool
+		conflict bool
+	}{
+		{
+			name:     "no concurrent write",
+			read:     func(txn *OptimisticTxn) { _, _ = txn.Get([]byte("a")) },
+			write:    func() error { return nil },
+			conflict: false,
+		},
+		{
+			name:     "write to read key",
+			read:     func(txn *OptimisticTxn) { _, _ = txn.Get([]byte("a")) },
+			write:    func() error { return d.Set([]byte("a"), []byte("1"), db.NoSync) },
+			conflict: true,
+		},
+		{
+			name:     "write to read key after flush",
+			read:     func(txn *OptimisticTxn) { _, _ = txn.Get([]byte("a")) },
+			write:    func() error { return d.Set([]byte("a"), []byte("2"), db.NoSync) },
+			flush:    true,
+			conflict: true,
+		},
+		{
+			name:     "write to other key",
+			read:     func(txn *OptimisticTxn) { _, _ = txn.Get([]byte("a")) },
+			write:    func() error { return d.Set([]byte("b"), []byte("3"), db.NoSync) },
+			conflict: false,
+		},
+		{
+			name:     "write to missing read key",
+			read:     func(txn *OptimisticTxn) { _, _ = txn.Get([]byte("x")) },
+			write:    func() error { return d.Set([]byte("x"), []byte("4"), db.NoSync) },
+			conflict: true,
+		},
+		{
+			name:     "range deletion of read key",
+			read:     func(txn *OptimisticTxn) { _, _ = txn.Get([]byte("b")) },
+			write:    func() error { return d.DeleteRange([]byte("a"), []byte("c"), db.NoSync) },
+			conflict: true,
+		},
+		{
+			name: "write within iterated range",
+			read: func(txn *OptimisticTxn) {
+				iter := txn.NewIter(&db.IterOptions{LowerBound: []byte("b"), UpperBound: []byte("d")})
+				_ = iter.Close()
+			},
+			write:    func() error { return d.Set([]byte("c"), []byte("5"), db.NoSync) },
+			conflict: true,
+		},
+		{
+			name: "write after iterated range",
+			read: func(txn *OptimisticTxn) {
+				iter := txn.NewIter(&db.IterOptions{LowerBound: []byte("b"), UpperBound: []byte("d")})
+				_ = iter.Close()
+			},
+			write:    func() error { return d.Set([]byte("d"), []byte("6"), db.NoSync) },
+			conflict: false,
+		},
+		{
+			name: "write within unbounded iterated range",
+			read: func(txn *OptimisticTxn) {
+				iter := txn.NewIter(nil)
+				_ = iter.Close()
+			},
+			write:    func() error { return d.Set([]byte("z"), []byte("7"), db.NoSync) },
+			flush:    true,
+			conflict: true,
+		},
+	}
+	for _, c := range testCases {
+		t.Run(c.name, func(t *testing.T) {
+			txn := d.NewOptimisticTxn()
+			c.read(txn)
+			if err := txn.Set([]byte("txn"), []byte(c.name)); err != nil {
+				t.Fatal(err)
+			}
+			if err := c.write(); err != nil {
+				t.Fatal(err)
+			}
+			if c.flush {
+				if err := d.Flush(); err != nil {
+					t.Fatal(err)
+				}
+			}
+			err := txn.Commit(db.NoSync)
+			if c.conflict {
+				if _, ok := err.(*ConflictError); !ok {
+					t.Fatalf("expected conflict, but found %v", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if v, err := d.Get([]byte("txn")); err != nil {
+				t.Fatal(err)
+			} else if string(v) != c.name {
+				t.Fatalf("expected %q, but found %q", c.name, v)
+			}
+		})
+	}
+}
+
+func TestOptimisticTxnReads(t *testing.T) {
+	d, err := Open("", &db.Options{FS: vfs.NewMem()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+
+	if err := d.Set([]byte("a"), []byte("1"), db.NoSync); err != nil {
+		t.Fatal(err)
+	}
+	txn := d.NewOptimisticTxn()
+	if err := d.Set([]byte("b"), []byte("2"), db.NoSync); err != nil {
+		t.Fatal(err)
+	}
+	if err := txn.Set([]byte("c"), []byte("3")); err != nil {
+		t.Fatal(err)
+	}
+
+	// The transaction observes its own writes and the DB at the time the
+	// transaction was created.
+	get := func(key string) string {
+		v, err := txn.Get([]byte(key))
+		if err == db.ErrNotFound {
+			return "<not found>"
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		return string(v)
+	}
+	for key, expected := range map[string]string{"a": "1", "b": "<not found>", "c": "3"} {
+		if actual := get(key); expected != actual {
+			t.Fatalf("%s: expected %q, but found %q", key, expected, actual)
+		}
+	}
+	iter := txn.NewIter(nil)
+	var keys []byte
+	for valid := iter.First(); valid; valid = iter.Next() {
+		keys = append(keys, iter.Key()...)
+	}
+	if err := iter.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if string(keys) != "ac" {
+		t.Fatalf("expected %q, but found %q", "ac", keys)
+	}
+
+	if err := txn.Rollback(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := txn.Get([]byte("a")); err != ErrTxnDone {
+		t.Fatalf("expected %v, but found %v", ErrTxnDone, err)
+	}
+	if err := txn.Commit(db.NoSync); err != ErrTxnDone {
+		t.Fatalf("expected %v, but found %v", ErrTxnDone, err)
+	}
+	if _, err := d.Get([]byte("c")); err != db.ErrNotFound {
+		t.Fatalf("expected %v, but found %v", db.ErrNotFound, err)
+	}
+}
+
+func TestOptimisticTxnConcurrentIncrements(t *testing.T) {
+	d, err := Open("", &db.Options{FS: vfs.NewMem()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+
+	const workers = 4
+	const increments = 100
+	key := []byte("counter")
+
+	var wg sync.WaitGroup
+	errCh := make(chan error, workers)
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < increments; {
+				txn := d.NewOptimisticTxn()
+				var n int
+				if v, err := txn.Get(key); err == nil {
+					n, _ = strconv.Atoi(string(v))
+				} else if err != db.ErrNotFound {
+					errCh <- err
+					return
+				}
+				if err := txn.Set(key, []byte(strconv.Itoa(n+1))); err != nil {
+					errCh <- err
+					return
+				}
+				switch err := txn.Commit(db.NoSync); err.(type) {
+				case nil:
+					j++
+				case *ConflictError:
+				default:
+					errCh <- err
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	close(errCh)
+	for err := range errCh {
+		t.Fatal(err)
+	}
+
+	v, err := d.Get(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := strconv.Itoa(workers * increments); string(v) != expected {
+		t.Fatalf("expected %s, but found %s", expected, v)
+	}
+}
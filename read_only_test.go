@@ -0,0 +1,165 @@
+// Copyright 2019 The LevelDB-Go and Pebble Authors. All rights reserved. Use
+// of this source code is governed by a BSD-style license that can be found in
+// the LICENSE file.
+
+package pebble
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/petermattis/pebble/db"
+	"github.com/petermattis/pebble/vfs"
+)
+
+func TestReadOnly(t *testing.T) {
+	mem := vfs.NewMem()
+	primary, err := Open("db", &db.Options{FS: mem})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer primary.Close()
+	for _, k := range []string{"a", "b"} {
+		if err := primary.Set([]byte(k), []byte(k), db.Sync); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := primary.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if err := primary.Set([]byte("c"), []byte("c"), db.Sync); err != nil {
+		t.Fatal(err)
+	}
+
+	listFiles := func() string {
+		ls, err := mem.List("db")
+		if err != nil {
+			t.Fatal(err)
+		}
+		sort.Strings(ls)
+		var files []string
+		for _, name := range ls {
+			info, err := mem.Stat("db/" + name)
+			if err != nil {
+				t.Fatal(err)
+			}
+			files = append(files, fmt.Sprintf("%s:%d", name, info.Size()))
+		}
+		return strings.Join(files, " ")
+	}
+	before := listFiles()
+
+	// A read-only DB can be opened while the primary holds the lock, and
+	// observes both the flushed and the logged data.
+	d, err := Open("db", &db.Options{FS: mem, ReadOnly: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected, actual := "a b c", scanKeys(t, d); expected != actual {
+		t.Fatalf("expected %q, but found %q", expected, actual)
+	}
+	if err := d.Set([]byte("x"), nil, db.NoSync); err != ErrReadOnly {
+		t.Fatalf("expected %v, but found %v", ErrReadOnly, err)
+	}
+	if err := d.Flush(); err != ErrReadOnly {
+		t.Fatalf("expected %v, but found %v", ErrReadOnly, err)
+	}
+	if err := d.Compact([]byte("a"), []byte("z")); err != ErrReadOnly {
+		t.Fatalf("expected %v, but found %v", ErrReadOnly, err)
+	}
+	if err := d.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if after := listFiles(); before != after {
+		t.Fatalf("expected files\n%s\nbut found\n%s", before, after)
+	}
+
+	// A read-only DB must already exist.
+	if _, err := Open("missing", &db.Options{FS: mem, ReadOnly: true}); err == nil {
+		t.Fatalf("expected error opening missing DB")
+	}
+	if _, err := mem.Stat("missing"); err == nil {
+		t.Fatalf("expected missing DB to not be created")
+	}
+}
+
+func TestSecondary(t *testing.T) {
+	mem := vfs.NewMem()
+	primary, err := Open("db", &db.Options{FS: mem})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer primary.Close()
+	for _, k := range []string{"a", "b", "c"} {
+		if err := primary.Set([]byte(k), []byte(k), db.Sync); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	secondary, err := OpenSecondary("db", &db.Options{FS: mem})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer secondary.Close()
+	if expected, actual := "a b c", scanKeys(t, secondary); expected != actual {
+		t.Fatalf("expected %q, but found %q", expected, actual)
+	}
+
+	// The writes to the primary, including the flushed ones, become visible
+	// once the secondary catches up.
+	if err := primary.Delete([]byte("a"), db.Sync); err != nil {
+		t.Fatal(err)
+	}
+	if err := primary.Set([]byte("d"), []byte("d"), db.Sync); err != nil {
+		t.Fatal(err)
+	}
+	if err := primary.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if err := primary.Set([]byte("e"), []byte("e"), db.Sync); err != nil {
+		t.Fatal(err)
+	}
+	if expected, actual := "a b c", scanKeys(t, secondary); expected != actual {
+		t.Fatalf("expected %q, but found %q", expected, actual)
+	}
+	iter := secondary.NewIter(nil)
+	for i := 0; i < 2; i++ {
+		if err := secondary.TryCatchUpWithPrimary(); err != nil {
+			t.Fatal(err)
+		}
+		if expected, actual := "b c d e", scanKeys(t, secondary); expected != actual {
+			t.Fatalf("%d: expected %q, but found %q", i, expected, actual)
+		}
+	}
+
+	// An iterator created before catching up is unaffected.
+	var keys []string
+	for valid := iter.First(); valid; valid = iter.Next() {
+		keys = append(keys, string(iter.Key()))
+	}
+	if err := iter.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if expected, actual := "a b c", strings.Join(keys, " "); expected != actual {
+		t.Fatalf("expected %q, but found %q", expected, actual)
+	}
+
+	if err := primary.TryCatchUpWithPrimary(); err == nil {
+		t.Fatalf("expected error catching up a primary")
+	}
+}
+
+func scanKeys(t *testing.T, r Reader) string {
+	t.Helper()
+	iter := r.NewIter(nil)
+	var keys []string
+	for valid := iter.First(); valid; valid = iter.Next() {
+		keys = append(keys, string(iter.Key()))
+	}
+	if err := iter.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return strings.Join(keys, " ")
+}
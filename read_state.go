@@ -51,30 +51,54 @@ func (s *readState) unrefLocked() {
 	}
 }
 
-// loadReadState returns the current readState. The returned readState must be
+// loadReadState returns the current readState of the column family, or nil if
+// the column family has been dropped. The returned readState must be
 // unreferenced when the caller is finished with it.
-func (d *DB) loadReadState() *readState {
-	d.readState.RLock()
-	state := d.readState.val
-	state.ref()
-	d.readState.RUnlock()
+func (cf *columnFamily) loadReadState() *readState {
+	cf.readState.RLock()
+	state := cf.readState.val
+	if state != nil {
+		state.ref()
+	}
+	cf.readState.RUnlock()
 	return state
 }
 
-// updateReadStateLocked creates a new readState from the current version and
-// list of memtables. Requires DB.mu is held.
+// updateReadStateLocked creates a new readState for each column family from
+// the current version and list of memtables. Requires DB.mu is held.
 func (d *DB) updateReadStateLocked() {
+	for _, cf := range d.mu.columnFamilies {
+		if cf.dropped {
+			continue
+		}
+		cf.updateReadStateLocked(d.mu.mem.queue)
+	}
+}
+
+// updateReadStateLocked creates a new readState for the column family from
+// its current version and its portion of the memtables in queue. Requires
+// DB.mu is held.
+func (cf *columnFamily) updateReadStateLocked(queue []flushable) {
+	memtables := queue
+	if cf.id != 0 {
+		memtables = make([]flushable, 0, len(queue))
+		for _, mem := range queue {
+			if m := cf.memTable(mem); m != nil {
+				memtables = append(memtables, m)
+			}
+		}
+	}
 	s := &readState{
 		refcnt:    1,
-		current:   d.mu.versions.currentVersion(),
-		memtables: d.mu.mem.queue,
+		current:   cf.versions.currentVersion(),
+		memtables: memtables,
 	}
 	s.current.ref()
 
-	d.readState.Lock()
-	old := d.readState.val
-	d.readState.val = s
-	d.readState.Unlock()
+	cf.readState.Lock()
+	old := cf.readState.val
+	cf.readState.val = s
+	cf.readState.Unlock()
 
 	if old != nil {
 		old.unrefLocked()
@@ -0,0 +1,138 @@
+// Copyright 2019 The LevelDB-Go and Pebble Authors. All rights reserved. Use
+// of this source code is governed by a BSD-style license that can be found in
+// the LICENSE file.
+
+package pebble
+
+import (
+	"errors"
+	"sort"
+	"sync/atomic"
+
+	"github.com/petermattis/pebble/db"
+)
+
+// OpenSecondary opens the DB in the specified directory as a secondary of the
+// primary DB which is concurrently open in another process. A secondary is
+// opened in read-only mode (see db.Options.ReadOnly), and observes the state
+// of the primary as of the time it was opened. TryCatchUpWithPrimary
+// refreshes that state.
+//
+// The secondary does not prevent the primary from deleting obsolete files. A
+// read from the secondary may fail if the primary has deleted an sstable the
+// secondary is still using, and the secondary should catch up with the
+// primary frequently enough to make this unlikely.
+func OpenSecondary(dirname string, opts *db.Options) (*DB, error) {
+	var o db.Options
+	if opts != nil {
+		o = *opts
+	}
+	o.ReadOnly = true
+	return Open(dirname, &o)
+}
+
+// TryCatchUpWithPrimary refreshes the state of a secondary (see OpenSecondary)
+// from the MANIFEST and WALs of the primary, making the batches committed to
+// the primary since the last refresh visible to reads. Existing iterators are
+// unaffected. Existing snapshots are not preserved: the primary does not know
+// about them, and may have compacted away the data they read. An error is
+// returned if the primary concurrently deleted a file which was being read, in
+// which case the state of the secondary is unchanged and the call can be
+// retried.
+//
+// Only the column families which existed when the secondary was opened are
+// refreshed. A column family dropped by the primary retains the state it had
+// before it was dropped.
+func (d *DB) TryCatchUpWithPrimary() error {
+	if !d.opts.ReadOnly {
+		return errors.New("pebble: not a secondary")
+	}
+	m, err := readManifest(d.opts.FS, d.dirname, d.opts.Comparer.Name, true /* tolerateTornTail */)
+	if err != nil {
+		return err
+	}
+	ls, err := d.opts.FS.List(d.walDirname)
+	if err != nil {
+		return err
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.mu.closed {
+		return errors.New("pebble: closed")
+	}
+	vs := &d.mu.versions
+
+	// Build the versions of the column families from the manifest. They are
+	// installed once the logs have been replayed successfully.
+	versions := make(map[uint32]*version)
+	for id, state := range m.columnFamilies {
+		if cf := vs.columnFamilies[id]; cf != nil {
+			v, err := state.bve.apply(cf.opts, nil, cf.cmp)
+			if err != nil {
+				return err
+			}
+			versions[id] = v
+		}
+	}
+
+	// Replay the logs which have not been flushed according to the manifest
+	// into a new set of memtables. The current memtables and prepared batches
+	// are restored if the replay fails.
+	minLogNumber := m.logNumber
+	if m.minLogNumberToKeep != 0 && m.minLogNumberToKeep < minLogNumber {
+		minLogNumber = m.minLogNumberToKeep
+	}
+	var logNums []uint64
+	for _, filename := range ls {
+		ft, fn, ok := parseDBFilename(filename)
+		if ok && ft == fileTypeLog && (fn >= minLogNumber || fn == m.prevLogNumber) {
+			logNums = append(logNums, fn)
+		}
+	}
+	sort.Slice(logNums, func(i, j int) bool {
+		return logNums[i] < logNums[j]
+	})
+
+	queue, prepared := d.mu.mem.queue, d.mu.prepared
+	logNumber, prevLogNumber := vs.logNumber, vs.prevLogNumber
+	d.mu.mem.queue = []flushable{d.mu.mem.mutable}
+	d.mu.prepared = make(map[string]*preparedBatch)
+	vs.logNumber, vs.prevLogNumber = m.logNumber, m.prevLogNumber
+	maxSeqNum := m.logSeqNum
+	for _, fn := range logNums {
+		var ve versionEdit
+		seqNum, stop, err := d.replayWAL(&ve, d.opts.FS, dbFilename(d.walDirname, fileTypeLog, fn), fn)
+		if err != nil {
+			d.mu.mem.queue, d.mu.prepared = queue, prepared
+			vs.logNumber, vs.prevLogNumber = logNumber, prevLogNumber
+			return err
+		}
+		if maxSeqNum < seqNum {
+			maxSeqNum = seqNum
+		}
+		if stop {
+			break
+		}
+	}
+
+	// Install the versions read from the manifest.
+	for id, v := range versions {
+		cf := vs.columnFamilies[id]
+		cf.append(v)
+		cf.picker = cf.newPicker(v)
+		cf.updateMetrics(v, nil)
+	}
+	// The secondary never deletes files, so the tables and blob files of the
+	// replaced versions are not retained as obsolete.
+	vs.obsoleteTables = nil
+	vs.obsoleteBlobs = nil
+
+	vs.minLogNumberToKeep = m.minLogNumberToKeep
+	if vs.logSeqNum < maxSeqNum {
+		vs.logSeqNum = maxSeqNum
+		atomic.StoreUint64(&vs.visibleSeqNum, maxSeqNum)
+	}
+	d.updateReadStateLocked()
+	return nil
+}
@@ -27,14 +27,14 @@ var _ Reader = (*Snapshot)(nil)
 // The caller should not modify the contents of the returned slice, but it is
 // safe to modify the contents of the argument after Get returns.
 func (s *Snapshot) Get(key []byte) ([]byte, error) {
-	return s.db.getInternal(key, nil /* batch */, s)
+	return s.db.getInternal(&s.db.columnFamily, key, nil /* batch */, s)
 }
 
 // NewIter returns an iterator that is unpositioned (Iterator.Valid() will
 // return false). The iterator can be positioned via a call to SeekGE,
 // SeekLT, First or Last.
 func (s *Snapshot) NewIter(o *db.IterOptions) *Iterator {
-	return s.db.newIterInternal(nil /* batchIter */, nil /* batchRangeDelIter */, s, o)
+	return s.db.newIterInternal(&s.db.columnFamily, nil /* batch */, s, o)
 }
 
 // Close closes the snapshot, releasing its resources. Close must be
@@ -637,6 +637,10 @@ func (i *blockIter) Close() error {
 	return i.err
 }
 
+// SetBounds implements internalIterator.SetBounds, as documented in the pebble
+// package. A blockIter does not check bounds, so SetBounds is a no-op.
+func (i *blockIter) SetBounds(lower, upper []byte) {}
+
 // invalidate the iterator, positioning it below the first entry.
 func (i *blockIter) invalidateLower() {
 	i.offset = -1
@@ -0,0 +1,100 @@
+// Copyright 2019 The LevelDB-Go and Pebble Authors. All rights reserved. Use
+// of this source code is governed by a BSD-style license that can be found in
+// the LICENSE file.
+
+package sstable
+
+import (
+	"encoding/binary"
+	"errors"
+	"strings"
+
+	"github.com/petermattis/pebble/db"
+)
+
+// maxBlockPropertyCollectors is the maximum number of block property
+// collectors that can be used for a table. The limit is imposed by the 1 byte
+// collector ID used to tag the properties in the index entries.
+const maxBlockPropertyCollectors = 256
+
+var errCorruptIndexEntry = errors.New("pebble/table: corrupt index entry")
+
+// emptyBlock is an encoded block containing no entries. It is loaded in place
+// of data blocks which are skipped by block property filters.
+var emptyBlock = block([]byte{0, 0, 0, 0, 1, 0, 0, 0})
+
+// blockPropertiesFilterer determines whether a data block can be skipped by
+// applying a set of block property filters to the properties stored in the
+// block's index entry.
+type blockPropertiesFilterer struct {
+	filters []db.BlockPropertyFilter
+	// ids[i] is the collector ID of the property consumed by filters[i].
+	ids []int
+}
+
+// newBlockPropertiesFilterer returns a filterer for the filters which consume
+// properties collected in the table read by r. Filters whose collector was not
+// used when writing the table are ignored. Returns nil if no filters apply.
+func newBlockPropertiesFilterer(
+	r *Reader, filters []db.BlockPropertyFilter,
+) *blockPropertiesFilterer {
+	if len(filters) == 0 || r.Properties.BlockPropertyCollectorNames == "" {
+		return nil
+	}
+	names := strings.TrimSuffix(strings.TrimPrefix(
+		r.Properties.BlockPropertyCollectorNames, "["), "]")
+	if names == "" {
+		return nil
+	}
+	var f *blockPropertiesFilterer
+	for id, name := range strings.Split(names, ",") {
+		for _, filter := range filters {
+			if filter.Name() != name {
+				continue
+			}
+			if f == nil {
+				f = &blockPropertiesFilterer{}
+			}
+			f.filters = append(f.filters, filter)
+			f.ids = append(f.ids, id)
+		}
+	}
+	return f
+}
+
+// validBlockProperties returns true if props is a well-formed sequence of
+// (collector ID, uvarint length, property) tuples.
+func validBlockProperties(props []byte) bool {
+	for len(props) > 0 {
+		length, n := binary.Uvarint(props[1:])
+		if n <= 0 || uint64(len(props)-1-n) < length {
+			return false
+		}
+		props = props[1+n+int(length):]
+	}
+	return true
+}
+
+// intersects returns true if every filter intersects with the corresponding
+// property in props, the encoded block properties which follow the block
+// handle in an index entry.
+func (f *blockPropertiesFilterer) intersects(props []byte) (bool, error) {
+	for len(props) > 0 {
+		id := int(props[0])
+		length, n := binary.Uvarint(props[1:])
+		if n <= 0 || uint64(len(props)-1-n) < length {
+			return false, errCorruptIndexEntry
+		}
+		prop := props[1+n : 1+n+int(length)]
+		props = props[1+n+int(length):]
+		for i := range f.ids {
+			if f.ids[i] != id {
+				continue
+			}
+			if ok, err := f.filters[i].Intersects(prop); err != nil || !ok {
+				return false, err
+			}
+		}
+	}
+	return true, nil
+}
@@ -5,6 +5,8 @@
 package sstable
 
 import (
+	"encoding/binary"
+
 	"github.com/petermattis/pebble/db"
 )
 
@@ -68,3 +70,126 @@ func (f *tableFilterWriter) metaName() string {
 func (f *tableFilterWriter) policyName() string {
 	return f.policy.Name()
 }
+
+// A block filter is a sequence of filters, each of which covers the data blocks
+// starting within a range of 2^blockFilterBaseLg bytes of the table. The filter
+// for a data block is found using the block's offset, which is obtained from
+// the index. The block filter format matches the LevelDB filter block format:
+//
+//   [filter 0]
+//   [filter 1]
+//   ...
+//   [filter N-1]
+//   [offset of filter 0]                  : 4 bytes
+//   [offset of filter 1]                  : 4 bytes
+//   ...
+//   [offset of filter N-1]                : 4 bytes
+//   [offset of beginning of offset array] : 4 bytes
+//   lg(base)                              : 1 byte
+//
+// The offsets are little-endian. Only the keys of the current filter are held
+// in memory while writing a block filter, unlike a table filter which holds
+// all of the keys of the table.
+const blockFilterBaseLg = 11
+
+type blockFilterReader struct {
+	policy db.FilterPolicy
+}
+
+func newBlockFilterReader(policy db.FilterPolicy) *blockFilterReader {
+	return &blockFilterReader{
+		policy: policy,
+	}
+}
+
+// mayContain returns whether the data block at the specified offset may
+// contain the key. Corrupt filters are treated as potential matches.
+func (f *blockFilterReader) mayContain(data []byte, blockOffset uint64, key []byte) bool {
+	n := len(data)
+	if n < 5 {
+		return true
+	}
+	baseLg := data[n-1]
+	offsetsStart := uint64(binary.LittleEndian.Uint32(data[n-5:]))
+	if offsetsStart > uint64(n-5) {
+		return true
+	}
+	index := blockOffset >> baseLg
+	if index >= (uint64(n-5)-offsetsStart)/4 {
+		return true
+	}
+	i := offsetsStart + 4*index
+	start := uint64(binary.LittleEndian.Uint32(data[i:]))
+	limit := uint64(binary.LittleEndian.Uint32(data[i+4:]))
+	if start > limit || limit > offsetsStart {
+		return true
+	}
+	// NB: an empty filter does not match any keys.
+	return f.policy.MayContain(db.BlockFilter, data[start:limit], key)
+}
+
+type blockFilterWriter struct {
+	policy db.FilterPolicy
+	writer db.FilterWriter
+	// count is the count of the number of keys added to the current filter.
+	count int
+	// data holds the finished filters.
+	data []byte
+	// offsets holds the offset in data of each finished filter.
+	offsets []uint32
+}
+
+func newBlockFilterWriter(policy db.FilterPolicy) *blockFilterWriter {
+	return &blockFilterWriter{
+		policy: policy,
+		writer: policy.NewWriter(db.BlockFilter),
+	}
+}
+
+func (f *blockFilterWriter) addKey(key []byte) {
+	f.count++
+	f.writer.AddKey(key)
+}
+
+func (f *blockFilterWriter) finishBlock(blockOffset uint64) error {
+	// Finish the filters for the ranges which end before the next block. The
+	// keys added so far belong to the first of these filters, and any
+	// remaining filters are empty.
+	for index := blockOffset >> blockFilterBaseLg; uint64(len(f.offsets)) < index; {
+		f.generateFilter()
+	}
+	return nil
+}
+
+func (f *blockFilterWriter) generateFilter() {
+	f.offsets = append(f.offsets, uint32(len(f.data)))
+	if f.count == 0 {
+		return
+	}
+	f.data = f.writer.Finish(f.data)
+	f.count = 0
+}
+
+func (f *blockFilterWriter) finish() ([]byte, error) {
+	if f.count > 0 {
+		f.generateFilter()
+	}
+	offsetsStart := uint32(len(f.data))
+	var tmp [4]byte
+	for _, offset := range f.offsets {
+		binary.LittleEndian.PutUint32(tmp[:], offset)
+		f.data = append(f.data, tmp[:]...)
+	}
+	binary.LittleEndian.PutUint32(tmp[:], offsetsStart)
+	f.data = append(f.data, tmp[:]...)
+	f.data = append(f.data, blockFilterBaseLg)
+	return f.data, nil
+}
+
+func (f *blockFilterWriter) metaName() string {
+	return "filter." + f.policy.Name()
+}
+
+func (f *blockFilterWriter) policyName() string {
+	return f.policy.Name()
+}
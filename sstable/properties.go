@@ -51,6 +51,10 @@ func init() {
 // automatically populated during sstable creation and load from the properties
 // meta block when an sstable is opened.
 type Properties struct {
+	// A comma separated list of names of the block property collectors used in
+	// this table. The position of a name in the list is the ID used to tag the
+	// collector's properties in the index entries of the data blocks.
+	BlockPropertyCollectorNames string `prop:"pebble.block.property.collectors"`
 	// ID of column family for this SST file, corresponding to the CF identified
 	// by column_family_name.
 	ColumnFamilyID uint64 `prop:"rocksdb.column.family.id"`
@@ -64,6 +68,9 @@ type Properties struct {
 	// The time when the SST file was created. Since SST files are immutable,
 	// this is equivalent to last modified time.
 	CreationTime uint64 `prop:"rocksdb.creation.time"`
+	// The identity of the DB session which created the table. Empty if the
+	// table was not created by a DB.
+	DBSessionID string `prop:"rocksdb.creating.session.identity"`
 	// The total size of all data blocks.
 	DataSize uint64 `prop:"rocksdb.data.size"`
 	// The name of the filter policy used in this table. Empty if no filter
@@ -84,7 +91,8 @@ type Properties struct {
 	IndexPartitions uint64 `prop:"rocksdb.index.partitions"`
 	// The size of index block.
 	IndexSize uint64 `prop:"rocksdb.index.size"`
-	// The index type. TODO(peter): add a more detailed description.
+	// The index type: 0 for a single index block, or 2 (kTwoLevelIndexSearch)
+	// for a partitioned index.
 	IndexType uint32 `prop:"rocksdb.block.based.table.index.type"`
 	// The name of the merge operator used in this table. Empty if no merge
 	// operator is used.
@@ -97,7 +105,8 @@ type Properties struct {
 	NumEntries uint64 `prop:"rocksdb.num.entries"`
 	// the number of range deletions in this table.
 	NumRangeDeletions uint64 `prop:"rocksdb.num.range-deletions"`
-	// Timestamp of the earliest key. 0 if unknown.
+	// Timestamp of the earliest key. 0 if unknown. Pebble does not track the
+	// time at which keys were written, and leaves it unknown.
 	OldestKeyTime uint64 `prop:"rocksdb.oldest.key.time"`
 	// The name of the prefix extractor used in this table. Empty if no prefix
 	// extractor is used.
@@ -111,6 +120,9 @@ type Properties struct {
 	RawKeySize uint64 `prop:"rocksdb.raw.key.size"`
 	// Total raw value size.
 	RawValueSize uint64 `prop:"rocksdb.raw.value.size"`
+	// The earliest expiration time of the SETEXPIRY entries in this table, in
+	// nanoseconds since the Unix epoch. 0 if the table has no SETEXPIRY entries.
+	SmallestExpiry uint64 `prop:"pebble.smallest.expiry"`
 	// Size of the top-level index if kTwoLevelIndexSearch is used.
 	TopLevelIndexSize uint64 `prop:"rocksdb.top-level.index.size"`
 	// User collected properties.
@@ -160,7 +172,7 @@ func (p *Properties) String() string {
 	}
 	sort.Strings(keys)
 	for _, key := range keys {
-		fmt.Fprintf(&buf, "%s: %s\n", keys, p.UserProperties[key])
+		fmt.Fprintf(&buf, "%s: %s\n", key, p.UserProperties[key])
 	}
 	return buf.String()
 }
@@ -242,6 +254,9 @@ func (p *Properties) save(w *rawBlockWriter) {
 		m[k] = []byte(v)
 	}
 
+	if p.BlockPropertyCollectorNames != "" {
+		p.saveString(m, unsafe.Offsetof(p.BlockPropertyCollectorNames), p.BlockPropertyCollectorNames)
+	}
 	p.saveUvarint(m, unsafe.Offsetof(p.ColumnFamilyID), p.ColumnFamilyID)
 	if p.ColumnFamilyName != "" {
 		p.saveString(m, unsafe.Offsetof(p.ColumnFamilyName), p.ColumnFamilyName)
@@ -253,6 +268,9 @@ func (p *Properties) save(w *rawBlockWriter) {
 		p.saveString(m, unsafe.Offsetof(p.CompressionName), p.CompressionName)
 	}
 	p.saveUvarint(m, unsafe.Offsetof(p.CreationTime), p.CreationTime)
+	if p.DBSessionID != "" {
+		p.saveString(m, unsafe.Offsetof(p.DBSessionID), p.DBSessionID)
+	}
 	p.saveUvarint(m, unsafe.Offsetof(p.DataSize), p.DataSize)
 	if p.FilterPolicyName != "" {
 		p.saveString(m, unsafe.Offsetof(p.FilterPolicyName), p.FilterPolicyName)
@@ -291,6 +309,9 @@ func (p *Properties) save(w *rawBlockWriter) {
 	}
 	p.saveUvarint(m, unsafe.Offsetof(p.RawKeySize), p.RawKeySize)
 	p.saveUvarint(m, unsafe.Offsetof(p.RawValueSize), p.RawValueSize)
+	if p.SmallestExpiry != 0 {
+		p.saveUvarint(m, unsafe.Offsetof(p.SmallestExpiry), p.SmallestExpiry)
+	}
 	p.saveUint32(m, unsafe.Offsetof(p.Version), p.Version)
 	p.saveBool(m, unsafe.Offsetof(p.WholeKeyFiltering), p.WholeKeyFiltering)
 
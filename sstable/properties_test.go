@@ -77,35 +77,38 @@ func TestPropertiesLoad(t *testing.T) {
 
 func TestPropertiesSave(t *testing.T) {
 	expected := &Properties{
-		ColumnFamilyID:         1,
-		ColumnFamilyName:       "column family name",
-		ComparatorName:         "comparator name",
-		CompressionName:        "compression name",
-		CreationTime:           2,
-		DataSize:               3,
-		FilterPolicyName:       "filter policy name",
-		FilterSize:             4,
-		FixedKeyLen:            5,
-		FormatVersion:          6,
-		GlobalSeqNum:           7,
-		IndexKeyIsUserKey:      8,
-		IndexPartitions:        9,
-		IndexSize:              10,
-		IndexType:              11,
-		MergeOperatorName:      "merge operator name",
-		NumDataBlocks:          12,
-		NumDeletions:           13,
-		NumEntries:             14,
-		NumRangeDeletions:      15,
-		OldestKeyTime:          16,
-		PrefixExtractorName:    "prefix extractor name",
-		PrefixFiltering:        true,
-		PropertyCollectorNames: "prefix collector names",
-		RawKeySize:             17,
-		RawValueSize:           18,
-		TopLevelIndexSize:      19,
-		Version:                20,
-		WholeKeyFiltering:      true,
+		BlockPropertyCollectorNames: "block property collector names",
+		ColumnFamilyID:              1,
+		ColumnFamilyName:            "column family name",
+		ComparatorName:              "comparator name",
+		CompressionName:             "compression name",
+		CreationTime:                2,
+		DBSessionID:                 "db session id",
+		DataSize:                    3,
+		FilterPolicyName:            "filter policy name",
+		FilterSize:                  4,
+		FixedKeyLen:                 5,
+		FormatVersion:               6,
+		GlobalSeqNum:                7,
+		IndexKeyIsUserKey:           8,
+		IndexPartitions:             9,
+		IndexSize:                   10,
+		IndexType:                   11,
+		MergeOperatorName:           "merge operator name",
+		NumDataBlocks:               12,
+		NumDeletions:                13,
+		NumEntries:                  14,
+		NumRangeDeletions:           15,
+		OldestKeyTime:               16,
+		PrefixExtractorName:         "prefix extractor name",
+		PrefixFiltering:             true,
+		PropertyCollectorNames:      "prefix collector names",
+		RawKeySize:                  17,
+		RawValueSize:                18,
+		SmallestExpiry:              21,
+		TopLevelIndexSize:           19,
+		Version:                     20,
+		WholeKeyFiltering:           true,
 		UserProperties: map[string]string{
 			"user-prop-a": "1",
 			"user-prop-b": "2",
@@ -47,7 +47,9 @@ type block []byte
 
 // Iterator iterates over an entire table of data. It is a two-level iterator:
 // to seek for a given key, it first looks in the index for the block that
-// contains that key, and then looks inside that block.
+// contains that key, and then looks inside that block. If the table has a
+// partitioned index, the index partition containing the key is first found in
+// the top-level index.
 type Iterator struct {
 	cmp db.Compare
 	// Global lower/upper bound for the iterator.
@@ -62,6 +64,17 @@ type Iterator struct {
 	data       blockIter
 	err        error
 	closeHook  func() error
+	// prefix is true if SeekGE should consult the table's prefix filter before
+	// loading any data blocks. See SetPrefix.
+	prefix bool
+	// blockFilter, if non-nil, is used to skip data blocks based on their
+	// block properties. See SetBlockPropertyFilters.
+	blockFilter *blockPropertiesFilterer
+	// topLevelIndex is positioned at the entry for the index partition loaded
+	// into index if the table has a partitioned index (i.e. if twoLevel is
+	// true), and is unused otherwise.
+	topLevelIndex blockIter
+	twoLevel      bool
 }
 
 var iterPool = sync.Pool{
@@ -87,11 +100,121 @@ func (i *Iterator) Init(r *Reader, lower, upper []byte) error {
 			return i.err
 		}
 		i.cmp = r.compare
-		i.err = i.index.init(i.cmp, index, r.Properties.GlobalSeqNum)
+		if r.Properties.IndexType == twoLevelIndexType {
+			i.twoLevel = true
+			i.err = i.topLevelIndex.init(i.cmp, index, r.Properties.GlobalSeqNum)
+		} else {
+			i.err = i.index.init(i.cmp, index, r.Properties.GlobalSeqNum)
+		}
 	}
 	return i.err
 }
 
+// loadIndex loads the index partition at the current top-level index position
+// and leaves i.index unpositioned. If unsuccessful, i.index is invalidated and
+// its error is set to any error encountered, which may be nil if we have
+// simply exhausted the top-level index. Index partitions are read through the
+// block cache.
+func (i *Iterator) loadIndex() bool {
+	i.index.err = nil
+	var err error
+	if i.topLevelIndex.Valid() {
+		v := i.topLevelIndex.Value()
+		h, n := decodeBlockHandle(v)
+		if n == 0 || n != len(v) {
+			err = errors.New("pebble/table: corrupt top-level index entry")
+		} else {
+			var b block
+			if b, _, err = i.reader.readBlock(h); err == nil {
+				if err = i.index.init(i.cmp, b, i.reader.Properties.GlobalSeqNum); err == nil {
+					return true
+				}
+			}
+		}
+	} else {
+		err = i.topLevelIndex.err
+	}
+	i.index.offset = 0
+	i.index.restarts = 0
+	i.index.clearCache()
+	i.index.err = err
+	return false
+}
+
+// seekIndexGE positions i.index at the first index entry whose key is >= the
+// given key, loading the index partition containing that entry if the index is
+// partitioned.
+func (i *Iterator) seekIndexGE(key []byte) *db.InternalKey {
+	if i.twoLevel {
+		// The key of a partition's top-level index entry is the last key in the
+		// partition, so the entry sought is in the partition found.
+		i.topLevelIndex.SeekGE(key)
+		if !i.loadIndex() {
+			return nil
+		}
+	}
+	ikey, _ := i.index.SeekGE(key)
+	return ikey
+}
+
+// firstIndex positions i.index at the first index entry.
+func (i *Iterator) firstIndex() *db.InternalKey {
+	if i.twoLevel {
+		i.topLevelIndex.First()
+		if !i.loadIndex() {
+			return nil
+		}
+	}
+	ikey, _ := i.index.First()
+	return ikey
+}
+
+// lastIndex positions i.index at the last index entry.
+func (i *Iterator) lastIndex() *db.InternalKey {
+	if i.twoLevel {
+		i.topLevelIndex.Last()
+		if !i.loadIndex() {
+			return nil
+		}
+	}
+	ikey, _ := i.index.Last()
+	return ikey
+}
+
+// nextIndex moves i.index to the next index entry, which is the first entry
+// of the next index partition if i.index is exhausted.
+func (i *Iterator) nextIndex() *db.InternalKey {
+	if ikey, _ := i.index.Next(); ikey != nil || !i.twoLevel {
+		return ikey
+	}
+	if i.index.err != nil {
+		return nil
+	}
+	i.topLevelIndex.Next()
+	if !i.loadIndex() {
+		return nil
+	}
+	ikey, _ := i.index.First()
+	return ikey
+}
+
+// prevIndex moves i.index to the previous index entry, which is the last
+// entry of the previous index partition if i.index is exhausted.
+func (i *Iterator) prevIndex() *db.InternalKey {
+	if ikey, _ := i.index.Prev(); ikey != nil || !i.twoLevel {
+		return ikey
+	}
+	if i.index.err != nil {
+		return nil
+	}
+	i.topLevelIndex.Prev()
+	if !i.loadIndex() {
+		return nil
+	}
+	ikey, _ := i.index.Last()
+	return ikey
+}
+
 func (i *Iterator) initBounds() {
 	if i.lower == nil && i.upper == nil {
 		return
@@ -120,7 +243,9 @@ func (i *Iterator) initBounds() {
 
 // loadBlock loads the block at the current index position and leaves i.data
 // unpositioned. If unsuccessful, it sets i.err to any error encountered, which
-// may be nil if we have simply exhausted the entire table.
+// may be nil if we have simply exhausted the entire table. If the block is
+// excluded by the block property filters, an empty block is loaded in its
+// place without reading the block.
 func (i *Iterator) loadBlock() bool {
 	if !i.index.Valid() {
 		i.err = i.index.err
@@ -131,12 +256,24 @@ func (i *Iterator) loadBlock() bool {
 		return false
 	}
 	// Load the next block.
-	v := i.index.Value()
-	h, n := decodeBlockHandle(v)
-	if n == 0 || n != len(v) {
-		i.err = errors.New("pebble/table: corrupt index entry")
+	h, props, err := i.reader.decodeIndexEntry(i.index.Value())
+	if err != nil {
+		i.err = err
 		return false
 	}
+	if i.blockFilter != nil {
+		ok, err := i.blockFilter.intersects(props)
+		if err != nil {
+			i.err = err
+			return false
+		}
+		if !ok {
+			i.err = i.data.init(i.cmp, emptyBlock, 0)
+			i.blockLower = nil
+			i.blockUpper = nil
+			return i.err == nil
+		}
+	}
 	block, _, err := i.reader.readBlock(h)
 	if err != nil {
 		i.err = err
@@ -160,10 +297,9 @@ func (i *Iterator) seekBlock(key []byte) bool {
 		return false
 	}
 	// Load the next block.
-	v := i.index.Value()
-	h, n := decodeBlockHandle(v)
-	if n == 0 || n != len(v) {
-		i.err = errors.New("pebble/table: corrupt index entry")
+	h, _, err := i.reader.decodeIndexEntry(i.index.Value())
+	if err != nil {
+		i.err = err
 		return false
 	}
 	block, _, err := i.reader.readBlock(h)
@@ -189,7 +325,18 @@ func (i *Iterator) SeekGE(key []byte) (*db.InternalKey, []byte) {
 		return nil, nil
 	}
 
-	if ikey, _ := i.index.SeekGE(key); ikey == nil {
+	if i.prefix && !i.mayContainPrefix(key) {
+		// The table does not contain any keys with the same prefix as the seek
+		// key. Position the iterator after the last entry without loading any
+		// data blocks.
+		i.index.invalidateUpper()
+		i.topLevelIndex.invalidateUpper()
+		i.data.offset = 0
+		i.data.restarts = 0
+		return nil, nil
+	}
+
+	if ikey := i.seekIndexGE(key); ikey == nil {
 		return nil, nil
 	}
 	if !i.loadBlock() {
@@ -197,7 +344,9 @@ func (i *Iterator) SeekGE(key []byte) (*db.InternalKey, []byte) {
 	}
 	ikey, val := i.data.SeekGE(key)
 	if ikey == nil {
-		return nil, nil
+		// The block was skipped by the block property filters, or key lies
+		// between the last key in the block and the block's index separator.
+		return i.skipForward()
 	}
 	if i.blockUpper != nil && i.cmp(ikey.UserKey, i.blockUpper) >= 0 {
 		i.data.offset = i.data.restarts
@@ -206,6 +355,22 @@ func (i *Iterator) SeekGE(key []byte) (*db.InternalKey, []byte) {
 	return ikey, val
 }
 
+// mayContainPrefix returns false if the table's prefix filter indicates that
+// the table does not contain any keys sharing the prefix of key, as determined
+// by Comparer.Split. Returns true if the table does not have a prefix filter.
+func (i *Iterator) mayContainPrefix(key []byte) bool {
+	r := i.reader
+	if r.tableFilter == nil || r.split == nil || !r.Properties.PrefixFiltering {
+		return true
+	}
+	data, err := r.readFilter()
+	if err != nil {
+		i.err = err
+		return false
+	}
+	return r.tableFilter.mayContain(data, key[:r.split(key)])
+}
+
 // SeekLT implements internalIterator.SeekLT, as documented in the pebble
 // package. Note that SeekLT only checks the lower bound. It is up to the
 // caller to ensure that key is less than the upper bound.
@@ -214,8 +379,8 @@ func (i *Iterator) SeekLT(key []byte) (*db.InternalKey, []byte) {
 		return nil, nil
 	}
 
-	if ikey, _ := i.index.SeekGE(key); ikey == nil {
-		i.index.Last()
+	if ikey := i.seekIndexGE(key); ikey == nil && i.index.err == nil {
+		i.lastIndex()
 	}
 	if !i.loadBlock() {
 		return nil, nil
@@ -232,16 +397,9 @@ func (i *Iterator) SeekLT(key []byte) (*db.InternalKey, []byte) {
 		// If these two keys end one block and start the next, the index key may
 		// be chosen as "compleu". The SeekGE in the index block will then point
 		// us to the block containing "complexion". If this happens, we want the
-		// last key from the previous data block.
-		if ikey, val = i.index.Prev(); ikey == nil {
-			return nil, nil
-		}
-		if !i.loadBlock() {
-			return nil, nil
-		}
-		if ikey, val = i.data.Last(); ikey == nil {
-			return nil, nil
-		}
+		// last key from the previous data block. The same applies if the block
+		// was skipped by the block property filters.
+		return i.skipBackward()
 	}
 	if i.blockLower != nil && i.cmp(ikey.UserKey, i.blockLower) < 0 {
 		i.data.invalidateLower() // force i.data.Valid() to return false
@@ -259,7 +417,7 @@ func (i *Iterator) First() (*db.InternalKey, []byte) {
 		return nil, nil
 	}
 
-	if ikey, _ := i.index.First(); ikey == nil {
+	if ikey := i.firstIndex(); ikey == nil {
 		return nil, nil
 	}
 	if !i.loadBlock() {
@@ -267,7 +425,7 @@ func (i *Iterator) First() (*db.InternalKey, []byte) {
 	}
 	ikey, val := i.data.First()
 	if ikey == nil {
-		return nil, nil
+		return i.skipForward()
 	}
 	if i.blockUpper != nil && i.cmp(ikey.UserKey, i.blockUpper) >= 0 {
 		i.data.invalidateUpper() // force i.data.Valid() to return false
@@ -285,14 +443,14 @@ func (i *Iterator) Last() (*db.InternalKey, []byte) {
 		return nil, nil
 	}
 
-	if ikey, _ := i.index.Last(); ikey == nil {
+	if ikey := i.lastIndex(); ikey == nil {
 		return nil, nil
 	}
 	if !i.loadBlock() {
 		return nil, nil
 	}
 	if ikey, _ := i.data.Last(); ikey == nil {
-		return nil, nil
+		return i.skipBackward()
 	}
 	if i.blockLower != nil && i.cmp(i.data.ikey.UserKey, i.blockLower) < 0 {
 		i.data.offset = -1
@@ -314,25 +472,33 @@ func (i *Iterator) Next() (*db.InternalKey, []byte) {
 		}
 		return key, val
 	}
+	return i.skipForward()
+}
+
+// skipForward loads the subsequent data blocks until a non-empty block is
+// found, returning the first key in that block. Blocks skipped by the block
+// property filters are empty.
+func (i *Iterator) skipForward() (*db.InternalKey, []byte) {
 	for {
 		if i.data.err != nil {
 			i.err = i.data.err
 			break
 		}
-		if key, _ := i.index.Next(); key == nil {
+		if key := i.nextIndex(); key == nil {
 			break
 		}
-		if i.loadBlock() {
-			key, val := i.data.First()
-			if key == nil {
-				return nil, nil
-			}
-			if i.blockUpper != nil && i.cmp(key.UserKey, i.blockUpper) >= 0 {
-				i.data.offset = i.data.restarts
-				return nil, nil
-			}
-			return key, val
+		if !i.loadBlock() {
+			break
+		}
+		key, val := i.data.First()
+		if key == nil {
+			continue
+		}
+		if i.blockUpper != nil && i.cmp(key.UserKey, i.blockUpper) >= 0 {
+			i.data.offset = i.data.restarts
+			return nil, nil
 		}
+		return key, val
 	}
 	return nil, nil
 }
@@ -350,25 +516,33 @@ func (i *Iterator) Prev() (*db.InternalKey, []byte) {
 		}
 		return key, val
 	}
+	return i.skipBackward()
+}
+
+// skipBackward loads the preceding data blocks until a non-empty block is
+// found, returning the last key in that block. Blocks skipped by the block
+// property filters are empty.
+func (i *Iterator) skipBackward() (*db.InternalKey, []byte) {
 	for {
 		if i.data.err != nil {
 			i.err = i.data.err
 			break
 		}
-		if key, _ := i.index.Prev(); key == nil {
+		if key := i.prevIndex(); key == nil {
 			break
 		}
-		if i.loadBlock() {
-			key, val := i.data.Last()
-			if key == nil {
-				return nil, nil
-			}
-			if i.blockLower != nil && i.cmp(key.UserKey, i.blockLower) < 0 {
-				i.data.offset = -1
-				return nil, nil
-			}
-			return key, val
+		if !i.loadBlock() {
+			break
 		}
+		key, val := i.data.Last()
+		if key == nil {
+			continue
+		}
+		if i.blockLower != nil && i.cmp(key.UserKey, i.blockLower) < 0 {
+			i.data.offset = -1
+			return nil, nil
+		}
+		return key, val
 	}
 	return nil, nil
 }
@@ -399,6 +573,22 @@ func (i *Iterator) Error() error {
 	return i.err
 }
 
+// SetPrefix configures whether SeekGE consults the table's prefix bloom filter
+// (see db.IterOptions.Prefix). If enabled and the filter indicates that the
+// table does not contain the prefix of the seek key, SeekGE exhausts the
+// iterator without loading any data blocks.
+func (i *Iterator) SetPrefix(prefix bool) {
+	i.prefix = prefix
+}
+
+// SetBlockPropertyFilters configures the filters used to skip data blocks
+// based on the properties stored in their index entries (see
+// db.IterOptions.BlockPropertyFilters). Filters whose collector was not used
+// when writing the table are ignored.
+func (i *Iterator) SetBlockPropertyFilters(filters []db.BlockPropertyFilter) {
+	i.blockFilter = newBlockPropertiesFilterer(i.reader, filters)
+}
+
 // SetCloseHook sets a function that will be called when the iterator is
 // closed.
 func (i *Iterator) SetCloseHook(fn func() error) {
@@ -422,6 +612,17 @@ func (i *Iterator) Close() error {
 	return err
 }
 
+// SetBounds implements internalIterator.SetBounds, as documented in the pebble
+// package.
+func (i *Iterator) SetBounds(lower, upper []byte) {
+	i.lower = lower
+	i.upper = upper
+	// The per-block bounds are trimmed when the next block is loaded. Until
+	// then, check the bounds on every key.
+	i.blockLower = lower
+	i.blockUpper = upper
+}
+
 type weakCachedBlock struct {
 	bh     blockHandle
 	mu     sync.RWMutex
@@ -442,6 +643,7 @@ type Reader struct {
 	compare     db.Compare
 	split       db.Split
 	tableFilter *tableFilterReader
+	blockFilter *blockFilterReader
 	Properties  Properties
 }
 
@@ -473,17 +675,15 @@ func (r *Reader) get(key []byte) (value []byte, err error) {
 		return nil, r.err
 	}
 
+	lookupKey := key
+	if r.split != nil {
+		lookupKey = key[:r.split(key)]
+	}
 	if r.tableFilter != nil {
 		data, err := r.readFilter()
 		if err != nil {
 			return nil, err
 		}
-		var lookupKey []byte
-		if r.split != nil {
-			lookupKey = key[:r.split(key)]
-		} else {
-			lookupKey = key
-		}
 		if !r.tableFilter.mayContain(data, lookupKey) {
 			return nil, db.ErrNotFound
 		}
@@ -491,7 +691,24 @@ func (r *Reader) get(key []byte) (value []byte, err error) {
 
 	i := iterPool.Get().(*Iterator)
 	if err := i.Init(r, nil, nil); err == nil {
-		i.index.SeekGE(key)
+		i.seekIndexGE(key)
+		if r.blockFilter != nil && i.index.Valid() {
+			// Consult the filter for the data block which may contain the key
+			// before loading the block.
+			if h, _, err := r.decodeIndexEntry(i.index.Value()); err == nil {
+				data, err := r.readFilter()
+				if err != nil {
+					i.Close()
+					return nil, err
+				}
+				if !r.blockFilter.mayContain(data, h.offset, lookupKey) {
+					if err := i.Close(); err != nil {
+						return nil, err
+					}
+					return nil, db.ErrNotFound
+				}
+			}
+		}
 		i.seekBlock(key)
 	}
 
@@ -535,6 +752,25 @@ func (r *Reader) NewRangeDelIter() *blockIter {
 	return i
 }
 
+// decodeIndexEntry decodes an index entry into the block handle of a data
+// block and the encoded properties of the block, which are empty unless the
+// table was written with block property collectors.
+func (r *Reader) decodeIndexEntry(v []byte) (blockHandle, []byte, error) {
+	h, n := decodeBlockHandle(v)
+	if n == 0 {
+		return blockHandle{}, nil, errCorruptIndexEntry
+	}
+	props := v[n:]
+	if r.Properties.BlockPropertyCollectorNames == "" {
+		if len(props) != 0 {
+			return blockHandle{}, nil, errCorruptIndexEntry
+		}
+	} else if !validBlockProperties(props) {
+		return blockHandle{}, nil, errCorruptIndexEntry
+	}
+	return h, props, nil
+}
+
 func (r *Reader) readIndex() (block, error) {
 	return r.readWeakCachedBlock(&r.index)
 }
@@ -678,6 +914,7 @@ func (r *Reader) readMetaindex(metaindexBH blockHandle, o *db.Options) error {
 			prefix string
 		}{
 			{db.TableFilter, "fullfilter."},
+			{db.BlockFilter, "filter."},
 		}
 		var done bool
 		for _, t := range types {
@@ -687,6 +924,8 @@ func (r *Reader) readMetaindex(metaindexBH blockHandle, o *db.Options) error {
 				switch t.ftype {
 				case db.TableFilter:
 					r.tableFilter = newTableFilterReader(fp)
+				case db.BlockFilter:
+					r.blockFilter = newBlockFilterReader(fp)
 				default:
 					return fmt.Errorf("unknown filter type: %v", t.ftype)
 				}
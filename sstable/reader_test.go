@@ -92,6 +92,17 @@ func TestReader(t *testing.T) {
 			FilterPolicy: bloom.FilterPolicy(100),
 			FilterType:   db.TableFilter,
 		},
+		"blockBloom10bit": db.LevelOptions{
+			// A block-level filter with a data block per key.
+			BlockSize:    1,
+			FilterPolicy: bloom.FilterPolicy(10),
+			FilterType:   db.BlockFilter,
+		},
+		"twoLevelIndex": db.LevelOptions{
+			// A partitioned index with a data block and index partition per key.
+			BlockSize:      1,
+			IndexBlockSize: 1,
+		},
 	}
 
 	opts := map[string]*db.Options{
@@ -233,6 +244,299 @@ func runTestReader(t *testing.T, o db.Options) {
 	})
 }
 
+func TestReaderPrefixFilter(t *testing.T) {
+	// The prefix of a key is everything up to and including the '@' separator.
+	comparer := *db.DefaultComparer
+	comparer.Name = "test-prefix"
+	comparer.Split = func(a []byte) int {
+		return bytes.IndexByte(a, '@') + 1
+	}
+	o := &db.Options{
+		Comparer: &comparer,
+		Levels: []db.LevelOptions{{
+			FilterPolicy: bloom.FilterPolicy(100),
+			FilterType:   db.TableFilter,
+		}},
+	}
+	o.EnsureDefaults()
+
+	mem := vfs.NewMem()
+	f, err := mem.Create("sstable")
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := NewWriter(f, o, o.Levels[0])
+	for i, k := range []string{"a@1", "a@2", "c@1", "c@2", "e@1"} {
+		w.Add(db.MakeInternalKey([]byte(k), uint64(i+1), db.InternalKeyKindSet), nil)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	f, err = mem.Open("sstable")
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := NewReader(f, 0, o)
+	defer r.Close()
+
+	testCases := []struct {
+		prefix bool
+		ops    string
+		want   string
+	}{
+		{false, "seek-ge:a@0", "a@1"},
+		{true, "seek-ge:a@0", "a@1"},
+		{false, "seek-ge:b@1", "c@1"},
+		{true, "seek-ge:b@1", "."},
+		{true, "seek-ge:d@1 prev", ". e@1"},
+		{true, "seek-ge:c@3 next", "e@1 ."},
+		{true, "seek-ge:f@1 first", ". a@1"},
+	}
+	for _, c := range testCases {
+		t.Run(fmt.Sprintf("prefix=%t,%s", c.prefix, c.ops), func(t *testing.T) {
+			iter := iterAdapter{r.NewIter(nil /* lower */, nil /* upper */)}
+			iter.SetPrefix(c.prefix)
+			defer iter.Close()
+
+			var got []string
+			for _, op := range strings.Fields(c.ops) {
+				switch {
+				case strings.HasPrefix(op, "seek-ge:"):
+					iter.SeekGE([]byte(op[len("seek-ge:"):]))
+				case op == "first":
+					iter.First()
+				case op == "next":
+					iter.Next()
+				case op == "prev":
+					iter.Prev()
+				default:
+					t.Fatalf("unknown op: %s", op)
+				}
+				if err := iter.Error(); err != nil {
+					t.Fatal(err)
+				}
+				if iter.Valid() {
+					got = append(got, string(iter.Key().UserKey))
+				} else {
+					got = append(got, ".")
+				}
+			}
+			if s := strings.Join(got, " "); c.want != s {
+				t.Fatalf("expected %q, but found %q", c.want, s)
+			}
+		})
+	}
+}
+
+// suffixIntervalCollector collects the [min,max] interval of the integer
+// suffixes (as determined by Comparer.Split) of the keys in each data block.
+type suffixIntervalCollector struct {
+	split    db.Split
+	min, max uint64
+}
+
+func (c *suffixIntervalCollector) Add(key db.InternalKey, value []byte) error {
+	v, err := strconv.ParseUint(string(key.UserKey[c.split(key.UserKey):]), 10, 64)
+	if err != nil {
+		return err
+	}
+	if c.min == 0 || v < c.min {
+		c.min = v
+	}
+	if v > c.max {
+		c.max = v
+	}
+	return nil
+}
+
+func (c *suffixIntervalCollector) FinishDataBlock() ([]byte, error) {
+	var buf [2 * binary.MaxVarintLen64]byte
+	n := binary.PutUvarint(buf[:], c.min)
+	n += binary.PutUvarint(buf[n:], c.max)
+	c.min, c.max = 0, 0
+	return buf[:n], nil
+}
+
+func (c *suffixIntervalCollector) Name() string {
+	return "suffix-interval"
+}
+
+// suffixIntervalFilter filters out data blocks whose suffix interval does not
+// intersect [min,max].
+type suffixIntervalFilter struct {
+	min, max uint64
+}
+
+func (f suffixIntervalFilter) Intersects(prop []byte) (bool, error) {
+	min, n := binary.Uvarint(prop)
+	max, _ := binary.Uvarint(prop[n:])
+	return min <= f.max && f.min <= max, nil
+}
+
+func (f suffixIntervalFilter) Name() string {
+	return "suffix-interval"
+}
+
+func TestReaderBlockPropertyFilter(t *testing.T) {
+	comparer := *db.DefaultComparer
+	comparer.Split = func(a []byte) int {
+		return bytes.IndexByte(a, '@') + 1
+	}
+	o := &db.Options{
+		Comparer: &comparer,
+		BlockPropertyCollectors: []func() db.BlockPropertyCollector{
+			func() db.BlockPropertyCollector {
+				return &suffixIntervalCollector{split: comparer.Split}
+			},
+		},
+		// A block size of 1 places every key in its own data block.
+		Levels: []db.LevelOptions{{BlockSize: 1}},
+	}
+	o.EnsureDefaults()
+
+	mem := vfs.NewMem()
+	f, err := mem.Create("sstable")
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := NewWriter(f, o, o.Levels[0])
+	for i, k := range []string{"a@1", "b@5", "c@2", "d@7", "e@3"} {
+		w.Add(db.MakeInternalKey([]byte(k), uint64(i+1), db.InternalKeyKindSet), nil)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	f, err = mem.Open("sstable")
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := NewReader(f, 0, o)
+	defer r.Close()
+	if expected, actual := "[suffix-interval]", r.Properties.BlockPropertyCollectorNames; expected != actual {
+		t.Fatalf("expected %q, but found %q", expected, actual)
+	}
+
+	testCases := []struct {
+		filters []db.BlockPropertyFilter
+		ops     string
+		want    string
+	}{
+		{nil, "first next next next next next", "a@1 b@5 c@2 d@7 e@3 ."},
+		{[]db.BlockPropertyFilter{suffixIntervalFilter{4, 9}},
+			"first next next", "b@5 d@7 ."},
+		{[]db.BlockPropertyFilter{suffixIntervalFilter{4, 9}},
+			"last prev prev", "d@7 b@5 ."},
+		{[]db.BlockPropertyFilter{suffixIntervalFilter{4, 9}},
+			"seek-ge:c seek-ge:a seek-ge:e", "d@7 b@5 ."},
+		{[]db.BlockPropertyFilter{suffixIntervalFilter{4, 9}},
+			"seek-lt:d seek-lt:z seek-lt:b", "b@5 d@7 ."},
+		{[]db.BlockPropertyFilter{suffixIntervalFilter{2, 3}},
+			"first next last prev", "c@2 e@3 e@3 c@2"},
+		{[]db.BlockPropertyFilter{suffixIntervalFilter{10, 20}},
+			"first last", ". ."},
+	}
+	for _, c := range testCases {
+		t.Run(c.ops, func(t *testing.T) {
+			iter := iterAdapter{r.NewIter(nil /* lower */, nil /* upper */)}
+			iter.SetBlockPropertyFilters(c.filters)
+			defer iter.Close()
+
+			var got []string
+			for _, op := range strings.Fields(c.ops) {
+				switch {
+				case strings.HasPrefix(op, "seek-ge:"):
+					iter.SeekGE([]byte(op[len("seek-ge:"):]))
+				case strings.HasPrefix(op, "seek-lt:"):
+					iter.SeekLT([]byte(op[len("seek-lt:"):]))
+				case op == "first":
+					iter.First()
+				case op == "last":
+					iter.Last()
+				case op == "next":
+					iter.Next()
+				case op == "prev":
+					iter.Prev()
+				default:
+					t.Fatalf("unknown op: %s", op)
+				}
+				if err := iter.Error(); err != nil {
+					t.Fatal(err)
+				}
+				if iter.Valid() {
+					got = append(got, string(iter.Key().UserKey))
+				} else {
+					got = append(got, ".")
+				}
+			}
+			if s := strings.Join(got, " "); c.want != s {
+				t.Fatalf("expected %q, but found %q", c.want, s)
+			}
+		})
+	}
+}
+
+type namedCollector struct {
+	suffixIntervalCollector
+	name string
+}
+
+func (c *namedCollector) Name() string {
+	return c.name
+}
+
+func TestWriterBlockPropertyCollectorName(t *testing.T) {
+	o := &db.Options{
+		BlockPropertyCollectors: []func() db.BlockPropertyCollector{
+			func() db.BlockPropertyCollector {
+				return &namedCollector{name: "a,b"}
+			},
+		},
+	}
+	f, err := vfs.NewMem().Create("sstable")
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := NewWriter(f, o, db.LevelOptions{})
+	if err := w.Close(); err == nil || !strings.Contains(err.Error(), "invalid block property collector name") {
+		t.Fatalf("expected an invalid name error, but found %v", err)
+	}
+}
+
+func TestReaderDecodeIndexEntry(t *testing.T) {
+	var buf [blockHandleMaxLen]byte
+	n := encodeBlockHandle(buf[:], blockHandle{offset: 10, length: 20})
+	entry := func(suffix ...byte) []byte {
+		return append(append([]byte(nil), buf[:n]...), suffix...)
+	}
+
+	testCases := []struct {
+		names string
+		v     []byte
+		ok    bool
+	}{
+		{"", entry(), true},
+		{"", entry(0), false},
+		{"", nil, false},
+		{"[p]", entry(), true},
+		{"[p]", entry(0, 2, 'x', 'y'), true},
+		{"[p]", entry(0, 3, 'x', 'y'), false},
+		{"[p]", entry(0), false},
+	}
+	for _, c := range testCases {
+		r := &Reader{}
+		r.Properties.BlockPropertyCollectorNames = c.names
+		h, _, err := r.decodeIndexEntry(c.v)
+		if ok := err == nil; ok != c.ok {
+			t.Fatalf("%s %x: expected ok=%t, but found %v", c.names, c.v, c.ok, err)
+		}
+		if c.ok && (h.offset != 10 || h.length != 20) {
+			t.Fatalf("%s %x: unexpected block handle %+v", c.names, c.v, h)
+		}
+	}
+}
+
 func buildBenchmarkTable(b *testing.B, blockSize, restartInterval int) (*Reader, [][]byte) {
 	mem := vfs.NewMem()
 	f0, err := mem.Create("bench")
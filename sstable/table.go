@@ -79,6 +79,9 @@ The table file format looks like:
 [data block 1]
 ...
 [data block N-1]
+[index partition 0]
+...
+[index partition P-1]
 [meta block 0]
 [meta block 1]
 ...
@@ -119,6 +122,19 @@ is a key that is >= every key in block i and is < every key i block i+1. The
 successor for the final block is a key that is >= every key in block N-1. The
 index block restart interval is 1: every entry is a restart point.
 
+If the index is larger than db.LevelOptions.IndexBlockSize, the index is
+partitioned and the index block is a top-level index: the i'th value is the
+encoded block handle of the i'th index partition and the i'th key is the last
+key of that partition. Each index partition is itself an index block over a
+subset of the data blocks. A partitioned index is recorded by the
+rocksdb.block.based.table.index.type property.
+
+If the table was written with block property collectors, the encoded block
+handle in each index entry is followed by the properties of the data block.
+Each property is encoded as a 1 byte collector ID (the position of the
+collector in the pebble.block.property.collectors property), a varint-encoded
+length and the literal property contents.
+
 A block handle is an offset and a length; the length does not include the 5
 byte trailer. Both numbers are varint-encoded, with no padding between the two
 values. The maximum size of an encoded block handle is therefore 20 bytes.
@@ -155,6 +171,12 @@ const (
 	noCompressionBlockType     byte = 0
 	snappyCompressionBlockType byte = 1
 
+	// The index type gives the layout of the index (the
+	// rocksdb.block.based.table.index.type property). These constants are part
+	// of the file format and should not be changed.
+	binarySearchIndexType = 0
+	twoLevelIndexType     = 2
+
 	metaPropertiesName = "rocksdb.properties"
 	metaRangeDelName   = "rocksdb.range_del"
 	metaRangeDelV2Name = "rocksdb.range_del2"
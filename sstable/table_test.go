@@ -317,6 +317,7 @@ func build(
 	fp db.FilterPolicy,
 	ftype db.FilterType,
 	comparer *db.Comparer,
+	indexBlockSize int,
 ) (vfs.File, error) {
 	// Create a sorted list of wordCount's keys.
 	keys := make([]string, len(wordCount))
@@ -341,9 +342,10 @@ func build(
 		},
 		Comparer: comparer,
 	}, db.LevelOptions{
-		Compression:  compression,
-		FilterPolicy: fp,
-		FilterType:   ftype,
+		Compression:    compression,
+		FilterPolicy:   fp,
+		FilterType:     ftype,
+		IndexBlockSize: indexBlockSize,
 	})
 	for _, k := range keys {
 		v := wordCount[k]
@@ -404,6 +406,7 @@ func TestReaderBloomUsed(t *testing.T) {
 		path     string
 		comparer *db.Comparer
 	}{
+		{"h.block-bloom.no-compression.sst", nil},
 		{"h.table-bloom.no-compression.sst", nil},
 		{"h.table-bloom.no-compression.prefix_extractor.no_whole_key_filter.sst", fixtureComparer},
 	}
@@ -531,18 +534,78 @@ func TestWriterRoundTrip(t *testing.T) {
 		"none":       nil,
 		"bloom10bit": bloom.FilterPolicy(10),
 	} {
-		t.Run(fmt.Sprintf("bloom=%s", name), func(t *testing.T) {
-			f, err := build(db.DefaultCompression, fp, db.TableFilter, nil)
-			if err != nil {
-				t.Fatal(err)
-			}
-			// Check that we can read a freshly made table.
+		for _, ftype := range []db.FilterType{db.TableFilter, db.BlockFilter} {
+			for _, indexBlockSize := range []int{0, 128} {
+				t.Run(fmt.Sprintf("bloom=%s,filterType=%s,indexBlockSize=%d", name, ftype, indexBlockSize), func(t *testing.T) {
+					f, err := build(db.DefaultCompression, fp, ftype, nil, indexBlockSize)
+					if err != nil {
+						t.Fatal(err)
+					}
+					// Check that we can read a freshly made table.
 
-			err = check(f, nil, nil)
-			if err != nil {
-				t.Fatal(err)
+					err = check(f, nil, fp)
+					if err != nil {
+						t.Fatal(err)
+					}
+				})
 			}
-		})
+		}
+	}
+}
+
+func TestWriterTwoLevelIndex(t *testing.T) {
+	f, err := build(db.DefaultCompression, nil, db.TableFilter, nil, 128)
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := NewReader(f, 0, nil)
+	defer r.Close()
+
+	p := &r.Properties
+	if p.IndexType != twoLevelIndexType {
+		t.Fatalf("expected index type %d, but found %d", twoLevelIndexType, p.IndexType)
+	}
+	if p.IndexPartitions < 2 {
+		t.Fatalf("expected several index partitions, but found %d", p.IndexPartitions)
+	}
+	if p.TopLevelIndexSize == 0 || p.TopLevelIndexSize >= p.IndexSize {
+		t.Fatalf("expected a top-level index size smaller than the index size %d, but found %d",
+			p.IndexSize, p.TopLevelIndexSize)
+	}
+	// The top-level index holds an entry for each index partition, while the
+	// partitions hold an entry for each data block.
+	index, err := r.readIndex()
+	if err != nil {
+		t.Fatal(err)
+	}
+	topLevel, err := newBlockIter(r.compare, index)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var partitions, dataBlocks uint64
+	for key, val := topLevel.First(); key != nil; key, val = topLevel.Next() {
+		partitions++
+		bh, n := decodeBlockHandle(val)
+		if n == 0 {
+			t.Fatalf("corrupt top-level index entry")
+		}
+		b, _, err := r.readBlock(bh)
+		if err != nil {
+			t.Fatal(err)
+		}
+		partition, err := newBlockIter(r.compare, b)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for key, _ := partition.First(); key != nil; key, _ = partition.Next() {
+			dataBlocks++
+		}
+	}
+	if partitions != p.IndexPartitions {
+		t.Fatalf("expected %d index partitions, but found %d", p.IndexPartitions, partitions)
+	}
+	if dataBlocks != p.NumDataBlocks {
+		t.Fatalf("expected %d data blocks, but found %d", p.NumDataBlocks, dataBlocks)
 	}
 }
 
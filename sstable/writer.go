@@ -6,11 +6,13 @@ package sstable
 
 import (
 	"bufio"
+	"bytes"
 	"encoding/binary"
 	"errors"
 	"fmt"
 	"io"
 	"math"
+	"strings"
 
 	"github.com/golang/snappy"
 	"github.com/petermattis/pebble/db"
@@ -27,6 +29,9 @@ type WriterMetadata struct {
 	LargestRange   db.InternalKey
 	SmallestSeqNum uint64
 	LargestSeqNum  uint64
+	// The earliest expiration time of the SETEXPIRY entries in the table (see
+	// Properties.SmallestExpiry).
+	SmallestExpiry uint64
 }
 
 func (m *WriterMetadata) updateSeqNum(seqNum uint64) {
@@ -92,6 +97,7 @@ type Writer struct {
 	// The following fields are copied from db.Options.
 	blockSize          int
 	blockSizeThreshold int
+	indexBlockSize     int
 	compare            db.Compare
 
 	split db.Split
@@ -114,6 +120,13 @@ type Writer struct {
 	indexBlock    blockWriter
 	rangeDelBlock blockWriter
 	props         Properties
+	// indexPartitions holds the finished index partitions, which are written
+	// when the table is closed. It is only populated if the index is larger
+	// than indexBlockSize, in which case the index block becomes the final
+	// partition and a top-level index is written in its place.
+	indexPartitions []indexPartition
+	// indexPartitionsSize is the total size of the finished index partitions.
+	indexPartitionsSize int
 	// compressedBuf is the destination buffer for snappy compression. It is
 	// re-used over the lifetime of the writer, avoiding the allocation of a
 	// temporary buffer for each block.
@@ -122,6 +135,18 @@ type Writer struct {
 	// either the output of w.split (i.e. a prefix extractor) if w.split is not
 	// nil, or the full keys otherwise.
 	filter filterWriter
+	// propCollectors are the user-defined table property collectors, created
+	// from db.Options.TablePropertyCollectors.
+	propCollectors []db.TablePropertyCollector
+	// blockPropCollectors are the user-defined block property collectors,
+	// created from db.Options.BlockPropertyCollectors.
+	blockPropCollectors []db.BlockPropertyCollector
+	// blockPropsBuf holds the encoded block properties of the last finished
+	// data block until they are added to the index along with pendingBH.
+	blockPropsBuf []byte
+	// indexValueBuf is a scratch buffer for index entries which contain block
+	// properties.
+	indexValueBuf []byte
 	// tmp is a scratch buffer, large enough to hold either footerLen bytes,
 	// blockTrailerLen bytes, or (5 * binary.MaxVarintLen64) bytes.
 	tmp [rocksDBFooterLen]byte
@@ -213,13 +238,33 @@ func (w *Writer) addPoint(key db.InternalKey, value []byte) error {
 		w.meta.SmallestPoint = key.Clone()
 	}
 	w.props.NumEntries++
-	if key.Kind() == db.InternalKeyKindDelete {
+	switch key.Kind() {
+	case db.InternalKeyKindDelete, db.InternalKeyKindSingleDelete:
 		w.props.NumDeletions++
+	case db.InternalKeyKindSetWithExpiry:
+		// The value is prefixed by the fixed64 expiration time of the entry. A
+		// value which is too short has expired at the Unix epoch, which is
+		// recorded as the smallest non-zero time.
+		expiry := uint64(1)
+		if len(value) >= 8 {
+			if v := int64(binary.LittleEndian.Uint64(value)); v > 1 {
+				expiry = uint64(v)
+			}
+		}
+		if w.props.SmallestExpiry == 0 || w.props.SmallestExpiry > expiry {
+			w.props.SmallestExpiry = expiry
+		}
 	}
 	w.props.RawKeySize += uint64(key.Size())
 	w.props.RawValueSize += uint64(len(value))
 	w.block.add(key, value)
-	return nil
+	for i := range w.blockPropCollectors {
+		if err := w.blockPropCollectors[i].Add(key, value); err != nil {
+			w.err = err
+			return err
+		}
+	}
+	return w.addToPropCollectors(key, value)
 }
 
 func (w *Writer) addTombstone(key db.InternalKey, value []byte) error {
@@ -261,6 +306,16 @@ func (w *Writer) addTombstone(key db.InternalKey, value []byte) error {
 	}
 	w.props.NumRangeDeletions++
 	w.rangeDelBlock.add(key, value)
+	return w.addToPropCollectors(key, value)
+}
+
+func (w *Writer) addToPropCollectors(key db.InternalKey, value []byte) error {
+	for i := range w.propCollectors {
+		if err := w.propCollectors[i].Add(key, value); err != nil {
+			w.err = err
+			return err
+		}
+	}
 	return nil
 }
 
@@ -296,7 +351,7 @@ func (w *Writer) maybeFlush(key db.InternalKey, value []byte) error {
 		}
 	}
 
-	bh, err := w.finishBlock(&w.block)
+	bh, err := w.finishDataBlock()
 	if err != nil {
 		w.err = err
 		return w.err
@@ -321,19 +376,108 @@ func (w *Writer) flushPendingBH(key db.InternalKey) {
 		sep = prevKey.Separator(w.compare, w.separator, nil, key)
 	}
 	n := encodeBlockHandle(w.tmp[:], w.pendingBH)
-	w.indexBlock.add(sep, w.tmp[:n])
+	if len(w.blockPropCollectors) == 0 {
+		w.addIndexEntry(sep, w.tmp[:n])
+	} else {
+		// The block properties are stored after the block handle in the index
+		// entry.
+		w.indexValueBuf = append(w.indexValueBuf[:0], w.tmp[:n]...)
+		w.indexValueBuf = append(w.indexValueBuf, w.blockPropsBuf...)
+		w.addIndexEntry(sep, w.indexValueBuf)
+	}
 	w.pendingBH = blockHandle{}
 }
 
-// finishBlock finishes the current block and returns its block handle, which is
-// its offset and length in the table.
-func (w *Writer) finishBlock(block *blockWriter) (blockHandle, error) {
-	bh, err := w.writeRawBlock(block.finish(), w.compression)
+// indexPartition is a finished partition of a two-level index.
+type indexPartition struct {
+	// sep is the last key in the partition, which is used as the key of the
+	// partition's entry in the top-level index.
+	sep      db.InternalKey
+	block    []byte
+	nEntries int
+}
+
+// addIndexEntry adds an entry to the index block, first finishing the index
+// block as an index partition if the entry would make it larger than the
+// target index block size.
+func (w *Writer) addIndexEntry(sep db.InternalKey, value []byte) {
+	if w.indexBlock.nEntries > 0 &&
+		w.indexBlock.estimatedSize()+sep.Size()+len(value) > w.indexBlockSize {
+		w.finishIndexPartition()
+	}
+	w.indexBlock.add(sep, value)
+}
+
+// finishIndexPartition finishes the current index block, holding it as an
+// index partition until the table is closed.
+func (w *Writer) finishIndexPartition() {
+	p := indexPartition{
+		sep:      db.DecodeInternalKey(w.indexBlock.curKey).Clone(),
+		nEntries: w.indexBlock.nEntries,
+	}
+	p.block = append([]byte(nil), w.indexBlock.finish()...)
+	w.indexPartitions = append(w.indexPartitions, p)
+	w.indexPartitionsSize += len(p.block)
+	w.indexBlock.reset()
+}
+
+// writeIndexPartitions writes the finished index partitions, including the
+// current index block, and replaces the index block with a top-level index
+// over the partitions.
+func (w *Writer) writeIndexPartitions() error {
+	w.finishIndexPartition()
+	for _, p := range w.indexPartitions {
+		bh, err := w.writeRawBlock(p.block, w.compression)
+		if err != nil {
+			return err
+		}
+		n := encodeBlockHandle(w.tmp[:], bh)
+		w.indexBlock.add(p.sep, w.tmp[:n])
+		// NB: RocksDB includes the block trailer length in the index size
+		// properties.
+		w.props.IndexSize += uint64(len(p.block)) + blockTrailerLen
+	}
+	w.props.IndexPartitions = uint64(len(w.indexPartitions))
+	w.props.TopLevelIndexSize = uint64(w.indexBlock.estimatedSize()) + blockTrailerLen
+	w.props.IndexType = twoLevelIndexType
+	w.indexPartitions = nil
+	w.indexPartitionsSize = 0
+	return nil
+}
 
+// finishDataBlock finishes the current data block and returns its block
+// handle. The block properties collected for the block are encoded into
+// w.blockPropsBuf as a sequence of (collector ID, uvarint length, property)
+// tuples.
+func (w *Writer) finishDataBlock() (blockHandle, error) {
+	bh, err := w.finishBlock(&w.block)
+	if err != nil {
+		return bh, err
+	}
 	// Calculate filters.
 	if w.filter != nil {
-		w.filter.finishBlock(w.offset)
+		if err := w.filter.finishBlock(w.offset); err != nil {
+			return bh, err
+		}
+	}
+	w.blockPropsBuf = w.blockPropsBuf[:0]
+	for i := range w.blockPropCollectors {
+		prop, err := w.blockPropCollectors[i].FinishDataBlock()
+		if err != nil {
+			return bh, err
+		}
+		n := binary.PutUvarint(w.tmp[:], uint64(len(prop)))
+		w.blockPropsBuf = append(w.blockPropsBuf, byte(i))
+		w.blockPropsBuf = append(w.blockPropsBuf, w.tmp[:n]...)
+		w.blockPropsBuf = append(w.blockPropsBuf, prop...)
 	}
+	return bh, nil
+}
+
+// finishBlock finishes the current block and returns its block handle, which is
+// its offset and length in the table.
+func (w *Writer) finishBlock(block *blockWriter) (blockHandle, error) {
+	bh, err := w.writeRawBlock(block.finish(), w.compression)
 
 	// Reset the per-block state.
 	block.reset()
@@ -396,7 +540,7 @@ func (w *Writer) Close() (err error) {
 	// aren't any data blocks at all.
 	w.flushPendingBH(db.InternalKey{})
 	if w.block.nEntries > 0 || w.indexBlock.nEntries == 0 {
-		bh, err := w.finishBlock(&w.block)
+		bh, err := w.finishDataBlock()
 		if err != nil {
 			w.err = err
 			return w.err
@@ -406,6 +550,17 @@ func (w *Writer) Close() (err error) {
 	}
 	w.props.DataSize = w.offset
 	w.props.NumDataBlocks = uint64(w.indexBlock.nEntries)
+	for i := range w.indexPartitions {
+		w.props.NumDataBlocks += uint64(w.indexPartitions[i].nEntries)
+	}
+
+	// Write the index partitions, if the index is partitioned.
+	if len(w.indexPartitions) > 0 {
+		if err := w.writeIndexPartitions(); err != nil {
+			w.err = err
+			return w.err
+		}
+	}
 
 	// Write the filter block.
 	var metaindex rawBlockWriter
@@ -458,7 +613,20 @@ func (w *Writer) Close() (err error) {
 		// NB: RocksDB includes the block trailer length in the index size
 		// property, though it doesn't include the trailer in the filter size
 		// property.
-		w.props.IndexSize = uint64(w.indexBlock.estimatedSize()) + blockTrailerLen
+		w.props.IndexSize += uint64(w.indexBlock.estimatedSize()) + blockTrailerLen
+		w.meta.SmallestExpiry = w.props.SmallestExpiry
+		if len(w.propCollectors) > 0 {
+			userProps := make(map[string]string)
+			for i := range w.propCollectors {
+				if err := w.propCollectors[i].Finish(userProps); err != nil {
+					w.err = err
+					return w.err
+				}
+			}
+			if len(userProps) > 0 {
+				w.props.UserProperties = userProps
+			}
+		}
 		w.props.save(&raw)
 		bh, err := w.writeRawBlock(raw.finish(), db.NoCompression)
 		if err != nil {
@@ -477,7 +645,8 @@ func (w *Writer) Close() (err error) {
 		return w.err
 	}
 
-	// Write the index block.
+	// Write the index block, which is the top-level index if the index is
+	// partitioned.
 	indexBH, err := w.finishBlock(&w.indexBlock)
 	if err != nil {
 		w.err = err
@@ -519,7 +688,8 @@ func (w *Writer) Close() (err error) {
 // EstimatedSize returns the estimated size of the sstable being written if a
 // called to Finish() was made without adding additional keys.
 func (w *Writer) EstimatedSize() uint64 {
-	return w.offset + uint64(w.block.estimatedSize()+w.indexBlock.estimatedSize())
+	return w.offset + uint64(w.block.estimatedSize()+w.indexBlock.estimatedSize()+
+		w.indexPartitionsSize)
 }
 
 // Metadata returns the metadata for the finished sstable. Only valid to call
@@ -531,6 +701,12 @@ func (w *Writer) Metadata() (*WriterMetadata, error) {
 	return &w.meta, nil
 }
 
+// SetDBSessionID records the identity of the DB session creating the table in
+// the table properties.
+func (w *Writer) SetDBSessionID(id string) {
+	w.props.DBSessionID = id
+}
+
 // NewWriter returns a new table writer for the file. Closing the writer will
 // close the file.
 func NewWriter(f writeCloseSyncer, o *db.Options, lo db.LevelOptions) *Writer {
@@ -544,6 +720,7 @@ func NewWriter(f writeCloseSyncer, o *db.Options, lo db.LevelOptions) *Writer {
 		},
 		blockSize:          lo.BlockSize,
 		blockSizeThreshold: (lo.BlockSize*lo.BlockSizeThreshold + 99) / 100,
+		indexBlockSize:     lo.IndexBlockSize,
 		compare:            o.Comparer.Compare,
 		split:              o.Comparer.Split,
 		compression:        lo.Compression,
@@ -570,22 +747,64 @@ func NewWriter(f writeCloseSyncer, o *db.Options, lo db.LevelOptions) *Writer {
 		switch lo.FilterType {
 		case db.TableFilter:
 			w.filter = newTableFilterWriter(lo.FilterPolicy)
-			if w.split != nil {
-				w.props.PrefixExtractorName = o.Comparer.Name
-				w.props.PrefixFiltering = true
-			} else {
-				w.props.WholeKeyFiltering = true
-			}
+		case db.BlockFilter:
+			w.filter = newBlockFilterWriter(lo.FilterPolicy)
 		default:
 			panic(fmt.Sprintf("unknown filter type: %v", lo.FilterType))
 		}
+		if w.split != nil {
+			w.props.PrefixExtractorName = o.Comparer.Name
+			w.props.PrefixFiltering = true
+		} else {
+			w.props.WholeKeyFiltering = true
+		}
 	}
 
 	w.props.ColumnFamilyID = math.MaxInt32
 	w.props.ComparatorName = o.Comparer.Name
 	w.props.CompressionName = lo.Compression.String()
 	w.props.MergeOperatorName = o.Merger.Name
-	w.props.PropertyCollectorNames = "[]"
+	if len(o.TablePropertyCollectors) > 0 {
+		w.propCollectors = make([]db.TablePropertyCollector, len(o.TablePropertyCollectors))
+		var buf bytes.Buffer
+		buf.WriteString("[")
+		for i := range o.TablePropertyCollectors {
+			w.propCollectors[i] = o.TablePropertyCollectors[i]()
+			if i > 0 {
+				buf.WriteString(",")
+			}
+			buf.WriteString(w.propCollectors[i].Name())
+		}
+		buf.WriteString("]")
+		w.props.PropertyCollectorNames = buf.String()
+	} else {
+		w.props.PropertyCollectorNames = "[]"
+	}
+	if n := len(o.BlockPropertyCollectors); n > 0 {
+		if n > maxBlockPropertyCollectors {
+			w.err = fmt.Errorf("pebble: too many block property collectors: %d > %d",
+				n, maxBlockPropertyCollectors)
+			return w
+		}
+		w.blockPropCollectors = make([]db.BlockPropertyCollector, n)
+		var buf bytes.Buffer
+		buf.WriteString("[")
+		for i := range o.BlockPropertyCollectors {
+			w.blockPropCollectors[i] = o.BlockPropertyCollectors[i]()
+			// The collector names are stored as a comma-separated list in the
+			// table properties.
+			if name := w.blockPropCollectors[i].Name(); strings.Contains(name, ",") {
+				w.err = fmt.Errorf("pebble: invalid block property collector name: %q", name)
+				return w
+			}
+			if i > 0 {
+				buf.WriteString(",")
+			}
+			buf.WriteString(w.blockPropCollectors[i].Name())
+		}
+		buf.WriteString("]")
+		w.props.BlockPropertyCollectorNames = buf.String()
+	}
 	w.props.Version = 2 // TODO(peter): what is this?
 
 	// If f does not have a Flush method, do our own buffering.
@@ -8,6 +8,7 @@ import (
 	"bytes"
 	"errors"
 	"fmt"
+	"reflect"
 	"strings"
 	"testing"
 
@@ -156,3 +157,105 @@ func TestWriter(t *testing.T) {
 		}
 	})
 }
+
+// keyCountPropertyCollector counts the number of point and range deletion
+// entries added to an sstable.
+type keyCountPropertyCollector struct {
+	points, rangeDels int
+}
+
+func (c *keyCountPropertyCollector) Add(key db.InternalKey, value []byte) error {
+	if key.Kind() == db.InternalKeyKindRangeDelete {
+		c.rangeDels++
+	} else {
+		c.points++
+	}
+	return nil
+}
+
+func (c *keyCountPropertyCollector) Finish(userProps map[string]string) error {
+	userProps["test.points"] = fmt.Sprint(c.points)
+	userProps["test.range-dels"] = fmt.Sprint(c.rangeDels)
+	return nil
+}
+
+func (c *keyCountPropertyCollector) Name() string {
+	return "key-count"
+}
+
+// errorPropertyCollector returns an error from Add.
+type errorPropertyCollector struct{}
+
+func (errorPropertyCollector) Add(key db.InternalKey, value []byte) error {
+	return errors.New("add failed")
+}
+
+func (errorPropertyCollector) Finish(userProps map[string]string) error {
+	return nil
+}
+
+func (errorPropertyCollector) Name() string {
+	return "error"
+}
+
+func TestWriterTablePropertyCollectors(t *testing.T) {
+	o := &db.Options{
+		TablePropertyCollectors: []func() db.TablePropertyCollector{
+			func() db.TablePropertyCollector { return &keyCountPropertyCollector{} },
+			func() db.TablePropertyCollector { return &keyCountPropertyCollector{} },
+		},
+	}
+	o.EnsureDefaults()
+
+	mem := vfs.NewMem()
+	f0, err := mem.Create("test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	w := NewWriter(f0, o, db.LevelOptions{})
+	for _, k := range []string{"a", "b", "c"} {
+		if err := w.Set([]byte(k), nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.DeleteRange([]byte("d"), []byte("e")); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	f1, err := mem.Open("test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := NewReader(f1, 0, o)
+	defer r.Close()
+
+	if expected, actual := "[key-count,key-count]", r.Properties.PropertyCollectorNames; expected != actual {
+		t.Fatalf("expected %q, but found %q", expected, actual)
+	}
+	expected := map[string]string{
+		"test.points":     "3",
+		"test.range-dels": "1",
+	}
+	if actual := r.Properties.UserProperties; !reflect.DeepEqual(expected, actual) {
+		t.Fatalf("expected %v, but found %v", expected, actual)
+	}
+
+	// An error returned by a property collector is returned by the Writer.
+	o.TablePropertyCollectors = []func() db.TablePropertyCollector{
+		func() db.TablePropertyCollector { return errorPropertyCollector{} },
+	}
+	f2, err := mem.Create("test2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	w = NewWriter(f2, o, db.LevelOptions{})
+	if err := w.Set([]byte("a"), nil); err == nil || err.Error() != "add failed" {
+		t.Fatalf("expected error, but found %v", err)
+	}
+	if err := w.Close(); err == nil || err.Error() != "add failed" {
+		t.Fatalf("expected error, but found %v", err)
+	}
+}
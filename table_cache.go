@@ -49,14 +49,32 @@ func (c *tableCache) init(dirname string, fs vfs.FS, opts *db.Options, size int)
 	}
 }
 
+// newIters returns the iterators for a table which is opened using the options
+// of the table cache.
 func (c *tableCache) newIters(
 	meta *fileMetadata, opts *db.IterOptions,
+) (internalIterator, internalIterator, error) {
+	return c.newTableIters(c.opts, meta, opts)
+}
+
+// newItersWithOptions returns a tableNewIters which opens the tables using the
+// specified options, such as the options of a column family. The tables of
+// all of the column families share the table cache, as file numbers are
+// unique within a DB.
+func (c *tableCache) newItersWithOptions(tableOpts *db.Options) tableNewIters {
+	return func(meta *fileMetadata, opts *db.IterOptions) (internalIterator, internalIterator, error) {
+		return c.newTableIters(tableOpts, meta, opts)
+	}
+}
+
+func (c *tableCache) newTableIters(
+	tableOpts *db.Options, meta *fileMetadata, opts *db.IterOptions,
 ) (internalIterator, internalIterator, error) {
 	// Calling findNode gives us the responsibility of decrementing n's
 	// refCount. If opening the underlying table resulted in error, then we
 	// decrement this straight away. Otherwise, we pass that responsibility to
 	// the sstable iterator, which decrements when it is closed.
-	n := c.findNode(meta)
+	n := c.findNode(meta, tableOpts)
 	x := <-n.result
 	if x.err != nil {
 		if !c.unrefNode(n) {
@@ -69,7 +87,17 @@ func (c *tableCache) newIters(
 	}
 	n.result <- x
 
+	if opts != nil && opts.TableFilter != nil &&
+		!opts.TableFilter(x.reader.Properties.UserProperties) {
+		// Return the empty iterator. This iterator has no mutable state, so
+		// using a singleton is fine.
+		c.unrefNode(n)
+		return emptyIter, nil, nil
+	}
+
 	iter := x.reader.NewIter(opts.GetLowerBound(), opts.GetUpperBound())
+	iter.SetPrefix(opts.GetPrefix())
+	iter.SetBlockPropertyFilters(opts.GetBlockPropertyFilters())
 	atomic.AddInt32(&c.mu.iterCount, 1)
 	if raceEnabled {
 		c.mu.Lock()
@@ -116,9 +144,10 @@ func (c *tableCache) releaseNode(n *tableCacheNode) {
 }
 
 // findNode returns the node for the table with the given file number, creating
-// that node if it didn't already exist. The caller is responsible for
-// decrementing the returned node's refCount.
-func (c *tableCache) findNode(meta *fileMetadata) *tableCacheNode {
+// that node if it didn't already exist, in which case the table is opened
+// using opts. The caller is responsible for decrementing the returned node's
+// refCount.
+func (c *tableCache) findNode(meta *fileMetadata, opts *db.Options) *tableCacheNode {
 	c.mu.Lock()
 	defer c.mu.Unlock()
 
@@ -126,6 +155,7 @@ func (c *tableCache) findNode(meta *fileMetadata) *tableCacheNode {
 	if n == nil {
 		n = &tableCacheNode{
 			meta:     meta,
+			opts:     opts,
 			refCount: 1,
 			result:   make(chan tableReaderOrError, 1),
 		}
@@ -219,6 +249,7 @@ type tableReaderOrError struct {
 
 type tableCacheNode struct {
 	meta   *fileMetadata
+	opts   *db.Options
 	result chan tableReaderOrError
 
 	// The remaining fields are protected by the tableCache mutex.
@@ -234,7 +265,7 @@ func (n *tableCacheNode) load(c *tableCache) {
 		n.result <- tableReaderOrError{err: err}
 		return
 	}
-	r := sstable.NewReader(f, n.meta.fileNum, c.opts)
+	r := sstable.NewReader(f, n.meta.fileNum, n.opts)
 	if n.meta.smallestSeqNum == n.meta.largestSeqNum {
 		r.Properties.GlobalSeqNum = n.meta.largestSeqNum
 	}
@@ -0,0 +1,35 @@
+// Copyright 2019 The LevelDB-Go and Pebble Authors. All rights reserved. Use
+// of this source code is governed by a BSD-style license that can be found in
+// the LICENSE file.
+
+package pebble
+
+import "encoding/binary"
+
+// expiryLen is the length of the expiration time which prefixes the value of
+// a SETEXPIRY entry.
+const expiryLen = 8
+
+// encodeExpiry encodes the expiration time of an entry, in nanoseconds since
+// the Unix epoch, into the first expiryLen bytes of buf.
+func encodeExpiry(buf []byte, expiry int64) {
+	binary.LittleEndian.PutUint64(buf, uint64(expiry))
+}
+
+// decodeExpiry decodes the value of a SETEXPIRY entry into the expiration time
+// of the entry and the value which was set. A value which is too short to
+// contain an expiration time is treated as having expired at the Unix epoch.
+func decodeExpiry(value []byte) (expiry int64, v []byte) {
+	if len(value) < expiryLen {
+		return 0, nil
+	}
+	return int64(binary.LittleEndian.Uint64(value)), value[expiryLen:]
+}
+
+// appendExpiry appends a SETEXPIRY value composed of the specified expiration
+// time and value to buf.
+func appendExpiry(buf []byte, expiry int64, v []byte) []byte {
+	var tmp [expiryLen]byte
+	encodeExpiry(tmp[:], expiry)
+	return append(append(buf, tmp[:]...), v...)
+}
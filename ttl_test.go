@@ -0,0 +1,198 @@
+// Copyright 2019 The LevelDB-Go and Pebble Authors. All rights reserved. Use
+// of this source code is governed by a BSD-style license that can be found in
+// the LICENSE file.
+
+package pebble
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/petermattis/pebble/db"
+	"github.com/petermattis/pebble/vfs"
+)
+
+func TestTTL(t *testing.T) {
+	start := time.Unix(1000, 0)
+	now := start
+	opts := &db.Options{
+		FS:  vfs.NewMem(),
+		Now: func() time.Time { return now },
+	}
+	d, err := Open("", opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := d.SetWithTTL([]byte("a"), []byte("a"), 10*time.Second, nil); err != nil {
+		t.Fatal(err)
+	}
+	b := d.NewIndexedBatch()
+	if err := b.SetWithTTL([]byte("b"), []byte("b"), 20*time.Second, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Merge([]byte("b"), []byte("1"), nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := b.Set([]byte("c"), []byte("c"), nil); err != nil {
+		t.Fatal(err)
+	}
+	if v, err := b.Get([]byte("b")); err != nil || string(v) != "1b" {
+		t.Fatalf("expected 1b, but found %q, %v", v, err)
+	}
+	if err := b.Commit(nil); err != nil {
+		t.Fatal(err)
+	}
+
+	// scan returns the key/value pairs read by forward and reverse iteration,
+	// which must agree.
+	scan := func() string {
+		t.Helper()
+		iter := d.NewIter(nil)
+		defer iter.Close()
+		var fwd, rev []string
+		for valid := iter.First(); valid; valid = iter.Next() {
+			fwd = append(fwd, fmt.Sprintf("%s:%s", iter.Key(), iter.Value()))
+		}
+		for valid := iter.Last(); valid; valid = iter.Prev() {
+			rev = append([]string{fmt.Sprintf("%s:%s", iter.Key(), iter.Value())}, rev...)
+		}
+		if f, r := strings.Join(fwd, " "), strings.Join(rev, " "); f != r {
+			t.Fatalf("forward iteration found %q, but reverse iteration found %q", f, r)
+		}
+		return strings.Join(fwd, " ")
+	}
+	get := func(key string) string {
+		t.Helper()
+		v, err := d.Get([]byte(key))
+		if err == db.ErrNotFound {
+			return "<not found>"
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		return string(v)
+	}
+
+	if expected, actual := "a:a b:1b c:c", scan(); expected != actual {
+		t.Fatalf("expected %q, but found %q", expected, actual)
+	}
+
+	// The entries survive reopening the DB.
+	if err := d.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if d, err = Open("", opts); err != nil {
+		t.Fatal(err)
+	}
+
+	// Expired entries are hidden, along with the merge operands of an expired
+	// key.
+	now = start.Add(10 * time.Second)
+	if expected, actual := "b:1b c:c", scan(); expected != actual {
+		t.Fatalf("expected %q, but found %q", expected, actual)
+	}
+	if v := get("a"); v != "<not found>" {
+		t.Fatalf("expected a to have expired, but found %q", v)
+	}
+	now = start.Add(20 * time.Second)
+	if expected, actual := "c:c", scan(); expected != actual {
+		t.Fatalf("expected %q, but found %q", expected, actual)
+	}
+	if v := get("b"); v != "<not found>" {
+		t.Fatalf("expected b to have expired, but found %q", v)
+	}
+
+	// An expired entry does not resurrect older values of its key.
+	if err := d.Set([]byte("d"), []byte("d"), nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.SetWithTTL([]byte("d"), []byte("d2"), 5*time.Second, nil); err != nil {
+		t.Fatal(err)
+	}
+	if v := get("d"); v != "d2" {
+		t.Fatalf("expected d2, but found %q", v)
+	}
+	now = start.Add(30 * time.Second)
+	if v := get("d"); v != "<not found>" {
+		t.Fatalf("expected d to have expired, but found %q", v)
+	}
+
+	// Compactions physically drop the expired entries, which remain gone when
+	// the clock is turned back.
+	if err := d.Compact([]byte("a"), []byte("z")); err != nil {
+		t.Fatal(err)
+	}
+	now = start
+	if expected, actual := "c:c", scan(); expected != actual {
+		t.Fatalf("expected %q, but found %q", expected, actual)
+	}
+	if err := d.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestTTLCompaction(t *testing.T) {
+	start := time.Unix(1000, 0)
+	now := start
+	d, err := Open("", &db.Options{
+		FS:  vfs.NewMem(),
+		Now: func() time.Time { return now },
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+
+	// tables returns the tables of the DB, along with the earliest expiration
+	// times of their entries.
+	tables := func() string {
+		d.mu.Lock()
+		defer d.mu.Unlock()
+		for d.mu.compact.compacting {
+			d.mu.compact.cond.Wait()
+		}
+		var buf strings.Builder
+		v := d.mu.versions.currentVersion()
+		for level := range v.files {
+			for _, f := range v.files[level] {
+				var expiry int64
+				if f.smallestExpiry != 0 {
+					expiry = time.Unix(0, int64(f.smallestExpiry)).Sub(start).Nanoseconds() / 1e9
+				}
+				fmt.Fprintf(&buf, "L%d:%d:%d ", level, f.fileNum, expiry)
+			}
+		}
+		return strings.TrimSpace(buf.String())
+	}
+
+	if err := d.Set([]byte("a"), []byte("a"), nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.SetWithTTL([]byte("b"), []byte("b"), 20*time.Second, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.SetWithTTL([]byte("c"), []byte("c"), 10*time.Second, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Compact([]byte("a"), []byte("z")); err != nil {
+		t.Fatal(err)
+	}
+	if expected, actual := "L6:6:10", tables(); expected != actual {
+		t.Fatalf("expected %q, but found %q", expected, actual)
+	}
+
+	// Once an entry of a table has expired, the table is compacted when the
+	// next version is installed, including a table in the bottommost level.
+	now = start.Add(10 * time.Second)
+	if err := d.Set([]byte("d"), []byte("d"), nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if expected, actual := "L0:8:0 L6:9:20", tables(); expected != actual {
+		t.Fatalf("expected %q, but found %q", expected, actual)
+	}
+}
@@ -0,0 +1,214 @@
+// Copyright 2019 The LevelDB-Go and Pebble Authors. All rights reserved. Use
+// of this source code is governed by a BSD-style license that can be found in
+// the LICENSE file.
+
+package pebble
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+
+	"github.com/petermattis/pebble/db"
+)
+
+// ErrNotPrepared is returned by DB.CommitPrepared and DB.RollbackPrepared when
+// no batch has been prepared under the specified name, or when the prepared
+// batch is concurrently being committed or rolled back.
+var ErrNotPrepared = errors.New("pebble: batch not prepared")
+
+// preparedBatch is a batch which has been prepared (see DB.Prepare) but not
+// yet committed or rolled back.
+type preparedBatch struct {
+	// The representation of the prepared batch, which is applied to the DB when
+	// the batch is committed.
+	data []byte
+	// The file number of the log containing the prepared batch. The log is
+	// retained until the batch is committed or rolled back.
+	logNum uint64
+	// True while the batch is being prepared, committed or rolled back.
+	busy bool
+}
+
+// Prepare durably writes the batch to the WAL under the specified name without
+// applying it to the DB. The prepared batch is later either atomically applied
+// to the DB by CommitPrepared, or discarded by RollbackPrepared. A prepared
+// batch which has been neither committed nor rolled back is recovered from the
+// WAL when the DB is reopened (see Prepared). This allows writes to be
+// committed atomically across several DBs using two-phase commit.
+//
+// The name must not be in use by another prepared batch. The batch is not
+// modified, and it is safe to reuse or close the batch after Prepare returns.
+// Prepare requires the WAL to be enabled.
+func (d *DB) Prepare(name string, batch *Batch, opts *db.WriteOptions) error {
+	if d.follower || d.opts.ReadOnly {
+		return ErrReadOnly
+	}
+	if d.opts.DisableWAL {
+		return errors.New("pebble: WAL disabled")
+	}
+	if len(batch.cfMemTableSize) > 0 {
+		if err := d.checkColumnFamilyBatch(batch); err != nil {
+			return err
+		}
+	}
+
+	// The prepared batch is written to the WAL enclosed by the prepare markers,
+	// which prevent its operations from being applied to the memtable.
+	b := newBatch(d)
+	defer b.release()
+	b.encodeTwoPhaseMarker(db.InternalKeyKindBeginPrepareXID, nil)
+	if err := b.Apply(batch, nil); err != nil {
+		return err
+	}
+	b.encodeTwoPhaseMarker(db.InternalKeyKindEndPrepareXID, []byte(name))
+	b.refreshMemTableSize()
+
+	d.mu.Lock()
+	if _, ok := d.mu.prepared[name]; ok {
+		d.mu.Unlock()
+		return fmt.Errorf("pebble: batch %q already prepared", name)
+	}
+	// The batch is written to the current log or a subsequent one.
+	p := &preparedBatch{
+		data:   append([]byte(nil), batch.storage.data...),
+		logNum: d.mu.log.queue[len(d.mu.log.queue)-1],
+		busy:   true,
+	}
+	d.mu.prepared[name] = p
+	d.mu.Unlock()
+
+	err := d.Apply(b, opts)
+	d.releasePrepared(name, p, err != nil /* forget */)
+	return err
+}
+
+// CommitPrepared atomically applies the batch prepared under the specified
+// name to the DB. It returns ErrNotPrepared if no such batch exists.
+func (d *DB) CommitPrepared(name string, opts *db.WriteOptions) error {
+	p, err := d.acquirePrepared(name)
+	if err != nil {
+		return err
+	}
+
+	// The operations of the prepared batch are written to the WAL again along
+	// with the commit marker, which allows the log containing the prepared
+	// batch to be released once the commit has been written.
+	b := newBatch(d)
+	defer b.release()
+	b.encodeTwoPhaseMarker(db.InternalKeyKindCommitXID, []byte(name))
+	prepared := Batch{}
+	prepared.storage.data = p.data
+	if err = b.Apply(&prepared, nil); err == nil {
+		err = d.Apply(b, opts)
+	}
+	d.releasePrepared(name, p, err == nil /* forget */)
+	return err
+}
+
+// RollbackPrepared discards the batch prepared under the specified name. It
+// returns ErrNotPrepared if no such batch exists.
+func (d *DB) RollbackPrepared(name string, opts *db.WriteOptions) error {
+	p, err := d.acquirePrepared(name)
+	if err != nil {
+		return err
+	}
+
+	b := newBatch(d)
+	defer b.release()
+	b.encodeTwoPhaseMarker(db.InternalKeyKindRollbackXID, []byte(name))
+	err = d.Apply(b, opts)
+	d.releasePrepared(name, p, err == nil /* forget */)
+	return err
+}
+
+// Prepared returns the sorted names of the batches which have been prepared
+// but not yet committed or rolled back, including the prepared batches
+// recovered from the WAL when the DB was opened.
+func (d *DB) Prepared() []string {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	names := make([]string, 0, len(d.mu.prepared))
+	for name := range d.mu.prepared {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// acquirePrepared marks the batch prepared under the specified name as busy,
+// preventing it from being concurrently committed or rolled back.
+func (d *DB) acquirePrepared(name string) (*preparedBatch, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	p := d.mu.prepared[name]
+	if p == nil || p.busy {
+		return nil, ErrNotPrepared
+	}
+	p.busy = true
+	return p, nil
+}
+
+// releasePrepared clears the busy mark on a prepared batch. If forget is true
+// the batch is removed from the set of prepared batches, releasing the log
+// containing it.
+func (d *DB) releasePrepared(name string, p *preparedBatch, forget bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if forget {
+		delete(d.mu.prepared, name)
+	} else {
+		p.busy = false
+	}
+}
+
+// minPreparedLogNumLocked returns the file number of the oldest log containing
+// a prepared batch, or 0 if there are no prepared batches. Requires d.mu is
+// held.
+func (d *DB) minPreparedLogNumLocked() uint64 {
+	var logNum uint64
+	for _, p := range d.mu.prepared {
+		if logNum == 0 || p.logNum < logNum {
+			logNum = p.logNum
+		}
+	}
+	return logNum
+}
+
+// replayPreparedLocked updates the set of prepared batches with the two-phase
+// commit markers contained in a batch read from the specified log during
+// recovery. Requires d.mu is held.
+func (d *DB) replayPreparedLocked(b *Batch, logNum uint64) {
+	var start int
+	var count uint32
+	var prepared bool
+	for iter := b.iter(); ; {
+		offset := len(b.storage.data) - len(iter)
+		_, kind, key, _, ok := iter.nextCF()
+		if !ok {
+			break
+		}
+		switch kind {
+		case db.InternalKeyKindBeginPrepareXID:
+			start, count, prepared = len(b.storage.data)-len(iter), 0, true
+		case db.InternalKeyKindEndPrepareXID:
+			var pb Batch
+			if offset > start {
+				pb.init(offset - start)
+				pb.storage.data = append(pb.storage.data, b.storage.data[start:offset]...)
+				pb.setCount(count)
+			}
+			d.mu.prepared[string(key)] = &preparedBatch{
+				data:   pb.storage.data,
+				logNum: logNum,
+			}
+			prepared = false
+		case db.InternalKeyKindCommitXID, db.InternalKeyKindRollbackXID:
+			delete(d.mu.prepared, string(key))
+		default:
+			if prepared {
+				count++
+			}
+		}
+	}
+}
@@ -0,0 +1,196 @@
+// Copyright 2019 The LevelDB-Go and Pebble Authors. All rights reserved. Use
+// of this source code is governed by a BSD-style license that can be found in
+// the LICENSE file.
+
+package pebble
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/petermattis/pebble/db"
+	"github.com/petermattis/pebble/vfs"
+)
+
+func TestTwoPhaseCommit(t *testing.T) {
+	d, err := Open("", &db.Options{FS: vfs.NewMem()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+
+	prepare := func(name, key string) {
+		b := d.NewBatch()
+		defer b.Close()
+		if err := b.Set([]byte(key), []byte(name), nil); err != nil {
+			t.Fatal(err)
+		}
+		if err := d.Prepare(name, b, db.NoSync); err != nil {
+			t.Fatal(err)
+		}
+	}
+	get := func(key string) string {
+		v, err := d.Get([]byte(key))
+		if err == db.ErrNotFound {
+			return "<not found>"
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		return string(v)
+	}
+
+	prepare("p1", "a")
+	prepare("p2", "b")
+	if err := d.Prepare("p1", d.NewBatch(), db.NoSync); err == nil {
+		t.Fatalf("expected error, but found success")
+	}
+	if expected, actual := "[p1 p2]", fmt.Sprint(d.Prepared()); expected != actual {
+		t.Fatalf("expected %s, but found %s", expected, actual)
+	}
+	// Prepared batches are not visible until they are committed.
+	if v := get("a"); v != "<not found>" {
+		t.Fatalf("expected <not found>, but found %q", v)
+	}
+
+	if err := d.CommitPrepared("p1", db.NoSync); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.RollbackPrepared("p2", db.NoSync); err != nil {
+		t.Fatal(err)
+	}
+	for key, expected := range map[string]string{"a": "p1", "b": "<not found>"} {
+		if actual := get(key); expected != actual {
+			t.Fatalf("%s: expected %q, but found %q", key, expected, actual)
+		}
+	}
+	if n := len(d.Prepared()); n != 0 {
+		t.Fatalf("expected no prepared batches, but found %d", n)
+	}
+	if err := d.CommitPrepared("p1", db.NoSync); err != ErrNotPrepared {
+		t.Fatalf("expected %v, but found %v", ErrNotPrepared, err)
+	}
+	if err := d.RollbackPrepared("p3", db.NoSync); err != ErrNotPrepared {
+		t.Fatalf("expected %v, but found %v", ErrNotPrepared, err)
+	}
+
+	// A prepared batch may be committed after the memtable it was prepared in
+	// has been flushed.
+	prepare("p3", "c")
+	if err := d.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.CommitPrepared("p3", db.NoSync); err != nil {
+		t.Fatal(err)
+	}
+	if v := get("c"); v != "p3" {
+		t.Fatalf("expected %q, but found %q", "p3", v)
+	}
+}
+
+func TestTwoPhaseCommitRecovery(t *testing.T) {
+	mem := vfs.NewMem()
+	opts := &db.Options{FS: mem}
+	d, err := Open("", opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	prepare := func(name string, keys ...string) {
+		b := d.NewBatch()
+		defer b.Close()
+		for _, key := range keys {
+			if err := b.Set([]byte(key), []byte(name), nil); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := d.Prepare(name, b, nil); err != nil {
+			t.Fatal(err)
+		}
+	}
+	reopen := func() {
+		if err := d.Close(); err != nil {
+			t.Fatal(err)
+		}
+		if d, err = Open("", opts); err != nil {
+			t.Fatal(err)
+		}
+	}
+	checkPrepared := func(expected string) {
+		t.Helper()
+		if actual := fmt.Sprint(d.Prepared()); expected != actual {
+			t.Fatalf("expected %s, but found %s", expected, actual)
+		}
+	}
+	get := func(key string) string {
+		v, err := d.Get([]byte(key))
+		if err == db.ErrNotFound {
+			return "<not found>"
+		} else if err != nil {
+			t.Fatal(err)
+		}
+		return string(v)
+	}
+
+	prepare("p1", "a", "b")
+	prepare("p2", "c")
+	prepare("p3", "d")
+	if err := d.CommitPrepared("p3", nil); err != nil {
+		t.Fatal(err)
+	}
+
+	// Flushing does not release the logs containing prepared batches.
+	for i := 0; i < 2; i++ {
+		if err := d.Set([]byte("x"), []byte(fmt.Sprint(i)), nil); err != nil {
+			t.Fatal(err)
+		}
+		if err := d.Flush(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	reopen()
+	checkPrepared("[p1 p2]")
+	for key, expected := range map[string]string{
+		"a": "<not found>", "c": "<not found>", "d": "p3", "x": "1",
+	} {
+		if actual := get(key); expected != actual {
+			t.Fatalf("%s: expected %q, but found %q", key, expected, actual)
+		}
+	}
+
+	// Recovered prepared batches can be committed and rolled back, and survive
+	// further restarts until they are.
+	if err := d.CommitPrepared("p1", nil); err != nil {
+		t.Fatal(err)
+	}
+	reopen()
+	checkPrepared("[p2]")
+	if err := d.RollbackPrepared("p2", nil); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	reopen()
+	checkPrepared("[]")
+	for key, expected := range map[string]string{
+		"a": "p1", "b": "p1", "c": "<not found>", "d": "p3",
+	} {
+		if actual := get(key); expected != actual {
+			t.Fatalf("%s: expected %q, but found %q", key, expected, actual)
+		}
+	}
+	if err := d.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestTwoPhaseCommitDisableWAL(t *testing.T) {
+	d, err := Open("", &db.Options{FS: vfs.NewMem(), DisableWAL: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+	if err := d.Prepare("p1", d.NewBatch(), db.NoSync); err == nil {
+		t.Fatalf("expected error, but found success")
+	}
+}
@@ -0,0 +1,298 @@
+// Copyright 2019 The LevelDB-Go and Pebble Authors. All rights reserved. Use
+// of this source code is governed by a BSD-style license that can be found in
+// the LICENSE file.
+
+package pebble
+
+import (
+	"errors"
+	"time"
+
+	"github.com/petermattis/pebble/db"
+)
+
+// ErrNoSavepoint is returned by Txn.RollbackToSavepoint when no savepoint has
+// been set.
+var ErrNoSavepoint = errors.New("pebble: no savepoint")
+
+// TxnOptions holds the optional parameters for a Txn.
+type TxnOptions struct {
+	// LockTimeout is the maximum duration to wait to acquire a lock. A zero
+	// LockTimeout waits indefinitely (deadlocks are still detected), while a
+	// negative LockTimeout fails immediately if a lock cannot be acquired.
+	LockTimeout time.Duration
+}
+
+// Txn is a pessimistic transaction which acquires locks on the keys and key
+// ranges it reads and writes. The locks are held until the transaction is
+// committed or rolled back, which ensures serializability among transactions
+// (strict two-phase locking). Writes performed outside of a transaction (e.g.
+// DB.Set) do not acquire locks.
+//
+// Reads acquire shared locks: Get locks the key and NewIter locks the range
+// covered by the iterator bounds (the entire key space if unbounded). Writes
+// acquire exclusive locks: Set, Merge, Delete and SingleDelete lock the key
+// and DeleteRange locks the range. Reads observe the writes of the
+// transaction layered on top of the latest state of the DB. GetForUpdate
+// acquires an exclusive lock up front in order to avoid a deadlock between
+// transactions which read and then write the same key.
+//
+// A lock request fails with ErrDeadlock if waiting for the lock would create a
+// cycle of waiting transactions, and with ErrLockTimeout if the lock is not
+// acquired within TxnOptions.LockTimeout. In either case the operation is not
+// performed, and the transaction should usually be rolled back and retried.
+//
+// A Txn operates on the default column family and is not safe for concurrent
+// use.
+type Txn struct {
+	db    *DB
+	id    uint64
+	opts  TxnOptions
+	batch *Batch
+	// The locks held by the transaction in acquisition order.
+	locks      []*lock
+	savepoints []txnSavepoint
+}
+
+// txnSavepoint records the state of a Txn which is restored by
+// Txn.RollbackToSavepoint.
+type txnSavepoint struct {
+	// The length and count of the batch.
+	batchLen   int
+	batchCount uint32
+	// The number of locks held.
+	numLocks int
+}
+
+var _ Reader = (*Txn)(nil)
+
+// NewTxn returns a new pessimistic transaction. The transaction must be
+// finished by calling either Commit or Rollback.
+func (d *DB) NewTxn(opts *TxnOptions) *Txn {
+	t := &Txn{
+		db:    d,
+		id:    d.lockTable.newTxnID(),
+		batch: d.NewIndexedBatch(),
+	}
+	if opts != nil {
+		t.opts = *opts
+	}
+	return t
+}
+
+// lock acquires a lock on the span unless the transaction already holds a
+// lock of at least the same strength covering the span.
+func (t *Txn) lock(span txnSpan, mode LockMode) error {
+	if t.batch == nil {
+		return ErrTxnDone
+	}
+	for _, l := range t.locks {
+		if l.mode >= mode && l.span.covers(t.db.cmp, &span) {
+			return nil
+		}
+	}
+	l := &lock{txnID: t.id, mode: mode, span: span}
+	if err := t.db.lockTable.acquire(l, t.opts.LockTimeout); err != nil {
+		return err
+	}
+	t.locks = append(t.locks, l)
+	return nil
+}
+
+// LockKey acquires a lock on the key.
+func (t *Txn) LockKey(key []byte, mode LockMode) error {
+	return t.lock(txnSpan{start: append([]byte(nil), key...), point: true}, mode)
+}
+
+// LockRange acquires a lock on the range of keys [start,end). A nil start or
+// end denotes an unbounded range.
+func (t *Txn) LockRange(start, end []byte, mode LockMode) error {
+	span := txnSpan{}
+	if start != nil {
+		span.start = append([]byte(nil), start...)
+	}
+	if end != nil {
+		span.end = append([]byte(nil), end...)
+	}
+	return t.lock(span, mode)
+}
+
+// Get acquires a shared lock on the key and gets its value. It returns
+// ErrNotFound if neither the transaction nor the DB contains the key.
+//
+// The caller should not modify the contents of the returned slice, but it is
+// safe to modify the contents of the argument after Get returns.
+func (t *Txn) Get(key []byte) ([]byte, error) {
+	if err := t.LockKey(key, LockShared); err != nil {
+		return nil, err
+	}
+	return t.db.getInternal(&t.db.columnFamily, key, t.batch, nil /* snapshot */)
+}
+
+// GetForUpdate acquires an exclusive lock on the key and gets its value. See
+// Get.
+func (t *Txn) GetForUpdate(key []byte) ([]byte, error) {
+	if err := t.LockKey(key, LockExclusive); err != nil {
+		return nil, err
+	}
+	return t.db.getInternal(&t.db.columnFamily, key, t.batch, nil /* snapshot */)
+}
+
+// NewIter acquires a shared lock on the range covered by the iterator bounds
+// and returns an iterator over the writes of the transaction merged with the
+// DB. The iterator is unpositioned (Iterator.Valid() will return false).
+func (t *Txn) NewIter(o *db.IterOptions) *Iterator {
+	if err := t.LockRange(o.GetLowerBound(), o.GetUpperBound(), LockShared); err != nil {
+		return &Iterator{err: err}
+	}
+	return t.db.newIterInternal(&t.db.columnFamily, t.batch, nil /* snapshot */, o)
+}
+
+// Set acquires an exclusive lock on the key and sets its value within the
+// transaction.
+//
+// It is safe to modify the contents of the arguments after Set returns.
+func (t *Txn) Set(key, value []byte) error {
+	if err := t.LockKey(key, LockExclusive); err != nil {
+		return err
+	}
+	return t.batch.Set(key, value, nil)
+}
+
+// Merge acquires an exclusive lock on the key and merges its value within the
+// transaction.
+//
+// It is safe to modify the contents of the arguments after Merge returns.
+func (t *Txn) Merge(key, value []byte) error {
+	if err := t.LockKey(key, LockExclusive); err != nil {
+		return err
+	}
+	return t.batch.Merge(key, value, nil)
+}
+
+// Delete acquires an exclusive lock on the key and deletes its value within
+// the transaction.
+//
+// It is safe to modify the contents of the arguments after Delete returns.
+func (t *Txn) Delete(key []byte) error {
+	if err := t.LockKey(key, LockExclusive); err != nil {
+		return err
+	}
+	return t.batch.Delete(key, nil)
+}
+
+// SingleDelete acquires an exclusive lock on the key and single deletes its
+// value within the transaction. See Writer.SingleDelete for the semantics of
+// SingleDelete.
+//
+// It is safe to modify the contents of the arguments after SingleDelete
+// returns.
+func (t *Txn) SingleDelete(key []byte) error {
+	if err := t.LockKey(key, LockExclusive); err != nil {
+		return err
+	}
+	return t.batch.SingleDelete(key, nil)
+}
+
+// DeleteRange acquires an exclusive lock on the range [start,end) and deletes
+// all of the keys (and values) in the range within the transaction.
+//
+// It is safe to modify the contents of the arguments after DeleteRange
+// returns.
+func (t *Txn) DeleteRange(start, end []byte) error {
+	if err := t.LockRange(start, end, LockExclusive); err != nil {
+		return err
+	}
+	return t.batch.DeleteRange(start, end, nil)
+}
+
+// SetSavepoint records the current state of the transaction, which can be
+// restored by RollbackToSavepoint. Savepoints nest.
+func (t *Txn) SetSavepoint() error {
+	if t.batch == nil {
+		return ErrTxnDone
+	}
+	sp := txnSavepoint{numLocks: len(t.locks)}
+	if len(t.batch.storage.data) > 0 {
+		sp.batchLen = len(t.batch.storage.data)
+		sp.batchCount = t.batch.count()
+	}
+	t.savepoints = append(t.savepoints, sp)
+	return nil
+}
+
+// RollbackToSavepoint discards the writes performed since the most recent
+// savepoint and releases the locks acquired since then, and removes the
+// savepoint. It returns ErrNoSavepoint if no savepoint has been set.
+func (t *Txn) RollbackToSavepoint() error {
+	if t.batch == nil {
+		return ErrTxnDone
+	}
+	if len(t.savepoints) == 0 {
+		return ErrNoSavepoint
+	}
+	sp := t.savepoints[len(t.savepoints)-1]
+	t.savepoints = t.savepoints[:len(t.savepoints)-1]
+
+	if len(t.batch.storage.data) > sp.batchLen {
+		// The index of the batch cannot be truncated, so a new batch is
+		// constructed from the prefix of the batch preceding the savepoint.
+		var prefix Batch
+		if sp.batchLen > 0 {
+			prefix.storage.data = append([]byte(nil), t.batch.storage.data[:sp.batchLen]...)
+			prefix.setCount(sp.batchCount)
+		}
+		b := t.db.NewIndexedBatch()
+		if err := b.Apply(&prefix, nil); err != nil {
+			b.release()
+			return err
+		}
+		t.batch.release()
+		t.batch = b
+	}
+
+	t.db.lockTable.release(t.locks[sp.numLocks:])
+	for i := sp.numLocks; i < len(t.locks); i++ {
+		t.locks[i] = nil
+	}
+	t.locks = t.locks[:sp.numLocks]
+	return nil
+}
+
+// Commit atomically applies the writes of the transaction to the DB and
+// releases the locks held by the transaction. The transaction is finished
+// regardless of the outcome.
+func (t *Txn) Commit(opts *db.WriteOptions) error {
+	if t.batch == nil {
+		return ErrTxnDone
+	}
+	defer t.finish()
+	return t.db.Apply(t.batch, opts)
+}
+
+// Rollback discards the writes of the transaction, releases the locks held by
+// the transaction and finishes the transaction.
+func (t *Txn) Rollback() error {
+	if t.batch == nil {
+		return ErrTxnDone
+	}
+	t.finish()
+	return nil
+}
+
+// Close implements Reader.Close by rolling back the transaction if it has not
+// already been finished.
+func (t *Txn) Close() error {
+	if t.batch != nil {
+		t.finish()
+	}
+	return nil
+}
+
+func (t *Txn) finish() {
+	t.db.lockTable.release(t.locks)
+	t.locks = nil
+	t.savepoints = nil
+	t.batch.release()
+	t.batch = nil
+}
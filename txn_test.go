@@ -0,0 +1,358 @@
+// Copyright 2019 The LevelDB-Go and Pebble Authors. All rights reserved. Use
+// of this source code is governed by a BSD-style license that can be found in
+// the LICENSE file.
+
+package pebble
+
+import (
+	"bytes"
+	"fmt"
+	"runtime"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/petermattis/pebble/db"
+	"github.com/petermattis/pebble/vfs"
+)
+
+func TestTxnLocks(t *testing.T) {
+	d, err := Open("", &db.Options{FS: vfs.NewMem()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+
+	noWait := &TxnOptions{LockTimeout: -1}
+	t1 := d.NewTxn(noWait)
+	t2 := d.NewTxn(noWait)
+
+	// Shared locks are compatible with each other.
+	if err := t1.LockKey([]byte("a"), LockShared); err != nil {
+		t.Fatal(err)
+	}
+	if err := t2.LockKey([]byte("a"), LockShared); err != nil {
+		t.Fatal(err)
+	}
+	// An exclusive lock conflicts with a shared lock held by another
+	// transaction, but not with a lock held by the same transaction.
+	if err := t2.LockKey([]byte("a"), LockExclusive); err != ErrLockTimeout {
+		t.Fatalf("expected %v, but found %v", ErrLockTimeout, err)
+	}
+	if err := t1.Rollback(); err != nil {
+		t.Fatal(err)
+	}
+	if err := t2.LockKey([]byte("a"), LockExclusive); err != nil {
+		t.Fatal(err)
+	}
+
+	// Range locks conflict with the point locks and range locks they
+	// intersect.
+	t3 := d.NewTxn(noWait)
+	for _, c := range []struct {
+		start, end string
+		err        error
+	}{
+		{"", "a", nil},
+		{"b", "c", nil},
+		{"", "b", ErrLockTimeout},
+		{"a", "", ErrLockTimeout},
+	} {
+		var start, end []byte
+		if c.start != "" {
+			start = []byte(c.start)
+		}
+		if c.end != "" {
+			end = []byte(c.end)
+		}
+		if err := t3.LockRange(start, end, LockShared); err != c.err {
+			t.Fatalf("[%s,%s): expected %v, but found %v", c.start, c.end, c.err, err)
+		}
+	}
+	if err := t2.LockRange([]byte("b"), []byte("bb"), LockExclusive); err != ErrLockTimeout {
+		t.Fatalf("expected %v, but found %v", ErrLockTimeout, err)
+	}
+	if err := t2.LockRange([]byte("c"), []byte("d"), LockExclusive); err != nil {
+		t.Fatal(err)
+	}
+
+	// A lock timeout bounds the time spent waiting.
+	t4 := d.NewTxn(&TxnOptions{LockTimeout: 10 * time.Millisecond})
+	if err := t4.Set([]byte("a"), nil); err != ErrLockTimeout {
+		t.Fatalf("expected %v, but found %v", ErrLockTimeout, err)
+	}
+
+	// A waiting transaction acquires the lock once it is released.
+	t5 := d.NewTxn(nil)
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- t5.Set([]byte("a"), []byte("t5"))
+	}()
+	waitForWaiters(d, 1)
+	if err := t2.Set([]byte("a"), []byte("t2")); err != nil {
+		t.Fatal(err)
+	}
+	if err := t2.Commit(db.NoSync); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-errCh; err != nil {
+		t.Fatal(err)
+	}
+	if v, err := d.Get([]byte("a")); err != nil {
+		t.Fatal(err)
+	} else if string(v) != "t2" {
+		t.Fatalf("expected %q, but found %q", "t2", v)
+	}
+	if err := t5.Commit(db.NoSync); err != nil {
+		t.Fatal(err)
+	}
+	if v, err := d.Get([]byte("a")); err != nil {
+		t.Fatal(err)
+	} else if string(v) != "t5" {
+		t.Fatalf("expected %q, but found %q", "t5", v)
+	}
+
+	for _, txn := range []*Txn{t3, t4} {
+		if err := txn.Rollback(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := t5.Rollback(); err != ErrTxnDone {
+		t.Fatalf("expected %v, but found %v", ErrTxnDone, err)
+	}
+}
+
+// waitForWaiters waits until n transactions are waiting to acquire locks.
+func waitForWaiters(d *DB, n int) {
+	for {
+		d.lockTable.mu.Lock()
+		waiters := len(d.lockTable.waitsFor)
+		d.lockTable.mu.Unlock()
+		if waiters >= n {
+			return
+		}
+		runtime.Gosched()
+	}
+}
+
+func TestLockTableComparer(t *testing.T) {
+	// Keys are compared case-insensitively, so "a" and "A" are the same key.
+	var lt lockTable
+	lt.init(func(a, b []byte) int {
+		return bytes.Compare(bytes.ToLower(a), bytes.ToLower(b))
+	})
+	point := func(txnID uint64, key string) *lock {
+		return &lock{txnID: txnID, mode: LockExclusive, span: txnSpan{start: []byte(key), point: true}}
+	}
+
+	l1 := point(1, "a")
+	if err := lt.acquire(l1, -1); err != nil {
+		t.Fatal(err)
+	}
+	if err := lt.acquire(point(2, "A"), -1); err != ErrLockTimeout {
+		t.Fatalf("expected %v, but found %v", ErrLockTimeout, err)
+	}
+	rangeLock := &lock{txnID: 2, mode: LockExclusive, span: txnSpan{start: []byte("A"), end: []byte("B")}}
+	if err := lt.acquire(rangeLock, -1); err != ErrLockTimeout {
+		t.Fatalf("expected %v, but found %v", ErrLockTimeout, err)
+	}
+	l2 := point(1, "A")
+	if err := lt.acquire(l2, -1); err != nil {
+		t.Fatal(err)
+	}
+	if err := lt.acquire(point(2, "b"), -1); err != nil {
+		t.Fatal(err)
+	}
+
+	lt.release([]*lock{l1})
+	if err := lt.acquire(point(2, "a"), -1); err != ErrLockTimeout {
+		t.Fatalf("expected %v, but found %v", ErrLockTimeout, err)
+	}
+	lt.release([]*lock{l2})
+	if err := lt.acquire(point(2, "a"), -1); err != nil {
+		t.Fatal(err)
+	}
+	if len(lt.points) != 2 {
+		t.Fatalf("expected point locks on 2 keys, but found %d", len(lt.points))
+	}
+}
+
+func TestTxnDeadlock(t *testing.T) {
+	d, err := Open("", &db.Options{FS: vfs.NewMem()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+
+	t1 := d.NewTxn(nil)
+	t2 := d.NewTxn(nil)
+	if _, err := t1.GetForUpdate([]byte("a")); err != db.ErrNotFound {
+		t.Fatalf("expected %v, but found %v", db.ErrNotFound, err)
+	}
+	if err := t2.Set([]byte("b"), []byte("t2")); err != nil {
+		t.Fatal(err)
+	}
+
+	// t2 waits on t1, so t1 waiting on t2 would deadlock.
+	errCh := make(chan error, 1)
+	go func() {
+		errCh <- t2.Set([]byte("a"), []byte("t2"))
+	}()
+	waitForWaiters(d, 1)
+	if err := t1.Set([]byte("b"), []byte("t1")); err != ErrDeadlock {
+		t.Fatalf("expected %v, but found %v", ErrDeadlock, err)
+	}
+
+	// Rolling back t1 allows t2 to proceed.
+	if err := t1.Rollback(); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-errCh; err != nil {
+		t.Fatal(err)
+	}
+	if err := t2.Commit(db.NoSync); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestTxnSavepoints(t *testing.T) {
+	d, err := Open("", &db.Options{FS: vfs.NewMem()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+
+	txn := d.NewTxn(nil)
+	if err := txn.RollbackToSavepoint(); err != ErrNoSavepoint {
+		t.Fatalf("expected %v, but found %v", ErrNoSavepoint, err)
+	}
+	set := func(keys ...string) {
+		for _, k := range keys {
+			if err := txn.Set([]byte(k), []byte(k)); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	scan := func() string {
+		iter := txn.NewIter(nil)
+		var keys []byte
+		for valid := iter.First(); valid; valid = iter.Next() {
+			keys = append(keys, iter.Key()...)
+		}
+		if err := iter.Close(); err != nil {
+			t.Fatal(err)
+		}
+		return string(keys)
+	}
+	rollback := func() {
+		if err := txn.RollbackToSavepoint(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := txn.SetSavepoint(); err != nil {
+		t.Fatal(err)
+	}
+	set("a")
+	if err := txn.SetSavepoint(); err != nil {
+		t.Fatal(err)
+	}
+	set("b", "c")
+	if err := txn.SetSavepoint(); err != nil {
+		t.Fatal(err)
+	}
+	set("d")
+	if expected, actual := "abcd", scan(); expected != actual {
+		t.Fatalf("expected %q, but found %q", expected, actual)
+	}
+	rollback()
+	if expected, actual := "abc", scan(); expected != actual {
+		t.Fatalf("expected %q, but found %q", expected, actual)
+	}
+	rollback()
+
+	// The locks acquired since the savepoint (including the shared locks
+	// acquired by the scans) have been released.
+	other := d.NewTxn(&TxnOptions{LockTimeout: -1})
+	if err := other.Set([]byte("b"), []byte("other")); err != nil {
+		t.Fatal(err)
+	}
+	if err := other.Set([]byte("a"), []byte("other")); err != ErrLockTimeout {
+		t.Fatalf("expected %v, but found %v", ErrLockTimeout, err)
+	}
+	if err := other.Commit(db.NoSync); err != nil {
+		t.Fatal(err)
+	}
+
+	if expected, actual := "ab", scan(); expected != actual {
+		t.Fatalf("expected %q, but found %q", expected, actual)
+	}
+	set("e")
+	if err := txn.Commit(db.NoSync); err != nil {
+		t.Fatal(err)
+	}
+	iter := d.NewIter(nil)
+	var kvs []string
+	for valid := iter.First(); valid; valid = iter.Next() {
+		kvs = append(kvs, string(iter.Key())+":"+string(iter.Value()))
+	}
+	if err := iter.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if expected, actual := "[a:a b:other e:e]", fmt.Sprint(kvs); expected != actual {
+		t.Fatalf("expected %q, but found %q", expected, actual)
+	}
+}
+
+func TestTxnConcurrentIncrements(t *testing.T) {
+	d, err := Open("", &db.Options{FS: vfs.NewMem()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer d.Close()
+
+	const workers = 4
+	const increments = 100
+	key := []byte("counter")
+
+	var wg sync.WaitGroup
+	errCh := make(chan error, workers)
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < increments; j++ {
+				txn := d.NewTxn(nil)
+				var n int
+				if v, err := txn.GetForUpdate(key); err == nil {
+					n, _ = strconv.Atoi(string(v))
+				} else if err != db.ErrNotFound {
+					errCh <- err
+					return
+				}
+				if err := txn.Set(key, []byte(strconv.Itoa(n+1))); err != nil {
+					errCh <- err
+					return
+				}
+				if err := txn.Commit(db.NoSync); err != nil {
+					errCh <- err
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	close(errCh)
+	for err := range errCh {
+		t.Fatal(err)
+	}
+
+	v, err := d.Get(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := strconv.Itoa(workers * increments); string(v) != expected {
+		t.Fatalf("expected %s, but found %s", expected, v)
+	}
+}
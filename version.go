@@ -35,6 +35,26 @@ type fileMetadata struct {
 	largestSeqNum  uint64
 	// true if client asked us nicely to compact this file.
 	markedForCompaction bool
+	// smallestExpiry is the earliest expiration time of the SETEXPIRY entries
+	// in the table, in nanoseconds since the Unix epoch, or 0 if the table has
+	// no such entries. The table is compacted once the time has passed.
+	smallestExpiry uint64
+	// blobFiles are the file numbers of the blob files holding the values
+	// which are referenced by the table, in increasing order.
+	blobFiles []uint64
+	// blobUsage describes the use of each of blobFiles by the table. It is
+	// nil if the usage is unknown, as for the tables written before it was
+	// recorded.
+	blobUsage []blobUsage
+}
+
+// blobUsage describes the use of a blob file by a table.
+type blobUsage struct {
+	// bytes is the size of the records of the blob file which are referenced
+	// by the table.
+	bytes uint64
+	// size is the size of the blob file, or 0 if unknown.
+	size uint64
 }
 
 func (m *fileMetadata) String() string {
@@ -204,13 +224,13 @@ func (v *version) unrefLocked() {
 	}
 }
 
-func (v *version) unrefFiles() []uint64 {
-	var obsolete []uint64
+func (v *version) unrefFiles() []*fileMetadata {
+	var obsolete []*fileMetadata
 	for _, files := range v.files {
 		for i := range files {
 			f := &files[i]
 			if atomic.AddInt32(f.refs, -1) == 0 {
-				obsolete = append(obsolete, f.fileNum)
+				obsolete = append(obsolete, f)
 			}
 		}
 	}
@@ -280,6 +300,85 @@ func (v *version) overlaps(
 	return files[lower:upper]
 }
 
+// blobFilesToRelocate returns the oldest of the blob files referenced by the
+// tables of the version, whose values are relocated by a compaction (see
+// db.Options.BlobGCAgeCutoff).
+func (v *version) blobFilesToRelocate(cutoff float64) map[uint64]bool {
+	if cutoff <= 0 {
+		return nil
+	}
+	seen := make(map[uint64]bool)
+	var fileNums []uint64
+	for _, files := range v.files {
+		for i := range files {
+			for _, fileNum := range files[i].blobFiles {
+				if !seen[fileNum] {
+					seen[fileNum] = true
+					fileNums = append(fileNums, fileNum)
+				}
+			}
+		}
+	}
+	n := int(cutoff * float64(len(fileNums)))
+	if n == 0 {
+		return nil
+	}
+	sort.Slice(fileNums, func(i, j int) bool {
+		return fileNums[i] < fileNums[j]
+	})
+	relocate := make(map[uint64]bool, n)
+	for _, fileNum := range fileNums[:n] {
+		relocate[fileNum] = true
+	}
+	return relocate
+}
+
+// blobFilesToCollect returns the blob files among those relocated by a
+// compaction whose obsolete fraction is at least threshold. The tables
+// referencing them are compacted to relocate their values (see
+// db.Options.BlobGCForceThreshold). A blob file is not collected if its
+// usage by any table is unknown.
+func (v *version) blobFilesToCollect(cutoff, threshold float64) map[uint64]bool {
+	if threshold < 0 {
+		return nil
+	}
+	relocate := v.blobFilesToRelocate(cutoff)
+	if len(relocate) == 0 {
+		return nil
+	}
+	usage := make(map[uint64]blobUsage, len(relocate))
+	for _, files := range v.files {
+		for i := range files {
+			f := &files[i]
+			for j, fileNum := range f.blobFiles {
+				if !relocate[fileNum] {
+					continue
+				}
+				if f.blobUsage == nil || f.blobUsage[j].size == 0 {
+					delete(relocate, fileNum)
+					continue
+				}
+				u := usage[fileNum]
+				u.bytes += f.blobUsage[j].bytes
+				u.size = f.blobUsage[j].size
+				usage[fileNum] = u
+			}
+		}
+	}
+	var collect map[uint64]bool
+	for fileNum := range relocate {
+		u := usage[fileNum]
+		if u.bytes > u.size || float64(u.size-u.bytes) < threshold*float64(u.size) {
+			continue
+		}
+		if collect == nil {
+			collect = make(map[uint64]bool)
+		}
+		collect[fileNum] = true
+	}
+	return collect
+}
+
 // checkOrdering checks that the files are consistent with respect to
 // increasing file numbers (for level 0 files) and increasing and non-
 // overlapping internal key ranges (for level non-0 files).
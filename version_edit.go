@@ -11,10 +11,12 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"math"
 	"sort"
 	"sync/atomic"
 
 	"github.com/petermattis/pebble/db"
+	"github.com/petermattis/pebble/internal/record"
 )
 
 // TODO(peter): describe the MANIFEST file format, independently of the C++
@@ -41,18 +43,25 @@ const (
 	tagPrevLogNumber  = 9
 
 	// RocksDB tags.
-	tagNewFile2         = 100
-	tagNewFile3         = 102
-	tagNewFile4         = 103
-	tagColumnFamily     = 200
-	tagColumnFamilyAdd  = 201
-	tagColumnFamilyDrop = 202
-	tagMaxColumnFamily  = 203
-
-	// The custom tags sub-format used by tagNewFile4.
+	tagMinLogNumberToKeep = 10
+	tagNewFile2           = 100
+	tagNewFile3           = 102
+	tagNewFile4           = 103
+	tagColumnFamily       = 200
+	tagColumnFamilyAdd    = 201
+	tagColumnFamilyDrop   = 202
+	tagMaxColumnFamily    = 203
+	tagInAtomicGroup      = 300
+
+	// The custom tags sub-format used by tagNewFile4. The tags specific to
+	// Pebble are numbered from 32 if they may be safely ignored, and from 66
+	// otherwise, above the tags defined by RocksDB.
 	customTagTerminate         = 1
 	customTagNeedsCompaction   = 2
+	customTagSmallestExpiry    = 32
+	customTagBlobUsage         = 33
 	customTagPathID            = 65
+	customTagBlobFiles         = 66
 	customTagNonSafeIgnoreMask = 1 << 6
 )
 
@@ -75,6 +84,52 @@ type versionEdit struct {
 	deletedFiles   map[deletedFileEntry]bool // A set of deletedFileEntry values.
 	newFiles       []newFileEntry
 	metrics        map[int]*LevelMetrics // level -> metrics update
+	// minLogNumberToKeep is the file number of the oldest log containing a
+	// batch which has been prepared but not yet committed or rolled back (see
+	// DB.Prepare). Logs older than logNumber but not older than
+	// minLogNumberToKeep are retained, and scanned for prepared batches during
+	// recovery. It is only meaningful on edits which set logNumber, where zero
+	// indicates that no older logs need to be retained.
+	minLogNumberToKeep uint64
+
+	// The ID of the column family the file changes in the edit apply to. The
+	// default column family has ID 0.
+	columnFamily uint32
+	// columnFamilyAdd is the name of the column family added by the edit, and
+	// columnFamilyOpts are its options. The options are not persisted.
+	columnFamilyAdd  string
+	columnFamilyOpts *db.Options
+	// columnFamilyDrop is true if the edit drops the column family.
+	columnFamilyDrop bool
+	// maxColumnFamily is the largest column family ID which has been
+	// allocated.
+	maxColumnFamily uint32
+	// columnFamilyEdits are the edits to other column families which are
+	// applied atomically with this edit. The log and file numbers are only
+	// present on the outermost edit.
+	columnFamilyEdits []*versionEdit
+
+	// inAtomicGroup is set by decode if the record is part of an atomic group,
+	// and atomicGroupRemaining is the number of records of the group which
+	// follow it.
+	inAtomicGroup        bool
+	atomicGroupRemaining uint64
+}
+
+// columnFamilyEdit returns the edit for the specified column family, creating
+// a nested edit if necessary.
+func (v *versionEdit) columnFamilyEdit(id uint32) *versionEdit {
+	if id == v.columnFamily {
+		return v
+	}
+	for _, e := range v.columnFamilyEdits {
+		if e.columnFamily == id {
+			return e
+		}
+	}
+	e := &versionEdit{columnFamily: id}
+	v.columnFamilyEdits = append(v.columnFamilyEdits, e)
+	return e
 }
 
 func (v *versionEdit) decode(r io.Reader) error {
@@ -83,6 +138,9 @@ func (v *versionEdit) decode(r io.Reader) error {
 		br = bufio.NewReader(r)
 	}
 	d := versionEditDecoder{br}
+	// The file changes are applied to the column family edit most recently
+	// started by a tagColumnFamily record.
+	cf := v
 	for {
 		tag, err := binary.ReadUvarint(br)
 		if err == io.EOF {
@@ -97,7 +155,7 @@ func (v *versionEdit) decode(r io.Reader) error {
 			if err != nil {
 				return err
 			}
-			v.comparatorName = string(s)
+			cf.comparatorName = string(s)
 
 		case tagLogNumber:
 			n, err := d.readUvarint()
@@ -138,10 +196,10 @@ func (v *versionEdit) decode(r io.Reader) error {
 			if err != nil {
 				return err
 			}
-			if v.deletedFiles == nil {
-				v.deletedFiles = make(map[deletedFileEntry]bool)
+			if cf.deletedFiles == nil {
+				cf.deletedFiles = make(map[deletedFileEntry]bool)
 			}
-			v.deletedFiles[deletedFileEntry{level, fileNum}] = true
+			cf.deletedFiles[deletedFileEntry{level, fileNum}] = true
 
 		case tagNewFile, tagNewFile2, tagNewFile3, tagNewFile4:
 			level, err := d.readLevel()
@@ -184,6 +242,9 @@ func (v *versionEdit) decode(r io.Reader) error {
 				}
 			}
 			var markedForCompaction bool
+			var smallestExpiry uint64
+			var blobFiles []uint64
+			var usage []blobUsage
 			if tag == tagNewFile4 {
 				for {
 					customTag, err := d.readUvarint()
@@ -204,17 +265,51 @@ func (v *versionEdit) decode(r io.Reader) error {
 						}
 						markedForCompaction = (field[0] == 1)
 
+					case customTagSmallestExpiry:
+						var n int
+						smallestExpiry, n = binary.Uvarint(field)
+						if n <= 0 || n != len(field) {
+							return fmt.Errorf("new-file4: smallest-expiry field corrupt")
+						}
+
 					case customTagPathID:
 						return fmt.Errorf("new-file4: path-id field not supported")
 
+					case customTagBlobFiles:
+						for len(field) > 0 {
+							fileNum, n := binary.Uvarint(field)
+							if n <= 0 {
+								return fmt.Errorf("new-file4: blob-files field corrupt")
+							}
+							blobFiles = append(blobFiles, fileNum)
+							field = field[n:]
+						}
+
+					case customTagBlobUsage:
+						for len(field) > 0 {
+							var u [2]uint64
+							for j := range u {
+								var n int
+								u[j], n = binary.Uvarint(field)
+								if n <= 0 {
+									return fmt.Errorf("new-file4: blob-usage field corrupt")
+								}
+								field = field[n:]
+							}
+							usage = append(usage, blobUsage{bytes: u[0], size: u[1]})
+						}
+
 					default:
 						if (customTag & customTagNonSafeIgnoreMask) != 0 {
 							return fmt.Errorf("new-file4: custom field not supported: %d", customTag)
 						}
 					}
 				}
+				if usage != nil && len(usage) != len(blobFiles) {
+					return fmt.Errorf("new-file4: blob-usage field corrupt")
+				}
 			}
-			v.newFiles = append(v.newFiles, newFileEntry{
+			cf.newFiles = append(cf.newFiles, newFileEntry{
 				level: level,
 				meta: fileMetadata{
 					fileNum:             fileNum,
@@ -224,6 +319,9 @@ func (v *versionEdit) decode(r io.Reader) error {
 					smallestSeqNum:      smallestSeqNum,
 					largestSeqNum:       largestSeqNum,
 					markedForCompaction: markedForCompaction,
+					smallestExpiry:      smallestExpiry,
+					blobFiles:           blobFiles,
+					blobUsage:           usage,
 				},
 			})
 
@@ -234,8 +332,50 @@ func (v *versionEdit) decode(r io.Reader) error {
 			}
 			v.prevLogNumber = n
 
-		case tagColumnFamily, tagColumnFamilyAdd, tagColumnFamilyDrop, tagMaxColumnFamily:
-			return fmt.Errorf("column families are not supported")
+		case tagMinLogNumberToKeep:
+			n, err := d.readUvarint()
+			if err != nil {
+				return err
+			}
+			v.minLogNumberToKeep = n
+
+		case tagColumnFamily:
+			n, err := d.readUvarint()
+			if err != nil {
+				return err
+			}
+			if n > math.MaxUint32 {
+				return errCorruptManifest
+			}
+			cf = v.columnFamilyEdit(uint32(n))
+
+		case tagColumnFamilyAdd:
+			s, err := d.readBytes()
+			if err != nil {
+				return err
+			}
+			cf.columnFamilyAdd = string(s)
+
+		case tagColumnFamilyDrop:
+			cf.columnFamilyDrop = true
+
+		case tagMaxColumnFamily:
+			n, err := d.readUvarint()
+			if err != nil {
+				return err
+			}
+			if n > math.MaxUint32 {
+				return errCorruptManifest
+			}
+			v.maxColumnFamily = uint32(n)
+
+		case tagInAtomicGroup:
+			n, err := d.readUvarint()
+			if err != nil {
+				return err
+			}
+			v.inAtomicGroup = true
+			v.atomicGroupRemaining = n
 
 		default:
 			return errCorruptManifest
@@ -244,11 +384,81 @@ func (v *versionEdit) decode(r io.Reader) error {
 	return nil
 }
 
+// readFrom reads the next edit from the manifest r. The records of an atomic
+// group are combined into a single edit. It returns io.EOF if there are no
+// more edits, and io.ErrUnexpectedEOF if the manifest ends within an atomic
+// group.
+func (v *versionEdit) readFrom(r *record.Reader) error {
+	for i := 0; ; i++ {
+		rr, err := r.Next()
+		if err == io.EOF && i > 0 {
+			return io.ErrUnexpectedEOF
+		}
+		if err != nil {
+			return err
+		}
+		// Each record of an atomic group starts with a tagColumnFamily record
+		// (unless it is for the default column family), so decoding the
+		// records into the same edit adds their changes to the edits of the
+		// respective column families.
+		v.inAtomicGroup = false
+		if err := v.decode(rr); err != nil {
+			return err
+		}
+		if !v.inAtomicGroup {
+			if i > 0 {
+				return errCorruptManifest
+			}
+			return nil
+		}
+		if v.atomicGroupRemaining == 0 {
+			v.inAtomicGroup = false
+			return nil
+		}
+	}
+}
+
+// writeTo writes the edit to the manifest w. As in RocksDB, the edits to other
+// column families are written as separate records, one per column family,
+// which are bracketed as an atomic group: a reader applies either all of the
+// records of the group or none of them.
+func (v *versionEdit) writeTo(w *record.Writer) error {
+	if len(v.columnFamilyEdits) == 0 {
+		rw, err := w.Next()
+		if err != nil {
+			return err
+		}
+		return v.encode(rw)
+	}
+	edits := append([]*versionEdit{v}, v.columnFamilyEdits...)
+	for i := range edits {
+		rw, err := w.Next()
+		if err != nil {
+			return err
+		}
+		e := *edits[i]
+		e.columnFamilyEdits = nil
+		e.inAtomicGroup = true
+		e.atomicGroupRemaining = uint64(len(edits) - i - 1)
+		if err := e.encode(rw); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// encode encodes the edit, excluding the nested column family edits, into a
+// single record (see writeTo).
 func (v *versionEdit) encode(w io.Writer) error {
 	e := versionEditEncoder{new(bytes.Buffer)}
-	if v.comparatorName != "" {
-		e.writeUvarint(tagComparator)
-		e.writeString(v.comparatorName)
+	if v.columnFamily != 0 {
+		e.writeUvarint(tagColumnFamily)
+		e.writeUvarint(uint64(v.columnFamily))
+	}
+	v.encodeFiles(e)
+	if v.maxColumnFamily != 0 {
+		e.writeUvarint(tagMaxColumnFamily)
+		e.writeUvarint(uint64(v.maxColumnFamily))
 	}
 	if v.logNumber != 0 {
 		e.writeUvarint(tagLogNumber)
@@ -258,6 +468,10 @@ func (v *versionEdit) encode(w io.Writer) error {
 		e.writeUvarint(tagPrevLogNumber)
 		e.writeUvarint(v.prevLogNumber)
 	}
+	if v.minLogNumberToKeep != 0 {
+		e.writeUvarint(tagMinLogNumberToKeep)
+		e.writeUvarint(v.minLogNumberToKeep)
+	}
 	if v.nextFileNumber != 0 {
 		e.writeUvarint(tagNextFileNumber)
 		e.writeUvarint(v.nextFileNumber)
@@ -266,6 +480,29 @@ func (v *versionEdit) encode(w io.Writer) error {
 		e.writeUvarint(tagLastSequence)
 		e.writeUvarint(v.lastSequence)
 	}
+	if v.inAtomicGroup {
+		e.writeUvarint(tagInAtomicGroup)
+		e.writeUvarint(v.atomicGroupRemaining)
+	}
+	_, err := w.Write(e.Bytes())
+	return err
+}
+
+// encodeFiles encodes the column family specific portion of the edit: the
+// comparator, the addition or removal of the column family and the file
+// changes.
+func (v *versionEdit) encodeFiles(e versionEditEncoder) {
+	if v.columnFamilyAdd != "" {
+		e.writeUvarint(tagColumnFamilyAdd)
+		e.writeString(v.columnFamilyAdd)
+	}
+	if v.columnFamilyDrop {
+		e.writeUvarint(tagColumnFamilyDrop)
+	}
+	if v.comparatorName != "" {
+		e.writeUvarint(tagComparator)
+		e.writeString(v.comparatorName)
+	}
 	for x := range v.deletedFiles {
 		e.writeUvarint(tagDeletedFile)
 		e.writeUvarint(uint64(x.level))
@@ -273,7 +510,7 @@ func (v *versionEdit) encode(w io.Writer) error {
 	}
 	for _, x := range v.newFiles {
 		var customFields bool
-		if x.meta.markedForCompaction {
+		if x.meta.markedForCompaction || x.meta.smallestExpiry != 0 || len(x.meta.blobFiles) > 0 {
 			customFields = true
 			e.writeUvarint(tagNewFile4)
 		} else {
@@ -291,11 +528,39 @@ func (v *versionEdit) encode(w io.Writer) error {
 				e.writeUvarint(customTagNeedsCompaction)
 				e.writeBytes([]byte{1})
 			}
+			if x.meta.smallestExpiry != 0 {
+				var buf [binary.MaxVarintLen64]byte
+				n := binary.PutUvarint(buf[:], x.meta.smallestExpiry)
+				e.writeUvarint(customTagSmallestExpiry)
+				e.writeBytes(buf[:n])
+			}
+			if len(x.meta.blobFiles) > 0 {
+				// The blob files referenced by the table are required to read it,
+				// so the field may not be ignored by older versions.
+				var field []byte
+				var buf [binary.MaxVarintLen64]byte
+				for _, fileNum := range x.meta.blobFiles {
+					n := binary.PutUvarint(buf[:], fileNum)
+					field = append(field, buf[:n]...)
+				}
+				e.writeUvarint(customTagBlobFiles)
+				e.writeBytes(field)
+			}
+			if len(x.meta.blobUsage) > 0 {
+				var field []byte
+				var buf [binary.MaxVarintLen64]byte
+				for _, u := range x.meta.blobUsage {
+					n := binary.PutUvarint(buf[:], u.bytes)
+					field = append(field, buf[:n]...)
+					n = binary.PutUvarint(buf[:], u.size)
+					field = append(field, buf[:n]...)
+				}
+				e.writeUvarint(customTagBlobUsage)
+				e.writeBytes(field)
+			}
 			e.writeUvarint(customTagTerminate)
 		}
 	}
-	_, err := w.Write(e.Bytes())
-	return err
 }
 
 type versionEditDecoder struct {
@@ -22,12 +22,20 @@ import (
 func checkRoundTrip(e0 versionEdit) error {
 	var e1 versionEdit
 	buf := new(bytes.Buffer)
-	if err := e0.encode(buf); err != nil {
+	w := record.NewWriter(buf)
+	if err := e0.writeTo(w); err != nil {
 		return fmt.Errorf("encode: %v", err)
 	}
-	if err := e1.decode(buf); err != nil {
+	if err := w.Close(); err != nil {
+		return fmt.Errorf("encode: %v", err)
+	}
+	r := record.NewReader(buf, 0 /* logNum */)
+	if err := e1.readFrom(r); err != nil {
 		return fmt.Errorf("decode: %v", err)
 	}
+	if err := e1.readFrom(r); err != io.EOF {
+		return fmt.Errorf("decode: expected EOF, but found %v", err)
+	}
 	if !reflect.DeepEqual(e1, e0) {
 		return fmt.Errorf("\n\tgot  %#v\n\twant %#v", e1, e0)
 	}
@@ -40,11 +48,12 @@ func TestVersionEditRoundTrip(t *testing.T) {
 		{},
 		// A complete version edit.
 		{
-			comparatorName: "11",
-			logNumber:      22,
-			prevLogNumber:  33,
-			nextFileNumber: 44,
-			lastSequence:   55,
+			comparatorName:     "11",
+			logNumber:          22,
+			prevLogNumber:      33,
+			minLogNumberToKeep: 11,
+			nextFileNumber:     44,
+			lastSequence:       55,
 			deletedFiles: map[deletedFileEntry]bool{
 				deletedFileEntry{
 					level:   3,
@@ -77,6 +86,65 @@ func TestVersionEditRoundTrip(t *testing.T) {
 						markedForCompaction: true,
 					},
 				},
+				{
+					level: 6,
+					meta: fileMetadata{
+						fileNum:        807,
+						size:           8070,
+						smallest:       db.DecodeInternalKey([]byte("a\x00\x01\x02\x03\x04\x05\x06\x07")),
+						largest:        db.DecodeInternalKey([]byte("z\x01\xff\xfe\xfd\xfc\xfb\xfa\xf9")),
+						smallestSeqNum: 6,
+						largestSeqNum:  9,
+						smallestExpiry: 1e18,
+						blobFiles:      []uint64{801, 804},
+						blobUsage:      []blobUsage{{bytes: 100, size: 4096}, {bytes: 0, size: 0}},
+					},
+				},
+			},
+		},
+		// A version edit with column family edits.
+		{
+			logNumber:       22,
+			nextFileNumber:  44,
+			maxColumnFamily: 3,
+			newFiles: []newFileEntry{
+				{
+					level: 0,
+					meta: fileMetadata{
+						fileNum:  800,
+						size:     8000,
+						smallest: db.DecodeInternalKey([]byte("abc\x00\x01\x02\x03\x04\x05\x06\x07")),
+						largest:  db.DecodeInternalKey([]byte("xyz\x01\xff\xfe\xfd\xfc\xfb\xfa\xf9")),
+					},
+				},
+			},
+			columnFamilyEdits: []*versionEdit{
+				{
+					columnFamily:    2,
+					columnFamilyAdd: "two",
+					comparatorName:  "reverse",
+					deletedFiles: map[deletedFileEntry]bool{
+						deletedFileEntry{
+							level:   1,
+							fileNum: 701,
+						}: true,
+					},
+					newFiles: []newFileEntry{
+						{
+							level: 2,
+							meta: fileMetadata{
+								fileNum:  802,
+								size:     8020,
+								smallest: db.DecodeInternalKey([]byte("A\x00\x01\x02\x03\x04\x05\x06\x07")),
+								largest:  db.DecodeInternalKey([]byte("Z\x01\xff\xfe\xfd\xfc\xfb\xfa\xf9")),
+							},
+						},
+					},
+				},
+				{
+					columnFamily:     3,
+					columnFamilyDrop: true,
+				},
 			},
 		},
 	}
@@ -192,3 +260,78 @@ func TestVersionEditDecode(t *testing.T) {
 		})
 	}
 }
+
+func TestVersionEditAtomicGroup(t *testing.T) {
+	ve := versionEdit{
+		logNumber:       22,
+		nextFileNumber:  44,
+		maxColumnFamily: 3,
+		columnFamilyEdits: []*versionEdit{
+			{columnFamily: 2, columnFamilyAdd: "two"},
+			{columnFamily: 3, columnFamilyDrop: true},
+		},
+	}
+	buf := new(bytes.Buffer)
+	w := record.NewWriter(buf)
+	if err := ve.writeTo(w); err != nil {
+		t.Fatal(err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Each column family edit is written as a separate record, as RocksDB
+	// expects.
+	var records [][]byte
+	r := record.NewReader(bytes.NewReader(buf.Bytes()), 0 /* logNum */)
+	for {
+		rr, err := r.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		b, err := ioutil.ReadAll(rr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		records = append(records, b)
+	}
+	if len(records) != 3 {
+		t.Fatalf("expected 3 records, but found %d", len(records))
+	}
+	for i, b := range records {
+		var e versionEdit
+		if err := e.decode(bytes.NewReader(b)); err != nil {
+			t.Fatal(err)
+		}
+		if !e.inAtomicGroup || e.atomicGroupRemaining != uint64(len(records)-i-1) {
+			t.Fatalf("%d: expected %d remaining records in the atomic group, but found %t %d",
+				i, len(records)-i-1, e.inAtomicGroup, e.atomicGroupRemaining)
+		}
+		if n := len(e.columnFamilyEdits); (i == 0 && n != 0) || (i > 0 && n != 1) {
+			t.Fatalf("%d: unexpected column family edits: %d", i, n)
+		}
+	}
+
+	// A manifest which ends within an atomic group is torn.
+	buf.Reset()
+	w = record.NewWriter(buf)
+	for _, b := range records[:2] {
+		rw, err := w.Next()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := rw.Write(b); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := w.Close(); err != nil {
+		t.Fatal(err)
+	}
+	var e versionEdit
+	if err := e.readFrom(record.NewReader(buf, 0 /* logNum */)); err != io.ErrUnexpectedEOF {
+		t.Fatalf("expected %v, but found %v", io.ErrUnexpectedEOF, err)
+	}
+}
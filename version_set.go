@@ -8,6 +8,7 @@ import (
 	"fmt"
 	"io"
 	"os"
+	"sort"
 	"sync"
 	"sync/atomic"
 
@@ -16,17 +17,16 @@ import (
 	"github.com/petermattis/pebble/vfs"
 )
 
-// versionSet manages a collection of immutable versions, and manages the
-// creation of a new version from the most recent version. A new versions is
-// created from an existing version by applying a version edit which is just
-// like it sounds: a delta from the previous version. Version edits are logged
-// to the manifest file, which is replayed at startup.
-type versionSet struct {
+// columnFamilyVersions manages the versions of the LSM of a single column
+// family. Each column family has its own comparer, options and compaction
+// picker, while the manifest, file numbers and sequence numbers are shared by
+// all of the column families in the versionSet.
+type columnFamilyVersions struct {
 	// Immutable fields.
-	dirname string
-	mu      *sync.Mutex
+	vs      *versionSet
+	id      uint32
+	name    string
 	opts    *db.Options
-	fs      vfs.FS
 	cmp     db.Compare
 	cmpName string
 	// Dynamic base level allows the dynamic base level computation to be
@@ -38,13 +38,92 @@ type versionSet struct {
 	picker   *compactionPicker
 
 	metrics VersionMetrics
+}
+
+func (cf *columnFamilyVersions) init(
+	vs *versionSet, id uint32, name string, opts *db.Options,
+) {
+	cf.vs = vs
+	cf.id = id
+	cf.name = name
+	cf.opts = opts
+	cf.cmp = opts.Comparer.Compare
+	cf.cmpName = opts.Comparer.Name
+	cf.dynamicBaseLevel = true
+	cf.versions.mu = vs.mu
+	cf.versions.init()
+}
+
+func (cf *columnFamilyVersions) append(v *version) {
+	if v.refs != 0 {
+		panic("pebble: version should be unreferenced")
+	}
+	if !cf.versions.empty() {
+		cf.versions.back().unrefLocked()
+	}
+	v.vs = cf.vs
+	v.ref()
+	cf.versions.pushBack(v)
+}
+
+func (cf *columnFamilyVersions) currentVersion() *version {
+	return cf.versions.back()
+}
+
+func (cf *columnFamilyVersions) newPicker(v *version) *compactionPicker {
+	picker := newCompactionPicker(v, cf.opts)
+	if !cf.dynamicBaseLevel {
+		picker.baseLevel = 1
+	}
+	return picker
+}
+
+func (cf *columnFamilyVersions) updateMetrics(v *version, update map[int]*LevelMetrics) {
+	for level, update := range update {
+		cf.metrics.Levels[level].Add(update)
+	}
+	for i := range cf.metrics.Levels {
+		l := &cf.metrics.Levels[i]
+		l.NumFiles = uint64(len(v.files[i]))
+		l.Size = uint64(totalSize(v.files[i]))
+	}
+}
+
+// versionSet manages a collection of immutable versions, and manages the
+// creation of a new version from the most recent version. A new versions is
+// created from an existing version by applying a version edit which is just
+// like it sounds: a delta from the previous version. Version edits are logged
+// to the manifest file, which is replayed at startup.
+//
+// The versions of the default column family are managed by the embedded
+// columnFamilyVersions. The versions of all of the column families (including
+// the default column family) are found in columnFamilies.
+type versionSet struct {
+	columnFamilyVersions
+
+	// Immutable fields.
+	dirname string
+	mu      *sync.Mutex
+	fs      vfs.FS
+
+	// Mutable fields.
+	columnFamilies  map[uint32]*columnFamilyVersions
+	maxColumnFamily uint32
 
 	obsoleteTables    []uint64
 	obsoleteManifests []uint64
 	obsoleteOptions   []uint64
+	// obsoleteBlobs holds the blob files which were referenced by obsolete
+	// tables. Such a blob file is obsolete unless it is still referenced by
+	// another table (see obsoleteBlobFiles).
+	obsoleteBlobs []uint64
+	// droppedColumnFamilies holds the dropped column families whose versions
+	// are still in use.
+	droppedColumnFamilies []*columnFamilyVersions
 
 	logNumber          uint64
 	prevLogNumber      uint64
+	minLogNumberToKeep uint64
 	nextFileNumber     uint64
 	logSeqNum          uint64 // next seqNum to use for WAL writes
 	visibleSeqNum      uint64 // visible seqNum (<= logSeqNum)
@@ -61,102 +140,189 @@ type versionSet struct {
 func (vs *versionSet) load(dirname string, opts *db.Options, mu *sync.Mutex) error {
 	vs.dirname = dirname
 	vs.mu = mu
-	vs.versions.mu = mu
 	vs.writerCond.L = mu
-	vs.opts = opts
 	vs.fs = opts.FS
-	vs.cmp = opts.Comparer.Compare
-	vs.cmpName = opts.Comparer.Name
-	vs.dynamicBaseLevel = true
-	vs.versions.init()
+	vs.columnFamilyVersions.init(vs, 0, defaultColumnFamilyName, opts)
+	vs.columnFamilies = map[uint32]*columnFamilyVersions{
+		0: &vs.columnFamilyVersions,
+	}
 	// For historical reasons, the next file number is initialized to 2.
 	vs.nextFileNumber = 2
 
+	m, err := readManifest(vs.fs, dirname, vs.cmpName, false /* tolerateTornTail */)
+	if err != nil {
+		return err
+	}
+	vs.maxColumnFamily = m.maxColumnFamily
+	vs.logNumber = m.logNumber
+	vs.minLogNumberToKeep = m.minLogNumberToKeep
+	vs.prevLogNumber = m.prevLogNumber
+	if m.nextFileNumber != 0 {
+		vs.nextFileNumber = m.nextFileNumber
+	}
+	vs.logSeqNum = m.logSeqNum
+	if vs.logNumber == 0 || vs.nextFileNumber == 0 {
+		if vs.nextFileNumber == 2 {
+			// We have a freshly created DB.
+		} else {
+			return fmt.Errorf("pebble: incomplete manifest file %q for DB %q", m.filename, dirname)
+		}
+	}
+	vs.markFileNumUsed(vs.logNumber)
+	vs.markFileNumUsed(vs.prevLogNumber)
+
+	for id, state := range m.columnFamilies {
+		cf := &vs.columnFamilyVersions
+		if id != 0 {
+			if opts.ColumnFamilies[state.name] == nil {
+				return fmt.Errorf("pebble: options for column family %q not specified", state.name)
+			}
+			cfOpts := columnFamilyOptions(opts, opts.ColumnFamilies[state.name])
+			if state.cmpName != "" && state.cmpName != cfOpts.Comparer.Name {
+				return fmt.Errorf("pebble: manifest file %q for DB %q: column family %q: "+
+					"comparer name from file %q != comparer name from db.Options %q",
+					m.filename, dirname, state.name, state.cmpName, cfOpts.Comparer.Name)
+			}
+			cf = &columnFamilyVersions{}
+			cf.init(vs, id, state.name, cfOpts)
+			vs.columnFamilies[id] = cf
+		}
+		newVersion, err := state.bve.apply(cf.opts, nil, cf.cmp)
+		if err != nil {
+			return err
+		}
+		cf.append(newVersion)
+		cf.picker = cf.newPicker(newVersion)
+		cf.updateMetrics(newVersion, nil)
+	}
+	return nil
+}
+
+// columnFamilyState is the state of a column family read from the manifest.
+type columnFamilyState struct {
+	name    string
+	cmpName string
+	bve     bulkVersionEdit
+}
+
+// manifestState is the state of a DB read from its current manifest.
+type manifestState struct {
+	filename           string
+	columnFamilies     map[uint32]*columnFamilyState
+	maxColumnFamily    uint32
+	logNumber          uint64
+	minLogNumberToKeep uint64
+	prevLogNumber      uint64
+	nextFileNumber     uint64
+	logSeqNum          uint64
+}
+
+// readManifest reads the version edits in the current manifest of the DB in
+// the specified directory. If tolerateTornTail is true, a partially written
+// edit at the end of the manifest (as found while the manifest is being
+// written by another process) is ignored.
+func readManifest(
+	fs vfs.FS, dirname string, cmpName string, tolerateTornTail bool,
+) (*manifestState, error) {
 	// Read the CURRENT file to find the current manifest file.
-	current, err := vs.fs.Open(dbFilename(dirname, fileTypeCurrent, 0))
+	current, err := fs.Open(dbFilename(dirname, fileTypeCurrent, 0))
 	if err != nil {
-		return fmt.Errorf("pebble: could not open CURRENT file for DB %q: %v", dirname, err)
+		return nil, fmt.Errorf("pebble: could not open CURRENT file for DB %q: %v", dirname, err)
 	}
 	defer current.Close()
 	stat, err := current.Stat()
 	if err != nil {
-		return err
+		return nil, err
 	}
 	n := stat.Size()
 	if n == 0 {
-		return fmt.Errorf("pebble: CURRENT file for DB %q is empty", dirname)
+		return nil, fmt.Errorf("pebble: CURRENT file for DB %q is empty", dirname)
 	}
 	if n > 4096 {
-		return fmt.Errorf("pebble: CURRENT file for DB %q is too large", dirname)
+		return nil, fmt.Errorf("pebble: CURRENT file for DB %q is too large", dirname)
 	}
 	b := make([]byte, n)
 	_, err = current.ReadAt(b, 0)
 	if err != nil {
-		return err
+		return nil, err
 	}
 	if b[n-1] != '\n' {
-		return fmt.Errorf("pebble: CURRENT file for DB %q is malformed", dirname)
+		return nil, fmt.Errorf("pebble: CURRENT file for DB %q is malformed", dirname)
 	}
 	b = b[:n-1]
 
-	// Read the versionEdits in the manifest file.
-	var bve bulkVersionEdit
-	manifest, err := vs.fs.Open(dirname + string(os.PathSeparator) + string(b))
+	// Read the versionEdits in the manifest file. The edits are accumulated
+	// separately for each of the column families.
+	m := &manifestState{
+		filename: string(b),
+		columnFamilies: map[uint32]*columnFamilyState{
+			0: &columnFamilyState{name: defaultColumnFamilyName},
+		},
+	}
+	columnFamilies := m.columnFamilies
+	manifest, err := fs.Open(dirname + string(os.PathSeparator) + string(b))
 	if err != nil {
-		return fmt.Errorf("pebble: could not open manifest file %q for DB %q: %v", b, dirname, err)
+		return nil, fmt.Errorf("pebble: could not open manifest file %q for DB %q: %v", b, dirname, err)
 	}
 	defer manifest.Close()
 	rr := record.NewReader(manifest, 0 /* logNum */)
 	for {
-		r, err := rr.Next()
+		var ve versionEdit
+		err := ve.readFrom(rr)
 		if err == io.EOF {
 			break
 		}
 		if err != nil {
-			return err
-		}
-		var ve versionEdit
-		err = ve.decode(r)
-		if err != nil {
-			return err
+			if tolerateTornTail && (err == io.ErrUnexpectedEOF ||
+				err == record.ErrZeroedChunk || err == record.ErrInvalidChunk) {
+				break
+			}
+			return nil, err
 		}
 		if ve.comparatorName != "" {
-			if ve.comparatorName != vs.cmpName {
-				return fmt.Errorf("pebble: manifest file %q for DB %q: "+
+			if ve.comparatorName != cmpName {
+				return nil, fmt.Errorf("pebble: manifest file %q for DB %q: "+
 					"comparer name from file %q != comparer name from db.Options %q",
-					b, dirname, ve.comparatorName, vs.cmpName)
+					b, dirname, ve.comparatorName, cmpName)
+			}
+		}
+		columnFamilies[0].bve.accumulate(&ve)
+		for _, e := range ve.columnFamilyEdits {
+			if e.columnFamilyAdd != "" {
+				columnFamilies[e.columnFamily] = &columnFamilyState{name: e.columnFamilyAdd}
+			}
+			cf := columnFamilies[e.columnFamily]
+			if cf == nil {
+				return nil, fmt.Errorf("pebble: manifest file %q for DB %q: unknown column family %d",
+					b, dirname, e.columnFamily)
+			}
+			if e.columnFamilyDrop {
+				delete(columnFamilies, e.columnFamily)
+				continue
+			}
+			if e.comparatorName != "" {
+				cf.cmpName = e.comparatorName
 			}
+			cf.bve.accumulate(e)
+		}
+		if m.maxColumnFamily < ve.maxColumnFamily {
+			m.maxColumnFamily = ve.maxColumnFamily
 		}
-		bve.accumulate(&ve)
 		if ve.logNumber != 0 {
-			vs.logNumber = ve.logNumber
+			m.logNumber = ve.logNumber
+			m.minLogNumberToKeep = ve.minLogNumberToKeep
 		}
 		if ve.prevLogNumber != 0 {
-			vs.prevLogNumber = ve.prevLogNumber
+			m.prevLogNumber = ve.prevLogNumber
 		}
 		if ve.nextFileNumber != 0 {
-			vs.nextFileNumber = ve.nextFileNumber
+			m.nextFileNumber = ve.nextFileNumber
 		}
 		if ve.lastSequence != 0 {
-			vs.logSeqNum = ve.lastSequence
+			m.logSeqNum = ve.lastSequence
 		}
 	}
-	if vs.logNumber == 0 || vs.nextFileNumber == 0 {
-		if vs.nextFileNumber == 2 {
-			// We have a freshly created DB.
-		} else {
-			return fmt.Errorf("pebble: incomplete manifest file %q for DB %q", b, dirname)
-		}
-	}
-	vs.markFileNumUsed(vs.logNumber)
-	vs.markFileNumUsed(vs.prevLogNumber)
-
-	newVersion, err := bve.apply(opts, nil, vs.cmp)
-	if err != nil {
-		return err
-	}
-	vs.append(newVersion)
-	return nil
+	return m, nil
 }
 
 // logAndApply logs the version edit to the manifest, applies the version edit
@@ -182,8 +348,56 @@ func (vs *versionSet) logAndApply(jobID int, ve *versionEdit, dir vfs.File) erro
 	}
 	ve.nextFileNumber = vs.nextFileNumber
 	ve.lastSequence = atomic.LoadUint64(&vs.logSeqNum)
-	currentVersion := vs.currentVersion()
-	var newVersion *version
+
+	// Edits to column families which have been dropped concurrently (e.g. by a
+	// flush racing with DB.DropColumnFamily) are discarded. The new files added
+	// by such edits are obsolete.
+	cfEdits := ve.columnFamilyEdits[:0]
+	for _, e := range ve.columnFamilyEdits {
+		if e.columnFamilyAdd != "" || vs.columnFamilies[e.columnFamily] != nil {
+			cfEdits = append(cfEdits, e)
+			continue
+		}
+		moved := make(map[uint64]bool, len(e.deletedFiles))
+		for df := range e.deletedFiles {
+			moved[df.fileNum] = true
+		}
+		for i := range e.newFiles {
+			if nf := &e.newFiles[i]; !moved[nf.meta.fileNum] {
+				vs.addObsoleteLocked([]*fileMetadata{&nf.meta})
+			}
+		}
+	}
+	ve.columnFamilyEdits = cfEdits
+
+	// The outermost edit and the nested column family edits are applied
+	// atomically: a new version is created for each of the column families in
+	// the edit, and all of the new versions are installed together.
+	edits := append([]*versionEdit{ve}, ve.columnFamilyEdits...)
+	type columnFamilyUpdate struct {
+		cf         *columnFamilyVersions
+		base       *version
+		newVersion *version
+		picker     *compactionPicker
+	}
+	updates := make([]columnFamilyUpdate, len(edits))
+	for i, e := range edits {
+		u := &updates[i]
+		if e.columnFamilyAdd != "" {
+			u.cf = &columnFamilyVersions{}
+			u.cf.init(vs, e.columnFamily, e.columnFamilyAdd, e.columnFamilyOpts)
+			e.comparatorName = u.cf.cmpName
+			if ve.maxColumnFamily < e.columnFamily {
+				ve.maxColumnFamily = e.columnFamily
+			}
+			continue
+		}
+		u.cf = vs.columnFamilies[e.columnFamily]
+		if u.cf == nil {
+			panic(fmt.Sprintf("pebble: unknown column family %d", e.columnFamily))
+		}
+		u.base = u.cf.currentVersion()
+	}
 
 	// Generate a new manifest if we don't currently have one, or the current one
 	// is too large.
@@ -192,18 +406,24 @@ func (vs *versionSet) logAndApply(jobID int, ve *versionEdit, dir vfs.File) erro
 		newManifestFileNumber = vs.nextFileNum()
 	}
 
-	var picker *compactionPicker
 	if err := func() error {
 		vs.mu.Unlock()
 		defer vs.mu.Lock()
 
-		var bve bulkVersionEdit
-		bve.accumulate(ve)
+		for i, e := range edits {
+			u := &updates[i]
+			if e.columnFamilyDrop {
+				continue
+			}
+			var bve bulkVersionEdit
+			bve.accumulate(e)
 
-		var err error
-		newVersion, err = bve.apply(vs.opts, currentVersion, vs.cmp)
-		if err != nil {
-			return err
+			var err error
+			u.newVersion, err = bve.apply(u.cf.opts, u.base, u.cf.cmp)
+			if err != nil {
+				return err
+			}
+			u.picker = u.cf.newPicker(u.newVersion)
 		}
 
 		if newManifestFileNumber != 0 {
@@ -212,11 +432,7 @@ func (vs *versionSet) logAndApply(jobID int, ve *versionEdit, dir vfs.File) erro
 			}
 		}
 
-		w, err := vs.manifest.Next()
-		if err != nil {
-			return err
-		}
-		if err := ve.encode(w); err != nil {
+		if err := ve.writeTo(vs.manifest); err != nil {
 			return err
 		}
 		if err := vs.manifest.Flush(); err != nil {
@@ -237,23 +453,41 @@ func (vs *versionSet) logAndApply(jobID int, ve *versionEdit, dir vfs.File) erro
 					JobID:   jobID,
 					Path:    dbFilename(vs.dirname, fileTypeManifest, newManifestFileNumber),
 					FileNum: newManifestFileNumber,
-					Err:     err,
 				})
 			}
 		}
-		picker = newCompactionPicker(newVersion, vs.opts)
-		if !vs.dynamicBaseLevel {
-			picker.baseLevel = 1
-		}
 		return nil
 	}(); err != nil {
 		return err
 	}
 
-	// Install the new version.
-	vs.append(newVersion)
+	// Install the new versions.
+	for i, e := range edits {
+		u := &updates[i]
+		if e.columnFamilyDrop {
+			// The files of a dropped column family become obsolete once the
+			// versions referencing them are no longer in use.
+			delete(vs.columnFamilies, e.columnFamily)
+			u.cf.picker = nil
+			u.base.unrefLocked()
+			if !u.cf.versions.empty() {
+				vs.droppedColumnFamilies = append(vs.droppedColumnFamilies, u.cf)
+			}
+			continue
+		}
+		if e.columnFamilyAdd != "" {
+			vs.columnFamilies[e.columnFamily] = u.cf
+		}
+		u.cf.append(u.newVersion)
+		u.cf.picker = u.picker
+		u.cf.updateMetrics(u.newVersion, e.metrics)
+	}
+	if vs.maxColumnFamily < ve.maxColumnFamily {
+		vs.maxColumnFamily = ve.maxColumnFamily
+	}
 	if ve.logNumber != 0 {
 		vs.logNumber = ve.logNumber
+		vs.minLogNumberToKeep = ve.minLogNumberToKeep
 	}
 	if ve.prevLogNumber != 0 {
 		vs.prevLogNumber = ve.prevLogNumber
@@ -264,18 +498,6 @@ func (vs *versionSet) logAndApply(jobID int, ve *versionEdit, dir vfs.File) erro
 		}
 		vs.manifestFileNumber = newManifestFileNumber
 	}
-	vs.picker = picker
-
-	if ve.metrics != nil {
-		for level, update := range ve.metrics {
-			vs.metrics.Levels[level].Add(update)
-		}
-	}
-	for i := range vs.metrics.Levels {
-		l := &vs.metrics.Levels[i]
-		l.NumFiles = uint64(len(newVersion.files[i]))
-		l.Size = uint64(totalSize(newVersion.files[i]))
-	}
 	return nil
 }
 
@@ -304,23 +526,10 @@ func (vs *versionSet) createManifest(dirname string, fileNum uint64) (err error)
 	}
 	manifest = record.NewWriter(manifestFile)
 
-	snapshot := versionEdit{
-		comparatorName: vs.cmpName,
-	}
-	for level, fileMetadata := range vs.currentVersion().files {
-		for _, meta := range fileMetadata {
-			snapshot.newFiles = append(snapshot.newFiles, newFileEntry{
-				level: level,
-				meta:  meta,
-			})
-		}
-	}
+	var snapshot versionEdit
+	vs.snapshot(&snapshot)
 
-	w, err1 := manifest.Next()
-	if err1 != nil {
-		return err1
-	}
-	if err := snapshot.encode(w); err != nil {
+	if err := snapshot.writeTo(manifest); err != nil {
 		return err
 	}
 
@@ -329,6 +538,45 @@ func (vs *versionSet) createManifest(dirname string, fileNum uint64) (err error)
 	return nil
 }
 
+// snapshot fills in ve with the column families and files of the current
+// versions of vs.
+func (vs *versionSet) snapshot(ve *versionEdit) {
+	ve.maxColumnFamily = vs.maxColumnFamily
+	ids := make([]uint32, 0, len(vs.columnFamilies))
+	for id := range vs.columnFamilies {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool {
+		return ids[i] < ids[j]
+	})
+	for _, id := range ids {
+		cf := vs.columnFamilies[id]
+		e := ve.columnFamilyEdit(id)
+		e.comparatorName = cf.cmpName
+		if id != 0 {
+			e.columnFamilyAdd = cf.name
+		}
+		for level, fileMetadata := range cf.currentVersion().files {
+			for _, meta := range fileMetadata {
+				e.newFiles = append(e.newFiles, newFileEntry{
+					level: level,
+					meta:  meta,
+				})
+			}
+		}
+	}
+}
+
+// minLogNumber returns the file number of the oldest log which is needed for
+// recovery: either the oldest log containing unflushed data, or an older log
+// containing a prepared batch (see versionEdit.minLogNumberToKeep).
+func (vs *versionSet) minLogNumber() uint64 {
+	if vs.minLogNumberToKeep != 0 && vs.minLogNumberToKeep < vs.logNumber {
+		return vs.minLogNumberToKeep
+	}
+	return vs.logNumber
+}
+
 func (vs *versionSet) markFileNumUsed(fileNum uint64) {
 	if vs.nextFileNumber <= fileNum {
 		vs.nextFileNumber = fileNum + 1
@@ -341,32 +589,76 @@ func (vs *versionSet) nextFileNum() uint64 {
 	return x
 }
 
-func (vs *versionSet) append(v *version) {
-	if v.refs != 0 {
-		panic("pebble: version should be unreferenced")
-	}
-	if !vs.versions.empty() {
-		vs.versions.back().unrefLocked()
+// numL0Files returns the largest number of L0 files of any column family.
+func (vs *versionSet) numL0Files() int {
+	var n int
+	for _, cf := range vs.columnFamilies {
+		if l0 := len(cf.currentVersion().files[0]); n < l0 {
+			n = l0
+		}
 	}
-	v.vs = vs
-	v.ref()
-	vs.versions.pushBack(v)
-}
-
-func (vs *versionSet) currentVersion() *version {
-	return vs.versions.back()
+	return n
 }
 
+// addLiveFileNums adds the tables of all of the versions in use to m, along
+// with the blob files referenced by those tables.
 func (vs *versionSet) addLiveFileNums(m map[uint64]struct{}) {
-	for v := vs.versions.root.next; v != &vs.versions.root; v = v.next {
-		for _, ff := range v.files {
-			for _, f := range ff {
-				m[f.fileNum] = struct{}{}
+	// The versions of a dropped column family may still be in use by
+	// iterators. The column family is forgotten once they are not.
+	dropped := vs.droppedColumnFamilies[:0]
+	for _, cf := range vs.droppedColumnFamilies {
+		if !cf.versions.empty() {
+			dropped = append(dropped, cf)
+		}
+	}
+	vs.droppedColumnFamilies = dropped
+
+	add := func(cf *columnFamilyVersions) {
+		for v := cf.versions.root.next; v != &cf.versions.root; v = v.next {
+			for _, ff := range v.files {
+				for _, f := range ff {
+					m[f.fileNum] = struct{}{}
+					for _, fileNum := range f.blobFiles {
+						m[fileNum] = struct{}{}
+					}
+				}
 			}
 		}
 	}
+	for _, cf := range vs.columnFamilies {
+		add(cf)
+	}
+	for _, cf := range vs.droppedColumnFamilies {
+		add(cf)
+	}
 }
 
-func (vs *versionSet) addObsoleteLocked(obsolete []uint64) {
-	vs.obsoleteTables = append(vs.obsoleteTables, obsolete...)
+func (vs *versionSet) addObsoleteLocked(obsolete []*fileMetadata) {
+	for _, f := range obsolete {
+		vs.obsoleteTables = append(vs.obsoleteTables, f.fileNum)
+		vs.obsoleteBlobs = append(vs.obsoleteBlobs, f.blobFiles...)
+	}
+}
+
+// obsoleteBlobFiles returns the blob files which are no longer referenced by
+// any table, and which are not being written. The blob files are only
+// considered if they were referenced by an obsolete table.
+func (vs *versionSet) obsoleteBlobFiles(pendingOutputs map[uint64]struct{}) []uint64 {
+	if len(vs.obsoleteBlobs) == 0 {
+		return nil
+	}
+	live := make(map[uint64]struct{}, len(pendingOutputs))
+	for fileNum := range pendingOutputs {
+		live[fileNum] = struct{}{}
+	}
+	vs.addLiveFileNums(live)
+
+	var obsolete []uint64
+	for _, fileNum := range merge(nil, vs.obsoleteBlobs) {
+		if _, ok := live[fileNum]; !ok {
+			obsolete = append(obsolete, fileNum)
+		}
+	}
+	vs.obsoleteBlobs = nil
+	return obsolete
 }
@@ -127,3 +127,37 @@ func (defaultFS) List(dir string) ([]string, error) {
 func (defaultFS) Stat(name string) (os.FileInfo, error) {
 	return os.Stat(name)
 }
+
+// Copy copies the contents of oldname to newname. If newname exists, it will
+// be overwritten.
+func Copy(fs FS, oldname, newname string) error {
+	src, err := fs.Open(oldname)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	dst, err := fs.Create(newname)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(dst, src); err != nil {
+		dst.Close()
+		return err
+	}
+	if err := dst.Sync(); err != nil {
+		dst.Close()
+		return err
+	}
+	return dst.Close()
+}
+
+// LinkOrCopy creates newname as a hard link to the oldname file. If creating
+// the hard link fails (e.g. because oldname and newname reside on different
+// file systems), LinkOrCopy falls back to copying the file.
+func LinkOrCopy(fs FS, oldname, newname string) error {
+	if err := fs.Link(oldname, newname); err == nil {
+		return nil
+	}
+	return Copy(fs, oldname, newname)
+}
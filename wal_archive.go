@@ -0,0 +1,191 @@
+// Copyright 2019 The LevelDB-Go and Pebble Authors. All rights reserved. Use
+// of this source code is governed by a BSD-style license that can be found in
+// the LICENSE file.
+
+package pebble
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/petermattis/pebble/db"
+	"github.com/petermattis/pebble/vfs"
+)
+
+// walArchiveDirname is the name of the subdirectory of the WAL directory
+// holding the archived logs.
+const walArchiveDirname = "archive"
+
+// ArchivedLog describes a write-ahead log in the WAL archive (see
+// db.Options.WALArchiveTTL).
+type ArchivedLog struct {
+	// FileNum is the file number of the log. The logs are numbered in the
+	// order in which they were written.
+	FileNum uint64
+	// Path is the path of the log in the archive.
+	Path string
+	// Size is the size of the log in bytes.
+	Size int64
+	// ModTime is the time the log was last modified.
+	ModTime time.Time
+}
+
+// walArchive holds the obsolete logs which are retained for use by change
+// feeds and replication.
+type walArchive struct {
+	fs        vfs.FS
+	dirname   string
+	ttl       time.Duration
+	sizeLimit int64
+	mu        struct {
+		sync.Mutex
+		// The archived logs, sorted by file number.
+		logs []ArchivedLog
+		size int64
+	}
+}
+
+// init enables the archive in the specified WAL directory, loading the logs
+// archived by previous instances of the DB.
+func (a *walArchive) init(fs vfs.FS, walDirname string, opts *db.Options) error {
+	a.fs = fs
+	a.dirname = filepath.Join(walDirname, walArchiveDirname)
+	a.ttl = opts.WALArchiveTTL
+	a.sizeLimit = opts.WALArchiveSizeLimit
+	if err := fs.MkdirAll(a.dirname, 0755); err != nil {
+		return err
+	}
+	ls, err := fs.List(a.dirname)
+	if err != nil {
+		return err
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	for _, filename := range ls {
+		ft, fn, ok := parseDBFilename(filename)
+		if !ok || ft != fileTypeLog {
+			continue
+		}
+		path := filepath.Join(a.dirname, filename)
+		info, err := fs.Stat(path)
+		if err != nil {
+			return err
+		}
+		a.mu.logs = append(a.mu.logs, ArchivedLog{
+			FileNum: fn,
+			Path:    path,
+			Size:    info.Size(),
+			ModTime: info.ModTime(),
+		})
+		a.mu.size += info.Size()
+	}
+	sort.Slice(a.mu.logs, func(i, j int) bool {
+		return a.mu.logs[i].FileNum < a.mu.logs[j].FileNum
+	})
+	return nil
+}
+
+func (a *walArchive) enabled() bool {
+	return a.dirname != ""
+}
+
+// path returns the path of the specified log in the archive.
+func (a *walArchive) path(fileNum uint64) string {
+	return dbFilename(a.dirname, fileTypeLog, fileNum)
+}
+
+// add moves the specified obsolete log into the archive.
+func (a *walArchive) add(walDirname string, fileNum uint64) error {
+	path := a.path(fileNum)
+	if err := a.fs.Rename(dbFilename(walDirname, fileTypeLog, fileNum), path); err != nil {
+		return err
+	}
+	info, err := a.fs.Stat(path)
+	if err != nil {
+		return err
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.mu.logs = append(a.mu.logs, ArchivedLog{
+		FileNum: fileNum,
+		Path:    path,
+		Size:    info.Size(),
+		ModTime: info.ModTime(),
+	})
+	a.mu.size += info.Size()
+	// Logs are normally archived in file number order, but may not be after
+	// the logs of a previous instance of the DB have been found obsolete.
+	sort.Slice(a.mu.logs, func(i, j int) bool {
+		return a.mu.logs[i].FileNum < a.mu.logs[j].FileNum
+	})
+	return nil
+}
+
+// expire removes the logs which have exceeded the TTL or size limit of the
+// archive from the set of archived logs, and returns them. The caller is
+// responsible for deleting the returned logs.
+func (a *walArchive) expire(now time.Time) []ArchivedLog {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	var expired []ArchivedLog
+	for len(a.mu.logs) > 0 {
+		l := a.mu.logs[0]
+		if (a.ttl == 0 || now.Sub(l.ModTime) <= a.ttl) &&
+			(a.sizeLimit == 0 || a.mu.size <= a.sizeLimit) {
+			break
+		}
+		expired = append(expired, l)
+		a.mu.logs = a.mu.logs[1:]
+		a.mu.size -= l.Size
+	}
+	return expired
+}
+
+// list returns the archived logs, sorted by file number.
+func (a *walArchive) list() []ArchivedLog {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return append([]ArchivedLog(nil), a.mu.logs...)
+}
+
+// ArchivedLogs returns the logs in the WAL archive, sorted by file number
+// (which is also the sequence number order of the batches they contain). The
+// archive is disabled unless db.Options.WALArchiveTTL or
+// db.Options.WALArchiveSizeLimit is set.
+func (d *DB) ArchivedLogs() []ArchivedLog {
+	return d.walArchive.list()
+}
+
+// OpenArchivedLog opens the archived log with the specified file number for
+// reading. An archived log may be deleted from the archive once it expires,
+// but remains readable through a LogReader opened before then.
+func (d *DB) OpenArchivedLog(fileNum uint64) (*LogReader, error) {
+	if !d.walArchive.enabled() {
+		return nil, os.ErrNotExist
+	}
+	file, err := d.opts.FS.Open(d.walArchive.path(fileNum))
+	if err != nil {
+		return nil, err
+	}
+	return NewLogReader(file, fileNum), nil
+}
+
+// purgeWALArchive deletes the logs which have expired from the WAL archive.
+func (d *DB) purgeWALArchive(jobID int) {
+	for _, l := range d.walArchive.expire(time.Now()) {
+		err := d.opts.FS.Remove(l.Path)
+		if d.opts.EventListener.WALDeleted != nil {
+			d.opts.EventListener.WALDeleted(db.WALDeleteInfo{
+				JobID:   jobID,
+				Path:    l.Path,
+				FileNum: l.FileNum,
+				Err:     err,
+			})
+		}
+	}
+}
@@ -0,0 +1,222 @@
+// Copyright 2019 The LevelDB-Go and Pebble Authors. All rights reserved. Use
+// of this source code is governed by a BSD-style license that can be found in
+// the LICENSE file.
+
+package pebble
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/petermattis/pebble/db"
+	"github.com/petermattis/pebble/vfs"
+)
+
+func TestWALArchive(t *testing.T) {
+	mem := vfs.NewMem()
+	opts := &db.Options{FS: mem, WALDir: "wal", WALArchiveTTL: time.Hour}
+	d, err := Open("", opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 3; i++ {
+		for _, k := range []string{"a", "b"} {
+			key := fmt.Sprintf("%s%d", k, i)
+			if err := d.Set([]byte(key), []byte(key), db.NoSync); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := d.Flush(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// The archived logs are read in sequence number order.
+	readArchive := func() string {
+		var keys []string
+		for _, l := range d.ArchivedLogs() {
+			r, err := d.OpenArchivedLog(l.FileNum)
+			if err != nil {
+				t.Fatal(err)
+			}
+			for {
+				_, b, err := r.Next()
+				if err == io.EOF {
+					break
+				} else if err != nil {
+					t.Fatal(err)
+				}
+				for br := b.Reader(); ; {
+					_, key, _, ok := br.Next()
+					if !ok {
+						break
+					}
+					keys = append(keys, string(key))
+				}
+			}
+			if err := r.Close(); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return strings.Join(keys, " ")
+	}
+	const expected = "a0 b0 a1 b1 a2 b2"
+	if actual := readArchive(); expected != actual {
+		t.Fatalf("expected %q, but found %q", expected, actual)
+	}
+	archived := d.ArchivedLogs()
+	for i := range archived {
+		if i > 0 && archived[i-1].FileNum >= archived[i].FileNum {
+			t.Fatalf("archived logs out of order: %v", archived)
+		}
+		if _, err := mem.Stat(dbFilename("wal", fileTypeLog, archived[i].FileNum)); err == nil {
+			t.Fatalf("archived log %d was not moved", archived[i].FileNum)
+		}
+	}
+
+	// A change feed can resume from the archived logs.
+	f, err := d.NewChangeFeed(&ChangeFeedOptions{StartSeqNum: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected, actual := `1: SET(b0,b0)
+2: SET(a1,a1)
+3: SET(b1,b1)`, readChangeFeed(t, f, 3); expected != actual {
+		t.Fatalf("expected\n%s\nbut found\n%s", expected, actual)
+	}
+	if err := f.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// The archive survives reopening the DB.
+	if err := d.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if d, err = Open("", opts); err != nil {
+		t.Fatal(err)
+	}
+	if actual := readArchive(); expected != actual {
+		t.Fatalf("expected %q, but found %q", expected, actual)
+	}
+
+	// Logs exceeding the size limit of the archive are deleted.
+	if err := d.Close(); err != nil {
+		t.Fatal(err)
+	}
+	var deleted []string
+	opts.WALArchiveSizeLimit = archived[len(archived)-1].Size
+	opts.EventListener.WALDeleted = func(info db.WALDeleteInfo) {
+		deleted = append(deleted, info.Path)
+	}
+	if d, err = Open("", opts); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	var size int64
+	for _, l := range d.ArchivedLogs() {
+		size += l.Size
+	}
+	if size > opts.WALArchiveSizeLimit {
+		t.Fatalf("expected at most %d archived bytes, but found %d", opts.WALArchiveSizeLimit, size)
+	}
+	if len(deleted) == 0 {
+		t.Fatalf("expected archived logs to be deleted")
+	}
+	for _, path := range deleted {
+		if _, err := mem.Stat(path); err == nil {
+			t.Fatalf("expected %s to be deleted", path)
+		}
+	}
+
+	// Logs exceeding the TTL of the archive are deleted.
+	if err := d.Close(); err != nil {
+		t.Fatal(err)
+	}
+	opts.WALArchiveSizeLimit = 0
+	opts.WALArchiveTTL = time.Nanosecond
+	if d, err = Open("", opts); err != nil {
+		t.Fatal(err)
+	}
+	if n := len(d.ArchivedLogs()); n != 0 {
+		t.Fatalf("expected no archived logs, but found %d", n)
+	}
+	if err := d.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// failRenameFS fails the renaming of files into the specified directory.
+type failRenameFS struct {
+	vfs.FS
+	dirname string
+}
+
+func (fs failRenameFS) Rename(oldname, newname string) error {
+	if filepath.Dir(newname) == fs.dirname {
+		return errors.New("injected error")
+	}
+	return fs.FS.Rename(oldname, newname)
+}
+
+func TestWALArchiveError(t *testing.T) {
+	mem := vfs.NewMem()
+	var log syncedBuffer
+	opts := &db.Options{
+		FS:            failRenameFS{FS: mem, dirname: filepath.Join("wal", walArchiveDirname)},
+		Logger:        &log,
+		WALDir:        "wal",
+		WALArchiveTTL: time.Hour,
+	}
+	d, err := Open("", opts)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 4; i++ {
+		key := []byte(fmt.Sprint(i))
+		if err := d.Set(key, key, db.NoSync); err != nil {
+			t.Fatal(err)
+		}
+		if err := d.Flush(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if archived := d.ArchivedLogs(); len(archived) != 0 {
+		t.Fatalf("expected no archived logs, but found %v", archived)
+	}
+	if !strings.Contains(log.buf.String(), "archival failed: injected error") {
+		t.Fatalf("expected archival failures to be logged, but found:\n%s", log.buf.String())
+	}
+
+	// The logs which could not be archived are recycled or deleted, so the WAL
+	// directory only contains the live logs and the recycled logs.
+	live := make(map[uint64]bool)
+	d.mu.Lock()
+	for _, logNum := range d.mu.log.queue {
+		live[logNum] = true
+	}
+	d.mu.Unlock()
+	for _, logNum := range d.logRecycler.logNums() {
+		live[logNum] = true
+	}
+	ls, err := mem.List("wal")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, filename := range ls {
+		if ft, fn, ok := parseDBFilename(filename); ok && ft == fileTypeLog && !live[fn] {
+			t.Fatalf("expected obsolete log %s to be recycled or deleted", filename)
+		}
+	}
+	if err := d.Close(); err != nil {
+		t.Fatal(err)
+	}
+}